@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	. "github.com/ory/workshop-dbg/store"
+)
+
+// MaxBatchSize is the maximum number of operations in a batch.
+const MaxBatchSize = 100
+
+// The operations supported in batches.
+const (
+	BatchCreate = "create"
+	BatchUpdate = "update"
+	BatchDelete = "delete"
+)
+
+// BatchRequest is the body of a batch request.
+type BatchRequest struct {
+	Operations []*BatchOperation `json:"operations"`
+}
+
+// BatchOperation is a single write. Creates and updates need a contact, updates and deletes an ID, which updates
+// may also give in the contact. Version makes updates and deletes conditional, like If-Match does.
+type BatchOperation struct {
+	Op      string          `json:"op"`
+	ID      string          `json:"id,omitempty"`
+	Version int             `json:"version,omitempty"`
+	Contact json.RawMessage `json:"contact,omitempty"`
+}
+
+// BatchResponse lists the results in the order of the operations.
+type BatchResponse struct {
+	Results []*BatchResult `json:"results"`
+}
+
+// BatchResult is the outcome of a single operation. Status is the status code the operation would have had as a
+// single request.
+type BatchResult struct {
+	Status  int           `json:"status"`
+	Contact *Contact      `json:"contact,omitempty"`
+	Error   *ErrorDetails `json:"error,omitempty"`
+}
+
+// errBatchFailed aborts an atomic batch.
+var errBatchFailed = errors.New("Batch operation failed")
+
+// BatchContacts applies several creates, updates and deletes. By default the batch is atomic: if one operation
+// fails, none is applied, the failed operation's status becomes the response's status and all other operations
+// fail with 424 Failed Dependency. With ?atomic=false, operations are applied independently and the response is
+// always 200.
+func BatchContacts(store ContactStorer) func(rw http.ResponseWriter, r *http.Request) {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		store := RequestStore(store, r)
+		atomic := true
+		if value := r.URL.Query().Get("atomic"); value != "" {
+			var err error
+			if atomic, err = strconv.ParseBool(value); err != nil {
+				WriteError(rw, fmt.Errorf("%w: atomic must be true or false", ErrBadRequest))
+				return
+			}
+		}
+
+		batch, err := ReadBatch(r)
+		if err != nil {
+			WriteError(rw, err)
+			return
+		}
+
+		results := make([]*BatchResult, len(batch.Operations))
+		run := func(s ContactStorer) error {
+			for i, op := range batch.Operations {
+				results[i] = applyBatchOperation(s, op)
+				if atomic && results[i].Error != nil {
+					return errBatchFailed
+				}
+			}
+			return nil
+		}
+
+		if !atomic {
+			err = run(store)
+		} else if tx, ok := store.(Transactor); ok {
+			err = tx.WithTx(run)
+		} else {
+			err = fmt.Errorf("%w: The store does not support atomic batches", ErrValidation)
+		}
+
+		if err == errBatchFailed {
+			code := failBatch(results)
+			WriteJSON(rw, code, &BatchResponse{Results: results})
+			return
+		} else if err != nil {
+			WriteError(rw, err)
+			return
+		}
+		WriteJSON(rw, http.StatusOK, &BatchResponse{Results: results})
+	}
+}
+
+// ReadBatch reads and checks a batch request. Contacts are decoded when the operations are applied, so invalid
+// contacts only fail their operation.
+func ReadBatch(r *http.Request) (*BatchRequest, error) {
+	body, err := ReadBody(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var batch BatchRequest
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&batch); err != nil {
+		return nil, fmt.Errorf("%w: Could not read the batch because %s", ErrBadRequest, err)
+	}
+
+	if len(batch.Operations) == 0 || len(batch.Operations) > MaxBatchSize {
+		return nil, fmt.Errorf("%w: A batch must contain between 1 and %d operations", ErrBadRequest, MaxBatchSize)
+	}
+	for i, op := range batch.Operations {
+		switch op.Op {
+		case BatchCreate, BatchUpdate, BatchDelete:
+		default:
+			return nil, fmt.Errorf("%w: Operation %d: unknown op %q, use create, update or delete", ErrBadRequest, i, op.Op)
+		}
+	}
+	return &batch, nil
+}
+
+func applyBatchOperation(store ContactStorer, op *BatchOperation) *BatchResult {
+	if op.Op == BatchDelete {
+		if op.ID == "" {
+			return batchError(fmt.Errorf("%w: The ID is required", ErrBadRequest))
+		} else if err := store.DeleteContact(op.ID, op.Version); err != nil {
+			return batchError(err)
+		}
+		return &BatchResult{Status: http.StatusNoContent}
+	}
+
+	if len(op.Contact) == 0 {
+		return batchError(fmt.Errorf("%w: The contact is required", ErrBadRequest))
+	}
+	c, err := DecodeContact(op.Contact)
+	if err != nil {
+		return batchError(err)
+	}
+
+	if op.Op == BatchCreate {
+		if err := store.CreateContact(&c); err != nil {
+			return batchError(err)
+		}
+		return &BatchResult{Status: http.StatusCreated, Contact: &c}
+	}
+
+	if c.ID == "" {
+		c.ID = op.ID
+	} else if op.ID != "" && c.ID != op.ID {
+		return batchError(fmt.Errorf("%w: The contact ID does not match the operation's ID", ErrBadRequest))
+	}
+	if c.ID == "" {
+		return batchError(fmt.Errorf("%w: The ID is required", ErrBadRequest))
+	}
+	if op.Version != 0 {
+		c.Version = op.Version
+	}
+
+	if err := store.UpdateContact(&c); err != nil {
+		return batchError(err)
+	}
+	return &BatchResult{Status: http.StatusOK, Contact: &c}
+}
+
+func batchError(err error) *BatchResult {
+	details := NewErrorDetails(err)
+	return &BatchResult{Status: details.Code, Error: details}
+}
+
+// failBatch marks all operations of a rolled back batch as failed and returns the status of the operation which
+// caused the rollback.
+func failBatch(results []*BatchResult) int {
+	failed := 0
+	for i, result := range results {
+		if result != nil && result.Error != nil {
+			failed = i
+		}
+	}
+
+	for i := range results {
+		if i != failed {
+			results[i] = batchError(fmt.Errorf("%w: Operation %d failed", ErrFailedDependency, failed))
+		}
+	}
+	return results[failed].Status
+}
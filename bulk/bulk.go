@@ -0,0 +1,78 @@
+// Package bulk reads and writes contacts in CSV, JSON Lines and vCard 4.0 (RFC 6350) format. Readers and writers
+// work on one contact at a time, so files of any size can be streamed.
+package bulk
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/ory/workshop-dbg/store"
+)
+
+// The media types of the supported formats.
+const (
+	CSVType    = "text/csv"
+	NDJSONType = "application/x-ndjson"
+	VCardType  = "text/vcard"
+)
+
+// Formats maps short format names, as used in query parameters, to media types.
+var Formats = map[string]string{
+	"csv":    CSVType,
+	"ndjson": NDJSONType,
+	"vcard":  VCardType,
+}
+
+// Extensions maps media types to file extensions.
+var Extensions = map[string]string{
+	CSVType:    "csv",
+	NDJSONType: "ndjson",
+	VCardType:  "vcf",
+}
+
+var (
+	// ErrUnsupportedFormat is returned for media types other than the supported ones.
+	ErrUnsupportedFormat = errors.New("Unsupported format")
+
+	// ErrMalformed is returned when a file is broken beyond a single row, for example because a CSV header is
+	// missing. Errors of single rows wrap store.ErrValidation instead.
+	ErrMalformed = errors.New("Malformed file")
+)
+
+// Writer writes contacts. Flush must be called after the last contact.
+type Writer interface {
+	Write(c *store.Contact) error
+	Flush() error
+}
+
+// NewReader returns a reader for the given media type.
+func NewReader(mediaType string, r io.Reader) (store.ContactReader, error) {
+	switch mediaType {
+	case CSVType:
+		return newCSVReader(r), nil
+	case NDJSONType:
+		return newNDJSONReader(r), nil
+	case VCardType:
+		return newVCardReader(r), nil
+	}
+	return nil, fmt.Errorf("%w: %q", ErrUnsupportedFormat, mediaType)
+}
+
+// NewWriter returns a writer for the given media type.
+func NewWriter(mediaType string, w io.Writer) (Writer, error) {
+	switch mediaType {
+	case CSVType:
+		return newCSVWriter(w), nil
+	case NDJSONType:
+		return newNDJSONWriter(w), nil
+	case VCardType:
+		return newVCardWriter(w), nil
+	}
+	return nil, fmt.Errorf("%w: %q", ErrUnsupportedFormat, mediaType)
+}
+
+// rowError wraps err so that it only fails the current row.
+func rowError(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: "+format, append([]interface{}{store.ErrValidation}, args...)...)
+}
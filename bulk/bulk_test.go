@@ -0,0 +1,126 @@
+package bulk
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/ory/workshop-dbg/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var contacts = []*store.Contact{
+	{ID: "john-bravo", Name: "John Bravo", Department: "IT", Company: "ACME Inc"},
+	{ID: "cathrine-mueller", Name: "Cathrine Müller", Department: "HR", Company: "Grove AG"},
+	{ID: "quotes", Name: `Eddie "The Eagle", Markson; Jr.`, Department: "", Company: "Back\\slash"},
+	{ID: "long", Name: strings.Repeat("Müller ", 30), Department: "R&D", Company: ""},
+}
+
+func readAll(t *testing.T, r store.ContactReader) ([]*store.Contact, []error) {
+	var result []*store.Contact
+	var errs []error
+	for {
+		c, err := r.Read()
+		if err == io.EOF {
+			return result, errs
+		} else if err != nil {
+			require.True(t, errors.Is(err, store.ErrValidation), "%s", err)
+			errs = append(errs, err)
+			continue
+		}
+		result = append(result, c)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, mediaType := range Formats {
+		var buf bytes.Buffer
+		w, err := NewWriter(mediaType, &buf)
+		require.Nil(t, err)
+		for _, c := range contacts {
+			require.Nil(t, w.Write(c))
+		}
+		require.Nil(t, w.Flush())
+
+		r, err := NewReader(mediaType, &buf)
+		require.Nil(t, err)
+		result, errs := readAll(t, r)
+		assert.Empty(t, errs, mediaType)
+		assert.Equal(t, contacts, result, mediaType)
+	}
+}
+
+func TestUnsupportedFormat(t *testing.T) {
+	_, err := NewReader("application/xml", nil)
+	assert.True(t, errors.Is(err, ErrUnsupportedFormat))
+	_, err = NewWriter("application/xml", nil)
+	assert.True(t, errors.Is(err, ErrUnsupportedFormat))
+}
+
+func TestCSV(t *testing.T) {
+	r, _ := NewReader(CSVType, strings.NewReader("\ufeffName,Company\nJohn Bravo,ACME Inc\nbroken\n\"Eddie\",\"Grove AG\"\n"))
+	result, errs := readAll(t, r)
+	assert.Len(t, errs, 1)
+	assert.Equal(t, []*store.Contact{
+		{Name: "John Bravo", Company: "ACME Inc"},
+		{Name: "Eddie", Company: "Grove AG"},
+	}, result)
+
+	r, _ = NewReader(CSVType, strings.NewReader("name,phone\nJohn,123\n"))
+	_, err := r.Read()
+	assert.True(t, errors.Is(err, ErrMalformed))
+
+	// An empty export still has a header.
+	var buf bytes.Buffer
+	w, _ := NewWriter(CSVType, &buf)
+	require.Nil(t, w.Flush())
+	assert.Equal(t, "id,name,department,company\n", buf.String())
+}
+
+func TestNDJSON(t *testing.T) {
+	r, _ := NewReader(NDJSONType, strings.NewReader(`{"name": "John"}`+"\n\n{\"name\": \n"+`{"name": "Eddie", "phone": "123"}`+"\n"+`{"name": "Cathrine"}`))
+	result, errs := readAll(t, r)
+	assert.Len(t, errs, 2)
+	assert.Equal(t, []*store.Contact{{Name: "John"}, {Name: "Cathrine"}}, result)
+}
+
+func TestVCard(t *testing.T) {
+	r, _ := NewReader(VCardType, strings.NewReader(
+		"BEGIN:VCARD\r\nVERSION:4.0\r\nitem1.FN;LANGUAGE=de:Cathrine M\r\n üller\r\nORG:Grove\\, AG;HR;Payroll\r\nTEL:123\r\nEND:VCARD\r\n"+
+			"\r\n"+
+			"begin:vcard\nUID:urn:uuid:1\nFN:John\nbroken\nEND:VCARD\n"+
+			"BEGIN:VCARD\nFN:Eddie\nEND:VCARD\n",
+	))
+	c, err := r.Read()
+	require.Nil(t, err)
+	assert.Equal(t, &store.Contact{Name: "Cathrine Müller", Company: "Grove, AG", Department: "HR"}, c)
+
+	c, err = r.Read()
+	assert.True(t, errors.Is(err, store.ErrValidation))
+	assert.Equal(t, "urn:uuid:1", c.ID)
+
+	c, err = r.Read()
+	require.Nil(t, err)
+	assert.Equal(t, "Eddie", c.Name)
+
+	_, err = r.Read()
+	assert.Equal(t, io.EOF, err)
+
+	r, _ = NewReader(VCardType, strings.NewReader("BEGIN:VCARD\nFN:John\n"))
+	_, err = r.Read()
+	assert.True(t, errors.Is(err, ErrMalformed))
+
+	// Folded lines are at most 75 bytes long and never split characters.
+	var buf bytes.Buffer
+	w, _ := NewWriter(VCardType, &buf)
+	require.Nil(t, w.Write(contacts[3]))
+	require.Nil(t, w.Flush())
+	for _, line := range strings.Split(buf.String(), "\r\n") {
+		assert.True(t, len(line) <= maxVCardLineLength, line)
+		assert.True(t, utf8.ValidString(line), line)
+	}
+}
@@ -0,0 +1,108 @@
+package bulk
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/ory/workshop-dbg/store"
+)
+
+// csvColumns are the columns written to CSV files. Files being read may order them differently or omit some.
+var csvColumns = []string{"id", "name", "department", "company"}
+
+type csvReader struct {
+	r       *csv.Reader
+	columns []func(c *store.Contact) *string
+}
+
+func newCSVReader(r io.Reader) *csvReader {
+	cr := csv.NewReader(r)
+	cr.TrimLeadingSpace = true
+	return &csvReader{r: cr}
+}
+
+func (r *csvReader) Read() (*store.Contact, error) {
+	if r.columns == nil {
+		if err := r.readHeader(); err != nil {
+			return nil, err
+		}
+	}
+
+	record, err := r.r.Read()
+	var parseErr *csv.ParseError
+	if errors.As(err, &parseErr) {
+		return nil, rowError("%s", parseErr.Err)
+	} else if err != nil {
+		return nil, err
+	}
+
+	c := new(store.Contact)
+	for i, field := range r.columns {
+		if field != nil {
+			*field(c) = record[i]
+		}
+	}
+	return c, nil
+}
+
+func (r *csvReader) readHeader() error {
+	header, err := r.r.Read()
+	if err == io.EOF {
+		return err
+	} else if err != nil {
+		return fmt.Errorf("%w: Could not read the CSV header because %s", ErrMalformed, err)
+	}
+
+	r.columns = make([]func(c *store.Contact) *string, len(header))
+	for i, name := range header {
+		switch strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff"))) {
+		case "id":
+			r.columns[i] = func(c *store.Contact) *string { return &c.ID }
+		case "name":
+			r.columns[i] = func(c *store.Contact) *string { return &c.Name }
+		case "department":
+			r.columns[i] = func(c *store.Contact) *string { return &c.Department }
+		case "company":
+			r.columns[i] = func(c *store.Contact) *string { return &c.Company }
+		default:
+			return fmt.Errorf("%w: Unknown CSV column %q, use %s", ErrMalformed, name, strings.Join(csvColumns, ", "))
+		}
+	}
+	return nil
+}
+
+type csvWriter struct {
+	w      *csv.Writer
+	header bool
+}
+
+func newCSVWriter(w io.Writer) *csvWriter {
+	return &csvWriter{w: csv.NewWriter(w)}
+}
+
+func (w *csvWriter) Write(c *store.Contact) error {
+	if err := w.writeHeader(); err != nil {
+		return err
+	}
+	return w.w.Write([]string{c.ID, c.Name, c.Department, c.Company})
+}
+
+// Flush also writes the header, so that exports without contacts are valid files.
+func (w *csvWriter) Flush() error {
+	if err := w.writeHeader(); err != nil {
+		return err
+	}
+	w.w.Flush()
+	return w.w.Error()
+}
+
+func (w *csvWriter) writeHeader() error {
+	if w.header {
+		return nil
+	}
+	w.header = true
+	return w.w.Write(csvColumns)
+}
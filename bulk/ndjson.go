@@ -0,0 +1,67 @@
+package bulk
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/ory/workshop-dbg/store"
+)
+
+// maxLineLength is the maximum length of a JSON line. Longer lines can not be valid contacts.
+const maxLineLength = 1 << 20
+
+type ndjsonReader struct {
+	s *bufio.Scanner
+}
+
+func newNDJSONReader(r io.Reader) *ndjsonReader {
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 64<<10), maxLineLength)
+	return &ndjsonReader{s: s}
+}
+
+func (r *ndjsonReader) Read() (*store.Contact, error) {
+	for r.s.Scan() {
+		line := bytes.TrimSpace(r.s.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		c := new(store.Contact)
+		dec := json.NewDecoder(bytes.NewReader(line))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(c); err != nil {
+			return nil, rowError("The line is not a valid contact because %s", err)
+		}
+		return c, nil
+	}
+
+	if err := r.s.Err(); err == bufio.ErrTooLong {
+		return nil, fmt.Errorf("%w: Lines must not be longer than %d bytes", ErrMalformed, maxLineLength)
+	} else if err != nil {
+		return nil, err
+	}
+	return nil, io.EOF
+}
+
+type ndjsonWriter struct {
+	w   *bufio.Writer
+	enc *json.Encoder
+}
+
+func newNDJSONWriter(w io.Writer) *ndjsonWriter {
+	bw := bufio.NewWriter(w)
+	return &ndjsonWriter{w: bw, enc: json.NewEncoder(bw)}
+}
+
+// Write writes c on a single line, json.Encoder terminates every value with a newline.
+func (w *ndjsonWriter) Write(c *store.Contact) error {
+	return w.enc.Encode(c)
+}
+
+func (w *ndjsonWriter) Flush() error {
+	return w.w.Flush()
+}
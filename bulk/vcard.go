@@ -0,0 +1,224 @@
+package bulk
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/ory/workshop-dbg/store"
+)
+
+// maxVCardLineLength is the length after which vCard content lines are folded, see RFC 6350 section 3.2.
+const maxVCardLineLength = 75
+
+// vcardEscaper escapes text values as described in RFC 6350 section 3.4.
+var vcardEscaper = strings.NewReplacer(`\`, `\\`, ",", `\,`, ";", `\;`, "\n", `\n`)
+
+// vcardReader reads vCards. UID is read into the ID, FN into the name and the first two components of ORG into
+// company and department. All other properties are ignored.
+type vcardReader struct {
+	s      *bufio.Scanner
+	peek   string
+	peeked bool
+}
+
+func newVCardReader(r io.Reader) *vcardReader {
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 64<<10), maxLineLength)
+	return &vcardReader{s: s}
+}
+
+func (r *vcardReader) Read() (*store.Contact, error) {
+	line, err := r.line()
+	for err == nil && strings.TrimSpace(line) == "" {
+		line, err = r.line()
+	}
+	if err != nil {
+		return nil, err
+	} else if !strings.EqualFold(line, "BEGIN:VCARD") {
+		return nil, fmt.Errorf("%w: Expected BEGIN:VCARD but got %q", ErrMalformed, line)
+	}
+
+	c := new(store.Contact)
+	var invalid error
+	for {
+		line, err := r.line()
+		if err == io.EOF {
+			return nil, fmt.Errorf("%w: The last vCard is not terminated by END:VCARD", ErrMalformed)
+		} else if err != nil {
+			return nil, err
+		}
+
+		name, value, ok := parseVCardProperty(line)
+		if !ok {
+			if invalid == nil {
+				invalid = rowError("Invalid vCard line %q", line)
+			}
+			continue
+		}
+
+		switch name {
+		case "BEGIN":
+			return nil, fmt.Errorf("%w: Nested vCards are not supported", ErrMalformed)
+		case "END":
+			return c, invalid
+		case "UID":
+			c.ID = unescapeVCard(value)
+		case "FN":
+			c.Name = unescapeVCard(value)
+		case "ORG":
+			components := splitVCard(value)
+			c.Company = components[0]
+			if len(components) > 1 {
+				c.Department = components[1]
+			}
+		}
+	}
+}
+
+// line returns the next unfolded content line.
+func (r *vcardReader) line() (string, error) {
+	var line string
+	if r.peeked {
+		line, r.peeked = r.peek, false
+	} else if r.s.Scan() {
+		line = r.s.Text()
+	} else {
+		return "", r.err()
+	}
+
+	for r.s.Scan() {
+		next := r.s.Text()
+		if next == "" || (next[0] != ' ' && next[0] != '\t') {
+			r.peek, r.peeked = next, true
+			break
+		}
+
+		line += next[1:]
+		if len(line) > maxLineLength {
+			return "", fmt.Errorf("%w: Lines must not be longer than %d bytes", ErrMalformed, maxLineLength)
+		}
+	}
+	if !r.peeked {
+		if err := r.err(); err != io.EOF {
+			return "", err
+		}
+	}
+	return line, nil
+}
+
+func (r *vcardReader) err() error {
+	if err := r.s.Err(); err == bufio.ErrTooLong {
+		return fmt.Errorf("%w: Lines must not be longer than %d bytes", ErrMalformed, maxLineLength)
+	} else if err != nil {
+		return err
+	}
+	return io.EOF
+}
+
+// parseVCardProperty splits a content line into its upper case property name and its value. Groups and
+// parameters are dropped.
+func parseVCardProperty(line string) (name, value string, ok bool) {
+	quoted := false
+	for i, r := range line {
+		switch {
+		case r == '"':
+			quoted = !quoted
+		case r == ':' && !quoted:
+			name = line[:i]
+			if j := strings.IndexByte(name, ';'); j >= 0 {
+				name = name[:j]
+			}
+			if j := strings.LastIndexByte(name, '.'); j >= 0 {
+				name = name[j+1:]
+			}
+			return strings.ToUpper(name), line[i+1:], name != ""
+		}
+	}
+	return "", "", false
+}
+
+// splitVCard splits a structured value at unescaped semicolons and unescapes the components.
+func splitVCard(value string) []string {
+	var components []string
+	start := 0
+	for i := 0; i < len(value); i++ {
+		switch value[i] {
+		case '\\':
+			i++
+		case ';':
+			components = append(components, unescapeVCard(value[start:i]))
+			start = i + 1
+		}
+	}
+	return append(components, unescapeVCard(value[start:]))
+}
+
+func unescapeVCard(value string) string {
+	if !strings.Contains(value, `\`) {
+		return value
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] == '\\' && i+1 < len(value) {
+			i++
+			if value[i] == 'n' || value[i] == 'N' {
+				b.WriteByte('\n')
+				continue
+			}
+		}
+		b.WriteByte(value[i])
+	}
+	return b.String()
+}
+
+type vcardWriter struct {
+	w *bufio.Writer
+}
+
+func newVCardWriter(w io.Writer) *vcardWriter {
+	return &vcardWriter{w: bufio.NewWriter(w)}
+}
+
+func (w *vcardWriter) Write(c *store.Contact) error {
+	w.line("BEGIN:VCARD")
+	w.line("VERSION:4.0")
+	if c.ID != "" {
+		w.line("UID:" + vcardEscaper.Replace(c.ID))
+	}
+	w.line("FN:" + vcardEscaper.Replace(c.Name))
+	if c.Department != "" {
+		w.line("ORG:" + vcardEscaper.Replace(c.Company) + ";" + vcardEscaper.Replace(c.Department))
+	} else if c.Company != "" {
+		w.line("ORG:" + vcardEscaper.Replace(c.Company))
+	}
+	return w.line("END:VCARD")
+}
+
+func (w *vcardWriter) Flush() error {
+	return w.w.Flush()
+}
+
+// line writes a content line, folded so that no line is longer than 75 bytes. Multi-byte characters are never
+// split. Errors are sticky, so only the last one needs to be checked.
+func (w *vcardWriter) line(line string) error {
+	limit := maxVCardLineLength
+	for len(line) > limit {
+		i := limit
+		for i > 0 && !utf8.RuneStart(line[i]) {
+			i--
+		}
+		w.w.WriteString(line[:i])
+		w.w.WriteString("\r\n ")
+		line = line[i:]
+
+		// The leading space counts towards the length of continuation lines.
+		limit = maxVCardLineLength - 1
+	}
+	w.w.WriteString(line)
+	_, err := w.w.WriteString("\r\n")
+	return err
+}
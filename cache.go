@@ -0,0 +1,14 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/ory/workshop-dbg/store/cache"
+)
+
+// CacheStats outputs the hit and miss counters of a cached store.
+func CacheStats(store *cache.Store) func(rw http.ResponseWriter, r *http.Request) {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		WriteJSON(rw, http.StatusOK, store.Stats())
+	}
+}
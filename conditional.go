@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	. "github.com/ory/workshop-dbg/store"
+)
+
+// ETag returns the entity tag of a contact with the given version.
+func ETag(version int) string {
+	return fmt.Sprintf(`"%d"`, version)
+}
+
+// WriteETag sets the ETag header of a response containing c.
+func WriteETag(rw http.ResponseWriter, c *Contact) {
+	if c.Version > 0 {
+		rw.Header().Set("ETag", ETag(c.Version))
+	}
+}
+
+// MatchETag returns true if the If-Match or If-None-Match header value matches the given version. Weak entity
+// tags (W/"1") only match if weak is true, as required for If-None-Match.
+func MatchETag(header string, version int, weak bool) bool {
+	return matchTags(header, weak, func(tag string) bool {
+		v, err := strconv.Atoi(tag)
+		return err == nil && v == version
+	})
+}
+
+// MatchRevision returns true if the If-None-Match header value matches the entity tag of the contact list with the
+// given revision, see ContactsMeta. Weak entity tags match, too.
+func MatchRevision(header, revision string) bool {
+	return matchTags(header, true, func(tag string) bool {
+		return tag == revision
+	})
+}
+
+// matchTags returns true if the header value is "*" or one of its entity tags matches. match is passed the tags
+// without quotes.
+func matchTags(header string, weak bool, match func(tag string) bool) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" {
+			return true
+		}
+
+		if strings.HasPrefix(tag, "W/") {
+			if !weak {
+				continue
+			}
+			tag = tag[2:]
+		}
+
+		if match(strings.Trim(tag, `"`)) {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckPreconditions evaluates the If-Match and If-None-Match headers of a request writing to the contact id. It
+// returns the version the write must be conditioned on, so that the contact can not change between checking the
+// headers and writing, or 0 if the request has no preconditions. Failed preconditions result in an error wrapping
+// ErrVersionMismatch.
+func CheckPreconditions(r *http.Request, store ContactStorer, id string) (int, error) {
+	ifMatch, ifNoneMatch := r.Header.Get("If-Match"), r.Header.Get("If-None-Match")
+	if ifMatch == "" && ifNoneMatch == "" {
+		return 0, nil
+	}
+
+	current, err := store.GetContact(id)
+	if errors.Is(err, ErrNotFound) {
+		if ifMatch != "" {
+			// If-Match never matches a resource which does not exist.
+			return 0, ErrVersionMismatch
+		}
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	if ifMatch != "" && !MatchETag(ifMatch, current.Version, false) {
+		return 0, ErrVersionMismatch
+	} else if ifNoneMatch != "" && MatchETag(ifNoneMatch, current.Version, true) {
+		return 0, ErrVersionMismatch
+	}
+	return current.Version, nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/ory/workshop-dbg/bulk"
+	"github.com/ory/workshop-dbg/patch"
+	. "github.com/ory/workshop-dbg/store"
+)
+
+var (
+	// ErrBadRequest is returned when the request itself is malformed, for example because the body is not valid JSON.
+	ErrBadRequest = errors.New("Bad request")
+
+	// ErrRequestTooLarge is returned when the request body exceeds the size limit.
+	ErrRequestTooLarge = errors.New("Request entity too large")
+
+	// ErrUnsupportedMediaType is returned when the request body has a content type the endpoint does not understand.
+	ErrUnsupportedMediaType = errors.New("Unsupported media type")
+
+	// ErrFailedDependency is returned for operations of a batch which were rolled back because another one failed.
+	ErrFailedDependency = errors.New("Failed dependency")
+
+	// ErrNotAcceptable is returned when the endpoint can not respond in any of the formats the client accepts.
+	ErrNotAcceptable = errors.New("Not acceptable")
+)
+
+// ErrorResponse is the JSON body written by WriteError.
+type ErrorResponse struct {
+	Error ErrorDetails `json:"error"`
+}
+
+// ErrorDetails describes what went wrong.
+type ErrorDetails struct {
+	// Code is the HTTP status code.
+	Code int `json:"code"`
+
+	// Status is the HTTP status text, for example "Not Found".
+	Status string `json:"status"`
+
+	// Message is the error message.
+	Message string `json:"message"`
+
+	// Fields lists the invalid fields if the request failed validation.
+	Fields []FieldError `json:"fields,omitempty"`
+}
+
+// StatusCode returns the HTTP status code for err. Errors not known to this function result in a 500.
+func StatusCode(err error) int {
+	switch {
+	case errors.Is(err, ErrBadRequest), errors.Is(err, patch.ErrMalformed), errors.Is(err, bulk.ErrMalformed):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrRequestTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, ErrUnsupportedMediaType):
+		return http.StatusUnsupportedMediaType
+	case errors.Is(err, ErrNotAcceptable):
+		return http.StatusNotAcceptable
+	case errors.Is(err, ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrAlreadyExists), errors.Is(err, ErrConflict), errors.Is(err, patch.ErrTestFailed):
+		return http.StatusConflict
+	case errors.Is(err, ErrVersionMismatch):
+		return http.StatusPreconditionFailed
+	case errors.Is(err, ErrValidation), errors.Is(err, patch.ErrCannotApply):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, ErrFailedDependency):
+		return http.StatusFailedDependency
+	case errors.Is(err, ErrUnavailable):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, context.Canceled):
+		// Stores may report a deadline as cancellation, for example when the database canceled the statement.
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusInternalServerError
+}
+
+// NewErrorDetails describes err, see StatusCode for the status code.
+func NewErrorDetails(err error) *ErrorDetails {
+	code := StatusCode(err)
+	details := &ErrorDetails{
+		Code:    code,
+		Status:  http.StatusText(code),
+		Message: err.Error(),
+	}
+
+	var validationErr *ValidationError
+	if errors.As(err, &validationErr) {
+		details.Fields = validationErr.Fields
+	}
+	return details
+}
+
+// WriteError writes err as a JSON error response with the status code returned by StatusCode.
+func WriteError(rw http.ResponseWriter, err error) {
+	details := NewErrorDetails(err)
+	WriteJSON(rw, details.Code, &ErrorResponse{Error: *details})
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	. "github.com/ory/workshop-dbg/store"
+	"golang.org/x/net/websocket"
+)
+
+// keepAliveInterval is how often an idle event stream sends a comment, so proxies do not close the connection.
+var keepAliveInterval = 30 * time.Second
+
+// ContactEvents streams the changes of a backend as they happen. Browsers get Server-Sent Events, where the
+// event's ID is the change's Seq and its type the action. Requests upgrading to a WebSocket get one JSON encoded
+// change per message instead.
+//
+// Clients resume a stream by passing the ID of the last change they received in the Last-Event-ID header or the
+// last_event_id query parameter, which WebSocket clients have to use. The changes they missed are replayed from the
+// history first. Other clients get the changes following the last one in the history when the stream opened. The
+// stream ends if the client falls behind, so it has to reconnect and resume.
+func ContactEvents(store ContactStorer) func(rw http.ResponseWriter, r *http.Request) {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		lastID := r.Header.Get("Last-Event-ID")
+		if lastID == "" {
+			lastID = r.URL.Query().Get("last_event_id")
+		}
+		var after int64
+		if lastID != "" {
+			var err error
+			if after, err = strconv.ParseInt(lastID, 10, 64); err != nil || after < 0 {
+				WriteError(rw, fmt.Errorf("%w: The last event ID must be a number", ErrBadRequest))
+				return
+			}
+		}
+
+		// Subscribing before replaying the history makes sure no change is missed in between.
+		changes, cancel, err := store.Subscribe()
+		if err != nil {
+			WriteError(rw, err)
+			return
+		}
+		defer cancel()
+
+		s := &eventStream{store: store.WithContext(r.Context()), changes: changes, after: after}
+		if lastID == "" {
+			if err := s.skip(); err != nil {
+				WriteError(rw, err)
+				return
+			}
+		}
+		if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+			websocket.Server{Handler: s.serveWebSocket}.ServeHTTP(rw, r)
+			return
+		}
+
+		flusher, ok := rw.(http.Flusher)
+		if !ok {
+			WriteError(rw, fmt.Errorf("%w: Streaming is not supported", ErrUnavailable))
+			return
+		}
+
+		rw.Header().Set("Content-Type", "text/event-stream")
+		rw.Header().Set("Cache-Control", "no-cache")
+		rw.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		s.run(r.Context().Done(), func(c *Change) error {
+			data, err := json.Marshal(c)
+			if err != nil {
+				return err
+			}
+			_, err = fmt.Fprintf(rw, "id: %d\nevent: %s\ndata: %s\n\n", c.Seq, c.Action, data)
+			flusher.Flush()
+			return err
+		}, func() error {
+			_, err := fmt.Fprint(rw, ": keep-alive\n\n")
+			flusher.Flush()
+			return err
+		})
+	}
+}
+
+// eventStream sends the changes of a store to a single client.
+type eventStream struct {
+	store   ContactStorer
+	changes <-chan *Change
+
+	// after is the Seq of the last change the client has seen. Streams opened without a last event ID start at the
+	// end of the history, see skip.
+	after int64
+}
+
+func (s *eventStream) serveWebSocket(ws *websocket.Conn) {
+	defer ws.Close()
+
+	// The client is not supposed to send anything, reading only detects when it goes away.
+	done := make(chan struct{})
+	go func() {
+		var discard []byte
+		for websocket.Message.Receive(ws, &discard) == nil {
+		}
+		close(done)
+	}()
+
+	s.run(done, func(c *Change) error {
+		return websocket.JSON.Send(ws, c)
+	}, nil)
+}
+
+// run sends changes until done is closed, the subscription ends or sending fails. keepAlive is optional and called
+// every keepAliveInterval.
+//
+// The changes are read using Audit and the subscription only tells when to look for more. This way they are sent in
+// the order of Audit, even if a change with a lower Seq is published later, and Last-Event-ID resumes the stream
+// without skipping any. Audit may hold back changes until they are final without them being published again, so it
+// is checked every keepAliveInterval as well.
+func (s *eventStream) run(done <-chan struct{}, send func(c *Change) error, keepAlive func() error) {
+	ticker := time.NewTicker(keepAliveInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := s.catchUp(send); err != nil {
+			return
+		}
+
+		select {
+		case <-done:
+			return
+		case _, ok := <-s.changes:
+			if !ok {
+				return
+			}
+		case <-ticker.C:
+			if keepAlive != nil && keepAlive() != nil {
+				return
+			}
+		}
+	}
+}
+
+// skip moves the stream to the last change Audit returns, so only the changes following it are sent. Changes which
+// Audit still holds back come after it and are sent once they are final.
+func (s *eventStream) skip() error {
+	return s.catchUp(func(c *Change) error { return nil })
+}
+
+// catchUp sends the changes following the one with Seq after.
+func (s *eventStream) catchUp(send func(c *Change) error) error {
+	for {
+		changes, err := s.store.Audit(&AuditQuery{After: s.after, Limit: MaxLimit})
+		if err != nil {
+			return err
+		}
+		for _, c := range changes {
+			if err := send(c); err != nil {
+				return err
+			}
+			s.after = c.Seq
+		}
+		if len(changes) < MaxLimit {
+			return nil
+		}
+	}
+}
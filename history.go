@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	. "github.com/ory/workshop-dbg/store"
+	"github.com/pborman/uuid"
+)
+
+// ActorHeader names the user making a request. It is recorded in the history of all contacts the request changes.
+const ActorHeader = "X-Actor"
+
+// RequestIDHeader identifies a request. Clients may set it, otherwise RequestID generates one.
+const RequestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength limits request IDs chosen by clients, as they end up in the history.
+const maxRequestIDLength = 128
+
+// RequestID makes sure every request has an X-Request-ID header and echoes it in the response.
+func RequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if id == "" || len(id) > maxRequestIDLength {
+			id = uuid.New()
+			r.Header.Set(RequestIDHeader, id)
+		}
+		rw.Header().Set(RequestIDHeader, id)
+		next.ServeHTTP(rw, r)
+	})
+}
+
+// RequestActor returns who made the request, for use with ContactStorer.WithActor.
+func RequestActor(r *http.Request) Actor {
+	return Actor{Name: r.Header.Get(ActorHeader), RequestID: r.Header.Get(RequestIDHeader)}
+}
+
+// RequestStore returns a store for handling r. Its operations end with the request, see Timeouts, and its changes
+// are attributed to RequestActor. The store must not be kept beyond the request.
+func RequestStore(store ContactStorer, r *http.Request) ContactStorer {
+	return store.WithContext(r.Context()).WithActor(RequestActor(r))
+}
+
+// ContactHistory lists the changes of a contact, oldest first. It keeps working after the contact was deleted.
+func ContactHistory(store ContactStorer) func(rw http.ResponseWriter, r *http.Request) {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		changes, err := RequestStore(store, r).History(mux.Vars(r)["id"])
+		if err != nil {
+			WriteError(rw, err)
+			return
+		}
+		WriteJSON(rw, http.StatusOK, changes)
+	}
+}
+
+// AuditEntry is a change in the audit feed, which merges the histories of all backends.
+type AuditEntry struct {
+	Backend string `json:"backend"`
+	*Change
+}
+
+// Audit lists the changes of all backends, oldest first. since and until (RFC 3339) restrict the feed to a time
+// range and limit sets the page size. If there are more changes, the Link header points to the next page.
+func Audit(stores map[string]ContactStorer) func(rw http.ResponseWriter, r *http.Request) {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		q, cursor, err := ParseAuditQuery(r)
+		if err != nil {
+			WriteError(rw, err)
+			return
+		}
+
+		// Every backend's changes are in order already, so they are merged by time, taking the oldest first.
+		backends := make([]string, 0, len(stores))
+		for backend := range stores {
+			backends = append(backends, backend)
+		}
+		sort.Strings(backends)
+
+		pending := map[string][]*Change{}
+		for _, backend := range backends {
+			bq := *q
+			bq.After = cursor[backend]
+			changes, err := stores[backend].WithContext(r.Context()).Audit(&bq)
+			if err != nil {
+				WriteError(rw, err)
+				return
+			}
+			pending[backend] = changes
+		}
+
+		entries := []*AuditEntry{}
+		for len(entries) < q.Limit {
+			next := ""
+			for _, backend := range backends {
+				if len(pending[backend]) > 0 && (next == "" || pending[backend][0].Time.Before(pending[next][0].Time)) {
+					next = backend
+				}
+			}
+			if next == "" {
+				break
+			}
+
+			c := pending[next][0]
+			pending[next] = pending[next][1:]
+			entries = append(entries, &AuditEntry{Backend: next, Change: c})
+			cursor[next] = c.Seq
+		}
+
+		// The merge only stops early once all backends ran out of changes, so a full page may be followed by more.
+		if len(entries) == q.Limit {
+			WriteLinks(rw, r, &Page{NextCursor: encodeAuditCursor(cursor)})
+		}
+		WriteJSON(rw, http.StatusOK, entries)
+	}
+}
+
+// ParseAuditQuery reads the since, until, limit and cursor query parameters. The cursor maps each backend to the
+// Seq of the last change already returned.
+func ParseAuditQuery(r *http.Request) (*AuditQuery, map[string]int64, error) {
+	values := r.URL.Query()
+	q := new(AuditQuery)
+	for _, p := range []struct {
+		name string
+		t    *time.Time
+	}{{"since", &q.Since}, {"until", &q.Until}} {
+		if value := values.Get(p.name); value != "" {
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return nil, nil, fmt.Errorf("%w: %s must be a time like 2006-01-02T15:04:05Z", ErrBadRequest, p.name)
+			}
+			*p.t = t
+		}
+	}
+
+	if value := values.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 {
+			return nil, nil, fmt.Errorf("%w: The limit must be a positive number", ErrBadRequest)
+		}
+		q.Limit = limit
+	}
+	q.Normalize()
+
+	cursor := map[string]int64{}
+	if value := values.Get("cursor"); value != "" {
+		raw, err := base64.RawURLEncoding.DecodeString(value)
+		if err != nil || json.Unmarshal(raw, &cursor) != nil {
+			return nil, nil, fmt.Errorf("%w: The cursor is invalid", ErrBadRequest)
+		}
+	}
+	return q, cursor, nil
+}
+
+func encodeAuditCursor(cursor map[string]int64) string {
+	out, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(out)
+}
@@ -2,8 +2,14 @@ package main
 
 // The import section defines libraries that we are going to use in our program.
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"mime"
 	"net/http"
 	"crypto/rand"
 
@@ -14,13 +20,24 @@ import (
 	"github.com/pborman/uuid"
 	"github.com/rs/cors"
 	"math"
+	"net/url"
+	"os"
+	"os/signal"
+	"reflect"
+	"sort"
 	"strconv"
+	"strings"
+	"syscall"
 
 	"github.com/jmoiron/sqlx"
 	_ "github.com/lib/pq"
+	"github.com/ory/workshop-dbg/patch"
 	. "github.com/ory/workshop-dbg/store"
+	"github.com/ory/workshop-dbg/store/cache"
+	"github.com/ory/workshop-dbg/store/file"
 	"github.com/ory/workshop-dbg/store/memory"
 	"github.com/ory/workshop-dbg/store/postgres"
+	"github.com/ory/workshop-dbg/webhook"
 	"time"
 )
 
@@ -28,100 +45,306 @@ import (
 var envHost = env.Getenv("HOST", "")
 var envPort = env.Getenv("PORT", "5678")
 var databaseURL = env.Getenv("DATABASE_URL", "")
+
+// The file backend keeps its contacts in this file, which is created if it does not exist. The backend is only
+// served if the path is set.
+var envFilePath = env.Getenv("FILE_PATH", "")
+
+// Open requests may take this long to finish when the server shuts down.
+const shutdownTimeout = 10 * time.Second
+
+// Deleted contacts are kept in the trash for this long, for example "720h" for 30 days.
+var envTrashRetention = env.Getenv("TRASH_RETENTION", "720h")
+
+// Requests taking longer than these fail with 504 Gateway Timeout, see Timeouts. "0" disables a timeout.
+var envReadTimeout = env.Getenv("READ_TIMEOUT", "5s")
+var envWriteTimeout = env.Getenv("WRITE_TIMEOUT", "10s")
+var envBulkTimeout = env.Getenv("BULK_TIMEOUT", "5m")
 var thisID = uuid.New()
 
 // MyContacts is an exemplary list of contacts.
 var MyContacts = Contacts{
-	// Each contact hs identified by its ID which is prepended with "my-id":
+	// Each contact is identified by its ID, which is also its key in the list.
 	// We are doing this because it is easier to manage and simpler to read.
+	// Like every stored contact, the seeded ones start at version 1, see CheckPreconditions.
 	"john-bravo": &Contact{
-		Name:       "Andreas Preuss",
-		Department: "IT",
-		Company:    "ACME Inc",
+		ID:           "john-bravo",
+		Name:         "Andreas Preuss",
+		Version:      1,
+		Department:   "IT",
+		Company:      "ACME Inc",
+		CompanyID:    "acme",
+		DepartmentID: "acme-it",
 	},
 	"cathrine-mueller": &Contact{
-		Name:       "Cathrine Eholzer",
-		Department: "HR",
-		Company:    "Grove AG",
+		ID:           "cathrine-mueller",
+		Name:         "Cathrine Eholzer",
+		Version:      1,
+		Department:   "HR",
+		Company:      "Grove AG",
+		CompanyID:    "grove",
+		DepartmentID: "grove-hr",
 	},
 	"maximilian-schmidt": &Contact{
-		Name:       "Maximilian Schmidt",
-		Department: "PR",
-		Company:    "Titanpad AG",
+		ID:           "maximilian-schmidt",
+		Name:         "Maximilian Schmidt",
+		Version:      1,
+		Department:   "PR",
+		Company:      "Titanpad AG",
+		CompanyID:    "titanpad",
+		DepartmentID: "titanpad-pr",
 	},
 	"uwe-charly": &Contact{
-		Name:       "Uwe Charly",
-		Department: "FAC",
-		Company:    "KPMG",
+		ID:           "uwe-charly",
+		Name:         "Uwe Charly",
+		Version:      1,
+		Department:   "FAC",
+		Company:      "KPMG",
+		CompanyID:    "kpmg",
+		DepartmentID: "kpmg-fac",
 	},
 	"Thomas-Aidan": &Contact{
-		Name:       "Thomas Aigan",
-		Department: "INO",
-		Company:    "OuterSpace",
+		ID:           "Thomas-Aidan",
+		Name:         "Thomas Aigan",
+		Version:      1,
+		Department:   "INO",
+		Company:      "OuterSpace",
+		CompanyID:    "outerspace",
+		DepartmentID: "outerspace-ino",
 	},
 	"frank-sec": &Contact{
+		ID:         "frank-sec",
 		Name:       "Frank Secure",
-		Department: "Unknow",
+		Version:    1,
+		Department: "Unknown",
 		Company:    "Secret",
+		CompanyID:  "secret",
 	},
 	"juergen-elsner": &Contact{
-		Name:       "Jürgen Elsner",
-		Department: "DaCS",
-		Company:    "DBG",
+		ID:           "juergen-elsner",
+		Name:         "Jürgen Elsner",
+		Version:      1,
+		Department:   "DaCS",
+		Company:      "DBG",
+		CompanyID:    "dbg",
+		DepartmentID: "dbg-dacs",
 	},
 	"Stephane-Deschamps": &Contact{
-		Name:       "Stephane Deschamps",
-		Department: "DaCS",
-		Company:    "DBG",
+		ID:           "Stephane-Deschamps",
+		Name:         "Stephane Deschamps",
+		Version:      1,
+		Department:   "DaCS",
+		Company:      "DBG",
+		CompanyID:    "dbg",
+		DepartmentID: "dbg-dacs",
 	},
 	"Gilles-Lamy": &Contact{
-		Name:       "MGilles Lamy",
-		Department: "DaCS",
-		Company:    "DBG",
+		ID:           "Gilles-Lamy",
+		Name:         "MGilles Lamy",
+		Version:      1,
+		Department:   "DaCS",
+		Company:      "DBG",
+		CompanyID:    "dbg",
+		DepartmentID: "dbg-dacs",
 	},
 	"Helge Harren": &Contact{
-		Name:       "Helge Harren",
-		Department: "TRIT",
-		Company:    "DBG",
+		ID:           "Helge Harren",
+		Name:         "Helge Harren",
+		Version:      1,
+		Department:   "TRIT",
+		Company:      "DBG",
+		CompanyID:    "dbg",
+		DepartmentID: "dbg-trit",
 	},
 	"Stephan Reinartz": &Contact{
-		Name:       "Stephan Reinartz",
-		Department: "SMMI",
-		Company:    "DBG",
+		ID:           "Stephan Reinartz",
+		Name:         "Stephan Reinartz",
+		Version:      1,
+		Department:   "SMMI",
+		Company:      "DBG",
+		CompanyID:    "dbg",
+		DepartmentID: "dbg-smmi",
 	},
 	"Ulrich Meyer": &Contact{
-		Name:       "Ulrich Meyer",
-		Department: "TRIT",
-		Company:    "DBG",
+		ID:           "Ulrich Meyer",
+		Name:         "Ulrich Meyer",
+		Version:      1,
+		Department:   "TRIT",
+		Company:      "DBG",
+		CompanyID:    "dbg",
+		DepartmentID: "dbg-trit",
 	},
 	"Ashwin Kumar": &Contact{
-		Name:       "Ashwin Kumar",
-		Department: "GPD",
-		Company:    "DBG",
+		ID:           "Ashwin Kumar",
+		Name:         "Ashwin Kumar",
+		Version:      1,
+		Department:   "GPD",
+		Company:      "DBG",
+		CompanyID:    "dbg",
+		DepartmentID: "dbg-gpd",
 	},
 	"Stefan Teis": &Contact{
-		Name:       "Stefan Teis",
-		Department: "GPD",
-		Company:    "DBG",
+		ID:           "Stefan Teis",
+		Name:         "Stefan Teis",
+		Version:      1,
+		Department:   "GPD",
+		Company:      "DBG",
+		CompanyID:    "dbg",
+		DepartmentID: "dbg-gpd",
 	},
 }
 
-var memoryStore = &memory.InMemoryStore{Contacts: MyContacts}
+// MyCompanies are the companies of MyContacts.
+var MyCompanies = map[string]*Company{
+	"acme":       {ID: "acme", Name: "ACME Inc"},
+	"grove":      {ID: "grove", Name: "Grove AG"},
+	"titanpad":   {ID: "titanpad", Name: "Titanpad AG"},
+	"kpmg":       {ID: "kpmg", Name: "KPMG"},
+	"outerspace": {ID: "outerspace", Name: "OuterSpace"},
+	"secret":     {ID: "secret", Name: "Secret"},
+	"dbg":        {ID: "dbg", Name: "DBG"},
+}
+
+// MyDepartments are the departments of MyContacts. The department of Frank Secure is unknown.
+var MyDepartments = map[string]*Department{
+	"acme-it":        {ID: "acme-it", CompanyID: "acme", Name: "IT"},
+	"grove-hr":       {ID: "grove-hr", CompanyID: "grove", Name: "HR"},
+	"titanpad-pr":    {ID: "titanpad-pr", CompanyID: "titanpad", Name: "PR"},
+	"kpmg-fac":       {ID: "kpmg-fac", CompanyID: "kpmg", Name: "FAC"},
+	"outerspace-ino": {ID: "outerspace-ino", CompanyID: "outerspace", Name: "INO"},
+	"dbg-dacs":       {ID: "dbg-dacs", CompanyID: "dbg", Name: "DaCS"},
+	"dbg-trit":       {ID: "dbg-trit", CompanyID: "dbg", Name: "TRIT"},
+	"dbg-smmi":       {ID: "dbg-smmi", CompanyID: "dbg", Name: "SMMI"},
+	"dbg-gpd":        {ID: "dbg-gpd", CompanyID: "dbg", Name: "GPD"},
+}
+
+var memoryStore = &memory.InMemoryStore{Contacts: MyContacts, Companies: MyCompanies, Departments: MyDepartments}
 
 // The main routine is going the "entry" point.
 func main() {
+	// "workshop-dbg migrate" manages the database schema instead of starting the server.
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := RunMigrate(os.Stdout, os.Args[2:]); err != nil {
+			log.Fatalf("Could not migrate because %s", err)
+		}
+		return
+	}
+
+	retention, err := time.ParseDuration(envTrashRetention)
+	if err != nil || retention <= 0 {
+		log.Fatalf("TRASH_RETENTION must be a positive duration like 720h, got %q", envTrashRetention)
+	}
+	purgeInterval := time.Hour
+	if retention < purgeInterval {
+		purgeInterval = retention
+	}
+
+	timeouts, err := ParseTimeouts(envReadTimeout, envWriteTimeout, envBulkTimeout)
+	if err != nil {
+		log.Fatalf("Could not configure timeouts because %s", err)
+	}
+
+	// The background jobs run until the server shuts down.
+	stop := make(chan struct{})
+
 	// Create a new router.
 	router := mux.NewRouter()
+	router.Use(timeouts.Handler)
 
 	// RESTful defines operations
 	// * GET for fetching data
+	// * HEAD for fetching metadata without the data itself
 	// * POST for inserting data
 	// * PUT for updating existing data
-	// * DELETE for deleting data
+	// * PATCH for updating parts of existing data
+	// * DELETE for deleting data, which moves it to the trash
 	router.HandleFunc("/memory/contacts", ListContacts(memoryStore)).Methods("GET")
+	router.HandleFunc("/memory/contacts", ContactsMeta(memoryStore)).Methods("HEAD")
 	router.HandleFunc("/memory/contacts", AddContact(memoryStore)).Methods("POST")
+	router.HandleFunc("/memory/contacts/search", SearchContacts(memoryStore)).Methods("GET")
+	router.HandleFunc("/memory/contacts/trash", TrashContacts(memoryStore)).Methods("GET")
+	router.HandleFunc("/memory/contacts/events", ContactEvents(memoryStore)).Methods("GET")
+	router.HandleFunc("/memory/contacts:import", ImportContacts(memoryStore)).Methods("POST")
+	router.HandleFunc("/memory/contacts:export", ExportContacts(memoryStore)).Methods("GET")
+	router.HandleFunc("/memory/contacts:batch", BatchContacts(memoryStore)).Methods("POST")
+	router.HandleFunc("/memory/contacts/{id}:restore", RestoreContact(memoryStore)).Methods("POST")
+	router.HandleFunc("/memory/contacts/{id}/history", ContactHistory(memoryStore)).Methods("GET")
+	router.HandleFunc("/memory/contacts/{id}", GetContact(memoryStore)).Methods("GET")
 	router.HandleFunc("/memory/contacts/{id}", UpdateContact(memoryStore)).Methods("PUT")
+	router.HandleFunc("/memory/contacts/{id}", PatchContact(memoryStore)).Methods("PATCH")
 	router.HandleFunc("/memory/contacts/{id}", DeleteContact(memoryStore)).Methods("DELETE")
+	router.HandleFunc("/memory/webhooks", ListWebhooks(memoryStore)).Methods("GET")
+	router.HandleFunc("/memory/webhooks", AddWebhook(memoryStore)).Methods("POST")
+	router.HandleFunc("/memory/webhooks/{id}", GetWebhook(memoryStore)).Methods("GET")
+	router.HandleFunc("/memory/webhooks/{id}", UpdateWebhook(memoryStore)).Methods("PUT")
+	router.HandleFunc("/memory/webhooks/{id}", DeleteWebhook(memoryStore)).Methods("DELETE")
+	router.HandleFunc("/memory/webhooks/{id}/deliveries", ListDeliveries(memoryStore)).Methods("GET")
+	router.HandleFunc("/memory/deliveries", ListDeliveries(memoryStore)).Methods("GET")
+	router.HandleFunc("/memory/deliveries/{id}:retry", RetryDelivery(memoryStore)).Methods("POST")
+	router.HandleFunc("/memory/companies", ListCompanies(memoryStore)).Methods("GET")
+	router.HandleFunc("/memory/companies", AddCompany(memoryStore)).Methods("POST")
+	router.HandleFunc("/memory/companies/{id}", GetCompany(memoryStore)).Methods("GET")
+	router.HandleFunc("/memory/companies/{id}", UpdateCompany(memoryStore)).Methods("PUT")
+	router.HandleFunc("/memory/companies/{id}", DeleteCompany(memoryStore)).Methods("DELETE")
+	router.HandleFunc("/memory/companies/{id}/departments", ListDepartments(memoryStore)).Methods("GET")
+	router.HandleFunc("/memory/companies/{id}/departments", AddDepartment(memoryStore)).Methods("POST")
+	router.HandleFunc("/memory/companies/{id}/departments/{department}", GetDepartment(memoryStore)).Methods("GET")
+	router.HandleFunc("/memory/companies/{id}/departments/{department}", UpdateDepartment(memoryStore)).Methods("PUT")
+	router.HandleFunc("/memory/companies/{id}/departments/{department}", DeleteDepartment(memoryStore)).Methods("DELETE")
+	router.HandleFunc("/memory/companies/{id}/org-chart", CompanyOrgChart(memoryStore)).Methods("GET")
+	go PurgeTrash(memoryStore, retention, purgeInterval, stop)
+	go (&webhook.Dispatcher{Store: memoryStore}).Run(stop)
+
+	// The audit feed merges the history of all backends.
+	stores := map[string]ContactStorer{"memory": memoryStore}
+
+	// Open the file store
+	if envFilePath == "" {
+		log.Printf("Not serving the file backend because FILE_PATH is not set")
+	} else if fileStore, err := file.Open(envFilePath); err != nil {
+		log.Printf("Could not open the contacts file because %s", err)
+	} else {
+		// main returns once the server has shut down, so no request uses the file anymore.
+		defer fileStore.Close()
+
+		router.HandleFunc("/file/contacts", ListContacts(fileStore)).Methods("GET")
+		router.HandleFunc("/file/contacts", ContactsMeta(fileStore)).Methods("HEAD")
+		router.HandleFunc("/file/contacts", AddContact(fileStore)).Methods("POST")
+		router.HandleFunc("/file/contacts/search", SearchContacts(fileStore)).Methods("GET")
+		router.HandleFunc("/file/contacts/trash", TrashContacts(fileStore)).Methods("GET")
+		router.HandleFunc("/file/contacts/events", ContactEvents(fileStore)).Methods("GET")
+		router.HandleFunc("/file/contacts:import", ImportContacts(fileStore)).Methods("POST")
+		router.HandleFunc("/file/contacts:export", ExportContacts(fileStore)).Methods("GET")
+		router.HandleFunc("/file/contacts:batch", BatchContacts(fileStore)).Methods("POST")
+		router.HandleFunc("/file/contacts/{id}:restore", RestoreContact(fileStore)).Methods("POST")
+		router.HandleFunc("/file/contacts/{id}/history", ContactHistory(fileStore)).Methods("GET")
+		router.HandleFunc("/file/contacts/{id}", GetContact(fileStore)).Methods("GET")
+		router.HandleFunc("/file/contacts/{id}", UpdateContact(fileStore)).Methods("PUT")
+		router.HandleFunc("/file/contacts/{id}", PatchContact(fileStore)).Methods("PATCH")
+		router.HandleFunc("/file/contacts/{id}", DeleteContact(fileStore)).Methods("DELETE")
+		router.HandleFunc("/file/webhooks", ListWebhooks(fileStore)).Methods("GET")
+		router.HandleFunc("/file/webhooks", AddWebhook(fileStore)).Methods("POST")
+		router.HandleFunc("/file/webhooks/{id}", GetWebhook(fileStore)).Methods("GET")
+		router.HandleFunc("/file/webhooks/{id}", UpdateWebhook(fileStore)).Methods("PUT")
+		router.HandleFunc("/file/webhooks/{id}", DeleteWebhook(fileStore)).Methods("DELETE")
+		router.HandleFunc("/file/webhooks/{id}/deliveries", ListDeliveries(fileStore)).Methods("GET")
+		router.HandleFunc("/file/deliveries", ListDeliveries(fileStore)).Methods("GET")
+		router.HandleFunc("/file/deliveries/{id}:retry", RetryDelivery(fileStore)).Methods("POST")
+		router.HandleFunc("/file/companies", ListCompanies(fileStore)).Methods("GET")
+		router.HandleFunc("/file/companies", AddCompany(fileStore)).Methods("POST")
+		router.HandleFunc("/file/companies/{id}", GetCompany(fileStore)).Methods("GET")
+		router.HandleFunc("/file/companies/{id}", UpdateCompany(fileStore)).Methods("PUT")
+		router.HandleFunc("/file/companies/{id}", DeleteCompany(fileStore)).Methods("DELETE")
+		router.HandleFunc("/file/companies/{id}/departments", ListDepartments(fileStore)).Methods("GET")
+		router.HandleFunc("/file/companies/{id}/departments", AddDepartment(fileStore)).Methods("POST")
+		router.HandleFunc("/file/companies/{id}/departments/{department}", GetDepartment(fileStore)).Methods("GET")
+		router.HandleFunc("/file/companies/{id}/departments/{department}", UpdateDepartment(fileStore)).Methods("PUT")
+		router.HandleFunc("/file/companies/{id}/departments/{department}", DeleteDepartment(fileStore)).Methods("DELETE")
+		router.HandleFunc("/file/companies/{id}/org-chart", CompanyOrgChart(fileStore)).Methods("GET")
+		go PurgeTrash(fileStore, retention, purgeInterval, stop)
+		go (&webhook.Dispatcher{Store: fileStore}).Run(stop)
+		stores["file"] = fileStore
+	}
 
 	// Connect to database store
 	db, err := sqlx.Connect("postgres", databaseURL)
@@ -129,16 +352,67 @@ func main() {
 		log.Printf("Could not connect to database because %s", err)
 	} else {
 		databaseStore := &postgres.PostgresStore{DB: db}
+
+		// Contacts are read through an in-memory cache, which is kept up to date with other replicas while listening.
+		cachedStore := &cache.Store{ContactStorer: databaseStore}
+
 		if err := databaseStore.CreateSchemas(); err != nil {
 			log.Printf("Could not set up relations %s", err)
 		} else {
-			router.HandleFunc("/database/contacts", ListContacts(databaseStore)).Methods("GET")
-			router.HandleFunc("/database/contacts", AddContact(databaseStore)).Methods("POST")
-			router.HandleFunc("/database/contacts/{id}", UpdateContact(databaseStore)).Methods("PUT")
-			router.HandleFunc("/database/contacts/{id}", DeleteContact(databaseStore)).Methods("DELETE")
+			// Without listening, everything but the event stream works.
+			if err := databaseStore.Listen(databaseURL); err != nil {
+				log.Printf("Could not listen for changes because %s", err)
+			} else {
+				go func() {
+					if err := cachedStore.Watch(stop); err != nil {
+						log.Printf("Could not watch for changes because %s", err)
+					}
+				}()
+			}
+
+			router.HandleFunc("/database/contacts", ListContacts(cachedStore)).Methods("GET")
+			router.HandleFunc("/database/contacts", ContactsMeta(cachedStore)).Methods("HEAD")
+			router.HandleFunc("/database/contacts", AddContact(cachedStore)).Methods("POST")
+			router.HandleFunc("/database/contacts/search", SearchContacts(cachedStore)).Methods("GET")
+			router.HandleFunc("/database/contacts/trash", TrashContacts(cachedStore)).Methods("GET")
+			router.HandleFunc("/database/contacts/events", ContactEvents(cachedStore)).Methods("GET")
+			router.HandleFunc("/database/contacts:import", ImportContacts(cachedStore)).Methods("POST")
+			router.HandleFunc("/database/contacts:export", ExportContacts(cachedStore)).Methods("GET")
+			router.HandleFunc("/database/contacts:batch", BatchContacts(cachedStore)).Methods("POST")
+			router.HandleFunc("/database/contacts/{id}:restore", RestoreContact(cachedStore)).Methods("POST")
+			router.HandleFunc("/database/contacts/{id}/history", ContactHistory(cachedStore)).Methods("GET")
+			router.HandleFunc("/database/contacts/{id}", GetContact(cachedStore)).Methods("GET")
+			router.HandleFunc("/database/contacts/{id}", UpdateContact(cachedStore)).Methods("PUT")
+			router.HandleFunc("/database/contacts/{id}", PatchContact(cachedStore)).Methods("PATCH")
+			router.HandleFunc("/database/contacts/{id}", DeleteContact(cachedStore)).Methods("DELETE")
+			router.HandleFunc("/database/cache", CacheStats(cachedStore)).Methods("GET")
+			router.HandleFunc("/database/webhooks", ListWebhooks(databaseStore)).Methods("GET")
+			router.HandleFunc("/database/webhooks", AddWebhook(databaseStore)).Methods("POST")
+			router.HandleFunc("/database/webhooks/{id}", GetWebhook(databaseStore)).Methods("GET")
+			router.HandleFunc("/database/webhooks/{id}", UpdateWebhook(databaseStore)).Methods("PUT")
+			router.HandleFunc("/database/webhooks/{id}", DeleteWebhook(databaseStore)).Methods("DELETE")
+			router.HandleFunc("/database/webhooks/{id}/deliveries", ListDeliveries(databaseStore)).Methods("GET")
+			router.HandleFunc("/database/deliveries", ListDeliveries(databaseStore)).Methods("GET")
+			router.HandleFunc("/database/deliveries/{id}:retry", RetryDelivery(databaseStore)).Methods("POST")
+			router.HandleFunc("/database/companies", ListCompanies(cachedStore)).Methods("GET")
+			router.HandleFunc("/database/companies", AddCompany(cachedStore)).Methods("POST")
+			router.HandleFunc("/database/companies/{id}", GetCompany(cachedStore)).Methods("GET")
+			router.HandleFunc("/database/companies/{id}", UpdateCompany(cachedStore)).Methods("PUT")
+			router.HandleFunc("/database/companies/{id}", DeleteCompany(cachedStore)).Methods("DELETE")
+			router.HandleFunc("/database/companies/{id}/departments", ListDepartments(cachedStore)).Methods("GET")
+			router.HandleFunc("/database/companies/{id}/departments", AddDepartment(cachedStore)).Methods("POST")
+			router.HandleFunc("/database/companies/{id}/departments/{department}", GetDepartment(cachedStore)).Methods("GET")
+			router.HandleFunc("/database/companies/{id}/departments/{department}", UpdateDepartment(cachedStore)).Methods("PUT")
+			router.HandleFunc("/database/companies/{id}/departments/{department}", DeleteDepartment(cachedStore)).Methods("DELETE")
+			router.HandleFunc("/database/companies/{id}/org-chart", CompanyOrgChart(cachedStore)).Methods("GET")
+			go PurgeTrash(cachedStore, retention, purgeInterval, stop)
+			go (&webhook.Dispatcher{Store: databaseStore}).Run(stop)
+			stores["database"] = cachedStore
 		}
 	}
 
+	router.HandleFunc("/audit", Audit(stores)).Methods("GET")
+
 	// The info endpoint is for showing demonstration purposes only and is not subject to any task.
 	router.HandleFunc("/info", InfoHandler).Methods("GET")
 	router.HandleFunc("/pi", ComputePi).Methods("GET")
@@ -151,37 +425,181 @@ func main() {
 	// Cross origin resource requests
 	c := cors.New(cors.Options{
 		AllowedOrigins: []string{"*"},
-		AllowedMethods: []string{"GET", "POST", "DELETE", "PUT"}},
+		AllowedMethods: []string{"GET", "HEAD", "POST", "DELETE", "PUT", "PATCH"}},
 	)
 
 	// Start up the server and check for errors.
 	listenOn := fmt.Sprintf("%s:%s", envHost, envPort)
-	if err := http.ListenAndServe(listenOn, c.Handler(router)); err != nil {
+	server := &http.Server{Addr: listenOn, Handler: c.Handler(RequestID(router))}
+
+	// On SIGINT or SIGTERM, the background jobs are stopped and open requests may finish before the server exits.
+	shutDown := make(chan struct{})
+	go func() {
+		defer close(shutDown)
+
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		<-signals
+
+		close(stop)
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			log.Printf("Could not shut down the server gracefully because %s", err)
+		}
+	}()
+
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 		log.Fatalf("Could not set up server because %s", err)
 	}
+
+	// ListenAndServe returns as soon as the shutdown starts, so wait for open requests before closing the stores.
+	<-shutDown
 }
 
-// ListContacts takes a contact list and outputs it.
+// ContactListVersion is the version of the ContactList format. It is incremented by incompatible changes, so
+// clients can tell which fields to expect.
+const ContactListVersion = 1
+
+// ContactList is a page of contacts as returned by ListContacts.
+type ContactList struct {
+	// Version is the ContactListVersion of the format.
+	Version int `json:"version"`
+
+	// Items are the contacts on this page in sort order.
+	Items []*Contact `json:"items"`
+
+	// Total is the number of contacts passing the filters on all pages.
+	Total int `json:"total"`
+
+	// NextCursor is the cursor parameter of the next page. It is empty on the last page.
+	NextCursor string `json:"next_cursor"`
+}
+
+// ListContacts outputs a page of contacts as a ContactList, sorted by ID unless the request sets the sort order
+// (see ParseQuery). The Link header points to the next and previous page.
+//
+// With ?format=map, all contacts are output as a map from ID to contact instead, which was the response of
+// earlier versions. This format does not support any of the query parameters.
 func ListContacts(store ContactStorer) func(rw http.ResponseWriter, r *http.Request) {
 	return func(rw http.ResponseWriter, r *http.Request) {
+		store := RequestStore(store, r)
+
+		switch format := r.URL.Query().Get("format"); format {
+		case "", "list":
+		case "map":
+			if IsQuery(r) {
+				WriteError(rw, fmt.Errorf("%w: The map format can not be paginated, sorted or filtered", ErrBadRequest))
+				return
+			}
+
+			contacts, err := store.FetchContacts()
+			if err != nil {
+				WriteError(rw, err)
+				return
+			}
+			pkg.WriteIndentJSON(rw, contacts)
+			return
+		default:
+			WriteError(rw, fmt.Errorf("%w: The format must be list or map, got %q", ErrBadRequest, format))
+			return
+		}
+
+		query, err := ParseQuery(r)
+		if err != nil {
+			WriteError(rw, err)
+			return
+		}
+
+		page, err := store.QueryContacts(query)
+		if err != nil {
+			WriteError(rw, err)
+			return
+		}
+
+		list := &ContactList{
+			Version:    ContactListVersion,
+			Items:      page.Contacts,
+			Total:      page.Total,
+			NextCursor: page.NextCursor,
+		}
+		if list.Items == nil {
+			list.Items = []*Contact{}
+		}
+
+		WriteLinks(rw, r, page)
+		pkg.WriteIndentJSON(rw, list)
+	}
+}
+
+// SearchContacts outputs the contacts matching the query parameter q, best matches first. The optional
+// parameter limit sets the maximum number of results.
+func SearchContacts(store ContactStorer) func(rw http.ResponseWriter, r *http.Request) {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		var limit int
+		if l := r.URL.Query().Get("limit"); l != "" {
+			var err error
+			if limit, err = strconv.Atoi(l); err != nil || limit < 1 {
+				WriteError(rw, fmt.Errorf("%w: The limit must be a positive number", ErrBadRequest))
+				return
+			}
+		}
 
-		// Write contact list to output
-		contacts, err := store.FetchContacts()
+		contacts, err := RequestStore(store, r).SearchContacts(r.URL.Query().Get("q"), limit)
 		if err != nil {
-			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			WriteError(rw, err)
 			return
 		}
 
 		pkg.WriteIndentJSON(rw, contacts)
+	}
+}
+
+// GetContact outputs a single contact or responds with 404 if it does not exist.
+func GetContact(store ContactStorer) func(rw http.ResponseWriter, r *http.Request) {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		contact, err := RequestStore(store, r).GetContact(mux.Vars(r)["id"])
+		if err != nil {
+			WriteError(rw, err)
+			return
+		}
+
+		// The ETag lets clients make conditional requests, see CheckPreconditions.
+		WriteETag(rw, contact)
+		if inm := r.Header.Get("If-None-Match"); inm != "" && MatchETag(inm, contact.Version, true) {
+			rw.WriteHeader(http.StatusNotModified)
+			return
+		}
 
+		pkg.WriteIndentJSON(rw, contact)
 	}
 }
 
-// ContactsMeta gets the metadata.
-func ContactsMeta (rw http.ResponseWriter, r *http.Request) {
-	rw.Header().Set("Content-Type","application/json")
+// ContactsMeta responds to HEAD requests with metadata about the contact list: the number of contacts
+// (X-Total-Count), an ETag which changes whenever the list changes and the time of the last change. Clients
+// sending a matching If-None-Match header receive a 304 Not Modified.
+func ContactsMeta(store ContactStorer) func(rw http.ResponseWriter, r *http.Request) {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		meta, err := RequestStore(store, r).FetchMeta()
+		if err != nil {
+			WriteError(rw, err)
+			return
+		}
 
+		etag := `"` + meta.Revision + `"`
+		rw.Header().Set("Content-Type", "application/json")
+		rw.Header().Set("X-Total-Count", strconv.Itoa(meta.Count))
+		rw.Header().Set("ETag", etag)
+		if !meta.LastModified.IsZero() {
+			rw.Header().Set("Last-Modified", meta.LastModified.UTC().Format(http.TimeFormat))
+		}
 
+		if inm := r.Header.Get("If-None-Match"); inm != "" && MatchRevision(inm, meta.Revision) {
+			rw.WriteHeader(http.StatusNotModified)
+			return
+		}
+		rw.WriteHeader(http.StatusOK)
+	}
 }
 
 // AddContact will add a contact to the list
@@ -193,30 +611,41 @@ func AddContact(contacts ContactStorer) func(rw http.ResponseWriter, r *http.Req
 
 		// Abort handling the request if an error occurs.
 		if err != nil {
-			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			WriteError(rw, err)
 			return
 		}
 
-		// Save newContact to the list of contacts.
-		if err = contacts.CreateContact(&contactToBeAdded); err != nil {
-			http.Error(rw, err.Error(), http.StatusInternalServerError)
+		// Save newContact to the list of contacts. The store assigns an ID if none was given.
+		if err = RequestStore(contacts, r).CreateContact(&contactToBeAdded); err != nil {
+			WriteError(rw, err)
 			return
 		}
 
-		// Output our newly created contact
-		pkg.WriteIndentJSON(rw, contactToBeAdded)
+		// Output our newly created contact and tell the client where to find it.
+		rw.Header().Set("Location", r.URL.Path+"/"+url.PathEscape(contactToBeAdded.ID))
+		WriteETag(rw, &contactToBeAdded)
+		WriteJSON(rw, http.StatusCreated, contactToBeAdded)
 	}
 }
 
 // DeleteContact will delete a contact from the list
 func DeleteContact(contacts ContactStorer) func(rw http.ResponseWriter, r *http.Request) {
 	return func(rw http.ResponseWriter, r *http.Request) {
+		contacts := RequestStore(contacts, r)
+
 		// Fetch the ID of the contact that is going to be deleted
 		contactToBeDeleted := mux.Vars(r)["id"]
 
+		// If-Match and If-None-Match make the deletion conditional.
+		version, err := CheckPreconditions(r, contacts, contactToBeDeleted)
+		if err != nil {
+			WriteError(rw, err)
+			return
+		}
+
 		// Delete the contact from the list
-		if err := contacts.DeleteContact(contactToBeDeleted); err != nil {
-			http.Error(rw, err.Error(), http.StatusInternalServerError)
+		if err := contacts.DeleteContact(contactToBeDeleted, version); err != nil {
+			WriteError(rw, err)
 			return
 		}
 
@@ -228,36 +657,233 @@ func DeleteContact(contacts ContactStorer) func(rw http.ResponseWriter, r *http.
 // UpdateContact will update a contact on the list
 func UpdateContact(store ContactStorer) func(rw http.ResponseWriter, r *http.Request) {
 	return func(rw http.ResponseWriter, r *http.Request) {
+		store := RequestStore(store, r)
+
 		// We parse the request's information into newContactData.
 		newContactData, err := ReadContactData(rw, r)
 
 		// Abort handling the request if an error occurs.
 		if err != nil {
-			http.Error(rw, err.Error(), http.StatusBadRequest)
+			WriteError(rw, err)
+			return
+		}
+
+		// The ID in the path identifies the contact. The body may omit the ID, but it must not point somewhere else.
+		id := mux.Vars(r)["id"]
+		if newContactData.ID == "" {
+			newContactData.ID = id
+		} else if newContactData.ID != id {
+			WriteError(rw, fmt.Errorf("%w: The contact ID in the body does not match the ID in the URL", ErrBadRequest))
 			return
 		}
 
+		// If-Match and If-None-Match make the update conditional. Without them, the version in the body is used.
+		if version, err := CheckPreconditions(r, store, id); err != nil {
+			WriteError(rw, err)
+			return
+		} else if version != 0 {
+			newContactData.Version = version
+		}
+
 		// Update the data in the contact list.
 		if err := store.UpdateContact(&newContactData); err != nil {
-			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			WriteError(rw, err)
 			return
 		}
 
 		// Set the new data
+		WriteETag(rw, &newContactData)
 		pkg.WriteIndentJSON(rw, newContactData)
 	}
 }
 
+// PatchContact applies a JSON Merge Patch (RFC 7396) or JSON Patch (RFC 6902) to a contact, depending on the
+// request's Content-Type. The patch is applied atomically by the store.
+func PatchContact(store ContactStorer) func(rw http.ResponseWriter, r *http.Request) {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		store := RequestStore(store, r)
+		id := mux.Vars(r)["id"]
+
+		mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if err != nil || (mediaType != patch.MergePatchType && mediaType != patch.JSONPatchType) {
+			rw.Header().Set("Accept-Patch", patch.MergePatchType+", "+patch.JSONPatchType)
+			WriteError(rw, fmt.Errorf("%w: Use %s or %s", ErrUnsupportedMediaType, patch.MergePatchType, patch.JSONPatchType))
+			return
+		}
+
+		body, err := ReadBody(r)
+		if err != nil {
+			WriteError(rw, err)
+			return
+		}
+
+		// If-Match and If-None-Match make the patch conditional.
+		version, err := CheckPreconditions(r, store, id)
+		if err != nil {
+			WriteError(rw, err)
+			return
+		}
+
+		contact, err := store.PatchContact(id, version, func(c *Contact) error {
+			doc, err := json.Marshal(c)
+			if err != nil {
+				return err
+			}
+
+			patched, err := patch.Apply(mediaType, doc, body)
+			if err != nil {
+				return err
+			}
+
+			result, err := DecodeContact(patched)
+			if err != nil {
+				return err
+			}
+
+			// The version is maintained by the store and can not be patched.
+			result.Version = c.Version
+			*c = result
+			return nil
+		})
+		if err != nil {
+			WriteError(rw, err)
+			return
+		}
+
+		WriteETag(rw, contact)
+		pkg.WriteIndentJSON(rw, contact)
+	}
+}
+
+// WriteJSON is a helper function for writing v as indented JSON with the given status code.
+func WriteJSON(rw http.ResponseWriter, code int, v interface{}) {
+	out, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(code)
+	rw.Write(out)
+}
+
+// MaxBodySize is the maximum size of request bodies in bytes.
+const MaxBodySize = 64 << 10
+
 // ReadContactData is a helper function for parsing a HTTP request body. It returns a contact on success and an
-// error if something went wrong.
+// error if something went wrong. The contact is not validated yet, the store does that when writing it.
 func ReadContactData(rw http.ResponseWriter, r *http.Request) (contact Contact, err error) {
-	err = json.NewDecoder(r.Body).Decode(&contact)
+	body, err := ReadBody(r)
 	if err != nil {
-		http.Error(rw, fmt.Sprintf("Could not read input data because %s", err), http.StatusBadRequest)
 		return contact, err
 	}
+	return DecodeContact(body)
+}
+
+// ReadBody reads the request body. Bodies larger than MaxBodySize result in an error wrapping
+// ErrRequestTooLarge.
+func ReadBody(r *http.Request) ([]byte, error) {
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, MaxBodySize+1))
+	if err != nil {
+		return nil, fmt.Errorf("%w: Could not read input data because %s", ErrBadRequest, err)
+	} else if len(body) > MaxBodySize {
+		return nil, fmt.Errorf("%w: The body must not be larger than %d bytes", ErrRequestTooLarge, MaxBodySize)
+	}
+	return body, nil
+}
+
+// DecodeContact parses a JSON contact. Unknown fields and fields of the wrong type result in a *ValidationError,
+// malformed JSON in an error wrapping ErrBadRequest.
+func DecodeContact(data []byte) (contact Contact, err error) {
+	if field := UnknownField(data, reflect.TypeOf(contact)); field != "" {
+		return contact, &ValidationError{Fields: []FieldError{{Field: field, Message: "is not a known field"}}}
+	}
+
+	if err = json.NewDecoder(bytes.NewReader(data)).Decode(&contact); err == nil {
+		return contact, nil
+	}
+
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		return contact, &ValidationError{Fields: []FieldError{{Field: typeErr.Field, Message: "must be a " + typeErr.Type.String()}}}
+	}
+	return contact, fmt.Errorf("%w: Could not read input data because %s", ErrBadRequest, err)
+}
+
+// UnknownField returns the path of the first field of the JSON object data which t has no field for, like
+// "emails[1].label", or "" if there is none. Nested objects and arrays of objects are checked, too. Like
+// encoding/json, names are compared ignoring case. Malformed JSON is left to the decoder to report.
+func UnknownField(data []byte, t reflect.Type) string {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if reflect.PtrTo(t).Implements(reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()) {
+		return ""
+	}
 
-	return contact, nil
+	switch t.Kind() {
+	case reflect.Struct:
+		var object map[string]json.RawMessage
+		if json.Unmarshal(data, &object) != nil {
+			return ""
+		}
+
+		keys := make([]string, 0, len(object))
+		for k := range object {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			f, ok := jsonField(t, k)
+			if !ok {
+				return k
+			} else if field := UnknownField(object[k], f.Type); field != "" {
+				return joinField(k, field)
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		var array []json.RawMessage
+		if json.Unmarshal(data, &array) != nil {
+			return ""
+		}
+		for i, v := range array {
+			if field := UnknownField(v, t.Elem()); field != "" {
+				return joinField(fmt.Sprintf("[%d]", i), field)
+			}
+		}
+	}
+	return ""
+}
+
+// joinField appends the path of a nested field to the path of its parent.
+func joinField(parent, field string) string {
+	if strings.HasPrefix(field, "[") {
+		return parent + field
+	}
+	return parent + "." + field
+}
+
+// jsonField returns the exported field of the struct type t which encoding/json decodes the key into.
+func jsonField(t reflect.Type, key string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		} else if name == "" {
+			name = f.Name
+		}
+		if strings.EqualFold(name, key) {
+			return f, true
+		}
+	}
+	return reflect.StructField{}, false
 }
 
 func Allocate(rw http.ResponseWriter, r *http.Request) {
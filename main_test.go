@@ -1,17 +1,29 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/gorilla/mux"
 	. "github.com/ory/workshop-dbg/store"
+	"github.com/ory/workshop-dbg/store/cache"
 	"github.com/ory/workshop-dbg/store/memory"
 	"github.com/parnurzeal/gorequest"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/net/websocket"
 )
 
 var mockedContactList = Contacts{
@@ -44,19 +56,199 @@ func TestListContacts(t *testing.T) {
 	router.HandleFunc("/contacts", ListContacts(store)).Methods("GET")
 	ts := httptest.NewServer(router)
 
-	// This helper function makes an http request to ListContacts and validates its output.
+	// Contacts are listed in order of their IDs.
+	resp, body, errs := gorequest.New().Get(ts.URL + "/contacts").End()
+	require.Len(t, errs, 0)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var list ContactList
+	require.Nil(t, json.Unmarshal([]byte(body), &list))
+	assert.Equal(t, ContactList{
+		Version: ContactListVersion,
+		Items:   []*Contact{mockedContactList["cathrine-mueller"], mockedContactList["john-bravo"]},
+		Total:   2,
+	}, list)
+	assert.Contains(t, body, `"next_cursor": ""`)
+
+	// This helper function makes an http request for the map format and validates its output.
 	fetchAndTestContactList(t, ts, mockedContactList)
+
+	for _, query := range []string{"?format=map&sort=name", "?format=xml"} {
+		resp, _, errs = gorequest.New().Get(ts.URL + "/contacts" + query).End()
+		require.Len(t, errs, 0)
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, query)
+	}
 }
-func TestHeadContacts(t *testing.T) {
 
+func TestListContactsPaginated(t *testing.T) {
+	store := &memory.InMemoryStore{Contacts: copyContacts(mockedContactList)}
+	require.Nil(t, store.CreateContact(mockContact.Clone()))
+
+	router := mux.NewRouter()
+	router.HandleFunc("/contacts", ListContacts(store)).Methods("GET")
+	ts := httptest.NewServer(router)
+
+	// Fetch the first page sorted by name
+	resp, body, errs := gorequest.New().Get(ts.URL + "/contacts?sort=name&limit=2").End()
+	require.Len(t, errs, 0)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var result ContactList
+	require.Nil(t, json.Unmarshal([]byte(body), &result))
+	require.Len(t, result.Items, 2)
+	assert.Equal(t, "cathrine-mueller", result.Items[0].ID)
+	assert.Equal(t, "eddie-markson", result.Items[1].ID)
+	assert.Equal(t, 3, result.Total)
+	require.NotEmpty(t, result.NextCursor)
+
+	// Follow the next link
+	links := resp.Header.Get("Link")
+	require.Contains(t, links, `rel="next"`)
+	assert.NotContains(t, links, `rel="prev"`)
+	next := strings.TrimSuffix(strings.TrimPrefix(links, "<"), `>; rel="next"`)
+	assert.Contains(t, next, "cursor="+result.NextCursor)
+
+	resp, body, errs = gorequest.New().Get(ts.URL + next).End()
+	require.Len(t, errs, 0)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	result = ContactList{}
+	require.Nil(t, json.Unmarshal([]byte(body), &result))
+	require.Len(t, result.Items, 1)
+	assert.Equal(t, "john-bravo", result.Items[0].ID)
+	assert.Equal(t, 3, result.Total)
+	assert.Empty(t, result.NextCursor)
+	assert.Contains(t, resp.Header.Get("Link"), `rel="prev"`)
+	assert.NotContains(t, resp.Header.Get("Link"), `rel="next"`)
+
+	// Filter by department
+	resp, body, errs = gorequest.New().Get(ts.URL + "/contacts?department=HR").End()
+	require.Len(t, errs, 0)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	result = ContactList{}
+	require.Nil(t, json.Unmarshal([]byte(body), &result))
+	require.Len(t, result.Items, 1)
+	assert.Equal(t, "cathrine-mueller", result.Items[0].ID)
+	assert.Equal(t, 1, result.Total)
+
+	// Filter by tag
+	require.Nil(t, store.CreateContact(&Contact{ID: "tagged", Name: "Tagged", Tags: []string{"vip"}}))
+	resp, body, errs = gorequest.New().Get(ts.URL + "/contacts?tag=vip").End()
+	require.Len(t, errs, 0)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	result = ContactList{}
+	require.Nil(t, json.Unmarshal([]byte(body), &result))
+	require.Len(t, result.Items, 1)
+	assert.Equal(t, []string{"vip"}, result.Items[0].Tags)
+	assert.Equal(t, 1, result.Total)
+
+	// Invalid parameters
+	resp, _, errs = gorequest.New().Get(ts.URL + "/contacts?limit=abc").End()
+	require.Len(t, errs, 0)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	resp, _, errs = gorequest.New().Get(ts.URL + "/contacts?sort=foo").End()
+	require.Len(t, errs, 0)
+	assert.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode)
+}
+
+func TestSearchContacts(t *testing.T) {
+	store := &memory.InMemoryStore{Contacts: copyContacts(mockedContactList)}
+	require.Nil(t, store.CreateContact(mockContact.Clone()))
+
+	router := mux.NewRouter()
+	router.HandleFunc("/contacts/search", SearchContacts(store)).Methods("GET")
+	router.HandleFunc("/contacts/{id}", GetContact(store)).Methods("GET")
+	ts := httptest.NewServer(router)
+
+	// Matching ignores case and accents, names rank higher than companies.
+	resp, body, errs := gorequest.New().Get(ts.URL + "/contacts/search?q=MULLER").End()
+	require.Len(t, errs, 0)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var result []*Contact
+	require.Nil(t, json.Unmarshal([]byte(body), &result))
+	require.Len(t, result, 1)
+	assert.Equal(t, "cathrine-mueller", result[0].ID)
+
+	resp, body, errs = gorequest.New().Get(ts.URL + "/contacts/search?q=acme").End()
+	require.Len(t, errs, 0)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Nil(t, json.Unmarshal([]byte(body), &result))
+	require.Len(t, result, 2)
+
+	resp, body, errs = gorequest.New().Get(ts.URL + "/contacts/search?q=acme+ed&limit=1").End()
+	require.Len(t, errs, 0)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Nil(t, json.Unmarshal([]byte(body), &result))
+	require.Len(t, result, 1)
+	assert.Equal(t, "eddie-markson", result[0].ID)
+
+	// An empty query is rejected
+	resp, _, errs = gorequest.New().Get(ts.URL + "/contacts/search?q=+").End()
+	require.Len(t, errs, 0)
+	assert.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode)
+}
+
+func TestGetContact(t *testing.T) {
+	store := &memory.InMemoryStore{Contacts: copyContacts(mockedContactList)}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/contacts/{id}", GetContact(store)).Methods("GET")
+	ts := httptest.NewServer(router)
+
+	// Fetch an existing contact
+	resp, body, errs := gorequest.New().Get(ts.URL + "/contacts/john-bravo").End()
+	require.Len(t, errs, 0)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var result Contact
+	require.Nil(t, json.Unmarshal([]byte(body), &result))
+	assert.Equal(t, mockedContactList["john-bravo"], &result)
+
+	// Fetch a contact that does not exist
+	resp, body, errs = gorequest.New().Get(ts.URL + "/contacts/does-not-exist").End()
+	require.Len(t, errs, 0)
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	var e ErrorResponse
+	require.Nil(t, json.Unmarshal([]byte(body), &e))
+	assert.Equal(t, http.StatusNotFound, e.Error.Code)
+}
+
+func TestHeadContacts(t *testing.T) {
+	store := &memory.InMemoryStore{Contacts: copyContacts(mockedContactList)}
 
 	// Initialize everything (very similar to main() function).
 	router := mux.NewRouter()
-	router.HandleFunc("/contacts", ContactsMeta).Methods("HEAD")
+	router.HandleFunc("/contacts", ContactsMeta(store)).Methods("HEAD")
 	ts := httptest.NewServer(router)
 
-	// This helper function makes an http request to ListContacts and validates its output.
-	fetchAndTestContactHead(t, ts)
+	// This helper function makes an http request to ContactsMeta and validates its output.
+	etag := fetchAndTestContactHead(t, ts, len(mockedContactList))
+
+	// The ETag did not change, so the client's copy is still fresh.
+	req, err := http.NewRequest("HEAD", ts.URL+"/contacts", nil)
+	require.Nil(t, err)
+	req.Header.Set("If-None-Match", etag)
+	resp, err := http.DefaultClient.Do(req)
+	require.Nil(t, err)
+	assert.Equal(t, http.StatusNotModified, resp.StatusCode)
+
+	// Lists of entity tags, weak ones and "*" match as well.
+	for _, inm := range []string{`"other", ` + etag, "W/" + etag, "*"} {
+		req.Header.Set("If-None-Match", inm)
+		resp, err := http.DefaultClient.Do(req)
+		require.Nil(t, err)
+		assert.Equal(t, http.StatusNotModified, resp.StatusCode, inm)
+	}
+	req.Header.Set("If-None-Match", `"other"`)
+	resp, err = http.DefaultClient.Do(req)
+	require.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// Adding a contact changes the metadata.
+	require.Nil(t, store.CreateContact(mockContact.Clone()))
+	assert.NotEqual(t, etag, fetchAndTestContactHead(t, ts, len(mockedContactList)+1))
 }
 func TestAddContacts(t *testing.T) {
 	// We create a copy of the store
@@ -71,8 +263,241 @@ func TestAddContacts(t *testing.T) {
 	// Make the request
 	resp, _, errs := gorequest.New().Post(ts.URL + "/contacts").SendStruct(mockContact).End()
 	require.Len(t, errs, 0)
-	require.Equal(t, http.StatusOK, resp.StatusCode)
-	require.Equal(t, contactListForThisTest[mockContact.ID], mockContact)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	require.Equal(t, "/contacts/"+mockContact.ID, resp.Header.Get("Location"))
+	require.Equal(t, `"1"`, resp.Header.Get("ETag"))
+
+	expected := mockContact.Clone()
+	expected.Version = 1
+	require.Equal(t, expected, contactListForThisTest[mockContact.ID])
+
+	// Adding the same contact again must fail because the ID is already taken.
+	resp, _, errs = gorequest.New().Post(ts.URL + "/contacts").SendStruct(mockContact).End()
+	require.Len(t, errs, 0)
+	require.Equal(t, http.StatusConflict, resp.StatusCode)
+}
+
+func TestAddContactsGeneratesID(t *testing.T) {
+	contactListForThisTest := copyContacts(mockedContactList)
+	store := &memory.InMemoryStore{Contacts: contactListForThisTest}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/contacts", AddContact(store)).Methods("POST")
+	ts := httptest.NewServer(router)
+
+	// Make the request without an ID
+	resp, body, errs := gorequest.New().Post(ts.URL + "/contacts").SendStruct(&Contact{Name: "Eddie Markson"}).End()
+	require.Len(t, errs, 0)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	var result Contact
+	require.Nil(t, json.Unmarshal([]byte(body), &result))
+	require.NotEmpty(t, result.ID)
+	assert.Equal(t, "/contacts/"+result.ID, resp.Header.Get("Location"))
+	assert.Equal(t, "Eddie Markson", contactListForThisTest[result.ID].Name)
+}
+
+func TestAddContactsValidates(t *testing.T) {
+	contactListForThisTest := copyContacts(mockedContactList)
+	store := &memory.InMemoryStore{Contacts: contactListForThisTest}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/contacts", AddContact(store)).Methods("POST")
+	ts := httptest.NewServer(router)
+
+	for k, c := range []struct {
+		body   string
+		code   int
+		fields []FieldError
+	}{
+		{
+			body:   `{"name": "", "department": "` + strings.Repeat("a", MaxFieldLength+1) + `"}`,
+			code:   http.StatusUnprocessableEntity,
+			fields: []FieldError{{Field: "name", Message: "is required"}, {Field: "department", Message: fmt.Sprintf("must not be longer than %d characters", MaxFieldLength)}},
+		},
+		{
+			body:   `{"name": "Eddie\u0007Markson"}`,
+			code:   http.StatusUnprocessableEntity,
+			fields: []FieldError{{Field: "name", Message: `must not contain the character '\a'`}},
+		},
+		{
+			body:   `{"name": "Eddie Markson", "phone": "123"}`,
+			code:   http.StatusUnprocessableEntity,
+			fields: []FieldError{{Field: "phone", Message: "is not a known field"}},
+		},
+		{
+			body: `{"name": "Eddie Markson", "emails": [{"address": "eddie"}], "phones": [{"type": "pager", "number": "069 211111"}]}`,
+			code: http.StatusUnprocessableEntity,
+			fields: []FieldError{
+				{Field: "emails[0].address", Message: "must be an email address like jane@example.com"},
+				{Field: "phones[0].type", Message: "must be one of work, home, mobile, fax, other"},
+				{Field: "phones[0].number", Message: "must be in E.164 format like +4969211111"},
+			},
+		},
+		{
+			body:   `{"name": "Eddie Markson", "emails": [{"address": "eddie@example.com"}, {"address": "e@example.com", "label": "old"}]}`,
+			code:   http.StatusUnprocessableEntity,
+			fields: []FieldError{{Field: "emails[1].label", Message: "is not a known field"}},
+		},
+		{
+			body:   `{"name": 1}`,
+			code:   http.StatusUnprocessableEntity,
+			fields: []FieldError{{Field: "name", Message: "must be a string"}},
+		},
+		{body: `{"name": `, code: http.StatusBadRequest},
+		{body: `{"name": "` + strings.Repeat("a", MaxBodySize) + `"}`, code: http.StatusRequestEntityTooLarge},
+	} {
+		resp, err := http.Post(ts.URL+"/contacts", "application/json", strings.NewReader(c.body))
+		require.Nil(t, err, "case %d", k)
+		assert.Equal(t, c.code, resp.StatusCode, "case %d", k)
+
+		var result ErrorResponse
+		require.Nil(t, json.NewDecoder(resp.Body).Decode(&result), "case %d", k)
+		resp.Body.Close()
+		assert.Equal(t, c.fields, result.Error.Fields, "case %d", k)
+	}
+
+	assert.Len(t, contactListForThisTest, len(mockedContactList))
+}
+
+func TestUnknownField(t *testing.T) {
+	for data, field := range map[string]string{
+		`{"name": "Eddie", "Department": "IT"}`:                       "",
+		`{"name": "Eddie", "phone": "123", "fax": "456"}`:             "fax",
+		`{"addresses": [{"city": "Frankfurt", "zip": "60485"}]}`:      "addresses[0].zip",
+		`{"attributes": {"cost_center": "4711"}, "deleted_at": null}`: "",
+		`{"name": `: "",
+		`[]`:        "",
+	} {
+		assert.Equal(t, field, UnknownField([]byte(data), reflect.TypeOf(Contact{})), data)
+	}
+}
+
+func TestImportExportContacts(t *testing.T) {
+	store := &memory.InMemoryStore{Contacts: Contacts{}}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/contacts:import", ImportContacts(store)).Methods("POST")
+	router.HandleFunc("/contacts:export", ExportContacts(store)).Methods("GET")
+	ts := httptest.NewServer(router)
+
+	csv := "id,name,department,company\njohn-bravo,John Bravo,IT,ACME Inc\ncathrine-mueller,,HR,Grove AG\n"
+
+	// Atomic imports fail if any row is invalid.
+	resp, err := http.Post(ts.URL+"/contacts:import?atomic=true", "text/csv", strings.NewReader(csv))
+	require.Nil(t, err)
+	assert.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode)
+
+	var report ImportReport
+	require.Nil(t, json.NewDecoder(resp.Body).Decode(&report))
+	assert.Equal(t, 0, report.Imported)
+	require.Len(t, report.Errors, 1)
+	assert.Equal(t, 2, report.Errors[0].Row)
+	assert.Equal(t, "cathrine-mueller", report.Errors[0].ID)
+	assert.Empty(t, store.Contacts)
+
+	// Otherwise invalid rows are skipped.
+	resp, err = http.Post(ts.URL+"/contacts:import", "text/csv; charset=utf-8", strings.NewReader(csv))
+	require.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Nil(t, json.NewDecoder(resp.Body).Decode(&report))
+	assert.Equal(t, 1, report.Imported)
+	assert.Len(t, store.Contacts, 1)
+
+	resp, err = http.Post(ts.URL+"/contacts:import", "application/xml", strings.NewReader(csv))
+	require.Nil(t, err)
+	assert.Equal(t, http.StatusUnsupportedMediaType, resp.StatusCode)
+
+	resp, err = http.Post(ts.URL+"/contacts:import", "text/csv", strings.NewReader("phone\n123\n"))
+	require.Nil(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	// Exports pick the format from the query or the Accept header.
+	resp, body, errs := gorequest.New().Get(ts.URL + "/contacts:export?format=csv").End()
+	require.Len(t, errs, 0)
+	assert.Equal(t, "text/csv", resp.Header.Get("Content-Type"))
+	assert.Equal(t, "id,name,department,company\njohn-bravo,John Bravo,IT,ACME Inc\n", body)
+
+	resp, body, errs = gorequest.New().Get(ts.URL+"/contacts:export").Set("Accept", "text/vcard").End()
+	require.Len(t, errs, 0)
+	assert.Equal(t, "text/vcard", resp.Header.Get("Content-Type"))
+	assert.Contains(t, body, "FN:John Bravo\r\n")
+
+	resp, body, errs = gorequest.New().Get(ts.URL + "/contacts:export").End()
+	require.Len(t, errs, 0)
+	assert.Equal(t, "application/x-ndjson", resp.Header.Get("Content-Type"))
+	assert.Equal(t, `{"id":"john-bravo","name":"John Bravo","department":"IT","company":"ACME Inc","version":1}`+"\n", body)
+
+	resp, _, errs = gorequest.New().Get(ts.URL+"/contacts:export").Set("Accept", "application/xml").End()
+	require.Len(t, errs, 0)
+	assert.Equal(t, http.StatusNotAcceptable, resp.StatusCode)
+}
+
+func TestBatchContacts(t *testing.T) {
+	contactListForThisTest := copyContacts(mockedContactList)
+	store := &memory.InMemoryStore{Contacts: contactListForThisTest}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/contacts:batch", BatchContacts(store)).Methods("POST")
+	ts := httptest.NewServer(router)
+
+	batch := func(query, body string) (*http.Response, *BatchResponse) {
+		resp, err := http.Post(ts.URL+"/contacts:batch"+query, "application/json", strings.NewReader(body))
+		require.Nil(t, err)
+		defer resp.Body.Close()
+
+		var result BatchResponse
+		require.Nil(t, json.NewDecoder(resp.Body).Decode(&result))
+		return resp, &result
+	}
+
+	// The second delete fails, so the whole batch is rolled back.
+	resp, result := batch("", `{"operations": [
+		{"op": "create", "contact": {"id": "eddie-markson", "name": "Eddie Markson"}},
+		{"op": "update", "id": "john-bravo", "contact": {"name": "John Bravo", "company": "Grove AG"}},
+		{"op": "delete", "id": "unknown", "version": 1}
+	]}`)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	require.Len(t, result.Results, 3)
+	assert.Equal(t, []int{http.StatusFailedDependency, http.StatusFailedDependency, http.StatusNotFound},
+		[]int{result.Results[0].Status, result.Results[1].Status, result.Results[2].Status})
+	assert.Len(t, contactListForThisTest, len(mockedContactList))
+	assert.Equal(t, "ACME Inc", contactListForThisTest["john-bravo"].Company)
+
+	resp, result = batch("", `{"operations": [
+		{"op": "create", "contact": {"id": "eddie-markson", "name": "Eddie Markson"}},
+		{"op": "update", "id": "john-bravo", "contact": {"name": "John Bravo", "company": "Grove AG"}},
+		{"op": "delete", "id": "cathrine-mueller"}
+	]}`)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Len(t, result.Results, 3)
+	assert.Equal(t, http.StatusCreated, result.Results[0].Status)
+	assert.Equal(t, 1, result.Results[0].Contact.Version)
+	assert.Equal(t, http.StatusOK, result.Results[1].Status)
+	assert.Equal(t, 1, result.Results[1].Contact.Version)
+	assert.Equal(t, http.StatusNoContent, result.Results[2].Status)
+	assert.Equal(t, "Grove AG", contactListForThisTest["john-bravo"].Company)
+	assert.NotNil(t, contactListForThisTest["eddie-markson"])
+	assert.Nil(t, contactListForThisTest["cathrine-mueller"])
+
+	// Non-atomic batches apply what they can.
+	resp, result = batch("?atomic=false", `{"operations": [
+		{"op": "create", "contact": {"id": "eddie-markson", "name": "Eddie Markson"}},
+		{"op": "update", "contact": {"id": "john-bravo", "name": ""}},
+		{"op": "delete", "id": "eddie-markson", "version": 1}
+	]}`)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Len(t, result.Results, 3)
+	assert.Equal(t, http.StatusConflict, result.Results[0].Status)
+	assert.Equal(t, http.StatusUnprocessableEntity, result.Results[1].Status)
+	assert.Equal(t, "name", result.Results[1].Error.Fields[0].Field)
+	assert.Equal(t, http.StatusNoContent, result.Results[2].Status)
+	assert.Nil(t, contactListForThisTest["eddie-markson"])
+
+	for _, body := range []string{`{"operations": []}`, `{"operations": [{"op": "upsert"}]}`, `{"ops": []}`} {
+		resp, _ := batch("", body)
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, body)
+	}
 }
 
 func TestDeleteContacts(t *testing.T) {
@@ -92,6 +517,607 @@ func TestDeleteContacts(t *testing.T) {
 
 	_, found := contactListForThisTest["john-bravo"]
 	require.False(t, found)
+
+	// Deleting it again fails because it is in the trash now.
+	resp, _, errs = gorequest.New().Delete(ts.URL + "/contacts/john-bravo").End()
+	require.Len(t, errs, 0)
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestTrash(t *testing.T) {
+	contactListForThisTest := copyContacts(mockedContactList)
+	store := &memory.InMemoryStore{Contacts: contactListForThisTest}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/contacts", ListContacts(store)).Methods("GET")
+	router.HandleFunc("/contacts/trash", TrashContacts(store)).Methods("GET")
+	router.HandleFunc("/contacts/{id}:restore", RestoreContact(store)).Methods("POST")
+	router.HandleFunc("/contacts/{id}", DeleteContact(store)).Methods("DELETE")
+	ts := httptest.NewServer(router)
+
+	resp, _, errs := gorequest.New().Delete(ts.URL + "/contacts/john-bravo").End()
+	require.Len(t, errs, 0)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	var trash []*Contact
+	resp, body, errs := gorequest.New().Get(ts.URL + "/contacts/trash").End()
+	require.Len(t, errs, 0)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Nil(t, json.Unmarshal([]byte(body), &trash))
+	require.Len(t, trash, 1)
+	assert.Equal(t, "john-bravo", trash[0].ID)
+	assert.NotNil(t, trash[0].DeletedAt)
+
+	// Lists hide trashed contacts unless asked otherwise.
+	var list ContactList
+	_, body, _ = gorequest.New().Get(ts.URL + "/contacts?sort=id").End()
+	require.Nil(t, json.Unmarshal([]byte(body), &list))
+	assert.Len(t, list.Items, len(mockedContactList)-1)
+	_, body, _ = gorequest.New().Get(ts.URL + "/contacts?include_deleted=true").End()
+	require.Nil(t, json.Unmarshal([]byte(body), &list))
+	assert.Len(t, list.Items, len(mockedContactList))
+
+	var restored Contact
+	resp, body, errs = gorequest.New().Post(ts.URL + "/contacts/john-bravo:restore").End()
+	require.Len(t, errs, 0)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Nil(t, json.Unmarshal([]byte(body), &restored))
+	assert.Nil(t, restored.DeletedAt)
+	assert.Equal(t, `"1"`, resp.Header.Get("ETag"))
+	assert.Equal(t, "John Bravo", contactListForThisTest["john-bravo"].Name)
+
+	resp, _, errs = gorequest.New().Post(ts.URL + "/contacts/john-bravo:restore").End()
+	require.Len(t, errs, 0)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestHistory(t *testing.T) {
+	store := &memory.InMemoryStore{Contacts: copyContacts(mockedContactList)}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/contacts/{id}/history", ContactHistory(store)).Methods("GET")
+	router.HandleFunc("/contacts/{id}", UpdateContact(store)).Methods("PUT")
+	router.HandleFunc("/contacts/{id}", DeleteContact(store)).Methods("DELETE")
+	ts := httptest.NewServer(RequestID(router))
+
+	resp, _, errs := gorequest.New().Get(ts.URL + "/contacts/john-bravo/history").End()
+	require.Len(t, errs, 0)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp, _, errs = gorequest.New().Put(ts.URL+"/contacts/john-bravo").
+		Set(ActorHeader, "alice").Set(RequestIDHeader, "req-1").
+		Send(`{"name": "Johnny Bravo", "department": "IT", "company": "ACME Inc"}`).End()
+	require.Len(t, errs, 0)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "req-1", resp.Header.Get(RequestIDHeader))
+
+	resp, _, errs = gorequest.New().Delete(ts.URL + "/contacts/john-bravo").End()
+	require.Len(t, errs, 0)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	generated := resp.Header.Get(RequestIDHeader)
+	assert.NotEmpty(t, generated)
+
+	// The history is kept for deleted contacts.
+	var changes []*Change
+	resp, body, errs := gorequest.New().Get(ts.URL + "/contacts/john-bravo/history").End()
+	require.Len(t, errs, 0)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Nil(t, json.Unmarshal([]byte(body), &changes))
+	require.Len(t, changes, 2)
+	assert.Equal(t, ActionUpdate, changes[0].Action)
+	assert.Equal(t, "alice", changes[0].Actor)
+	assert.Equal(t, "req-1", changes[0].RequestID)
+	assert.Equal(t, "John Bravo", changes[0].Before.Name)
+	assert.Equal(t, "Johnny Bravo", changes[0].After.Name)
+	assert.Equal(t, ActionDelete, changes[1].Action)
+	assert.Equal(t, "", changes[1].Actor)
+	assert.Equal(t, generated, changes[1].RequestID)
+}
+
+func TestAudit(t *testing.T) {
+	first := &memory.InMemoryStore{Contacts: Contacts{}}
+	second := &memory.InMemoryStore{Contacts: Contacts{}}
+	for i, s := range []*memory.InMemoryStore{first, second, first, second, first} {
+		require.Nil(t, s.CreateContact(&Contact{ID: strconv.Itoa(i), Name: "Contact"}))
+		// The feed is ordered by time, which must differ between the backends.
+		time.Sleep(time.Millisecond)
+	}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/audit", Audit(map[string]ContactStorer{"first": first, "second": second})).Methods("GET")
+	ts := httptest.NewServer(router)
+
+	// The feed is paged through using the Link header.
+	var ids, backends []string
+	next := "/audit?limit=2"
+	for next != "" {
+		var entries []*AuditEntry
+		resp, body, errs := gorequest.New().Get(ts.URL + next).End()
+		require.Len(t, errs, 0)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Nil(t, json.Unmarshal([]byte(body), &entries))
+		for _, e := range entries {
+			ids = append(ids, e.ContactID)
+			backends = append(backends, e.Backend)
+		}
+
+		next = ""
+		if link := resp.Header.Get("Link"); link != "" {
+			next = link[1:strings.Index(link, ">")]
+		}
+		require.True(t, len(ids) <= 5)
+	}
+	assert.Equal(t, []string{"0", "1", "2", "3", "4"}, ids)
+	assert.Equal(t, []string{"first", "second", "first", "second", "first"}, backends)
+
+	changes, _ := first.History("2")
+	var entries []*AuditEntry
+	_, body, _ := gorequest.New().Get(ts.URL + "/audit?since=" + changes[0].Time.Add(time.Second).Format(time.RFC3339)).End()
+	require.Nil(t, json.Unmarshal([]byte(body), &entries))
+	assert.Empty(t, entries)
+
+	for _, query := range []string{"since=yesterday", "limit=0", "cursor=x"} {
+		resp, _, errs := gorequest.New().Get(ts.URL + "/audit?" + query).End()
+		require.Len(t, errs, 0)
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, query)
+	}
+}
+
+func TestContactEvents(t *testing.T) {
+	store := &memory.InMemoryStore{Contacts: copyContacts(mockedContactList)}
+	require.Nil(t, store.DeleteContact("john-bravo", 0))
+
+	router := mux.NewRouter()
+	router.HandleFunc("/contacts/events", ContactEvents(store)).Methods("GET")
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	req, _ := http.NewRequest("GET", ts.URL+"/contacts/events", nil)
+	req.Header.Set("Last-Event-ID", "0")
+	resp, err := http.DefaultClient.Do(req)
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	events := bufio.NewReader(resp.Body)
+	readEvent := func() (id, event string, c *Change) {
+		for {
+			line, err := events.ReadString('\n')
+			require.Nil(t, err)
+			line = strings.TrimSuffix(line, "\n")
+			switch {
+			case line == "":
+				return id, event, c
+			case strings.HasPrefix(line, "id: "):
+				id = line[4:]
+			case strings.HasPrefix(line, "event: "):
+				event = line[7:]
+			case strings.HasPrefix(line, "data: "):
+				require.Nil(t, json.Unmarshal([]byte(line[6:]), &c))
+			}
+		}
+	}
+
+	// The missed change is replayed, then new ones follow.
+	id, event, c := readEvent()
+	assert.Equal(t, "1", id)
+	assert.Equal(t, ActionDelete, event)
+	assert.Equal(t, "john-bravo", c.ContactID)
+
+	_, err = store.RestoreContact("john-bravo")
+	require.Nil(t, err)
+	id, event, c = readEvent()
+	assert.Equal(t, "2", id)
+	assert.Equal(t, ActionRestore, event)
+	assert.Equal(t, "John Bravo", c.After.Name)
+
+	// WebSocket clients resume using the query.
+	ws, err := websocket.Dial("ws"+ts.URL[4:]+"/contacts/events?last_event_id=1", "", ts.URL)
+	require.Nil(t, err)
+	defer ws.Close()
+	require.Nil(t, websocket.JSON.Receive(ws, &c))
+	assert.Equal(t, int64(2), c.Seq)
+
+	require.Nil(t, store.DeleteContact("cathrine-mueller", 0))
+	require.Nil(t, websocket.JSON.Receive(ws, &c))
+	assert.Equal(t, int64(3), c.Seq)
+	assert.Equal(t, "cathrine-mueller", c.ContactID)
+
+	resp, _, errs := gorequest.New().Get(ts.URL+"/contacts/events").Set("Last-Event-ID", "latest").End()
+	require.Len(t, errs, 0)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+// heldBackStore holds back the changes of a contact and the ones following them from Audit, like PostgreSQL does
+// with changes which may still be followed by a lower Seq. Its subscription only receives what the test sends.
+type heldBackStore struct {
+	*memory.InMemoryStore
+	live chan *Change
+
+	mu   sync.Mutex
+	held string
+}
+
+func (s *heldBackStore) WithContext(ctx context.Context) ContactStorer {
+	return s
+}
+
+func (s *heldBackStore) Subscribe() (<-chan *Change, func(), error) {
+	return s.live, func() {}, nil
+}
+
+func (s *heldBackStore) Audit(q *AuditQuery) ([]*Change, error) {
+	changes, err := s.InMemoryStore.Audit(q)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, c := range changes {
+		if c.ContactID == s.held {
+			return changes[:i], err
+		}
+	}
+	return changes, err
+}
+
+func TestContactEventsFollowAudit(t *testing.T) {
+	store := &heldBackStore{
+		InMemoryStore: &memory.InMemoryStore{Contacts: copyContacts(mockedContactList)},
+		live:          make(chan *Change, 1),
+		held:          "cathrine-mueller",
+	}
+	require.Nil(t, store.DeleteContact("john-bravo", 0))
+	require.Nil(t, store.DeleteContact("cathrine-mueller", 0))
+	_, err := store.RestoreContact("john-bravo")
+	require.Nil(t, err)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/contacts/events", ContactEvents(store)).Methods("GET")
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	ws, err := websocket.Dial("ws"+ts.URL[4:]+"/contacts/events?last_event_id=0", "", ts.URL)
+	require.Nil(t, err)
+	defer ws.Close()
+	var c Change
+	require.Nil(t, websocket.JSON.Receive(ws, &c))
+	assert.Equal(t, int64(1), c.Seq)
+
+	// Once the held back change is final, it is sent together with the one following it, which was never published.
+	store.mu.Lock()
+	store.held = ""
+	store.mu.Unlock()
+	changes, err := store.History("cathrine-mueller")
+	require.Nil(t, err)
+	store.live <- changes[0]
+	for _, seq := range []int64{2, 3} {
+		require.Nil(t, websocket.JSON.Receive(ws, &c))
+		assert.Equal(t, seq, c.Seq)
+	}
+}
+
+// Streams opened without a last event ID start at the end of Audit, so changes it still holds back are sent, too.
+func TestContactEventsStartAtAudit(t *testing.T) {
+	store := &heldBackStore{
+		InMemoryStore: &memory.InMemoryStore{Contacts: copyContacts(mockedContactList)},
+		live:          make(chan *Change, 1),
+		held:          "cathrine-mueller",
+	}
+	require.Nil(t, store.DeleteContact("john-bravo", 0))
+	require.Nil(t, store.DeleteContact("cathrine-mueller", 0))
+
+	router := mux.NewRouter()
+	router.HandleFunc("/contacts/events", ContactEvents(store)).Methods("GET")
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	ws, err := websocket.Dial("ws"+ts.URL[4:]+"/contacts/events", "", ts.URL)
+	require.Nil(t, err)
+	defer ws.Close()
+
+	_, err = store.RestoreContact("john-bravo")
+	require.Nil(t, err)
+	changes, err := store.History("john-bravo")
+	require.Nil(t, err)
+	store.mu.Lock()
+	store.held = ""
+	store.mu.Unlock()
+	store.live <- changes[1]
+
+	var c Change
+	for _, seq := range []int64{2, 3} {
+		require.Nil(t, websocket.JSON.Receive(ws, &c))
+		assert.Equal(t, seq, c.Seq)
+	}
+}
+
+func TestCacheStats(t *testing.T) {
+	store := &cache.Store{ContactStorer: &memory.InMemoryStore{Contacts: copyContacts(mockedContactList)}}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/contacts/{id}", GetContact(store)).Methods("GET")
+	router.HandleFunc("/contacts/{id}", UpdateContact(store)).Methods("PUT")
+	router.HandleFunc("/cache", CacheStats(store)).Methods("GET")
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	get := func() string {
+		resp, body, errs := gorequest.New().Get(ts.URL + "/contacts/john-bravo").End()
+		require.Len(t, errs, 0)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		return body
+	}
+
+	// The second read is a hit, the update invalidates the contact.
+	assert.Contains(t, get(), "John Bravo")
+	assert.Contains(t, get(), "John Bravo")
+	resp, _, errs := gorequest.New().Put(ts.URL + "/contacts/john-bravo").Send(`{"name": "Johnny Bravo"}`).End()
+	require.Len(t, errs, 0)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, get(), "Johnny Bravo")
+
+	var stats cache.Stats
+	_, body, errs := gorequest.New().Get(ts.URL + "/cache").End()
+	require.Len(t, errs, 0)
+	require.Nil(t, json.Unmarshal([]byte(body), &stats))
+	assert.Equal(t, cache.Stats{Hits: 1, Misses: 2, Size: 1}, stats)
+}
+
+func TestWebhooks(t *testing.T) {
+	store := &memory.InMemoryStore{Contacts: copyContacts(mockedContactList)}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/contacts/{id}", DeleteContact(store)).Methods("DELETE")
+	router.HandleFunc("/webhooks", ListWebhooks(store)).Methods("GET")
+	router.HandleFunc("/webhooks", AddWebhook(store)).Methods("POST")
+	router.HandleFunc("/webhooks/{id}", GetWebhook(store)).Methods("GET")
+	router.HandleFunc("/webhooks/{id}", UpdateWebhook(store)).Methods("PUT")
+	router.HandleFunc("/webhooks/{id}", DeleteWebhook(store)).Methods("DELETE")
+	router.HandleFunc("/webhooks/{id}/deliveries", ListDeliveries(store)).Methods("GET")
+	router.HandleFunc("/deliveries", ListDeliveries(store)).Methods("GET")
+	router.HandleFunc("/deliveries/{id}:retry", RetryDelivery(store)).Methods("POST")
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	resp, body, errs := gorequest.New().Post(ts.URL + "/webhooks").Send(`{"url": "mailto:hr@example.com", "events": ["rename"]}`).End()
+	require.Len(t, errs, 0)
+	require.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode)
+	var errResp ErrorResponse
+	require.Nil(t, json.Unmarshal([]byte(body), &errResp))
+	assert.Len(t, errResp.Error.Fields, 2)
+
+	// The secret is generated and only returned on creation.
+	var created Webhook
+	resp, body, errs = gorequest.New().Post(ts.URL + "/webhooks").Send(`{"url": "http://example.com/hook", "events": ["delete"]}`).End()
+	require.Len(t, errs, 0)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	require.Nil(t, json.Unmarshal([]byte(body), &created))
+	assert.NotEmpty(t, created.Secret)
+	assert.True(t, created.Active)
+	assert.Equal(t, "/webhooks/"+created.ID, resp.Header.Get("Location"))
+
+	var w Webhook
+	_, body, _ = gorequest.New().Get(ts.URL + "/webhooks/" + created.ID).End()
+	require.Nil(t, json.Unmarshal([]byte(body), &w))
+	assert.Empty(t, w.Secret)
+	assert.Equal(t, []string{ActionDelete}, w.Events)
+
+	var list []*Webhook
+	_, body, _ = gorequest.New().Get(ts.URL + "/webhooks").End()
+	require.Nil(t, json.Unmarshal([]byte(body), &list))
+	require.Len(t, list, 1)
+	assert.Empty(t, list[0].Secret)
+
+	// Replacing a webhook without a secret keeps it.
+	resp, _, errs = gorequest.New().Put(ts.URL + "/webhooks/" + created.ID).Send(`{"url": "http://example.com/other", "events": ["delete"]}`).End()
+	require.Len(t, errs, 0)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	stored, err := store.GetWebhook(created.ID)
+	require.Nil(t, err)
+	assert.Equal(t, created.Secret, stored.Secret)
+	assert.Equal(t, "http://example.com/other", stored.URL)
+
+	resp, _, errs = gorequest.New().Delete(ts.URL + "/contacts/john-bravo").End()
+	require.Len(t, errs, 0)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	var deliveries []*Delivery
+	_, body, _ = gorequest.New().Get(ts.URL + "/webhooks/" + created.ID + "/deliveries").End()
+	require.Nil(t, json.Unmarshal([]byte(body), &deliveries))
+	require.Len(t, deliveries, 1)
+	assert.Equal(t, DeliveryPending, deliveries[0].Status)
+	assert.Equal(t, "john-bravo", deliveries[0].Change.ContactID)
+
+	// Dead letters can be retried.
+	d := deliveries[0]
+	d.Status, d.Attempts = DeliveryDead, 8
+	require.Nil(t, store.UpdateDelivery(d))
+	_, body, _ = gorequest.New().Get(ts.URL + "/deliveries?status=dead").End()
+	require.Nil(t, json.Unmarshal([]byte(body), &deliveries))
+	require.Len(t, deliveries, 1)
+
+	resp, _, errs = gorequest.New().Post(ts.URL + "/deliveries/" + strconv.FormatInt(d.ID, 10) + ":retry").End()
+	require.Len(t, errs, 0)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	retried, err := store.GetDelivery(d.ID)
+	require.Nil(t, err)
+	assert.Equal(t, DeliveryPending, retried.Status)
+	assert.Equal(t, 0, retried.Attempts)
+
+	for _, path := range []string{"/deliveries?status=lost", "/deliveries?limit=0"} {
+		resp, _, errs = gorequest.New().Get(ts.URL + path).End()
+		require.Len(t, errs, 0)
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, path)
+	}
+
+	resp, _, errs = gorequest.New().Delete(ts.URL + "/webhooks/" + created.ID).End()
+	require.Len(t, errs, 0)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	resp, _, errs = gorequest.New().Get(ts.URL + "/webhooks/" + created.ID + "/deliveries").End()
+	require.Len(t, errs, 0)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestCompanies(t *testing.T) {
+	store := &memory.InMemoryStore{Contacts: copyContacts(mockedContactList)}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/contacts", AddContact(store)).Methods("POST")
+	router.HandleFunc("/contacts/{id}", GetContact(store)).Methods("GET")
+	router.HandleFunc("/companies", ListCompanies(store)).Methods("GET")
+	router.HandleFunc("/companies", AddCompany(store)).Methods("POST")
+	router.HandleFunc("/companies/{id}", GetCompany(store)).Methods("GET")
+	router.HandleFunc("/companies/{id}", UpdateCompany(store)).Methods("PUT")
+	router.HandleFunc("/companies/{id}", DeleteCompany(store)).Methods("DELETE")
+	router.HandleFunc("/companies/{id}/departments", ListDepartments(store)).Methods("GET")
+	router.HandleFunc("/companies/{id}/departments", AddDepartment(store)).Methods("POST")
+	router.HandleFunc("/companies/{id}/departments/{department}", GetDepartment(store)).Methods("GET")
+	router.HandleFunc("/companies/{id}/departments/{department}", UpdateDepartment(store)).Methods("PUT")
+	router.HandleFunc("/companies/{id}/departments/{department}", DeleteDepartment(store)).Methods("DELETE")
+	router.HandleFunc("/companies/{id}/org-chart", CompanyOrgChart(store)).Methods("GET")
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	resp, body, errs := gorequest.New().Post(ts.URL + "/companies").Send(`{"id": "acme", "name": "ACME Inc"}`).End()
+	require.Len(t, errs, 0)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.Equal(t, "/companies/acme", resp.Header.Get("Location"))
+	var acme Company
+	require.Nil(t, json.Unmarshal([]byte(body), &acme))
+	assert.False(t, acme.CreatedAt.IsZero())
+
+	for k, c := range []struct {
+		path string
+		body string
+		code int
+	}{
+		{path: "/companies", body: `{"name": "acme inc"}`, code: http.StatusConflict},
+		{path: "/companies", body: `{"name": ""}`, code: http.StatusUnprocessableEntity},
+		{path: "/companies", body: `{"name": "Grove AG", "size": 3}`, code: http.StatusBadRequest},
+		{path: "/companies/grove/departments", body: `{"name": "HR"}`, code: http.StatusNotFound},
+		{path: "/companies/acme/departments", body: `{"id": "acme-it", "name": "IT"}`, code: http.StatusCreated},
+		{path: "/companies/acme/departments", body: `{"name": "it"}`, code: http.StatusConflict},
+		{path: "/companies/acme/departments", body: `{"id": "acme-hr", "name": "HR"}`, code: http.StatusCreated},
+	} {
+		resp, _, errs := gorequest.New().Post(ts.URL + c.path).Send(c.body).End()
+		require.Len(t, errs, 0, "case %d", k)
+		assert.Equal(t, c.code, resp.StatusCode, "case %d", k)
+	}
+
+	// Departments are only found under their company.
+	resp, _, errs = gorequest.New().Get(ts.URL + "/companies/acme/departments/acme-it").End()
+	require.Len(t, errs, 0)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	resp, _, errs = gorequest.New().Get(ts.URL + "/companies/grove/departments/acme-it").End()
+	require.Len(t, errs, 0)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp, _, errs = gorequest.New().Put(ts.URL + "/companies/acme/departments/acme-hr").Send(`{"name": "People"}`).End()
+	require.Len(t, errs, 0)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var departments []*Department
+	_, body, _ = gorequest.New().Get(ts.URL + "/companies/acme/departments").End()
+	require.Nil(t, json.Unmarshal([]byte(body), &departments))
+	require.Len(t, departments, 2)
+	assert.Equal(t, "IT", departments[0].Name)
+	assert.Equal(t, "People", departments[1].Name)
+
+	// Contacts may only reference existing companies, departments of their company and managers.
+	for k, c := range []struct {
+		body  string
+		field string
+	}{
+		{body: `{"name": "Eddie Markson", "company_id": "grove"}`, field: "company_id"},
+		{body: `{"name": "Eddie Markson", "company_id": "acme", "department_id": "grove-hr"}`, field: "department_id"},
+		{body: `{"name": "Eddie Markson", "department_id": "acme-it"}`, field: "department_id"},
+		{body: `{"name": "Eddie Markson", "manager_id": "jane-doe"}`, field: "manager_id"},
+		{body: `{"name": "Eddie Markson", "company": "Grove AG", "company_id": "acme"}`, field: "company"},
+	} {
+		resp, body, errs := gorequest.New().Post(ts.URL + "/contacts").Send(c.body).End()
+		require.Len(t, errs, 0, "case %d", k)
+		require.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode, "case %d", k)
+		var errResp ErrorResponse
+		require.Nil(t, json.Unmarshal([]byte(body), &errResp), "case %d", k)
+		require.Len(t, errResp.Error.Fields, 1, "case %d", k)
+		assert.Equal(t, c.field, errResp.Error.Fields[0].Field, "case %d", k)
+	}
+
+	for _, body := range []string{
+		`{"id": "jane-doe", "name": "Jane Doe", "company_id": "acme", "department_id": "acme-it"}`,
+		`{"id": "eddie-markson", "name": "Eddie Markson", "company_id": "acme", "department_id": "acme-it", "manager_id": "jane-doe"}`,
+		`{"id": "max-mustermann", "name": "Max Mustermann", "company_id": "acme"}`,
+	} {
+		resp, _, errs := gorequest.New().Post(ts.URL + "/contacts").Send(body).End()
+		require.Len(t, errs, 0)
+		require.Equal(t, http.StatusCreated, resp.StatusCode, body)
+	}
+
+	resp, body, errs = gorequest.New().Get(ts.URL + "/companies/acme/org-chart").End()
+	require.Len(t, errs, 0)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var chart OrgChart
+	require.Nil(t, json.Unmarshal([]byte(body), &chart))
+	assert.Equal(t, "ACME Inc", chart.Company.Name)
+	require.Len(t, chart.Departments, 2)
+	require.Len(t, chart.Departments[0].Members, 1)
+	assert.Equal(t, "jane-doe", chart.Departments[0].Members[0].ID)
+	require.Len(t, chart.Departments[0].Members[0].Reports, 1)
+	assert.Equal(t, "eddie-markson", chart.Departments[0].Members[0].Reports[0].ID)
+	assert.Empty(t, chart.Departments[1].Members)
+	require.Len(t, chart.Unassigned, 1)
+	assert.Equal(t, "max-mustermann", chart.Unassigned[0].ID)
+
+	// Companies and departments which are still referenced can not be deleted.
+	for _, path := range []string{"/companies/acme", "/companies/acme/departments/acme-it"} {
+		resp, _, errs = gorequest.New().Delete(ts.URL + path).End()
+		require.Len(t, errs, 0)
+		assert.Equal(t, http.StatusConflict, resp.StatusCode, path)
+	}
+	resp, _, errs = gorequest.New().Delete(ts.URL + "/companies/acme/departments/acme-hr").End()
+	require.Len(t, errs, 0)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	resp, _, errs = gorequest.New().Put(ts.URL + "/companies/acme").Send(`{"name": "ACME Corp"}`).End()
+	require.Len(t, errs, 0)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var companies []*Company
+	_, body, _ = gorequest.New().Get(ts.URL + "/companies").End()
+	require.Nil(t, json.Unmarshal([]byte(body), &companies))
+	require.Len(t, companies, 1)
+	assert.Equal(t, "ACME Corp", companies[0].Name)
+	assert.Equal(t, acme.CreatedAt, companies[0].CreatedAt)
+
+	// The contacts of the company are renamed, too.
+	resp, body, errs = gorequest.New().Get(ts.URL + "/contacts/jane-doe").End()
+	require.Len(t, errs, 0)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var jane Contact
+	require.Nil(t, json.Unmarshal([]byte(body), &jane))
+	assert.Equal(t, "ACME Corp", jane.Company)
+	assert.Equal(t, "IT", jane.Department)
+	assert.Equal(t, 2, jane.Version)
+
+	resp, _, errs = gorequest.New().Get(ts.URL + "/companies/grove/org-chart").End()
+	require.Len(t, errs, 0)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestPurgeTrash(t *testing.T) {
+	store := &memory.InMemoryStore{Contacts: copyContacts(mockedContactList)}
+	require.Nil(t, store.DeleteContact("john-bravo", 0))
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		PurgeTrash(store, time.Nanosecond, time.Millisecond, stop)
+		close(done)
+	}()
+
+	assert.Eventually(t, func() bool {
+		trash, err := store.FetchTrash()
+		return err == nil && len(trash) == 0
+	}, time.Second, time.Millisecond)
+	close(stop)
+	<-done
 }
 
 func TestUpdateContacts(t *testing.T) {
@@ -104,14 +1130,152 @@ func TestUpdateContacts(t *testing.T) {
 	router.HandleFunc("/contacts/{id}", UpdateContact(store)).Methods("PUT")
 	ts := httptest.NewServer(router)
 
-	// Make the request
-	resp, _, errs := gorequest.New().Put(ts.URL + "/contacts/john-bravo").SendStruct(mockContact).End()
+	// Make the request without an ID in the body, the ID from the URL is used.
+	update := &Contact{Name: "John Bravo", Department: "Finance", Company: "ACME Inc"}
+	resp, _, errs := gorequest.New().Put(ts.URL + "/contacts/john-bravo").SendStruct(update).End()
 	require.Len(t, errs, 0)
 	require.Equal(t, http.StatusOK, resp.StatusCode)
 
-	// The new contact should be inserted
+	// The existing contact should be updated and no new contact should be inserted
+	assert.Equal(t, "Finance", contactListForThisTest["john-bravo"].Department)
+	assert.Len(t, contactListForThisTest, len(mockedContactList))
+
+	// An ID in the body that does not match the URL is rejected
+	resp, _, errs = gorequest.New().Put(ts.URL + "/contacts/john-bravo").SendStruct(mockContact).End()
+	require.Len(t, errs, 0)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
 	_, found := contactListForThisTest[mockContact.ID]
-	require.True(t, found)
+	require.False(t, found)
+
+	// Updating a contact that does not exist results in a 404
+	resp, _, errs = gorequest.New().Put(ts.URL + "/contacts/" + mockContact.ID).SendStruct(mockContact).End()
+	require.Len(t, errs, 0)
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestConditionalRequests(t *testing.T) {
+	store := &memory.InMemoryStore{Contacts: Contacts{}}
+	require.Nil(t, store.CreateContact(mockContact.Clone()))
+
+	router := mux.NewRouter()
+	router.HandleFunc("/contacts/{id}", GetContact(store)).Methods("GET")
+	router.HandleFunc("/contacts/{id}", UpdateContact(store)).Methods("PUT")
+	router.HandleFunc("/contacts/{id}", DeleteContact(store)).Methods("DELETE")
+	ts := httptest.NewServer(router)
+	u := ts.URL + "/contacts/" + mockContact.ID
+
+	resp, _, errs := gorequest.New().Get(u).End()
+	require.Len(t, errs, 0)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	etag := resp.Header.Get("ETag")
+	require.Equal(t, `"1"`, etag)
+
+	// The client's copy is still fresh
+	resp, _, errs = gorequest.New().Get(u).Set("If-None-Match", etag).End()
+	require.Len(t, errs, 0)
+	assert.Equal(t, http.StatusNotModified, resp.StatusCode)
+
+	// The first update succeeds, the second one is based on a stale version
+	for _, expected := range []int{http.StatusOK, http.StatusPreconditionFailed} {
+		resp, _, errs = gorequest.New().Put(u).Set("If-Match", etag).SendStruct(&Contact{Name: "Eddie"}).End()
+		require.Len(t, errs, 0)
+		require.Equal(t, expected, resp.StatusCode)
+		if expected == http.StatusOK {
+			assert.Equal(t, `"2"`, resp.Header.Get("ETag"))
+		}
+	}
+
+	// A stale version in the body is rejected as well
+	resp, _, errs = gorequest.New().Put(u).SendStruct(&Contact{Name: "Eddie", Version: 1}).End()
+	require.Len(t, errs, 0)
+	require.Equal(t, http.StatusPreconditionFailed, resp.StatusCode)
+
+	// If-None-Match: * fails because the contact exists
+	resp, _, errs = gorequest.New().Put(u).Set("If-None-Match", "*").SendStruct(&Contact{Name: "Eddie"}).End()
+	require.Len(t, errs, 0)
+	require.Equal(t, http.StatusPreconditionFailed, resp.StatusCode)
+
+	// Deleting with a stale version fails, with the current version it succeeds
+	resp, _, errs = gorequest.New().Delete(u).Set("If-Match", etag).End()
+	require.Len(t, errs, 0)
+	require.Equal(t, http.StatusPreconditionFailed, resp.StatusCode)
+
+	resp, _, errs = gorequest.New().Delete(u).Set("If-Match", `"2"`).End()
+	require.Len(t, errs, 0)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	// If-Match never matches contacts which do not exist
+	resp, _, errs = gorequest.New().Delete(u).Set("If-Match", "*").End()
+	require.Len(t, errs, 0)
+	require.Equal(t, http.StatusPreconditionFailed, resp.StatusCode)
+}
+
+// The seeded contacts are at version 1 like created ones, so preconditions on version 0 fail for them.
+func TestConditionalRequestsOnSeededContacts(t *testing.T) {
+	store := &memory.InMemoryStore{Contacts: copyContacts(MyContacts)}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/contacts/{id}", UpdateContact(store)).Methods("PUT")
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	for id, c := range MyContacts {
+		assert.Equal(t, 1, c.Version, id)
+	}
+
+	u := ts.URL + "/contacts/john-bravo"
+	for _, c := range []struct {
+		etag string
+		code int
+	}{
+		{etag: `"0"`, code: http.StatusPreconditionFailed},
+		{etag: `"1"`, code: http.StatusOK},
+	} {
+		resp, _, errs := gorequest.New().Put(u).Set("If-Match", c.etag).Send(`{"name": "Andreas Preuss"}`).End()
+		require.Len(t, errs, 0)
+		assert.Equal(t, c.code, resp.StatusCode, c.etag)
+	}
+}
+
+func TestPatchContact(t *testing.T) {
+	contactListForThisTest := copyContacts(mockedContactList)
+	store := &memory.InMemoryStore{Contacts: contactListForThisTest}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/contacts/{id}", PatchContact(store)).Methods("PATCH")
+	ts := httptest.NewServer(router)
+	u := ts.URL + "/contacts/john-bravo"
+
+	for k, c := range []struct {
+		contentType, body string
+		code              int
+		department        string
+	}{
+		{contentType: "application/merge-patch+json", body: `{"department":"Finance"}`, code: http.StatusOK, department: "Finance"},
+		{contentType: "application/json-patch+json", body: `[{"op":"replace","path":"/department","value":"HR"}]`, code: http.StatusOK, department: "HR"},
+		{contentType: "application/json-patch+json", body: `[{"op":"test","path":"/department","value":"IT"}]`, code: http.StatusConflict, department: "HR"},
+		{contentType: "application/json-patch+json", body: `[{"op":"remove","path":"/phone"}]`, code: http.StatusUnprocessableEntity, department: "HR"},
+		{contentType: "application/json-patch+json", body: `{"op":"remove"}`, code: http.StatusBadRequest, department: "HR"},
+		{contentType: "application/merge-patch+json", body: `{"id":"someone-else"}`, code: http.StatusUnprocessableEntity, department: "HR"},
+		{contentType: "application/merge-patch+json", body: `{"phone":"123"}`, code: http.StatusUnprocessableEntity, department: "HR"},
+		{contentType: "application/json", body: `{"department":"IT"}`, code: http.StatusUnsupportedMediaType, department: "HR"},
+	} {
+		resp, _, errs := gorequest.New().Patch(u).Set("Content-Type", c.contentType).Send(c.body).End()
+		require.Len(t, errs, 0, "case %d", k)
+		assert.Equal(t, c.code, resp.StatusCode, "case %d", k)
+
+		r, err := store.GetContact("john-bravo")
+		require.Nil(t, err)
+		assert.Equal(t, c.department, r.Department, "case %d", k)
+		assert.Equal(t, "John Bravo", r.Name, "case %d", k)
+	}
+
+	// Patching a contact that does not exist results in a 404
+	resp, _, errs := gorequest.New().Patch(ts.URL+"/contacts/does-not-exist").
+		Set("Content-Type", "application/merge-patch+json").Send(`{"department":"HR"}`).End()
+	require.Len(t, errs, 0)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
 }
 
 func TestPis(t *testing.T) {
@@ -172,9 +1336,122 @@ func TestAllocate(t *testing.T) {
 	assert.Equal(t, "Processed!", res.Result)
 }
 
+func TestWriteError(t *testing.T) {
+	for k, c := range []struct {
+		err  error
+		code int
+	}{
+		{err: ErrBadRequest, code: http.StatusBadRequest},
+		{err: ErrRequestTooLarge, code: http.StatusRequestEntityTooLarge},
+		{err: ErrNotAcceptable, code: http.StatusNotAcceptable},
+		{err: ErrFailedDependency, code: http.StatusFailedDependency},
+		{err: ErrNotFound, code: http.StatusNotFound},
+		{err: ErrAlreadyExists, code: http.StatusConflict},
+		{err: ErrConflict, code: http.StatusConflict},
+		{err: ErrVersionMismatch, code: http.StatusPreconditionFailed},
+		{err: fmt.Errorf("%w: name is required", ErrValidation), code: http.StatusUnprocessableEntity},
+		{err: fmt.Errorf("%w: connection refused", ErrUnavailable), code: http.StatusServiceUnavailable},
+		{err: context.DeadlineExceeded, code: http.StatusGatewayTimeout},
+		{err: fmt.Errorf("%w: canceling statement due to user request", context.Canceled), code: http.StatusGatewayTimeout},
+		{err: errors.New("something else"), code: http.StatusInternalServerError},
+	} {
+		rw := httptest.NewRecorder()
+		WriteError(rw, c.err)
+		assert.Equal(t, c.code, rw.Code, "case %d", k)
+		assert.Equal(t, "application/json", rw.Header().Get("Content-Type"), "case %d", k)
+
+		var result ErrorResponse
+		require.Nil(t, json.NewDecoder(rw.Body).Decode(&result), "case %d", k)
+		assert.Equal(t, c.code, result.Error.Code, "case %d", k)
+		assert.Equal(t, http.StatusText(c.code), result.Error.Status, "case %d", k)
+		assert.Equal(t, c.err.Error(), result.Error.Message, "case %d", k)
+	}
+}
+
+// slowStore stands in for a backend which does not answer before the request's context is done.
+type slowStore struct {
+	*memory.InMemoryStore
+	ctx context.Context
+}
+
+func (s *slowStore) WithContext(ctx context.Context) ContactStorer {
+	return &slowStore{InMemoryStore: s.InMemoryStore, ctx: ctx}
+}
+
+func (s *slowStore) WithActor(actor Actor) ContactStorer {
+	return s
+}
+
+func (s *slowStore) GetContact(id string) (*Contact, error) {
+	<-s.ctx.Done()
+	return nil, s.ctx.Err()
+}
+
+func (s *slowStore) GetCompany(id string) (*Company, error) {
+	<-s.ctx.Done()
+	return nil, s.ctx.Err()
+}
+
+func TestTimeouts(t *testing.T) {
+	_, err := ParseTimeouts("5s", "-1s", "1m")
+	assert.NotNil(t, err)
+	_, err = ParseTimeouts("5s", "10s", "soon")
+	assert.NotNil(t, err)
+	timeouts, err := ParseTimeouts("20ms", "10s", "0")
+	require.Nil(t, err)
+	assert.Equal(t, &Timeouts{Read: 20 * time.Millisecond, Write: 10 * time.Second}, timeouts)
+
+	store := &slowStore{InMemoryStore: &memory.InMemoryStore{Contacts: copyContacts(mockedContactList)}}
+	deadlines := map[string]bool{}
+	record := func(rw http.ResponseWriter, r *http.Request) {
+		_, ok := r.Context().Deadline()
+		deadlines[r.Method+" "+r.URL.Path] = ok
+	}
+
+	router := mux.NewRouter()
+	router.Use(timeouts.Handler)
+	router.HandleFunc("/contacts/events", record).Methods("GET")
+	router.HandleFunc("/contacts:export", record).Methods("GET")
+	router.HandleFunc("/contacts/{id}", GetContact(store)).Methods("GET")
+	router.HandleFunc("/contacts/{id}", record).Methods("DELETE")
+	router.HandleFunc("/companies/{id}", GetCompany(store)).Methods("GET")
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	// The store gives up once the read timeout passed, for contacts as well as companies.
+	for _, path := range []string{"/contacts/john-bravo", "/companies/dbg"} {
+		started := time.Now()
+		resp, body, errs := gorequest.New().Get(ts.URL + path).End()
+		require.Len(t, errs, 0)
+		assert.Equal(t, http.StatusGatewayTimeout, resp.StatusCode, body)
+		assert.True(t, time.Since(started) < 5*time.Second, path)
+	}
+
+	for _, path := range []string{"/contacts/events", "/contacts:export"} {
+		resp, _, errs := gorequest.New().Get(ts.URL + path).End()
+		require.Len(t, errs, 0)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+	_, _, errs := gorequest.New().Delete(ts.URL + "/contacts/x:export").End()
+	require.Len(t, errs, 0)
+	assert.Equal(t, map[string]bool{
+		"GET /contacts/events":      false,
+		"GET /contacts:export":      false,
+		"DELETE /contacts/x:export": true,
+	}, deadlines)
+}
+
+func TestRunMigrateRejectsUnknownCommands(t *testing.T) {
+	var out bytes.Buffer
+	assert.NotNil(t, RunMigrate(&out, []string{"sideways"}))
+	assert.Contains(t, out.String(), "Usage: workshop-dbg migrate")
+
+	assert.NotNil(t, RunMigrate(&out, []string{"down", "zero"}))
+}
+
 func fetchAndTestContactList(t *testing.T, ts *httptest.Server, compareWith Contacts) {
-	// Request ListContacts
-	resp, err := http.Get(ts.URL + "/contacts")
+	// Request ListContacts in the map format
+	resp, err := http.Get(ts.URL + "/contacts?format=map")
 
 	// Verify that no errors occurred
 	require.Nil(t, err)
@@ -189,15 +1466,20 @@ func fetchAndTestContactList(t *testing.T, ts *httptest.Server, compareWith Cont
 	// Compare the outputs
 	assert.Equal(t, compareWith, result)
 }
-func fetchAndTestContactHead(t *testing.T, ts *httptest.Server) {
-	// Request ListContacts
+func fetchAndTestContactHead(t *testing.T, ts *httptest.Server, count int) string {
+	// Request ContactsMeta
 	resp, err := http.Head(ts.URL + "/contacts")
 
 	// Verify that no errors occurred
 	require.Nil(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
 	// Compare the outputs
 	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+	assert.Equal(t, strconv.Itoa(count), resp.Header.Get("X-Total-Count"))
+	assert.NotEmpty(t, resp.Header.Get("ETag"))
 	t.Logf("%s", resp.Header)
+	return resp.Header.Get("ETag")
 }
 func copyContacts(original Contacts) Contacts {
 	result := Contacts{}
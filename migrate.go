@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/ory/workshop-dbg/store/postgres"
+)
+
+const migrateUsage = `Usage: workshop-dbg migrate [command]
+
+Manages the schema of the database set by DATABASE_URL.
+
+Commands:
+  up        Apply all pending migrations (default)
+  down [n]  Revert the latest n migrations (default 1)
+  status    List all migrations and whether they have been applied
+`
+
+// RunMigrate implements the migrate subcommand. args are the arguments following "migrate".
+func RunMigrate(out io.Writer, args []string) error {
+	command := "up"
+	if len(args) > 0 {
+		command = args[0]
+	}
+
+	steps := 1
+	if command == "down" && len(args) > 1 {
+		n, err := strconv.Atoi(args[1])
+		if err != nil || n < 1 {
+			return fmt.Errorf("The number of migrations to revert must be a positive number, got %q", args[1])
+		}
+		steps = n
+	}
+
+	switch command {
+	case "up", "down", "status":
+	default:
+		fmt.Fprint(out, migrateUsage)
+		return fmt.Errorf("Unknown command %q", command)
+	}
+
+	db, err := sqlx.Connect("postgres", databaseURL)
+	if err != nil {
+		return fmt.Errorf("Could not connect to database because %s", err)
+	}
+	defer db.Close()
+	s := &postgres.PostgresStore{DB: db}
+
+	switch command {
+	case "up":
+		n, err := s.MigrateUp()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "Applied %d migrations\n", n)
+	case "down":
+		n, err := s.MigrateDown(steps)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "Reverted %d migrations\n", n)
+	case "status":
+		status, err := s.MigrationStatus()
+		if err != nil {
+			return err
+		}
+		applied := 0
+		for _, m := range status {
+			state := "pending"
+			if m.AppliedAt != nil {
+				state = "applied " + m.AppliedAt.Format("2006-01-02 15:04:05")
+				applied++
+			}
+			fmt.Fprintf(out, "%4d  %-26s  %s\n", m.Version, state, m.Description)
+		}
+		if applied == 0 {
+			fmt.Fprintln(out, "No migrations applied")
+		}
+	}
+	return nil
+}
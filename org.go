@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/gorilla/mux"
+	. "github.com/ory/workshop-dbg/store"
+)
+
+// OrgRequest is the body of requests creating or renaming companies and departments. The ID is optional when
+// creating and ignored when renaming, which takes the ID from the path.
+type OrgRequest struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// ListCompanies outputs all companies ordered by name.
+func ListCompanies(store ContactStorer) func(rw http.ResponseWriter, r *http.Request) {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		orgs, err := RequestOrgs(store, r)
+		if err != nil {
+			WriteError(rw, err)
+			return
+		}
+
+		companies, err := orgs.FetchCompanies()
+		if err != nil {
+			WriteError(rw, err)
+			return
+		}
+		WriteJSON(rw, http.StatusOK, companies)
+	}
+}
+
+// AddCompany creates a company. Company names are unique, ignoring case.
+func AddCompany(store ContactStorer) func(rw http.ResponseWriter, r *http.Request) {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		orgs, err := RequestOrgs(store, r)
+		if err != nil {
+			WriteError(rw, err)
+			return
+		}
+
+		req, err := ReadOrgRequest(r)
+		if err != nil {
+			WriteError(rw, err)
+			return
+		}
+
+		c := &Company{ID: req.ID, Name: req.Name}
+		if err := orgs.CreateCompany(c); err != nil {
+			WriteError(rw, err)
+			return
+		}
+
+		rw.Header().Set("Location", r.URL.Path+"/"+url.PathEscape(c.ID))
+		WriteJSON(rw, http.StatusCreated, c)
+	}
+}
+
+// GetCompany outputs a company.
+func GetCompany(store ContactStorer) func(rw http.ResponseWriter, r *http.Request) {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		orgs, err := RequestOrgs(store, r)
+		if err != nil {
+			WriteError(rw, err)
+			return
+		}
+
+		c, err := orgs.GetCompany(mux.Vars(r)["id"])
+		if err != nil {
+			WriteError(rw, err)
+			return
+		}
+		WriteJSON(rw, http.StatusOK, c)
+	}
+}
+
+// UpdateCompany renames a company.
+func UpdateCompany(store ContactStorer) func(rw http.ResponseWriter, r *http.Request) {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		orgs, err := RequestOrgs(store, r)
+		if err != nil {
+			WriteError(rw, err)
+			return
+		}
+
+		req, err := ReadOrgRequest(r)
+		if err != nil {
+			WriteError(rw, err)
+			return
+		}
+
+		c := &Company{ID: mux.Vars(r)["id"], Name: req.Name}
+		if err := orgs.UpdateCompany(c); err != nil {
+			WriteError(rw, err)
+			return
+		}
+		WriteJSON(rw, http.StatusOK, c)
+	}
+}
+
+// DeleteCompany deletes a company. Companies which still have departments or contacts are kept and result in
+// 409 Conflict.
+func DeleteCompany(store ContactStorer) func(rw http.ResponseWriter, r *http.Request) {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		orgs, err := RequestOrgs(store, r)
+		if err != nil {
+			WriteError(rw, err)
+			return
+		}
+
+		if err := orgs.DeleteCompany(mux.Vars(r)["id"]); err != nil {
+			WriteError(rw, err)
+			return
+		}
+		rw.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// ListDepartments outputs the departments of a company ordered by name.
+func ListDepartments(store ContactStorer) func(rw http.ResponseWriter, r *http.Request) {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		orgs, err := RequestOrgs(store, r)
+		if err != nil {
+			WriteError(rw, err)
+			return
+		}
+
+		departments, err := orgs.FetchDepartments(mux.Vars(r)["id"])
+		if err != nil {
+			WriteError(rw, err)
+			return
+		}
+		WriteJSON(rw, http.StatusOK, departments)
+	}
+}
+
+// AddDepartment creates a department of a company. Department names are unique within their company, ignoring
+// case.
+func AddDepartment(store ContactStorer) func(rw http.ResponseWriter, r *http.Request) {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		orgs, err := RequestOrgs(store, r)
+		if err != nil {
+			WriteError(rw, err)
+			return
+		}
+
+		req, err := ReadOrgRequest(r)
+		if err != nil {
+			WriteError(rw, err)
+			return
+		}
+
+		d := &Department{ID: req.ID, CompanyID: mux.Vars(r)["id"], Name: req.Name}
+		if err := orgs.CreateDepartment(d); err != nil {
+			WriteError(rw, err)
+			return
+		}
+
+		rw.Header().Set("Location", r.URL.Path+"/"+url.PathEscape(d.ID))
+		WriteJSON(rw, http.StatusCreated, d)
+	}
+}
+
+// GetDepartment outputs a department of a company.
+func GetDepartment(store ContactStorer) func(rw http.ResponseWriter, r *http.Request) {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		orgs, err := RequestOrgs(store, r)
+		if err != nil {
+			WriteError(rw, err)
+			return
+		}
+
+		d, err := CompanyDepartment(orgs, r)
+		if err != nil {
+			WriteError(rw, err)
+			return
+		}
+		WriteJSON(rw, http.StatusOK, d)
+	}
+}
+
+// UpdateDepartment renames a department of a company.
+func UpdateDepartment(store ContactStorer) func(rw http.ResponseWriter, r *http.Request) {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		orgs, err := RequestOrgs(store, r)
+		if err != nil {
+			WriteError(rw, err)
+			return
+		}
+
+		req, err := ReadOrgRequest(r)
+		if err != nil {
+			WriteError(rw, err)
+			return
+		}
+
+		d, err := CompanyDepartment(orgs, r)
+		if err != nil {
+			WriteError(rw, err)
+			return
+		}
+
+		d.Name = req.Name
+		if err := orgs.UpdateDepartment(d); err != nil {
+			WriteError(rw, err)
+			return
+		}
+		WriteJSON(rw, http.StatusOK, d)
+	}
+}
+
+// DeleteDepartment deletes a department of a company. Departments which still have contacts are kept and result
+// in 409 Conflict.
+func DeleteDepartment(store ContactStorer) func(rw http.ResponseWriter, r *http.Request) {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		orgs, err := RequestOrgs(store, r)
+		if err != nil {
+			WriteError(rw, err)
+			return
+		}
+
+		d, err := CompanyDepartment(orgs, r)
+		if err != nil {
+			WriteError(rw, err)
+			return
+		}
+
+		if err := orgs.DeleteDepartment(d.ID); err != nil {
+			WriteError(rw, err)
+			return
+		}
+		rw.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// CompanyOrgChart outputs the org chart of a company, see BuildOrgChart.
+func CompanyOrgChart(store ContactStorer) func(rw http.ResponseWriter, r *http.Request) {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		store := RequestStore(store, r)
+		orgs, err := Orgs(store)
+		if err != nil {
+			WriteError(rw, err)
+			return
+		}
+
+		id := mux.Vars(r)["id"]
+		company, err := orgs.GetCompany(id)
+		if err != nil {
+			WriteError(rw, err)
+			return
+		}
+
+		departments, err := orgs.FetchDepartments(id)
+		if err != nil {
+			WriteError(rw, err)
+			return
+		}
+
+		all, err := store.FetchContacts()
+		if err != nil {
+			WriteError(rw, err)
+			return
+		}
+		cs := make([]*Contact, 0, len(all))
+		for id, c := range all {
+			if c.ID == "" {
+				c.ID = id
+			}
+			cs = append(cs, c)
+		}
+
+		WriteJSON(rw, http.StatusOK, BuildOrgChart(company, departments, cs))
+	}
+}
+
+// RequestOrgs returns the companies and departments of RequestStore(store, r), see Orgs.
+func RequestOrgs(store ContactStorer, r *http.Request) (OrgStorer, error) {
+	return Orgs(RequestStore(store, r))
+}
+
+// Orgs returns store as an OrgStorer. Like the other optional interfaces, it fails with ErrValidation if the store
+// does not keep companies and departments.
+func Orgs(store ContactStorer) (OrgStorer, error) {
+	orgs, ok := store.(OrgStorer)
+	if !ok {
+		return nil, fmt.Errorf("%w: The store does not support companies and departments", ErrValidation)
+	}
+	return orgs, nil
+}
+
+// CompanyDepartment reads the department of the request's path. Departments of other companies are not found.
+func CompanyDepartment(store OrgStorer, r *http.Request) (*Department, error) {
+	vars := mux.Vars(r)
+	d, err := store.GetDepartment(vars["department"])
+	if err != nil {
+		return nil, err
+	} else if d.CompanyID != vars["id"] {
+		return nil, ErrNotFound
+	}
+	return d, nil
+}
+
+// ReadOrgRequest reads an OrgRequest. The company or department is validated by the store.
+func ReadOrgRequest(r *http.Request) (*OrgRequest, error) {
+	body, err := ReadBody(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var req OrgRequest
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		return nil, fmt.Errorf("%w: Could not read the request because %s", ErrBadRequest, err)
+	}
+	return &req, nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	. "github.com/ory/workshop-dbg/store"
+)
+
+// queryParameters are the query parameters understood by ParseQuery.
+var queryParameters = []string{"limit", "cursor", "sort", "department", "department_prefix", "company", "company_prefix", "tag", "include_deleted"}
+
+// IsQuery returns true if the request contains any of the parameters understood by ParseQuery.
+func IsQuery(r *http.Request) bool {
+	values := r.URL.Query()
+	for _, p := range queryParameters {
+		if _, ok := values[p]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseQuery reads pagination, sorting and filtering parameters from the request's query string.
+func ParseQuery(r *http.Request) (*Query, error) {
+	values := r.URL.Query()
+	q := &Query{
+		Cursor:           values.Get("cursor"),
+		SortBy:           values.Get("sort"),
+		Department:       values.Get("department"),
+		DepartmentPrefix: values.Get("department_prefix"),
+		Company:          values.Get("company"),
+		CompanyPrefix:    values.Get("company_prefix"),
+		Tag:              values.Get("tag"),
+	}
+
+	if limit := values.Get("limit"); limit != "" {
+		l, err := strconv.Atoi(limit)
+		if err != nil || l < 1 {
+			return nil, fmt.Errorf("%w: The limit must be a positive number", ErrBadRequest)
+		}
+		q.Limit = l
+	}
+
+	if include := values.Get("include_deleted"); include != "" {
+		b, err := strconv.ParseBool(include)
+		if err != nil {
+			return nil, fmt.Errorf("%w: include_deleted must be true or false", ErrBadRequest)
+		}
+		q.IncludeDeleted = b
+	}
+	return q, nil
+}
+
+// WriteLinks sets a Link header (RFC 5988) pointing to the next and previous page, if there are any.
+func WriteLinks(rw http.ResponseWriter, r *http.Request, page *Page) {
+	var links []string
+	for _, l := range []struct{ rel, cursor string }{
+		{rel: "next", cursor: page.NextCursor},
+		{rel: "prev", cursor: page.PrevCursor},
+	} {
+		if l.cursor == "" {
+			continue
+		}
+
+		values := r.URL.Query()
+		values.Set("cursor", l.cursor)
+		u := url.URL{Path: r.URL.Path, RawQuery: values.Encode()}
+		links = append(links, fmt.Sprintf(`<%s>; rel="%s"`, u.String(), l.rel))
+	}
+
+	if len(links) > 0 {
+		rw.Header().Set("Link", strings.Join(links, ", "))
+	}
+}
@@ -0,0 +1,355 @@
+// Package patch implements JSON Merge Patch (RFC 7396) and JSON Patch (RFC 6902).
+package patch
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// The media types of the supported patch formats.
+const (
+	MergePatchType = "application/merge-patch+json"
+	JSONPatchType  = "application/json-patch+json"
+)
+
+var (
+	// ErrMalformed is returned when the patch document itself is invalid.
+	ErrMalformed = errors.New("Malformed patch document")
+
+	// ErrCannotApply is returned when the patch can not be applied to the document, for example because a path
+	// does not exist.
+	ErrCannotApply = errors.New("Patch can not be applied")
+
+	// ErrTestFailed is returned when a JSON Patch test operation fails.
+	ErrTestFailed = errors.New("Patch test operation failed")
+)
+
+// Apply applies a patch of the given media type to the JSON document doc and returns the patched document.
+func Apply(mediaType string, doc, patch []byte) ([]byte, error) {
+	switch mediaType {
+	case MergePatchType:
+		return MergePatch(doc, patch)
+	case JSONPatchType:
+		return JSONPatch(doc, patch)
+	}
+	return nil, fmt.Errorf("%w: Unsupported media type %q", ErrMalformed, mediaType)
+}
+
+// MergePatch applies a JSON Merge Patch (RFC 7396) to doc.
+func MergePatch(doc, patch []byte) ([]byte, error) {
+	var target, p interface{}
+	if err := json.Unmarshal(doc, &target); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(patch, &p); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrMalformed, err)
+	}
+	return json.Marshal(merge(target, p))
+}
+
+func merge(target, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+
+	t, ok := target.(map[string]interface{})
+	if !ok {
+		t = map[string]interface{}{}
+	}
+
+	for k, v := range p {
+		if v == nil {
+			delete(t, k)
+		} else {
+			t[k] = merge(t[k], v)
+		}
+	}
+	return t
+}
+
+// Operation is a single JSON Patch operation.
+type Operation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// JSONPatch applies a JSON Patch (RFC 6902) to doc. Either all operations are applied or none.
+func JSONPatch(doc, patch []byte) ([]byte, error) {
+	var target interface{}
+	if err := json.Unmarshal(doc, &target); err != nil {
+		return nil, err
+	}
+
+	var ops []Operation
+	if err := json.Unmarshal(patch, &ops); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrMalformed, err)
+	}
+
+	for i, op := range ops {
+		var err error
+		if target, err = apply(target, op); err != nil {
+			return nil, fmt.Errorf("operation %d (%s %s): %w", i, op.Op, op.Path, err)
+		}
+	}
+	return json.Marshal(target)
+}
+
+func apply(doc interface{}, op Operation) (interface{}, error) {
+	path, err := parsePointer(op.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	value := func() (interface{}, error) {
+		if len(op.Value) == 0 {
+			return nil, fmt.Errorf("%w: The operation has no value", ErrMalformed)
+		}
+		var v interface{}
+		if err := json.Unmarshal(op.Value, &v); err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrMalformed, err)
+		}
+		return v, nil
+	}
+
+	switch op.Op {
+	case "add":
+		v, err := value()
+		if err != nil {
+			return nil, err
+		}
+		return add(doc, path, v)
+	case "remove":
+		doc, _, err := remove(doc, path)
+		return doc, err
+	case "replace":
+		v, err := value()
+		if err != nil {
+			return nil, err
+		} else if len(path) == 0 {
+			return v, nil
+		}
+		doc, _, err := remove(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		return add(doc, path, v)
+	case "move", "copy":
+		from, err := parsePointer(op.From)
+		if err != nil {
+			return nil, err
+		}
+
+		var v interface{}
+		if op.Op == "move" {
+			// Moving a value to where it is leaves the document as it is, but the value must exist.
+			if len(path) == len(from) && from.contains(path) {
+				_, err := get(doc, from)
+				return doc, err
+			} else if len(path) > len(from) && from.contains(path) {
+				return nil, fmt.Errorf("%w: A value can not be moved into one of its children", ErrCannotApply)
+			}
+			if doc, v, err = remove(doc, from); err != nil {
+				return nil, err
+			}
+		} else {
+			if v, err = get(doc, from); err != nil {
+				return nil, err
+			}
+			if v, err = deepCopy(v); err != nil {
+				return nil, err
+			}
+		}
+		return add(doc, path, v)
+	case "test":
+		v, err := value()
+		if err != nil {
+			return nil, err
+		}
+		actual, err := get(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		if !reflect.DeepEqual(v, actual) {
+			return nil, ErrTestFailed
+		}
+		return doc, nil
+	}
+	return nil, fmt.Errorf("%w: Unknown operation %q", ErrMalformed, op.Op)
+}
+
+// pointer is a parsed JSON Pointer (RFC 6901).
+type pointer []string
+
+func parsePointer(s string) (pointer, error) {
+	if s == "" {
+		return pointer{}, nil
+	} else if !strings.HasPrefix(s, "/") {
+		return nil, fmt.Errorf("%w: Invalid JSON pointer %q", ErrMalformed, s)
+	}
+
+	tokens := strings.Split(s[1:], "/")
+	for i, t := range tokens {
+		tokens[i] = strings.NewReplacer("~1", "/", "~0", "~").Replace(t)
+	}
+	return tokens, nil
+}
+
+// contains returns true if other points to p itself or a location inside of it.
+func (p pointer) contains(other pointer) bool {
+	if len(other) < len(p) {
+		return false
+	}
+	for i := range p {
+		if p[i] != other[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// index parses an array index. If appending is true, "-" and len(a) are accepted as well and point past the end.
+func index(token string, a []interface{}, appending bool) (int, error) {
+	max := len(a) - 1
+	if appending {
+		if token == "-" {
+			return len(a), nil
+		}
+		max = len(a)
+	}
+
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || i > max || (len(token) > 1 && token[0] == '0') {
+		return 0, fmt.Errorf("%w: Invalid array index %q", ErrCannotApply, token)
+	}
+	return i, nil
+}
+
+func get(doc interface{}, path pointer) (interface{}, error) {
+	for _, t := range path {
+		switch d := doc.(type) {
+		case map[string]interface{}:
+			v, ok := d[t]
+			if !ok {
+				return nil, fmt.Errorf("%w: Path does not exist", ErrCannotApply)
+			}
+			doc = v
+		case []interface{}:
+			i, err := index(t, d, false)
+			if err != nil {
+				return nil, err
+			}
+			doc = d[i]
+		default:
+			return nil, fmt.Errorf("%w: Path does not exist", ErrCannotApply)
+		}
+	}
+	return doc, nil
+}
+
+// add sets the value at path and returns the modified document.
+func add(doc interface{}, path pointer, v interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return v, nil
+	}
+
+	switch d := doc.(type) {
+	case map[string]interface{}:
+		if len(path) == 1 {
+			d[path[0]] = v
+			return d, nil
+		}
+
+		child, ok := d[path[0]]
+		if !ok {
+			return nil, fmt.Errorf("%w: Path does not exist", ErrCannotApply)
+		}
+		child, err := add(child, path[1:], v)
+		if err != nil {
+			return nil, err
+		}
+		d[path[0]] = child
+		return d, nil
+	case []interface{}:
+		if len(path) == 1 {
+			i, err := index(path[0], d, true)
+			if err != nil {
+				return nil, err
+			}
+			d = append(d, nil)
+			copy(d[i+1:], d[i:])
+			d[i] = v
+			return d, nil
+		}
+
+		i, err := index(path[0], d, false)
+		if err != nil {
+			return nil, err
+		}
+		child, err := add(d[i], path[1:], v)
+		if err != nil {
+			return nil, err
+		}
+		d[i] = child
+		return d, nil
+	}
+	return nil, fmt.Errorf("%w: Path does not exist", ErrCannotApply)
+}
+
+// remove deletes the value at path and returns the modified document and the removed value.
+func remove(doc interface{}, path pointer) (interface{}, interface{}, error) {
+	if len(path) == 0 {
+		return nil, nil, fmt.Errorf("%w: The document root can not be removed", ErrCannotApply)
+	}
+
+	switch d := doc.(type) {
+	case map[string]interface{}:
+		child, ok := d[path[0]]
+		if !ok {
+			return nil, nil, fmt.Errorf("%w: Path does not exist", ErrCannotApply)
+		}
+		if len(path) == 1 {
+			delete(d, path[0])
+			return d, child, nil
+		}
+
+		child, removed, err := remove(child, path[1:])
+		if err != nil {
+			return nil, nil, err
+		}
+		d[path[0]] = child
+		return d, removed, nil
+	case []interface{}:
+		i, err := index(path[0], d, false)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(path) == 1 {
+			removed := d[i]
+			return append(d[:i], d[i+1:]...), removed, nil
+		}
+
+		child, removed, err := remove(d[i], path[1:])
+		if err != nil {
+			return nil, nil, err
+		}
+		d[i] = child
+		return d, removed, nil
+	}
+	return nil, nil, fmt.Errorf("%w: Path does not exist", ErrCannotApply)
+}
+
+func deepCopy(v interface{}) (interface{}, error) {
+	out, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var c interface{}
+	return c, json.Unmarshal(out, &c)
+}
@@ -0,0 +1,165 @@
+package patch
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMergePatch(t *testing.T) {
+	// Test cases from RFC 7396, Appendix A.
+	for k, c := range []struct {
+		doc, patch, expected string
+	}{
+		{doc: `{"a":"b"}`, patch: `{"a":"c"}`, expected: `{"a":"c"}`},
+		{doc: `{"a":"b"}`, patch: `{"b":"c"}`, expected: `{"a":"b","b":"c"}`},
+		{doc: `{"a":"b"}`, patch: `{"a":null}`, expected: `{}`},
+		{doc: `{"a":"b","b":"c"}`, patch: `{"a":null}`, expected: `{"b":"c"}`},
+		{doc: `{"a":["b"]}`, patch: `{"a":"c"}`, expected: `{"a":"c"}`},
+		{doc: `{"a":"c"}`, patch: `{"a":["b"]}`, expected: `{"a":["b"]}`},
+		{doc: `{"a":{"b":"c"}}`, patch: `{"a":{"b":"d","c":null}}`, expected: `{"a":{"b":"d"}}`},
+		{doc: `{"a":[{"b":"c"}]}`, patch: `{"a":[1]}`, expected: `{"a":[1]}`},
+		{doc: `["a","b"]`, patch: `["c","d"]`, expected: `["c","d"]`},
+		{doc: `{"a":"b"}`, patch: `["c"]`, expected: `["c"]`},
+		{doc: `{"a":"foo"}`, patch: `null`, expected: `null`},
+		{doc: `{"e":null}`, patch: `{"a":1}`, expected: `{"a":1,"e":null}`},
+		{doc: `[1,2]`, patch: `{"a":"b","c":null}`, expected: `{"a":"b"}`},
+		{doc: `{}`, patch: `{"a":{"bb":{"ccc":null}}}`, expected: `{"a":{"bb":{}}}`},
+	} {
+		out, err := MergePatch([]byte(c.doc), []byte(c.patch))
+		require.Nil(t, err, "case %d", k)
+		assert.JSONEq(t, c.expected, string(out), "case %d", k)
+	}
+
+	_, err := MergePatch([]byte(`{}`), []byte(`{`))
+	assert.True(t, errors.Is(err, ErrMalformed))
+}
+
+func TestJSONPatch(t *testing.T) {
+	// Most test cases are taken from RFC 6902, Appendix A.
+	for k, c := range []struct {
+		doc, patch, expected string
+		err                  error
+	}{
+		{
+			doc:      `{"foo":"bar"}`,
+			patch:    `[{"op":"add","path":"/baz","value":"qux"}]`,
+			expected: `{"baz":"qux","foo":"bar"}`,
+		},
+		{
+			doc:      `{"foo":["bar","baz"]}`,
+			patch:    `[{"op":"add","path":"/foo/1","value":"qux"}]`,
+			expected: `{"foo":["bar","qux","baz"]}`,
+		},
+		{
+			doc:      `{"baz":"qux","foo":"bar"}`,
+			patch:    `[{"op":"remove","path":"/baz"}]`,
+			expected: `{"foo":"bar"}`,
+		},
+		{
+			doc:      `{"foo":["bar","qux","baz"]}`,
+			patch:    `[{"op":"remove","path":"/foo/1"}]`,
+			expected: `{"foo":["bar","baz"]}`,
+		},
+		{
+			doc:      `{"baz":"qux","foo":"bar"}`,
+			patch:    `[{"op":"replace","path":"/baz","value":"boo"}]`,
+			expected: `{"baz":"boo","foo":"bar"}`,
+		},
+		{
+			doc:      `{"foo":{"bar":"baz","waldo":"fred"},"qux":{"corge":"grault"}}`,
+			patch:    `[{"op":"move","from":"/foo/waldo","path":"/qux/thud"}]`,
+			expected: `{"foo":{"bar":"baz"},"qux":{"corge":"grault","thud":"fred"}}`,
+		},
+		{
+			doc:      `{"foo":["all","grass","cows","eat"]}`,
+			patch:    `[{"op":"move","from":"/foo/1","path":"/foo/3"}]`,
+			expected: `{"foo":["all","cows","eat","grass"]}`,
+		},
+		{
+			doc:      `{"x":{"y":1},"z":[1,2]}`,
+			patch:    `[{"op":"move","from":"/x","path":"/x"},{"op":"move","from":"/z/0","path":"/z/0"},{"op":"move","from":"","path":""}]`,
+			expected: `{"x":{"y":1},"z":[1,2]}`,
+		},
+		{
+			doc:      `{"baz":"value","foo":"bar"}`,
+			patch:    `[{"op":"copy","from":"/baz","path":"/qux"}]`,
+			expected: `{"baz":"value","foo":"bar","qux":"value"}`,
+		},
+		{
+			doc:      `{"baz":"qux","foo":["a",2,"c"]}`,
+			patch:    `[{"op":"test","path":"/baz","value":"qux"},{"op":"test","path":"/foo/1","value":2}]`,
+			expected: `{"baz":"qux","foo":["a",2,"c"]}`,
+		},
+		{
+			doc:   `{"baz":"qux"}`,
+			patch: `[{"op":"test","path":"/baz","value":"bar"}]`,
+			err:   ErrTestFailed,
+		},
+		{
+			doc:      `{"foo":["bar"]}`,
+			patch:    `[{"op":"add","path":"/foo/-","value":["abc","def"]}]`,
+			expected: `{"foo":["bar",["abc","def"]]}`,
+		},
+		{
+			doc:      `{"/":9,"~1":10}`,
+			patch:    `[{"op":"test","path":"/~01","value":10},{"op":"remove","path":"/~1"}]`,
+			expected: `{"~1":10}`,
+		},
+		{
+			doc:      `{"foo":"bar"}`,
+			patch:    `[{"op":"add","path":"/baz","value":null}]`,
+			expected: `{"baz":null,"foo":"bar"}`,
+		},
+		{
+			doc:   `{"foo":"bar"}`,
+			patch: `[{"op":"add","path":"/baz/bat","value":"qux"}]`,
+			err:   ErrCannotApply,
+		},
+		{
+			doc:   `{"foo":["bar"]}`,
+			patch: `[{"op":"add","path":"/foo/2","value":"qux"}]`,
+			err:   ErrCannotApply,
+		},
+		{
+			doc:   `{"foo":"bar"}`,
+			patch: `[{"op":"replace","path":"/baz","value":"qux"}]`,
+			err:   ErrCannotApply,
+		},
+		{
+			doc:   `{"foo":{"bar":1}}`,
+			patch: `[{"op":"move","from":"/foo","path":"/foo/bar/baz"}]`,
+			err:   ErrCannotApply,
+		},
+		{
+			doc:   `{"foo":{"bar":1}}`,
+			patch: `[{"op":"move","from":"/x","path":"/x"}]`,
+			err:   ErrCannotApply,
+		},
+		{
+			doc:   `{"foo":"bar"}`,
+			patch: `[{"op":"add","path":"/baz"}]`,
+			err:   ErrMalformed,
+		},
+		{
+			doc:   `{"foo":"bar"}`,
+			patch: `[{"op":"invent","path":"/baz"}]`,
+			err:   ErrMalformed,
+		},
+		{
+			doc:   `{"foo":"bar"}`,
+			patch: `{"op":"add"}`,
+			err:   ErrMalformed,
+		},
+	} {
+		out, err := JSONPatch([]byte(c.doc), []byte(c.patch))
+		if c.err != nil {
+			assert.True(t, errors.Is(err, c.err), "case %d: %v", k, err)
+			continue
+		}
+		require.Nil(t, err, "case %d", k)
+		assert.JSONEq(t, c.expected, string(out), "case %d", k)
+	}
+}
@@ -0,0 +1,448 @@
+// Package cache keeps recently read contacts in memory in front of a slower store.ContactStorer.
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ory/workshop-dbg/store"
+)
+
+// The defaults of a Store.
+const (
+	DefaultSize = 10000
+	DefaultTTL  = time.Minute
+)
+
+// listKey caches FetchContacts. Contacts and the pages of QueryContacts are cached under their ID and query with a
+// prefix, so the keys never collide.
+const listKey = "list"
+
+// queryPrefix starts the keys of all pages.
+const queryPrefix = "query:"
+
+func contactKey(id string) string {
+	return "contact:" + id
+}
+
+// queryKey identifies a page by all fields of its query, which is why it is encoded as a whole.
+func queryKey(q *store.Query) string {
+	out, _ := json.Marshal(q)
+	return queryPrefix + string(out)
+}
+
+// errAborted is returned to callers waiting for a load which panicked.
+var errAborted = errors.New("Could not load the contact because the load was aborted")
+
+// Stats counts the lookups of a Store. Concurrent misses of the same contact count as a miss each, but only one of
+// them reaches the backend.
+type Stats struct {
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Evictions uint64 `json:"evictions"`
+
+	// Size is the number of entries currently cached.
+	Size int `json:"size"`
+}
+
+// Store caches the contacts returned by GetContact, FetchContacts and QueryContacts of the embedded backend for TTL,
+// keeping the Size most recently used ones. Concurrent misses of the same contact or page are coalesced into a
+// single read from the backend. All other reads go to the backend directly.
+//
+// Writes made through the store invalidate the contacts they touch and all pages, as any write may move contacts
+// between pages or change their totals, so it reads its own writes. Writes made through other stores sharing the
+// backend, for example by other replicas, are only seen once the cached entries expired, unless Watch is running.
+//
+// Zero fields take their defaults. The fields must not be changed once the store is in use.
+type Store struct {
+	store.ContactStorer
+
+	// Size is the maximum number of cached entries. The full contact list and every page count as a single entry.
+	Size int
+
+	// TTL is how long entries are cached.
+	TTL time.Duration
+
+	// now returns the current time. It is replaced in tests.
+	now func() time.Time
+
+	once  sync.Once
+	state *state
+}
+
+// state is shared by the store and the stores returned by its WithActor.
+type state struct {
+	mu    sync.Mutex
+	ttl   time.Duration
+	now   func() time.Time
+	lru   *lru
+	calls map[string]*call
+
+	// generation is incremented by every invalidation. Loads which started before are not cached, because they may
+	// have read the contacts before the write.
+	generation uint64
+
+	hits, misses, evictions uint64
+}
+
+func (s *Store) cache() *state {
+	s.once.Do(func() {
+		if s.state != nil {
+			return
+		}
+
+		size, ttl, now := s.Size, s.TTL, s.now
+		if size <= 0 {
+			size = DefaultSize
+		}
+		if ttl <= 0 {
+			ttl = DefaultTTL
+		}
+		if now == nil {
+			now = time.Now
+		}
+		s.state = &state{ttl: ttl, now: now, lru: newLRU(size), calls: map[string]*call{}}
+	})
+	return s.state
+}
+
+// Stats returns the counters of the store, including the lookups of the stores returned by its WithActor.
+func (s *Store) Stats() Stats {
+	c := s.cache()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return Stats{Hits: c.hits, Misses: c.misses, Evictions: c.evictions, Size: c.lru.len()}
+}
+
+func (s *Store) GetContact(id string) (*store.Contact, error) {
+	v, err := s.cache().load(contactKey(id), func() (interface{}, error) {
+		return s.ContactStorer.GetContact(id)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*store.Contact).Clone(), nil
+}
+
+func (s *Store) FetchContacts() (store.Contacts, error) {
+	v, err := s.cache().load(listKey, func() (interface{}, error) {
+		return s.ContactStorer.FetchContacts()
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	contacts := v.(store.Contacts)
+	cs := make(store.Contacts, len(contacts))
+	for id, c := range contacts {
+		cs[id] = c.Clone()
+	}
+	return cs, nil
+}
+
+func (s *Store) QueryContacts(q *store.Query) (*store.Page, error) {
+	v, err := s.cache().load(queryKey(q), func() (interface{}, error) {
+		return s.ContactStorer.QueryContacts(q)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	page := *v.(*store.Page)
+	page.Contacts = make([]*store.Contact, len(page.Contacts))
+	for i, c := range v.(*store.Page).Contacts {
+		page.Contacts[i] = c.Clone()
+	}
+	return &page, nil
+}
+
+func (s *Store) CreateContact(c *store.Contact) error {
+	err := s.ContactStorer.CreateContact(c)
+	s.cache().invalidate(c.ID)
+	return err
+}
+
+// UpdateContact invalidates the contact even if the update fails, because a version mismatch may be caused by a
+// stale cache.
+func (s *Store) UpdateContact(c *store.Contact) error {
+	err := s.ContactStorer.UpdateContact(c)
+	s.cache().invalidate(c.ID)
+	return err
+}
+
+func (s *Store) PatchContact(id string, version int, patch func(*store.Contact) error) (*store.Contact, error) {
+	c, err := s.ContactStorer.PatchContact(id, version, patch)
+	s.cache().invalidate(id)
+	return c, err
+}
+
+func (s *Store) DeleteContact(id string, version int) error {
+	err := s.ContactStorer.DeleteContact(id, version)
+	s.cache().invalidate(id)
+	return err
+}
+
+func (s *Store) RestoreContact(id string) (*store.Contact, error) {
+	c, err := s.ContactStorer.RestoreContact(id)
+	s.cache().invalidate(id)
+	return c, err
+}
+
+// PurgeContacts drops all pages, because queries including the trash may have returned the purged contacts.
+func (s *Store) PurgeContacts(deletedBefore time.Time) (int, error) {
+	n, err := s.ContactStorer.PurgeContacts(deletedBefore)
+	s.cache().invalidateQueries()
+	return n, err
+}
+
+// WithActor returns a store sharing the cache.
+func (s *Store) WithActor(actor store.Actor) store.ContactStorer {
+	return &Store{ContactStorer: s.ContactStorer.WithActor(actor), state: s.cache()}
+}
+
+// WithContext returns a store sharing the cache, which loads missing contacts using ctx.
+func (s *Store) WithContext(ctx context.Context) store.ContactStorer {
+	return &Store{ContactStorer: s.ContactStorer.WithContext(ctx), state: s.cache()}
+}
+
+// WithTx runs f in a transaction of the backend, if it supports them. tx reads from the backend directly, so it sees
+// its own writes, and the whole cache is dropped once the transaction ended.
+func (s *Store) WithTx(f func(tx store.ContactStorer) error) error {
+	t, ok := s.ContactStorer.(store.Transactor)
+	if !ok {
+		return fmt.Errorf("%w: The store does not support transactions", store.ErrValidation)
+	}
+
+	defer s.cache().flush()
+	return t.WithTx(f)
+}
+
+// ImportContacts imports atomically using the backend, if it supports it, and drops the whole cache.
+func (s *Store) ImportContacts(r store.ContactReader) (*store.ImportReport, error) {
+	importer, ok := s.ContactStorer.(store.Importer)
+	if !ok {
+		return nil, fmt.Errorf("%w: The store does not support atomic imports", store.ErrValidation)
+	}
+
+	defer s.cache().flush()
+	return importer.ImportContacts(r)
+}
+
+// orgs returns the store.OrgStorer of the backend. Companies and departments are not cached. Renaming them updates
+// the names of their contacts, so the whole cache is dropped.
+func (s *Store) orgs() (store.OrgStorer, error) {
+	orgs, ok := s.ContactStorer.(store.OrgStorer)
+	if !ok {
+		return nil, fmt.Errorf("%w: The store does not support companies and departments", store.ErrValidation)
+	}
+	return orgs, nil
+}
+
+func (s *Store) CreateCompany(c *store.Company) error {
+	orgs, err := s.orgs()
+	if err != nil {
+		return err
+	}
+	return orgs.CreateCompany(c)
+}
+
+func (s *Store) GetCompany(id string) (*store.Company, error) {
+	orgs, err := s.orgs()
+	if err != nil {
+		return nil, err
+	}
+	return orgs.GetCompany(id)
+}
+
+func (s *Store) FetchCompanies() ([]*store.Company, error) {
+	orgs, err := s.orgs()
+	if err != nil {
+		return nil, err
+	}
+	return orgs.FetchCompanies()
+}
+
+func (s *Store) UpdateCompany(c *store.Company) error {
+	orgs, err := s.orgs()
+	if err != nil {
+		return err
+	}
+	defer s.cache().flush()
+	return orgs.UpdateCompany(c)
+}
+
+func (s *Store) DeleteCompany(id string) error {
+	orgs, err := s.orgs()
+	if err != nil {
+		return err
+	}
+	return orgs.DeleteCompany(id)
+}
+
+func (s *Store) CreateDepartment(d *store.Department) error {
+	orgs, err := s.orgs()
+	if err != nil {
+		return err
+	}
+	return orgs.CreateDepartment(d)
+}
+
+func (s *Store) GetDepartment(id string) (*store.Department, error) {
+	orgs, err := s.orgs()
+	if err != nil {
+		return nil, err
+	}
+	return orgs.GetDepartment(id)
+}
+
+func (s *Store) FetchDepartments(companyID string) ([]*store.Department, error) {
+	orgs, err := s.orgs()
+	if err != nil {
+		return nil, err
+	}
+	return orgs.FetchDepartments(companyID)
+}
+
+func (s *Store) UpdateDepartment(d *store.Department) error {
+	orgs, err := s.orgs()
+	if err != nil {
+		return err
+	}
+	defer s.cache().flush()
+	return orgs.UpdateDepartment(d)
+}
+
+func (s *Store) DeleteDepartment(id string) error {
+	orgs, err := s.orgs()
+	if err != nil {
+		return err
+	}
+	return orgs.DeleteDepartment(id)
+}
+
+// Watch invalidates the contacts changed through other stores sharing the backend until stop is closed. It returns
+// an error if the backend can not stream its changes, see store.ContactStorer.Subscribe.
+func (s *Store) Watch(stop <-chan struct{}) error {
+	for {
+		changes, cancel, err := s.ContactStorer.Subscribe()
+		if err != nil {
+			return err
+		}
+
+		// Changes may have been missed before subscribing or while resubscribing.
+		s.cache().flush()
+
+		more := s.watch(changes, stop)
+		cancel()
+		if !more {
+			return nil
+		}
+	}
+}
+
+// watch invalidates the changed contacts until the subscription ends, and returns false once stop is closed.
+func (s *Store) watch(changes <-chan *store.Change, stop <-chan struct{}) bool {
+	for {
+		select {
+		case <-stop:
+			return false
+		case c, ok := <-changes:
+			if !ok {
+				return true
+			}
+			s.cache().invalidate(c.ContactID)
+		}
+	}
+}
+
+// load returns the cached value of key or loads it using fetch. Concurrent loads of the same key wait for the first
+// one. Errors are not cached. If the first load ended because its caller's context did, the waiting callers load
+// the key again using their own contexts.
+func (c *state) load(key string, fetch func() (interface{}, error)) (interface{}, error) {
+	c.mu.Lock()
+	if v, ok := c.lru.get(key, c.now()); ok {
+		c.hits++
+		c.mu.Unlock()
+		return v, nil
+	}
+	c.misses++
+
+	if cl, ok := c.calls[key]; ok {
+		c.mu.Unlock()
+		cl.done.Wait()
+		if errors.Is(cl.err, context.Canceled) || errors.Is(cl.err, context.DeadlineExceeded) {
+			return c.load(key, fetch)
+		}
+		return cl.value, cl.err
+	}
+
+	cl := &call{err: errAborted}
+	cl.done.Add(1)
+	c.calls[key] = cl
+	generation := c.generation
+	c.mu.Unlock()
+
+	// The waiting callers are released even if fetch panics.
+	defer func() {
+		c.mu.Lock()
+		if c.calls[key] == cl {
+			delete(c.calls, key)
+		}
+		if cl.err == nil && c.generation == generation {
+			c.evictions += uint64(c.lru.add(key, cl.value, c.now().Add(c.ttl)))
+		}
+		c.mu.Unlock()
+		cl.done.Done()
+	}()
+
+	cl.value, cl.err = fetch()
+	return cl.value, cl.err
+}
+
+// invalidate drops a contact, the contact list and all pages. Callers missing them afterwards do not wait for loads
+// which started before.
+func (c *state) invalidate(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+	for _, key := range []string{contactKey(id), listKey} {
+		c.lru.remove(key)
+		delete(c.calls, key)
+	}
+	c.removeQueries()
+}
+
+// invalidateQueries drops all pages.
+func (c *state) invalidateQueries() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+	c.removeQueries()
+}
+
+// removeQueries drops all pages and the loads of pages in progress. c.mu must be held.
+func (c *state) removeQueries() {
+	c.lru.removePrefix(queryPrefix)
+	for key := range c.calls {
+		if strings.HasPrefix(key, queryPrefix) {
+			delete(c.calls, key)
+		}
+	}
+}
+
+// flush drops all entries.
+func (c *state) flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+	c.lru.clear()
+	c.calls = map[string]*call{}
+}
@@ -0,0 +1,364 @@
+package cache
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ory/workshop-dbg/bulk"
+	"github.com/ory/workshop-dbg/store"
+	"github.com/ory/workshop-dbg/store/memory"
+	"github.com/ory/workshop-dbg/store/storetest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// countingStore counts the reads reaching the backend. If block is set, GetContact waits for it to be closed after
+// reading the contact, which simulates a slow backend.
+type countingStore struct {
+	*memory.InMemoryStore
+
+	mu      sync.Mutex
+	gets    int
+	fetches int
+	queries int
+	block   chan struct{}
+}
+
+func (s *countingStore) GetContact(id string) (*store.Contact, error) {
+	c, err := s.InMemoryStore.GetContact(id)
+
+	s.mu.Lock()
+	s.gets++
+	block := s.block
+	s.mu.Unlock()
+	if block != nil {
+		<-block
+	}
+	return c, err
+}
+
+func (s *countingStore) FetchContacts() (store.Contacts, error) {
+	s.mu.Lock()
+	s.fetches++
+	s.mu.Unlock()
+	return s.InMemoryStore.FetchContacts()
+}
+
+func (s *countingStore) QueryContacts(q *store.Query) (*store.Page, error) {
+	s.mu.Lock()
+	s.queries++
+	s.mu.Unlock()
+	return s.InMemoryStore.QueryContacts(q)
+}
+
+func (s *countingStore) queryCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.queries
+}
+
+func (s *countingStore) counts() (gets, fetches int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.gets, s.fetches
+}
+
+func newBackend() *countingStore {
+	return &countingStore{InMemoryStore: &memory.InMemoryStore{Contacts: store.Contacts{
+		"a": {ID: "a", Name: "A", Department: "IT", Company: "ACME"},
+		"b": {ID: "b", Name: "B", Department: "HR", Company: "ACME"},
+	}}}
+}
+
+func TestGetContact(t *testing.T) {
+	backend := newBackend()
+	s := &Store{ContactStorer: backend}
+
+	for i := 0; i < 3; i++ {
+		c, err := s.GetContact("a")
+		require.Nil(t, err)
+		assert.Equal(t, "A", c.Name)
+
+		// Callers get copies.
+		c.Name = "Changed"
+	}
+	gets, _ := backend.counts()
+	assert.Equal(t, 1, gets)
+
+	// Errors are not cached.
+	for i := 0; i < 2; i++ {
+		_, err := s.GetContact("unknown")
+		assert.Equal(t, store.ErrNotFound, err)
+	}
+	gets, _ = backend.counts()
+	assert.Equal(t, 3, gets)
+
+	for i := 0; i < 2; i++ {
+		cs, err := s.FetchContacts()
+		require.Nil(t, err)
+		assert.Len(t, cs, 2)
+		delete(cs, "a")
+	}
+	_, fetches := backend.counts()
+	assert.Equal(t, 1, fetches)
+
+	assert.Equal(t, Stats{Hits: 3, Misses: 4, Size: 2}, s.Stats())
+}
+
+func TestInvalidation(t *testing.T) {
+	backend := newBackend()
+	s := &Store{ContactStorer: backend}
+
+	// warm reads a and the list and returns how often the backend was read since the last call.
+	var lastGets, lastFetches int
+	warm := func() (int, int) {
+		s.GetContact("a")
+		s.FetchContacts()
+		gets, fetches := backend.counts()
+		defer func() { lastGets, lastFetches = gets, fetches }()
+		return gets - lastGets, fetches - lastFetches
+	}
+	warm()
+
+	for k, write := range []func() error{
+		func() error {
+			return s.UpdateContact(&store.Contact{ID: "a", Name: "A2", Department: "IT", Company: "ACME"})
+		},
+		func() error {
+			_, err := s.PatchContact("a", 0, func(c *store.Contact) error { c.Name = "A3"; return nil })
+			return err
+		},
+		func() error { return s.DeleteContact("a", 0) },
+		func() error { _, err := s.RestoreContact("a"); return err },
+		func() error {
+			return s.WithActor(store.Actor{Name: "alice"}).UpdateContact(&store.Contact{ID: "a", Name: "A4"})
+		},
+		func() error {
+			return s.WithTx(func(tx store.ContactStorer) error {
+				return tx.UpdateContact(&store.Contact{ID: "a", Name: "A5"})
+			})
+		},
+		func() error {
+			r, _ := bulk.NewReader(bulk.NDJSONType, strings.NewReader(`{"id": "c", "name": "C"}`))
+			_, err := s.ImportContacts(r)
+			return err
+		},
+	} {
+		require.Nil(t, write(), "%d", k)
+		gets, fetches := warm()
+		assert.Equal(t, 1, gets, "%d", k)
+		assert.Equal(t, 1, fetches, "%d", k)
+	}
+
+	c, err := s.GetContact("a")
+	require.Nil(t, err)
+	assert.Equal(t, "A5", c.Name)
+
+	// Failed writes invalidate as well, the cache may have been stale.
+	require.NotNil(t, s.UpdateContact(&store.Contact{ID: "a", Name: "A6", Version: 1}))
+	gets, fetches := warm()
+	assert.Equal(t, 1, gets)
+	assert.Equal(t, 1, fetches)
+
+	// Creating only invalidates the list.
+	require.Nil(t, s.CreateContact(&store.Contact{Name: "D"}))
+	gets, fetches = warm()
+	assert.Equal(t, 0, gets)
+	assert.Equal(t, 1, fetches)
+
+	// Reads within a transaction see its writes, but do not fill the cache.
+	require.Nil(t, s.WithTx(func(tx store.ContactStorer) error {
+		if err := tx.UpdateContact(&store.Contact{ID: "b", Name: "B2"}); err != nil {
+			return err
+		}
+		c, err := tx.GetContact("b")
+		require.Nil(t, err)
+		assert.Equal(t, "B2", c.Name)
+		return nil
+	}))
+	c, err = s.GetContact("b")
+	require.Nil(t, err)
+	assert.Equal(t, "B2", c.Name)
+}
+
+func TestQueryContacts(t *testing.T) {
+	backend := newBackend()
+	s := &Store{ContactStorer: backend}
+
+	for i := 0; i < 2; i++ {
+		page, err := s.QueryContacts(&store.Query{Limit: 1})
+		require.Nil(t, err)
+		require.Len(t, page.Contacts, 1)
+		assert.Equal(t, "A", page.Contacts[0].Name)
+		assert.Equal(t, 2, page.Total)
+		assert.NotEmpty(t, page.NextCursor)
+
+		// Callers get copies.
+		page.Contacts[0].Name = "Changed"
+	}
+	assert.Equal(t, 1, backend.queryCount())
+
+	// Every query is cached on its own.
+	page, err := s.QueryContacts(&store.Query{Department: "HR"})
+	require.Nil(t, err)
+	require.Len(t, page.Contacts, 1)
+	assert.Equal(t, "b", page.Contacts[0].ID)
+	assert.Equal(t, 2, backend.queryCount())
+	assert.Equal(t, 2, s.Stats().Size)
+
+	// Any write drops all pages, even if they did not contain the contact.
+	require.Nil(t, s.UpdateContact(&store.Contact{ID: "a", Name: "A2", Department: "HR"}))
+	assert.Equal(t, 0, s.Stats().Size)
+	page, err = s.QueryContacts(&store.Query{Department: "HR"})
+	require.Nil(t, err)
+	assert.Len(t, page.Contacts, 2)
+	assert.Equal(t, 3, backend.queryCount())
+
+	// Purging drops the pages including the trash.
+	require.Nil(t, s.DeleteContact("a", 0))
+	page, err = s.QueryContacts(&store.Query{IncludeDeleted: true})
+	require.Nil(t, err)
+	assert.Equal(t, 2, page.Total)
+	n, err := s.PurgeContacts(time.Now().Add(time.Minute))
+	require.Nil(t, err)
+	assert.Equal(t, 1, n)
+	page, err = s.QueryContacts(&store.Query{IncludeDeleted: true})
+	require.Nil(t, err)
+	assert.Equal(t, 1, page.Total)
+	assert.Equal(t, 5, backend.queryCount())
+}
+
+func TestExpiry(t *testing.T) {
+	now := time.Now()
+	backend := newBackend()
+	s := &Store{ContactStorer: backend, TTL: time.Minute, now: func() time.Time { return now }}
+
+	s.GetContact("a")
+	now = now.Add(59 * time.Second)
+	s.GetContact("a")
+	gets, _ := backend.counts()
+	assert.Equal(t, 1, gets)
+
+	now = now.Add(time.Second)
+	s.GetContact("a")
+	gets, _ = backend.counts()
+	assert.Equal(t, 2, gets)
+}
+
+func TestEviction(t *testing.T) {
+	backend := newBackend()
+	require.Nil(t, backend.CreateContact(&store.Contact{ID: "c", Name: "C"}))
+	s := &Store{ContactStorer: backend, Size: 2}
+
+	// a is used more recently than b, so b is evicted to make room for c.
+	for _, id := range []string{"a", "b", "a", "c", "a", "b"} {
+		_, err := s.GetContact(id)
+		require.Nil(t, err)
+	}
+	gets, _ := backend.counts()
+	assert.Equal(t, 4, gets)
+
+	stats := s.Stats()
+	assert.Equal(t, uint64(2), stats.Evictions)
+	assert.Equal(t, 2, stats.Size)
+}
+
+func TestCoalescing(t *testing.T) {
+	backend := newBackend()
+	backend.block = make(chan struct{})
+	s := &Store{ContactStorer: backend}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c, err := s.GetContact("a")
+			assert.Nil(t, err)
+			assert.Equal(t, "A", c.Name)
+		}()
+	}
+
+	// Wait until all callers missed before releasing the backend.
+	for deadline := time.Now().Add(5 * time.Second); s.Stats().Misses < 10; {
+		require.True(t, time.Now().Before(deadline))
+		time.Sleep(time.Millisecond)
+	}
+	close(backend.block)
+	wg.Wait()
+
+	gets, _ := backend.counts()
+	assert.Equal(t, 1, gets)
+}
+
+func TestStaleLoad(t *testing.T) {
+	backend := newBackend()
+	block := make(chan struct{})
+	backend.block = block
+	s := &Store{ContactStorer: backend}
+
+	// The load reads the contact before the update, but only returns afterwards.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c, err := s.GetContact("a")
+		assert.Nil(t, err)
+		assert.Equal(t, "A", c.Name)
+	}()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		if gets, _ := backend.counts(); gets == 1 {
+			break
+		}
+		require.True(t, time.Now().Before(deadline))
+	}
+
+	require.Nil(t, s.UpdateContact(&store.Contact{ID: "a", Name: "A2"}))
+	backend.mu.Lock()
+	backend.block = nil
+	backend.mu.Unlock()
+
+	// Callers reading after the update do not wait for the stale load.
+	c, err := s.GetContact("a")
+	require.Nil(t, err)
+	assert.Equal(t, "A2", c.Name)
+
+	// The stale load does not replace the cached contact either.
+	close(block)
+	<-done
+	c, err = s.GetContact("a")
+	require.Nil(t, err)
+	assert.Equal(t, "A2", c.Name)
+}
+
+func TestWatch(t *testing.T) {
+	backend := newBackend()
+	s := &Store{ContactStorer: backend}
+
+	stop := make(chan struct{})
+	watching := make(chan error)
+	go func() { watching <- s.Watch(stop) }()
+
+	// Writes made directly to the backend are not seen until the change arrives.
+	s.GetContact("a")
+	require.Nil(t, backend.UpdateContact(&store.Contact{ID: "a", Name: "A2"}))
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		c, err := s.GetContact("a")
+		require.Nil(t, err)
+		if c.Name == "A2" {
+			break
+		}
+		require.True(t, time.Now().Before(deadline))
+		time.Sleep(time.Millisecond)
+	}
+
+	close(stop)
+	assert.Nil(t, <-watching)
+}
+
+func TestConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) (store.ContactStorer, func()) {
+		return &Store{ContactStorer: &memory.InMemoryStore{Contacts: store.Contacts{}}}, nil
+	})
+}
@@ -0,0 +1,92 @@
+package cache
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+	"time"
+)
+
+// entry is a cached value. Values are never modified once cached.
+type entry struct {
+	key     string
+	value   interface{}
+	expires time.Time
+}
+
+// lru holds at most size entries and evicts the least recently used one to make room. It is not safe for
+// concurrent use.
+type lru struct {
+	size    int
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+func newLRU(size int) *lru {
+	return &lru{size: size, order: list.New(), entries: map[string]*list.Element{}}
+}
+
+// get returns the value of key unless it is missing or expired at now.
+func (l *lru) get(key string, now time.Time) (interface{}, bool) {
+	el, ok := l.entries[key]
+	if !ok {
+		return nil, false
+	}
+
+	e := el.Value.(*entry)
+	if !now.Before(e.expires) {
+		l.remove(key)
+		return nil, false
+	}
+	l.order.MoveToFront(el)
+	return e.value, true
+}
+
+// add caches value until expires and returns the number of entries evicted to make room.
+func (l *lru) add(key string, value interface{}, expires time.Time) int {
+	if el, ok := l.entries[key]; ok {
+		el.Value = &entry{key: key, value: value, expires: expires}
+		l.order.MoveToFront(el)
+		return 0
+	}
+
+	l.entries[key] = l.order.PushFront(&entry{key: key, value: value, expires: expires})
+	evicted := 0
+	for l.order.Len() > l.size {
+		l.remove(l.order.Back().Value.(*entry).key)
+		evicted++
+	}
+	return evicted
+}
+
+func (l *lru) remove(key string) {
+	if el, ok := l.entries[key]; ok {
+		l.order.Remove(el)
+		delete(l.entries, key)
+	}
+}
+
+// removePrefix removes all entries whose key starts with prefix.
+func (l *lru) removePrefix(prefix string) {
+	for key := range l.entries {
+		if strings.HasPrefix(key, prefix) {
+			l.remove(key)
+		}
+	}
+}
+
+func (l *lru) clear() {
+	l.order.Init()
+	l.entries = map[string]*list.Element{}
+}
+
+func (l *lru) len() int {
+	return l.order.Len()
+}
+
+// call is a load in progress. Callers missing the same key wait for it instead of loading the value again.
+type call struct {
+	done  sync.WaitGroup
+	value interface{}
+	err   error
+}
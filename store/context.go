@@ -0,0 +1,249 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// ContextStorer is the context-aware version of ContactStorer. Its operations end with ctx: backends stop waiting
+// once ctx is done and return an error wrapping context.Canceled or context.DeadlineExceeded, rolling back
+// unfinished writes. The operations of ContactStorer run with context.Background.
+//
+// Backends implementing it return Bind(ctx, s) from WithContext. WithActor should return a ContextStorer as well,
+// otherwise the bound store binds the store returned using its WithContext.
+type ContextStorer interface {
+	ContactStorer
+
+	FetchContactsContext(ctx context.Context) (Contacts, error)
+	GetContactContext(ctx context.Context, id string) (*Contact, error)
+	DeleteContactContext(ctx context.Context, id string, version int) error
+	CreateContactContext(ctx context.Context, c *Contact) error
+	UpdateContactContext(ctx context.Context, c *Contact) error
+	PatchContactContext(ctx context.Context, id string, version int, patch func(*Contact) error) (*Contact, error)
+	FetchMetaContext(ctx context.Context) (*Meta, error)
+	QueryContactsContext(ctx context.Context, q *Query) (*Page, error)
+	SearchContactsContext(ctx context.Context, query string, limit int) ([]*Contact, error)
+	FetchTrashContext(ctx context.Context) ([]*Contact, error)
+	RestoreContactContext(ctx context.Context, id string) (*Contact, error)
+	PurgeContactsContext(ctx context.Context, deletedBefore time.Time) (int, error)
+	HistoryContext(ctx context.Context, id string) ([]*Change, error)
+	AuditContext(ctx context.Context, q *AuditQuery) ([]*Change, error)
+}
+
+// ContextTransactor is the context-aware version of Transactor. The store passed to f is bound to ctx.
+type ContextTransactor interface {
+	WithTxContext(ctx context.Context, f func(tx ContactStorer) error) error
+}
+
+// ContextImporter is the context-aware version of Importer.
+type ContextImporter interface {
+	ImportContactsContext(ctx context.Context, r ContactReader) (*ImportReport, error)
+}
+
+// ContextOrgStorer is the context-aware version of OrgStorer, see ContextStorer. Bound stores implement OrgStorer
+// using it.
+type ContextOrgStorer interface {
+	CreateCompanyContext(ctx context.Context, c *Company) error
+	GetCompanyContext(ctx context.Context, id string) (*Company, error)
+	FetchCompaniesContext(ctx context.Context) ([]*Company, error)
+	UpdateCompanyContext(ctx context.Context, c *Company) error
+	DeleteCompanyContext(ctx context.Context, id string) error
+
+	CreateDepartmentContext(ctx context.Context, d *Department) error
+	GetDepartmentContext(ctx context.Context, id string) (*Department, error)
+	FetchDepartmentsContext(ctx context.Context, companyID string) ([]*Department, error)
+	UpdateDepartmentContext(ctx context.Context, d *Department) error
+	DeleteDepartmentContext(ctx context.Context, id string) error
+}
+
+// Bind returns a store running the operations of s with ctx. It implements Transactor, Importer and OrgStorer, which
+// fail unless s implements ContextTransactor, ContextImporter and ContextOrgStorer.
+//
+// The store returned is done once ctx is, so it must not be kept beyond the request or job ctx belongs to.
+func Bind(ctx context.Context, s ContextStorer) ContactStorer {
+	return &boundStore{ctx: ctx, s: s}
+}
+
+// boundStore adapts a ContextStorer to ContactStorer, see Bind.
+type boundStore struct {
+	ctx context.Context
+	s   ContextStorer
+}
+
+func (b *boundStore) FetchContacts() (Contacts, error) {
+	return b.s.FetchContactsContext(b.ctx)
+}
+
+func (b *boundStore) GetContact(id string) (*Contact, error) {
+	return b.s.GetContactContext(b.ctx, id)
+}
+
+func (b *boundStore) DeleteContact(id string, version int) error {
+	return b.s.DeleteContactContext(b.ctx, id, version)
+}
+
+func (b *boundStore) CreateContact(c *Contact) error {
+	return b.s.CreateContactContext(b.ctx, c)
+}
+
+func (b *boundStore) UpdateContact(c *Contact) error {
+	return b.s.UpdateContactContext(b.ctx, c)
+}
+
+func (b *boundStore) PatchContact(id string, version int, patch func(*Contact) error) (*Contact, error) {
+	return b.s.PatchContactContext(b.ctx, id, version, patch)
+}
+
+func (b *boundStore) FetchMeta() (*Meta, error) {
+	return b.s.FetchMetaContext(b.ctx)
+}
+
+func (b *boundStore) QueryContacts(q *Query) (*Page, error) {
+	return b.s.QueryContactsContext(b.ctx, q)
+}
+
+func (b *boundStore) SearchContacts(query string, limit int) ([]*Contact, error) {
+	return b.s.SearchContactsContext(b.ctx, query, limit)
+}
+
+func (b *boundStore) FetchTrash() ([]*Contact, error) {
+	return b.s.FetchTrashContext(b.ctx)
+}
+
+func (b *boundStore) RestoreContact(id string) (*Contact, error) {
+	return b.s.RestoreContactContext(b.ctx, id)
+}
+
+func (b *boundStore) PurgeContacts(deletedBefore time.Time) (int, error) {
+	return b.s.PurgeContactsContext(b.ctx, deletedBefore)
+}
+
+func (b *boundStore) History(id string) ([]*Change, error) {
+	return b.s.HistoryContext(b.ctx, id)
+}
+
+func (b *boundStore) Audit(q *AuditQuery) ([]*Change, error) {
+	return b.s.AuditContext(b.ctx, q)
+}
+
+func (b *boundStore) WithActor(actor Actor) ContactStorer {
+	s := b.s.WithActor(actor)
+	if c, ok := s.(ContextStorer); ok {
+		return Bind(b.ctx, c)
+	}
+	return s.WithContext(b.ctx)
+}
+
+func (b *boundStore) WithContext(ctx context.Context) ContactStorer {
+	return Bind(ctx, b.s)
+}
+
+func (b *boundStore) Subscribe() (<-chan *Change, func(), error) {
+	return b.s.Subscribe()
+}
+
+func (b *boundStore) WithTx(f func(tx ContactStorer) error) error {
+	t, ok := b.s.(ContextTransactor)
+	if !ok {
+		return fmt.Errorf("%w: The store does not support transactions", ErrValidation)
+	}
+	return t.WithTxContext(b.ctx, f)
+}
+
+func (b *boundStore) ImportContacts(r ContactReader) (*ImportReport, error) {
+	importer, ok := b.s.(ContextImporter)
+	if !ok {
+		return nil, fmt.Errorf("%w: The store does not support atomic imports", ErrValidation)
+	}
+	return importer.ImportContactsContext(b.ctx, r)
+}
+
+// orgs returns the ContextOrgStorer of b.s or fails like the other optional interfaces.
+func (b *boundStore) orgs() (ContextOrgStorer, error) {
+	orgs, ok := b.s.(ContextOrgStorer)
+	if !ok {
+		return nil, fmt.Errorf("%w: The store does not support companies and departments", ErrValidation)
+	}
+	return orgs, nil
+}
+
+func (b *boundStore) CreateCompany(c *Company) error {
+	orgs, err := b.orgs()
+	if err != nil {
+		return err
+	}
+	return orgs.CreateCompanyContext(b.ctx, c)
+}
+
+func (b *boundStore) GetCompany(id string) (*Company, error) {
+	orgs, err := b.orgs()
+	if err != nil {
+		return nil, err
+	}
+	return orgs.GetCompanyContext(b.ctx, id)
+}
+
+func (b *boundStore) FetchCompanies() ([]*Company, error) {
+	orgs, err := b.orgs()
+	if err != nil {
+		return nil, err
+	}
+	return orgs.FetchCompaniesContext(b.ctx)
+}
+
+func (b *boundStore) UpdateCompany(c *Company) error {
+	orgs, err := b.orgs()
+	if err != nil {
+		return err
+	}
+	return orgs.UpdateCompanyContext(b.ctx, c)
+}
+
+func (b *boundStore) DeleteCompany(id string) error {
+	orgs, err := b.orgs()
+	if err != nil {
+		return err
+	}
+	return orgs.DeleteCompanyContext(b.ctx, id)
+}
+
+func (b *boundStore) CreateDepartment(d *Department) error {
+	orgs, err := b.orgs()
+	if err != nil {
+		return err
+	}
+	return orgs.CreateDepartmentContext(b.ctx, d)
+}
+
+func (b *boundStore) GetDepartment(id string) (*Department, error) {
+	orgs, err := b.orgs()
+	if err != nil {
+		return nil, err
+	}
+	return orgs.GetDepartmentContext(b.ctx, id)
+}
+
+func (b *boundStore) FetchDepartments(companyID string) ([]*Department, error) {
+	orgs, err := b.orgs()
+	if err != nil {
+		return nil, err
+	}
+	return orgs.FetchDepartmentsContext(b.ctx, companyID)
+}
+
+func (b *boundStore) UpdateDepartment(d *Department) error {
+	orgs, err := b.orgs()
+	if err != nil {
+		return err
+	}
+	return orgs.UpdateDepartmentContext(b.ctx, d)
+}
+
+func (b *boundStore) DeleteDepartment(id string) error {
+	orgs, err := b.orgs()
+	if err != nil {
+		return err
+	}
+	return orgs.DeleteDepartmentContext(b.ctx, id)
+}
@@ -0,0 +1,40 @@
+package store
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// contextless is a store which does not implement ContextStorer. It remembers the context it was given.
+type contextless struct {
+	ContactStorer
+	actor Actor
+	ctx   context.Context
+}
+
+func (s *contextless) WithContext(ctx context.Context) ContactStorer {
+	return &contextless{actor: s.actor, ctx: ctx}
+}
+
+// plainActors implements ContextStorer, but WithActor does not return one.
+type plainActors struct {
+	ContextStorer
+}
+
+func (s *plainActors) WithActor(actor Actor) ContactStorer {
+	return &contextless{actor: actor}
+}
+
+func TestBindWithActor(t *testing.T) {
+	type key struct{}
+	ctx := context.WithValue(context.Background(), key{}, "bound")
+	alice := Actor{Name: "alice"}
+
+	s, ok := Bind(ctx, &plainActors{}).WithActor(alice).(*contextless)
+	if assert.True(t, ok) {
+		assert.Equal(t, alice, s.actor)
+		assert.Equal(t, ctx, s.ctx)
+	}
+}
@@ -0,0 +1,58 @@
+package store
+
+// The types of emails, phones and addresses. Emails and addresses may be of TypeWork, TypeHome or TypeOther, phones
+// additionally of TypeMobile and TypeFax. The type is optional.
+const (
+	TypeWork   = "work"
+	TypeHome   = "home"
+	TypeMobile = "mobile"
+	TypeFax    = "fax"
+	TypeOther  = "other"
+)
+
+// The limits of a contact's multi-valued fields.
+const (
+	// MaxValues is the maximum number of emails, phones and addresses each.
+	MaxValues = 20
+
+	// MaxTags is the maximum number of tags, MaxTagLength the maximum length of a tag in characters.
+	MaxTags      = 50
+	MaxTagLength = 64
+
+	// MaxAttributes is the maximum number of custom attributes, MaxAttributeKeyLength the maximum length of their
+	// keys. Values may be as long as MaxFieldLength.
+	MaxAttributes         = 50
+	MaxAttributeKeyLength = 64
+)
+
+// Email is an email address of a contact.
+type Email struct {
+	Type    string `json:"type,omitempty"`
+	Address string `json:"address"`
+}
+
+// Phone is a phone number of a contact in E.164 format, for example +4969211111.
+type Phone struct {
+	Type   string `json:"type,omitempty"`
+	Number string `json:"number"`
+}
+
+// Address is a postal address of a contact. Country is an ISO 3166-1 alpha-2 code like DE.
+type Address struct {
+	Type       string `json:"type,omitempty"`
+	Street     string `json:"street,omitempty"`
+	City       string `json:"city,omitempty"`
+	PostalCode string `json:"postal_code,omitempty"`
+	Region     string `json:"region,omitempty"`
+	Country    string `json:"country,omitempty"`
+}
+
+// HasTag returns true if the contact is tagged with tag.
+func (c *Contact) HasTag(tag string) bool {
+	for _, t := range c.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,31 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+)
+
+// These errors are returned by all ContactStorer implementations. Backends may wrap them to add details,
+// so use errors.Is to check for them.
+var (
+	// ErrNotFound is returned when the requested resource does not exist.
+	ErrNotFound = errors.New("Resource not found")
+
+	// ErrAlreadyExists is returned when a resource is created with an ID that is already taken.
+	ErrAlreadyExists = errors.New("Resource already exists")
+
+	// ErrValidation is returned when a resource is rejected because of invalid data.
+	ErrValidation = errors.New("Validation failed")
+
+	// ErrConflict is returned when a write conflicts with the current state of the store.
+	ErrConflict = errors.New("Conflict")
+
+	// ErrVersionMismatch is returned when a write expected a different version of the resource than the stored one.
+	ErrVersionMismatch = errors.New("The resource was modified in the meantime")
+
+	// ErrIDChanged is returned when a patch tries to change the ID of a contact.
+	ErrIDChanged = fmt.Errorf("%w: The ID of a contact can not be changed", ErrValidation)
+
+	// ErrUnavailable is returned when the backend can not be reached.
+	ErrUnavailable = errors.New("Store unavailable")
+)
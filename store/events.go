@@ -0,0 +1,64 @@
+package store
+
+import "sync"
+
+// SubscriberBuffer is the number of changes buffered for each subscriber. Subscribers which fall further behind are
+// dropped.
+const SubscriberBuffer = 256
+
+// Broker fans out changes to subscribers. Publish never blocks: subscribers which do not keep up are dropped by
+// closing their channel, and may catch up using ContactStorer.Audit. The zero value is ready to use.
+type Broker struct {
+	mu          sync.Mutex
+	subscribers map[chan *Change]struct{}
+}
+
+// Subscribe returns a channel receiving all changes published after the call. cancel ends the subscription and
+// must be called once the channel is no longer read.
+func (b *Broker) Subscribe() (changes <-chan *Change, cancel func()) {
+	ch := make(chan *Change, SubscriberBuffer)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.subscribers == nil {
+		b.subscribers = map[chan *Change]struct{}{}
+	}
+	b.subscribers[ch] = struct{}{}
+	return ch, func() { b.drop(ch) }
+}
+
+// Publish sends c to all subscribers. They share c and must not modify it.
+func (b *Broker) Publish(c *Change) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for ch := range b.subscribers {
+		select {
+		case ch <- c:
+		default:
+			delete(b.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// DropAll ends all subscriptions, for example because changes may have been missed.
+func (b *Broker) DropAll() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for ch := range b.subscribers {
+		delete(b.subscribers, ch)
+		close(ch)
+	}
+}
+
+func (b *Broker) drop(ch chan *Change) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.subscribers[ch]; ok {
+		delete(b.subscribers, ch)
+		close(ch)
+	}
+}
@@ -0,0 +1,37 @@
+package store
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBroker(t *testing.T) {
+	var b Broker
+	fast, cancelFast := b.Subscribe()
+	slow, cancelSlow := b.Subscribe()
+	defer cancelSlow()
+
+	for i := 1; i <= SubscriberBuffer+1; i++ {
+		b.Publish(&Change{Seq: int64(i)})
+		assert.Equal(t, int64(i), (<-fast).Seq)
+	}
+
+	// The slow subscriber got a full buffer and was dropped afterwards.
+	var n int
+	for range slow {
+		n++
+	}
+	assert.Equal(t, SubscriberBuffer, n)
+
+	cancelFast()
+	cancelFast()
+	_, ok := <-fast
+	assert.False(t, ok)
+
+	other, cancel := b.Subscribe()
+	defer cancel()
+	b.DropAll()
+	_, ok = <-other
+	assert.False(t, ok)
+}
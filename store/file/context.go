@@ -0,0 +1,120 @@
+package file
+
+import (
+	"context"
+	"time"
+
+	"github.com/ory/workshop-dbg/store"
+)
+
+// The operations without a context run with context.Background. Requests use WithContext instead.
+
+// WithContext returns a store which does not start transactions once ctx is done, see store.Bind. Transactions are
+// short, bbolt can not abort them while they run.
+func (s *FileStore) WithContext(ctx context.Context) store.ContactStorer {
+	return store.Bind(ctx, s)
+}
+
+func (s *FileStore) FetchContacts() (store.Contacts, error) {
+	return s.FetchContactsContext(context.Background())
+}
+
+func (s *FileStore) GetContact(id string) (*store.Contact, error) {
+	return s.GetContactContext(context.Background(), id)
+}
+
+func (s *FileStore) DeleteContact(id string, version int) error {
+	return s.DeleteContactContext(context.Background(), id, version)
+}
+
+func (s *FileStore) CreateContact(c *store.Contact) error {
+	return s.CreateContactContext(context.Background(), c)
+}
+
+func (s *FileStore) UpdateContact(c *store.Contact) error {
+	return s.UpdateContactContext(context.Background(), c)
+}
+
+func (s *FileStore) PatchContact(id string, version int, patch func(*store.Contact) error) (*store.Contact, error) {
+	return s.PatchContactContext(context.Background(), id, version, patch)
+}
+
+func (s *FileStore) FetchMeta() (*store.Meta, error) {
+	return s.FetchMetaContext(context.Background())
+}
+
+func (s *FileStore) QueryContacts(q *store.Query) (*store.Page, error) {
+	return s.QueryContactsContext(context.Background(), q)
+}
+
+func (s *FileStore) SearchContacts(query string, limit int) ([]*store.Contact, error) {
+	return s.SearchContactsContext(context.Background(), query, limit)
+}
+
+func (s *FileStore) FetchTrash() ([]*store.Contact, error) {
+	return s.FetchTrashContext(context.Background())
+}
+
+func (s *FileStore) RestoreContact(id string) (*store.Contact, error) {
+	return s.RestoreContactContext(context.Background(), id)
+}
+
+func (s *FileStore) PurgeContacts(deletedBefore time.Time) (int, error) {
+	return s.PurgeContactsContext(context.Background(), deletedBefore)
+}
+
+func (s *FileStore) History(id string) ([]*store.Change, error) {
+	return s.HistoryContext(context.Background(), id)
+}
+
+func (s *FileStore) Audit(q *store.AuditQuery) ([]*store.Change, error) {
+	return s.AuditContext(context.Background(), q)
+}
+
+func (s *FileStore) WithTx(f func(tx store.ContactStorer) error) error {
+	return s.WithTxContext(context.Background(), f)
+}
+
+func (s *FileStore) ImportContacts(r store.ContactReader) (*store.ImportReport, error) {
+	return s.ImportContactsContext(context.Background(), r)
+}
+
+func (s *FileStore) CreateCompany(c *store.Company) error {
+	return s.CreateCompanyContext(context.Background(), c)
+}
+
+func (s *FileStore) GetCompany(id string) (*store.Company, error) {
+	return s.GetCompanyContext(context.Background(), id)
+}
+
+func (s *FileStore) FetchCompanies() ([]*store.Company, error) {
+	return s.FetchCompaniesContext(context.Background())
+}
+
+func (s *FileStore) UpdateCompany(c *store.Company) error {
+	return s.UpdateCompanyContext(context.Background(), c)
+}
+
+func (s *FileStore) DeleteCompany(id string) error {
+	return s.DeleteCompanyContext(context.Background(), id)
+}
+
+func (s *FileStore) CreateDepartment(d *store.Department) error {
+	return s.CreateDepartmentContext(context.Background(), d)
+}
+
+func (s *FileStore) GetDepartment(id string) (*store.Department, error) {
+	return s.GetDepartmentContext(context.Background(), id)
+}
+
+func (s *FileStore) FetchDepartments(companyID string) ([]*store.Department, error) {
+	return s.FetchDepartmentsContext(context.Background(), companyID)
+}
+
+func (s *FileStore) UpdateDepartment(d *store.Department) error {
+	return s.UpdateDepartmentContext(context.Background(), d)
+}
+
+func (s *FileStore) DeleteDepartment(id string) error {
+	return s.DeleteDepartmentContext(context.Background(), id)
+}
@@ -0,0 +1,569 @@
+// Package file stores contacts in a single local file using bbolt, so data survives restarts without a database
+// server. Only one process can open the file at a time.
+package file
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ory/workshop-dbg/store"
+	bolt "go.etcd.io/bbolt"
+)
+
+// The buckets of the file. Contacts in the trash are kept in their own bucket, so their IDs stay taken.
+var (
+	contactBucket = []byte("contacts")
+	trashBucket   = []byte("trash")
+	metaBucket    = []byte("meta")
+)
+
+// The keys of metaBucket.
+var (
+	revisionKey = []byte("revision")
+	modifiedKey = []byte("modified")
+)
+
+// OpenTimeout is how long Open waits for another process to close the file.
+const OpenTimeout = time.Second
+
+// FileStore keeps contacts in a bbolt database. It is safe for concurrent use. Use Open to create one.
+type FileStore struct {
+	DB *bolt.DB
+
+	// tx is set for stores passed to WithTx callbacks. All reads and writes use it.
+	tx *bolt.Tx
+
+	// actor is recorded with every change, see WithActor.
+	actor store.Actor
+
+	// events publishes the committed changes. It is shared by all stores using the same file.
+	events *store.Broker
+}
+
+// Open opens the file at path, creating it if it does not exist.
+func Open(path string) (*FileStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: OpenTimeout})
+	if err != nil {
+		return nil, fmt.Errorf("%w: Could not open %s because %s", store.ErrUnavailable, path, err)
+	}
+
+	s := &FileStore{DB: db, events: new(store.Broker)}
+	if err := s.CreateBuckets(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Close ends all subscriptions and closes the file.
+func (s *FileStore) Close() error {
+	s.events.DropAll()
+	return s.DB.Close()
+}
+
+// CreateBuckets creates the buckets which do not exist yet.
+func (s *FileStore) CreateBuckets() error {
+	return s.DB.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{
+			contactBucket, trashBucket, metaBucket, historyBucket, contactHistoryBucket,
+			webhookBucket, deliveryBucket, pendingBucket, companyBucket, departmentBucket,
+		} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// view runs f in a read-only transaction, or in the store's transaction if it has one. No transaction is started
+// once ctx is done.
+func (s *FileStore) view(ctx context.Context, f func(tx *bolt.Tx) error) error {
+	if s.tx != nil {
+		return f(s.tx)
+	} else if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.DB.View(f)
+}
+
+// update runs f in a new read-write transaction, or in the store's transaction if it has one. In the latter case
+// committing is up to WithTx. No transaction is started once ctx is done.
+func (s *FileStore) update(ctx context.Context, f func(tx *bolt.Tx) error) error {
+	if s.tx != nil {
+		return f(s.tx)
+	} else if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.DB.Update(f)
+}
+
+// WithTxContext runs f in a read-write transaction, which is committed if f returns nil. bbolt allows a single writer
+// at a time, so f must be quick. Within a transaction, WithTx reuses it instead of starting another one.
+func (s *FileStore) WithTxContext(ctx context.Context, f func(tx store.ContactStorer) error) error {
+	return s.update(ctx, func(tx *bolt.Tx) error {
+		return f(store.Bind(ctx, &FileStore{DB: s.DB, tx: tx, actor: s.actor, events: s.events}))
+	})
+}
+
+// get reads a contact from bucket. It returns nil if there is no such contact.
+func get(b *bolt.Bucket, id string) (*store.Contact, error) {
+	data := b.Get([]byte(id))
+	if data == nil {
+		return nil, nil
+	}
+
+	var c store.Contact
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("Could not read contact %q because %s", id, err)
+	}
+	return &c, nil
+}
+
+// put writes c to bucket.
+func put(b *bolt.Bucket, c *store.Contact) error {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(c.ID), data)
+}
+
+// each calls f for every contact in bucket, ordered by ID.
+func each(b *bolt.Bucket, f func(c *store.Contact) error) error {
+	return b.ForEach(func(k, v []byte) error {
+		var c store.Contact
+		if err := json.Unmarshal(v, &c); err != nil {
+			return fmt.Errorf("Could not read contact %q because %s", k, err)
+		}
+		return f(&c)
+	})
+}
+
+// lockContact reads a contact which is not in the trash and checks its version, unless version is 0. Read-write
+// transactions are serialized, so the contact does not change until the transaction ends.
+func lockContact(tx *bolt.Tx, id string, version int) (*store.Contact, error) {
+	c, err := get(tx.Bucket(contactBucket), id)
+	if err != nil {
+		return nil, err
+	} else if c == nil {
+		return nil, store.ErrNotFound
+	} else if version != 0 && c.Version != version {
+		return nil, store.ErrVersionMismatch
+	}
+	return c, nil
+}
+
+// taken returns true if id is used by a contact or by a contact in the trash.
+func taken(tx *bolt.Tx, id string) bool {
+	return tx.Bucket(contactBucket).Get([]byte(id)) != nil || tx.Bucket(trashBucket).Get([]byte(id)) != nil
+}
+
+// touch records a change of the contact list at now.
+func touch(tx *bolt.Tx, now time.Time) error {
+	b := tx.Bucket(metaBucket)
+	var revision uint64
+	if v := b.Get(revisionKey); v != nil {
+		revision = binary.BigEndian.Uint64(v)
+	}
+
+	modified, err := now.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	if err := b.Put(revisionKey, itob(revision+1)); err != nil {
+		return err
+	}
+	return b.Put(modifiedKey, modified)
+}
+
+// itob encodes n so that the keys sort numerically.
+func itob(n uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, n)
+	return b
+}
+
+func (s *FileStore) FetchContactsContext(ctx context.Context) (store.Contacts, error) {
+	cs := store.Contacts{}
+	err := s.view(ctx, func(tx *bolt.Tx) error {
+		return each(tx.Bucket(contactBucket), func(c *store.Contact) error {
+			cs[c.ID] = c
+			return nil
+		})
+	})
+	return cs, err
+}
+
+func (s *FileStore) GetContactContext(ctx context.Context, id string) (*store.Contact, error) {
+	var c *store.Contact
+	err := s.view(ctx, func(tx *bolt.Tx) error {
+		var err error
+		c, err = get(tx.Bucket(contactBucket), id)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	} else if c == nil {
+		return nil, store.ErrNotFound
+	}
+	return c, nil
+}
+
+func (s *FileStore) QueryContactsContext(ctx context.Context, q *store.Query) (*store.Page, error) {
+	cursor, err := q.Normalize()
+	if err != nil {
+		return nil, err
+	}
+
+	var cs []*store.Contact
+	err = s.view(ctx, func(tx *bolt.Tx) error {
+		buckets := []*bolt.Bucket{tx.Bucket(contactBucket)}
+		if q.IncludeDeleted {
+			buckets = append(buckets, tx.Bucket(trashBucket))
+		}
+		for _, b := range buckets {
+			if err := each(b, func(c *store.Contact) error {
+				if q.Matches(c) {
+					cs = append(cs, c)
+				}
+				return nil
+			}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return store.Paginate(cs, q, cursor), nil
+}
+
+// Matches in a contact's name weigh more than matches in its department or company.
+const (
+	nameWeight  = 3
+	otherWeight = 1
+)
+
+// SearchContactsContext scans all contacts. A token matches words it is a prefix of, exact matches score twice as high,
+// just like in the in-memory index.
+func (s *FileStore) SearchContactsContext(ctx context.Context, query string, limit int) ([]*store.Contact, error) {
+	tokens, limit, err := store.NormalizeSearch(query, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	cs := []*store.Contact{}
+	scores := map[string]int{}
+	err = s.view(ctx, func(tx *bolt.Tx) error {
+		return each(tx.Bucket(contactBucket), func(c *store.Contact) error {
+			if score := score(tokens, c); score > 0 {
+				cs = append(cs, c)
+				scores[c.ID] = score
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(cs, func(i, j int) bool {
+		if si, sj := scores[cs[i].ID], scores[cs[j].ID]; si != sj {
+			return si > sj
+		} else if cs[i].Name != cs[j].Name {
+			return cs[i].Name < cs[j].Name
+		}
+		return cs[i].ID < cs[j].ID
+	})
+
+	if len(cs) > limit {
+		cs = cs[:limit]
+	}
+	return cs, nil
+}
+
+// score returns the score of c, or 0 unless every token matches.
+func score(tokens []string, c *store.Contact) int {
+	weights := map[string]int{}
+	for _, f := range []struct {
+		text   string
+		weight int
+	}{
+		{text: c.Name, weight: nameWeight},
+		{text: c.Department, weight: otherWeight},
+		{text: c.Company, weight: otherWeight},
+	} {
+		for _, w := range store.IndexWords(f.text) {
+			if f.weight > weights[w] {
+				weights[w] = f.weight
+			}
+		}
+	}
+
+	total := 0
+	for _, t := range tokens {
+		best := 0
+		for w, weight := range weights {
+			if !strings.HasPrefix(w, t) {
+				continue
+			}
+			if w == t {
+				weight *= 2
+			}
+			if weight > best {
+				best = weight
+			}
+		}
+		if best == 0 {
+			return 0
+		}
+		total += best
+	}
+	return total
+}
+
+func (s *FileStore) FetchMetaContext(ctx context.Context) (*store.Meta, error) {
+	m := new(store.Meta)
+	err := s.view(ctx, func(tx *bolt.Tx) error {
+		m.Count = tx.Bucket(contactBucket).Stats().KeyN
+
+		b := tx.Bucket(metaBucket)
+		var revision uint64
+		if v := b.Get(revisionKey); v != nil {
+			revision = binary.BigEndian.Uint64(v)
+		}
+		if v := b.Get(modifiedKey); v != nil {
+			if err := m.LastModified.UnmarshalBinary(v); err != nil {
+				return err
+			}
+			m.LastModified = m.LastModified.UTC()
+		}
+		m.Revision = store.CountedRevision(m.LastModified, revision)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (s *FileStore) CreateContactContext(ctx context.Context, c *store.Contact) error {
+	if err := c.Validate(); err != nil {
+		return err
+	}
+
+	return s.update(ctx, func(tx *bolt.Tx) error {
+		if c.ID == "" {
+			c.ID = store.NewID()
+		} else if taken(tx, c.ID) {
+			return store.ErrAlreadyExists
+		}
+		if err := checkManager(tx, c, nil); err != nil {
+			return err
+		}
+
+		c.Version, c.DeletedAt = 1, nil
+		return s.write(tx, store.ActionCreate, nil, c)
+	})
+}
+
+func (s *FileStore) UpdateContactContext(ctx context.Context, c *store.Contact) error {
+	if err := c.Validate(); err != nil {
+		return err
+	}
+
+	after := c.Clone()
+	err := s.update(ctx, func(tx *bolt.Tx) error {
+		before, err := lockContact(tx, c.ID, c.Version)
+		if err != nil {
+			return err
+		} else if err := checkManager(tx, after, nil); err != nil {
+			return err
+		}
+
+		after.Version, after.DeletedAt = before.Version+1, nil
+		return s.write(tx, store.ActionUpdate, before, after)
+	})
+	if err != nil {
+		return err
+	}
+
+	c.Version, c.DeletedAt, c.Company, c.Department = after.Version, nil, after.Company, after.Department
+	return nil
+}
+
+func (s *FileStore) PatchContactContext(ctx context.Context, id string, version int, patch func(*store.Contact) error) (*store.Contact, error) {
+	var c *store.Contact
+	err := s.update(ctx, func(tx *bolt.Tx) error {
+		before, err := lockContact(tx, id, version)
+		if err != nil {
+			return err
+		}
+
+		c = before.Clone()
+		if err := patch(c); err != nil {
+			return err
+		} else if c.ID != id {
+			return store.ErrIDChanged
+		} else if err := c.Validate(); err != nil {
+			return err
+		} else if err := checkManager(tx, c, nil); err != nil {
+			return err
+		}
+
+		c.Version, c.DeletedAt = before.Version+1, nil
+		return s.write(tx, store.ActionUpdate, before, c)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// write checks the references of after, stores it, as it is not in the trash, and records the change.
+func (s *FileStore) write(tx *bolt.Tx, action string, before, after *store.Contact) error {
+	now := time.Now().UTC()
+	if err := checkReferences(tx, after); err != nil {
+		return err
+	} else if err := put(tx.Bucket(contactBucket), after); err != nil {
+		return err
+	} else if err := touch(tx, now); err != nil {
+		return err
+	}
+	return s.record(tx, action, after.ID, before, after, now)
+}
+
+func (s *FileStore) DeleteContactContext(ctx context.Context, id string, version int) error {
+	return s.update(ctx, func(tx *bolt.Tx) error {
+		before, err := lockContact(tx, id, version)
+		if err != nil {
+			return err
+		}
+
+		now := time.Now().UTC()
+		after := before.Clone()
+		after.DeletedAt = &now
+		if err := tx.Bucket(contactBucket).Delete([]byte(id)); err != nil {
+			return err
+		} else if err := put(tx.Bucket(trashBucket), after); err != nil {
+			return err
+		} else if err := touch(tx, now); err != nil {
+			return err
+		}
+		return s.record(tx, store.ActionDelete, id, before, after, now)
+	})
+}
+
+func (s *FileStore) FetchTrashContext(ctx context.Context) ([]*store.Contact, error) {
+	cs := []*store.Contact{}
+	err := s.view(ctx, func(tx *bolt.Tx) error {
+		return each(tx.Bucket(trashBucket), func(c *store.Contact) error {
+			cs = append(cs, c)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(cs, func(i, j int) bool {
+		return cs[i].DeletedAt.After(*cs[j].DeletedAt)
+	})
+	return cs, nil
+}
+
+func (s *FileStore) RestoreContactContext(ctx context.Context, id string) (*store.Contact, error) {
+	var c *store.Contact
+	err := s.update(ctx, func(tx *bolt.Tx) error {
+		before, err := get(tx.Bucket(trashBucket), id)
+		if err != nil {
+			return err
+		} else if before == nil {
+			return store.ErrNotFound
+		}
+
+		// The company or department may have been renamed meanwhile.
+		c = before.Clone()
+		c.Version, c.DeletedAt = before.Version+1, nil
+		if err := syncNames(tx, c); err != nil {
+			return err
+		} else if err := tx.Bucket(trashBucket).Delete([]byte(id)); err != nil {
+			return err
+		}
+		return s.write(tx, store.ActionRestore, before, c)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (s *FileStore) PurgeContactsContext(ctx context.Context, deletedBefore time.Time) (int, error) {
+	var purged int
+	err := s.update(ctx, func(tx *bolt.Tx) error {
+		b := tx.Bucket(trashBucket)
+		var due []*store.Contact
+		if err := each(b, func(c *store.Contact) error {
+			if c.DeletedAt.Before(deletedBefore) {
+				due = append(due, c)
+			}
+			return nil
+		}); err != nil || len(due) == 0 {
+			return err
+		}
+
+		now := time.Now().UTC()
+		if err := touch(tx, now); err != nil {
+			return err
+		}
+		for _, c := range due {
+			if err := b.Delete([]byte(c.ID)); err != nil {
+				return err
+			} else if err := s.record(tx, store.ActionPurge, c.ID, c, nil, now); err != nil {
+				return err
+			}
+		}
+		purged = len(due)
+		return nil
+	})
+	return purged, err
+}
+
+// ImportContactsContext reads all contacts before starting the transaction, so a slow upload does not block other
+// writes.
+func (s *FileStore) ImportContactsContext(ctx context.Context, r store.ContactReader) (*store.ImportReport, error) {
+	batch, err := store.ReadImportBatch(r)
+	if err != nil {
+		return batch.Report, err
+	}
+
+	err = s.update(ctx, func(tx *bolt.Tx) error {
+		if err := batch.Check(func(c *store.Contact) error {
+			if taken(tx, c.ID) {
+				return store.ErrAlreadyExists
+			} else if err := checkReferences(tx, c); err != nil {
+				return err
+			}
+			return checkManager(tx, c, batch)
+		}); err != nil || len(batch.Report.Errors) > 0 {
+			return err
+		}
+
+		for _, c := range batch.Contacts {
+			c.Version, c.DeletedAt = 1, nil
+			if err := s.write(tx, store.ActionCreate, nil, c); err != nil {
+				return err
+			}
+		}
+		batch.Report.Imported = len(batch.Contacts)
+		return nil
+	})
+	return batch.Report, err
+}
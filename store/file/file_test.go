@@ -0,0 +1,444 @@
+package file
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ory/workshop-dbg/bulk"
+	"github.com/ory/workshop-dbg/store"
+	"github.com/ory/workshop-dbg/store/storetest"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// openStore opens a store in a new temporary directory and returns its path. The directory is removed by cleanup.
+func openStore(t *testing.T) (s *FileStore, path string, cleanup func()) {
+	dir, err := ioutil.TempDir("", "workshop-dbg")
+	require.Nil(t, err)
+
+	path = filepath.Join(dir, "contacts.db")
+	s, err = Open(path)
+	require.Nil(t, err)
+	return s, path, func() {
+		s.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestFileStore(t *testing.T) {
+	s, _, cleanup := openStore(t)
+	defer cleanup()
+
+	c1 := &store.Contact{ID: uuid.New(), Name: "a", Department: "a1", Company: "a2"}
+	c2 := &store.Contact{ID: uuid.New(), Name: "b", Department: "b1", Company: "b2"}
+	c3 := &store.Contact{ID: c2.ID, Name: "ba", Department: "ba1", Company: "ba2"}
+	_, err := s.GetContact(c1.ID)
+	assert.Equal(t, store.ErrNotFound, err)
+
+	assert.Equal(t, store.ErrNotFound, s.DeleteContact(c1.ID, 0))
+	assert.Nil(t, s.CreateContact(c1))
+	assert.Nil(t, s.CreateContact(c2))
+	assert.Equal(t, store.ErrAlreadyExists, s.CreateContact(&store.Contact{ID: c1.ID, Name: "a"}))
+
+	cs, err := s.FetchContacts()
+	assert.Nil(t, err)
+	assert.Len(t, cs, 2)
+	assert.EqualValues(t, c1, cs[c1.ID])
+
+	r, err := s.GetContact(c2.ID)
+	assert.Nil(t, err)
+	assert.EqualValues(t, c2, r)
+
+	assert.Equal(t, store.ErrNotFound, s.UpdateContact(&store.Contact{ID: uuid.New(), Name: "c"}))
+	assert.Nil(t, s.UpdateContact(c3))
+	assert.Equal(t, 2, c3.Version)
+	r, err = s.GetContact(c2.ID)
+	assert.Nil(t, err)
+	assert.EqualValues(t, c3, r)
+
+	// Stale writes are rejected.
+	assert.Equal(t, store.ErrVersionMismatch, s.UpdateContact(&store.Contact{ID: c2.ID, Name: "d", Version: 1}))
+	assert.Equal(t, store.ErrVersionMismatch, s.DeleteContact(c2.ID, 1))
+
+	meta, err := s.FetchMeta()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, meta.Count)
+	assert.False(t, meta.LastModified.IsZero())
+
+	assert.Nil(t, s.DeleteContact(c1.ID, 1))
+	assert.Equal(t, store.ErrNotFound, s.DeleteContact(c1.ID, 0))
+	cs, err = s.FetchContacts()
+	assert.Nil(t, err)
+	assert.Len(t, cs, 1)
+
+	updated, err := s.FetchMeta()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, updated.Count)
+	assert.NotEqual(t, meta.Revision, updated.Revision)
+
+	var invalid *store.ValidationError
+	assert.True(t, errors.As(s.CreateContact(&store.Contact{Name: ""}), &invalid))
+}
+
+func TestPersistence(t *testing.T) {
+	s, path, cleanup := openStore(t)
+	defer cleanup()
+
+	require.Nil(t, s.CreateContact(&store.Contact{ID: "a", Name: "A"}))
+	require.Nil(t, s.CreateContact(&store.Contact{ID: "b", Name: "B"}))
+	require.Nil(t, s.DeleteContact("b", 0))
+	meta, err := s.FetchMeta()
+	require.Nil(t, err)
+
+	// The file is locked while it is open.
+	_, err = Open(path)
+	assert.True(t, errors.Is(err, store.ErrUnavailable))
+
+	require.Nil(t, s.Close())
+	s, err = Open(path)
+	require.Nil(t, err)
+
+	c, err := s.GetContact("a")
+	require.Nil(t, err)
+	assert.Equal(t, "A", c.Name)
+
+	trash, err := s.FetchTrash()
+	require.Nil(t, err)
+	require.Len(t, trash, 1)
+	assert.Equal(t, "b", trash[0].ID)
+
+	reopened, err := s.FetchMeta()
+	require.Nil(t, err)
+	assert.Equal(t, meta, reopened)
+
+	history, err := s.History("b")
+	require.Nil(t, err)
+	assert.Len(t, history, 2)
+
+	// Sequence numbers continue after reopening.
+	require.Nil(t, s.CreateContact(&store.Contact{ID: "c", Name: "C"}))
+	history, err = s.History("c")
+	require.Nil(t, err)
+	assert.Equal(t, int64(4), history[0].Seq)
+}
+
+func TestQueryAndSearch(t *testing.T) {
+	s, _, cleanup := openStore(t)
+	defer cleanup()
+
+	for _, c := range []*store.Contact{
+		{ID: "juergen-elsner", Name: "Jürgen Elsner", Department: "DaCS", Company: "DBG"},
+		{ID: "ulrich-meyer", Name: "Ulrich Meyer", Department: "TRIT", Company: "DBG"},
+		{ID: "dbg-bot", Name: "DBG Bot", Department: "IT", Company: "ACME"},
+	} {
+		require.Nil(t, s.CreateContact(c))
+	}
+
+	page, err := s.QueryContacts(&store.Query{SortBy: store.SortByName, Limit: 2, Company: "DBG"})
+	require.Nil(t, err)
+	require.Len(t, page.Contacts, 2)
+	assert.Equal(t, "juergen-elsner", page.Contacts[0].ID)
+	assert.Empty(t, page.NextCursor)
+
+	cs, err := s.SearchContacts("jurgen", 0)
+	assert.Nil(t, err)
+	require.Len(t, cs, 1)
+	assert.Equal(t, "juergen-elsner", cs[0].ID)
+
+	// Matches in the name score higher.
+	cs, err = s.SearchContacts("DBG", 0)
+	assert.Nil(t, err)
+	require.Len(t, cs, 3)
+	assert.Equal(t, "dbg-bot", cs[0].ID)
+
+	cs, err = s.SearchContacts("dbg meyer", 0)
+	assert.Nil(t, err)
+	require.Len(t, cs, 1)
+	assert.Equal(t, "ulrich-meyer", cs[0].ID)
+
+	require.Nil(t, s.DeleteContact("juergen-elsner", 0))
+	cs, err = s.SearchContacts("els", 0)
+	assert.Nil(t, err)
+	assert.Len(t, cs, 0)
+
+	page, err = s.QueryContacts(&store.Query{DepartmentPrefix: "Da", IncludeDeleted: true})
+	require.Nil(t, err)
+	assert.Len(t, page.Contacts, 1)
+
+	_, err = s.SearchContacts("  ", 0)
+	assert.True(t, errors.Is(err, store.ErrValidation))
+}
+
+func TestPatchContact(t *testing.T) {
+	s, _, cleanup := openStore(t)
+	defer cleanup()
+
+	require.Nil(t, s.CreateContact(&store.Contact{ID: "a", Name: "A"}))
+	c, err := s.PatchContact("a", 1, func(c *store.Contact) error {
+		c.Department = "IT"
+		return nil
+	})
+	require.Nil(t, err)
+	assert.Equal(t, 2, c.Version)
+	assert.Equal(t, "IT", c.Department)
+
+	_, err = s.PatchContact("a", 1, func(c *store.Contact) error { return nil })
+	assert.Equal(t, store.ErrVersionMismatch, err)
+	_, err = s.PatchContact("a", 0, func(c *store.Contact) error { c.ID = "b"; return nil })
+	assert.Equal(t, store.ErrIDChanged, err)
+	_, err = s.PatchContact("b", 0, func(c *store.Contact) error { return nil })
+	assert.Equal(t, store.ErrNotFound, err)
+}
+
+func TestTrash(t *testing.T) {
+	s, _, cleanup := openStore(t)
+	defer cleanup()
+
+	for _, id := range []string{"a", "b", "c"} {
+		require.Nil(t, s.CreateContact(&store.Contact{ID: id, Name: strings.ToUpper(id)}))
+		require.Nil(t, s.DeleteContact(id, 0))
+	}
+
+	// Trashed IDs stay taken.
+	assert.Equal(t, store.ErrAlreadyExists, s.CreateContact(&store.Contact{ID: "a", Name: "A"}))
+
+	trash, err := s.FetchTrash()
+	require.Nil(t, err)
+	require.Len(t, trash, 3)
+	assert.Equal(t, "c", trash[0].ID)
+	assert.NotNil(t, trash[0].DeletedAt)
+
+	c, err := s.RestoreContact("a")
+	require.Nil(t, err)
+	assert.Equal(t, 2, c.Version)
+	assert.Nil(t, c.DeletedAt)
+	_, err = s.RestoreContact("a")
+	assert.Equal(t, store.ErrNotFound, err)
+
+	n, err := s.WithActor(store.Actor{Name: "janitor"}).PurgeContacts(time.Now().Add(time.Minute))
+	require.Nil(t, err)
+	assert.Equal(t, 2, n)
+	trash, err = s.FetchTrash()
+	require.Nil(t, err)
+	assert.Len(t, trash, 0)
+
+	history, err := s.History("b")
+	require.Nil(t, err)
+	require.Len(t, history, 3)
+	assert.Equal(t, store.ActionPurge, history[2].Action)
+	assert.Equal(t, "janitor", history[2].Actor)
+	assert.Nil(t, history[2].After)
+}
+
+func TestWithTx(t *testing.T) {
+	s, _, cleanup := openStore(t)
+	defer cleanup()
+
+	require.Nil(t, s.CreateContact(&store.Contact{ID: "a", Name: "A"}))
+
+	// A failing transaction leaves no trace.
+	failed := errors.New("failed")
+	assert.Equal(t, failed, s.WithTx(func(tx store.ContactStorer) error {
+		require.Nil(t, tx.CreateContact(&store.Contact{ID: "b", Name: "B"}))
+		require.Nil(t, tx.DeleteContact("a", 0))
+		_, err := tx.GetContact("b")
+		require.Nil(t, err)
+		return failed
+	}))
+	cs, err := s.FetchContacts()
+	require.Nil(t, err)
+	assert.Len(t, cs, 1)
+	assert.Contains(t, cs, "a")
+	_, err = s.History("b")
+	assert.Equal(t, store.ErrNotFound, err)
+
+	require.Nil(t, s.WithActor(store.Actor{Name: "alice"}).(store.Transactor).WithTx(func(tx store.ContactStorer) error {
+		return tx.CreateContact(&store.Contact{ID: "b", Name: "B"})
+	}))
+	history, err := s.History("b")
+	require.Nil(t, err)
+	require.Len(t, history, 1)
+	assert.Equal(t, "alice", history[0].Actor)
+}
+
+func TestImportContacts(t *testing.T) {
+	s, _, cleanup := openStore(t)
+	defer cleanup()
+
+	require.Nil(t, s.CreateContact(&store.Contact{ID: "a", Name: "A"}))
+
+	r, _ := bulk.NewReader(bulk.NDJSONType, strings.NewReader(`{"id": "b", "name": "B"}`+"\n"+`{"id": "a", "name": "A"}`))
+	report, err := s.ImportContacts(r)
+	require.Nil(t, err)
+	assert.Equal(t, 0, report.Imported)
+	require.Len(t, report.Errors, 1)
+	assert.Equal(t, 2, report.Errors[0].Row)
+	_, err = s.GetContact("b")
+	assert.Equal(t, store.ErrNotFound, err)
+
+	r, _ = bulk.NewReader(bulk.NDJSONType, strings.NewReader(`{"id": "b", "name": "B"}`+"\n"+`{"name": "C"}`))
+	report, err = s.ImportContacts(r)
+	require.Nil(t, err)
+	assert.Equal(t, 2, report.Imported)
+	cs, err := s.FetchContacts()
+	require.Nil(t, err)
+	assert.Len(t, cs, 3)
+}
+
+func TestAudit(t *testing.T) {
+	s, _, cleanup := openStore(t)
+	defer cleanup()
+
+	require.Nil(t, s.CreateContact(&store.Contact{ID: "a", Name: "A"}))
+	require.Nil(t, s.WithActor(store.Actor{Name: "bob", RequestID: "r1"}).UpdateContact(&store.Contact{ID: "a", Name: "A2"}))
+	require.Nil(t, s.CreateContact(&store.Contact{ID: "b", Name: "B"}))
+
+	changes, err := s.Audit(&store.AuditQuery{})
+	require.Nil(t, err)
+	require.Len(t, changes, 3)
+	assert.Equal(t, store.ActionUpdate, changes[1].Action)
+	assert.Equal(t, "A", changes[1].Before.Name)
+	assert.Equal(t, "A2", changes[1].After.Name)
+	assert.Equal(t, "bob", changes[1].Actor)
+	assert.Equal(t, "r1", changes[1].RequestID)
+
+	changes, err = s.Audit(&store.AuditQuery{After: 1, Limit: 1})
+	require.Nil(t, err)
+	require.Len(t, changes, 1)
+	assert.Equal(t, int64(2), changes[0].Seq)
+
+	changes, err = s.Audit(&store.AuditQuery{Since: time.Now().Add(time.Minute)})
+	require.Nil(t, err)
+	assert.Len(t, changes, 0)
+}
+
+func TestSubscribe(t *testing.T) {
+	s, _, cleanup := openStore(t)
+	defer cleanup()
+
+	changes, cancel, err := s.Subscribe()
+	require.Nil(t, err)
+	defer cancel()
+
+	// Only committed changes are published.
+	s.WithTx(func(tx store.ContactStorer) error {
+		tx.CreateContact(&store.Contact{ID: "a", Name: "A"})
+		return errors.New("rollback")
+	})
+	require.Nil(t, s.CreateContact(&store.Contact{ID: "b", Name: "B"}))
+
+	select {
+	case c := <-changes:
+		assert.Equal(t, "b", c.ContactID)
+		assert.Equal(t, store.ActionCreate, c.Action)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no change received")
+	}
+}
+
+func TestConcurrency(t *testing.T) {
+	s, _, cleanup := openStore(t)
+	defer cleanup()
+
+	require.Nil(t, s.CreateContact(&store.Contact{ID: "counter", Name: "Counter"}))
+
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				_, err := s.PatchContact("counter", 0, func(c *store.Contact) error {
+					c.Department += "x"
+					return nil
+				})
+				assert.Nil(t, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	c, err := s.GetContact("counter")
+	require.Nil(t, err)
+	assert.Equal(t, 161, c.Version)
+	assert.Len(t, c.Department, 160)
+}
+
+func TestWebhooks(t *testing.T) {
+	s, _, cleanup := openStore(t)
+	defer cleanup()
+
+	w := &store.Webhook{URL: "http://example.com/hook", Events: []string{store.ActionDelete}, Active: true}
+	require.Nil(t, s.CreateWebhook(w))
+	require.Nil(t, s.CreateWebhook(&store.Webhook{URL: "http://example.com/inactive", Events: []string{}}))
+
+	var invalid *store.ValidationError
+	assert.True(t, errors.As(s.CreateWebhook(&store.Webhook{URL: "ftp://example.com"}), &invalid))
+
+	webhooks, err := s.FetchWebhooks()
+	require.Nil(t, err)
+	require.Len(t, webhooks, 2)
+	assert.Equal(t, w.ID, webhooks[0].ID)
+
+	// Only active webhooks subscribed to the action get deliveries, rolled back changes none at all.
+	require.Nil(t, s.CreateContact(&store.Contact{ID: "a", Name: "A"}))
+	s.WithTx(func(tx store.ContactStorer) error {
+		tx.DeleteContact("a", 0)
+		return errors.New("rollback")
+	})
+	require.Nil(t, s.DeleteContact("a", 0))
+
+	now := time.Now()
+	claimed, err := s.ClaimDeliveries(now.Add(time.Second), time.Minute, 10)
+	require.Nil(t, err)
+	require.Len(t, claimed, 1)
+	assert.Equal(t, w.ID, claimed[0].WebhookID)
+	assert.Equal(t, "a", claimed[0].Change.ContactID)
+	assert.Equal(t, store.ActionDelete, claimed[0].Change.Action)
+
+	// Claimed deliveries are leased.
+	claimed2, err := s.ClaimDeliveries(now.Add(time.Second), time.Minute, 10)
+	require.Nil(t, err)
+	assert.Len(t, claimed2, 0)
+
+	d := claimed[0]
+	d.Status, d.Attempts, d.LastStatus = store.DeliveryDelivered, 1, 204
+	require.Nil(t, s.UpdateDelivery(d))
+	claimed, err = s.ClaimDeliveries(now.Add(time.Hour), time.Minute, 10)
+	require.Nil(t, err)
+	assert.Len(t, claimed, 0)
+
+	stored, err := s.GetDelivery(d.ID)
+	require.Nil(t, err)
+	assert.Equal(t, store.DeliveryDelivered, stored.Status)
+	assert.Equal(t, 204, stored.LastStatus)
+
+	deliveries, err := s.FetchDeliveries(&store.DeliveryQuery{Status: store.DeliveryDelivered})
+	require.Nil(t, err)
+	assert.Len(t, deliveries, 1)
+
+	w.URL = "https://example.com/hook"
+	require.Nil(t, s.UpdateWebhook(w))
+	updated, err := s.GetWebhook(w.ID)
+	require.Nil(t, err)
+	assert.Equal(t, w.URL, updated.URL)
+
+	require.Nil(t, s.DeleteWebhook(w.ID))
+	assert.Equal(t, store.ErrNotFound, s.DeleteWebhook(w.ID))
+	_, err = s.GetDelivery(d.ID)
+	assert.Equal(t, store.ErrNotFound, err)
+}
+
+func TestConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) (store.ContactStorer, func()) {
+		s, _, cleanup := openStore(t)
+		return s, cleanup
+	})
+}
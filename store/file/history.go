@@ -0,0 +1,130 @@
+package file
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/ory/workshop-dbg/store"
+	bolt "go.etcd.io/bbolt"
+)
+
+// historyBucket maps sequence numbers to changes. contactHistoryBucket indexes them by contact, its keys are the
+// contact ID, a zero byte and the sequence number, so the changes of a contact are next to each other in order.
+var (
+	historyBucket        = []byte("history")
+	contactHistoryBucket = []byte("contact_history")
+)
+
+func contactHistoryPrefix(id string) []byte {
+	return append([]byte(id), 0)
+}
+
+// record appends a change to the history and queues its deliveries. It is published once tx is committed.
+func (s *FileStore) record(tx *bolt.Tx, action, id string, before, after *store.Contact, now time.Time) error {
+	b := tx.Bucket(historyBucket)
+	seq, err := b.NextSequence()
+	if err != nil {
+		return err
+	}
+
+	c := &store.Change{
+		Seq:       int64(seq),
+		ContactID: id,
+		Action:    action,
+		Before:    before.Clone(),
+		After:     after.Clone(),
+		Actor:     s.actor.Name,
+		RequestID: s.actor.RequestID,
+		Time:      now,
+	}
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+
+	if err := b.Put(itob(seq), data); err != nil {
+		return err
+	} else if err := tx.Bucket(contactHistoryBucket).Put(append(contactHistoryPrefix(id), itob(seq)...), nil); err != nil {
+		return err
+	} else if err := enqueue(tx, c); err != nil {
+		return err
+	}
+
+	tx.OnCommit(func() { s.events.Publish(c) })
+	return nil
+}
+
+// change reads a change from historyBucket.
+func change(data []byte) (*store.Change, error) {
+	var c store.Change
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("Could not read change because %s", err)
+	}
+	return &c, nil
+}
+
+// HistoryContext returns the changes of a contact, oldest first.
+func (s *FileStore) HistoryContext(ctx context.Context, id string) ([]*store.Change, error) {
+	var changes []*store.Change
+	err := s.view(ctx, func(tx *bolt.Tx) error {
+		history := tx.Bucket(historyBucket)
+		prefix := contactHistoryPrefix(id)
+		cur := tx.Bucket(contactHistoryBucket).Cursor()
+		for k, _ := cur.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = cur.Next() {
+			c, err := change(history.Get(k[len(prefix):]))
+			if err != nil {
+				return err
+			}
+			changes = append(changes, c)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	} else if len(changes) == 0 {
+		return nil, store.ErrNotFound
+	}
+	return changes, nil
+}
+
+func (s *FileStore) AuditContext(ctx context.Context, q *store.AuditQuery) ([]*store.Change, error) {
+	q.Normalize()
+
+	changes := []*store.Change{}
+	err := s.view(ctx, func(tx *bolt.Tx) error {
+		after := uint64(0)
+		if q.After > 0 {
+			after = uint64(q.After)
+		}
+
+		cur := tx.Bucket(historyBucket).Cursor()
+		for k, v := cur.Seek(itob(after + 1)); k != nil && len(changes) < q.Limit; k, v = cur.Next() {
+			c, err := change(v)
+			if err != nil {
+				return err
+			} else if q.Matches(c) {
+				changes = append(changes, c)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
+
+// Subscribe streams the changes committed through any store sharing the file.
+func (s *FileStore) Subscribe() (<-chan *store.Change, func(), error) {
+	changes, cancel := s.events.Subscribe()
+	return changes, cancel, nil
+}
+
+func (s *FileStore) WithActor(actor store.Actor) store.ContactStorer {
+	c := *s
+	c.actor = actor
+	return &c
+}
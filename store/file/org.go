@@ -0,0 +1,376 @@
+package file
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ory/workshop-dbg/store"
+	bolt "go.etcd.io/bbolt"
+)
+
+// The buckets of companies and departments, both keyed by ID.
+var (
+	companyBucket    = []byte("companies")
+	departmentBucket = []byte("departments")
+)
+
+// errStop ends iterations early.
+var errStop = errors.New("stop")
+
+func getCompany(b *bolt.Bucket, id string) (*store.Company, error) {
+	data := b.Get([]byte(id))
+	if data == nil {
+		return nil, store.ErrNotFound
+	}
+
+	var c store.Company
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("Could not read company %q because %s", id, err)
+	}
+	return &c, nil
+}
+
+func getDepartment(b *bolt.Bucket, id string) (*store.Department, error) {
+	data := b.Get([]byte(id))
+	if data == nil {
+		return nil, store.ErrNotFound
+	}
+
+	var d store.Department
+	if err := json.Unmarshal(data, &d); err != nil {
+		return nil, fmt.Errorf("Could not read department %q because %s", id, err)
+	}
+	return &d, nil
+}
+
+func putJSON(b *bolt.Bucket, id string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(id), data)
+}
+
+func eachCompany(tx *bolt.Tx, f func(c *store.Company) error) error {
+	b := tx.Bucket(companyBucket)
+	return b.ForEach(func(k, _ []byte) error {
+		c, err := getCompany(b, string(k))
+		if err != nil {
+			return err
+		}
+		return f(c)
+	})
+}
+
+func eachDepartment(tx *bolt.Tx, f func(d *store.Department) error) error {
+	b := tx.Bucket(departmentBucket)
+	return b.ForEach(func(k, _ []byte) error {
+		d, err := getDepartment(b, string(k))
+		if err != nil {
+			return err
+		}
+		return f(d)
+	})
+}
+
+func (s *FileStore) CreateCompanyContext(ctx context.Context, c *store.Company) error {
+	if err := c.Validate(); err != nil {
+		return err
+	}
+
+	return s.update(ctx, func(tx *bolt.Tx) error {
+		b := tx.Bucket(companyBucket)
+		if c.ID == "" {
+			c.ID = store.NewID()
+		} else if b.Get([]byte(c.ID)) != nil {
+			return store.ErrAlreadyExists
+		}
+		if err := companyNamed(tx, c); err != nil {
+			return err
+		}
+
+		c.CreatedAt = time.Now().UTC()
+		return putJSON(b, c.ID, c)
+	})
+}
+
+func (s *FileStore) GetCompanyContext(ctx context.Context, id string) (*store.Company, error) {
+	var c *store.Company
+	err := s.view(ctx, func(tx *bolt.Tx) error {
+		var err error
+		c, err = getCompany(tx.Bucket(companyBucket), id)
+		return err
+	})
+	return c, err
+}
+
+func (s *FileStore) FetchCompaniesContext(ctx context.Context) ([]*store.Company, error) {
+	cs := []*store.Company{}
+	err := s.view(ctx, func(tx *bolt.Tx) error {
+		return eachCompany(tx, func(c *store.Company) error {
+			cs = append(cs, c)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	store.SortCompanies(cs)
+	return cs, nil
+}
+
+func (s *FileStore) UpdateCompanyContext(ctx context.Context, c *store.Company) error {
+	if err := c.Validate(); err != nil {
+		return err
+	}
+
+	return s.update(ctx, func(tx *bolt.Tx) error {
+		b := tx.Bucket(companyBucket)
+		current, err := getCompany(b, c.ID)
+		if err != nil {
+			return err
+		} else if err := companyNamed(tx, c); err != nil {
+			return err
+		}
+
+		c.CreatedAt = current.CreatedAt
+		if err := putJSON(b, c.ID, c); err != nil {
+			return err
+		}
+		return s.syncContacts(tx, func(contact *store.Contact) bool { return contact.CompanyID == c.ID })
+	})
+}
+
+func (s *FileStore) DeleteCompanyContext(ctx context.Context, id string) error {
+	return s.update(ctx, func(tx *bolt.Tx) error {
+		b := tx.Bucket(companyBucket)
+		if b.Get([]byte(id)) == nil {
+			return store.ErrNotFound
+		}
+
+		if err := eachDepartment(tx, func(d *store.Department) error {
+			if d.CompanyID == id {
+				return store.ErrCompanyInUse
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		if used, err := referenced(tx, func(c *store.Contact) bool { return c.CompanyID == id }); err != nil {
+			return err
+		} else if used {
+			return store.ErrCompanyInUse
+		}
+		return b.Delete([]byte(id))
+	})
+}
+
+// companyNamed returns ErrAlreadyExists if another company is named like c.
+func companyNamed(tx *bolt.Tx, c *store.Company) error {
+	return eachCompany(tx, func(other *store.Company) error {
+		if other.ID != c.ID && store.SameName(other.Name, c.Name) {
+			return store.ErrAlreadyExists
+		}
+		return nil
+	})
+}
+
+func (s *FileStore) CreateDepartmentContext(ctx context.Context, d *store.Department) error {
+	if err := d.Validate(); err != nil {
+		return err
+	}
+
+	return s.update(ctx, func(tx *bolt.Tx) error {
+		if tx.Bucket(companyBucket).Get([]byte(d.CompanyID)) == nil {
+			return store.ErrNotFound
+		}
+
+		b := tx.Bucket(departmentBucket)
+		if d.ID == "" {
+			d.ID = store.NewID()
+		} else if b.Get([]byte(d.ID)) != nil {
+			return store.ErrAlreadyExists
+		}
+		if err := departmentNamed(tx, d); err != nil {
+			return err
+		}
+
+		d.CreatedAt = time.Now().UTC()
+		return putJSON(b, d.ID, d)
+	})
+}
+
+func (s *FileStore) GetDepartmentContext(ctx context.Context, id string) (*store.Department, error) {
+	var d *store.Department
+	err := s.view(ctx, func(tx *bolt.Tx) error {
+		var err error
+		d, err = getDepartment(tx.Bucket(departmentBucket), id)
+		return err
+	})
+	return d, err
+}
+
+func (s *FileStore) FetchDepartmentsContext(ctx context.Context, companyID string) ([]*store.Department, error) {
+	ds := []*store.Department{}
+	err := s.view(ctx, func(tx *bolt.Tx) error {
+		if tx.Bucket(companyBucket).Get([]byte(companyID)) == nil {
+			return store.ErrNotFound
+		}
+		return eachDepartment(tx, func(d *store.Department) error {
+			if d.CompanyID == companyID {
+				ds = append(ds, d)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	store.SortDepartments(ds)
+	return ds, nil
+}
+
+func (s *FileStore) UpdateDepartmentContext(ctx context.Context, d *store.Department) error {
+	return s.update(ctx, func(tx *bolt.Tx) error {
+		b := tx.Bucket(departmentBucket)
+		current, err := getDepartment(b, d.ID)
+		if err != nil {
+			return err
+		}
+
+		d.CompanyID = current.CompanyID
+		if err := d.Validate(); err != nil {
+			return err
+		} else if err := departmentNamed(tx, d); err != nil {
+			return err
+		}
+
+		d.CreatedAt = current.CreatedAt
+		if err := putJSON(b, d.ID, d); err != nil {
+			return err
+		}
+		return s.syncContacts(tx, func(c *store.Contact) bool { return c.DepartmentID == d.ID })
+	})
+}
+
+func (s *FileStore) DeleteDepartmentContext(ctx context.Context, id string) error {
+	return s.update(ctx, func(tx *bolt.Tx) error {
+		b := tx.Bucket(departmentBucket)
+		if b.Get([]byte(id)) == nil {
+			return store.ErrNotFound
+		}
+		if used, err := referenced(tx, func(c *store.Contact) bool { return c.DepartmentID == id }); err != nil {
+			return err
+		} else if used {
+			return store.ErrDepartmentInUse
+		}
+		return b.Delete([]byte(id))
+	})
+}
+
+// departmentNamed returns ErrAlreadyExists if another department of d's company is named like d.
+func departmentNamed(tx *bolt.Tx, d *store.Department) error {
+	return eachDepartment(tx, func(other *store.Department) error {
+		if other.ID != d.ID && other.CompanyID == d.CompanyID && store.SameName(other.Name, d.Name) {
+			return store.ErrAlreadyExists
+		}
+		return nil
+	})
+}
+
+// referenced returns true if f is true for any contact, including those in the trash.
+func referenced(tx *bolt.Tx, f func(c *store.Contact) bool) (bool, error) {
+	for _, name := range [][]byte{contactBucket, trashBucket} {
+		if err := each(tx.Bucket(name), func(c *store.Contact) error {
+			if f(c) {
+				return errStop
+			}
+			return nil
+		}); err == errStop {
+			return true, nil
+		} else if err != nil {
+			return false, err
+		}
+	}
+	return false, nil
+}
+
+// syncNames sets the company and department names of c to those of the referenced company and department, see
+// store.CheckReferences.
+func syncNames(tx *bolt.Tx, c *store.Contact) error {
+	if c.CompanyID != "" {
+		c.Company = ""
+	}
+	if c.DepartmentID != "" {
+		c.Department = ""
+	}
+	return checkReferences(tx, c)
+}
+
+// syncContacts updates the names of the contacts matching f after a rename, see syncNames, and records the updates.
+// Contacts in the trash are synced once they are restored.
+func (s *FileStore) syncContacts(tx *bolt.Tx, f func(c *store.Contact) bool) error {
+	// The bucket can not be written while iterating over it.
+	var due []*store.Contact
+	if err := each(tx.Bucket(contactBucket), func(c *store.Contact) error {
+		if f(c) {
+			due = append(due, c)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	for _, before := range due {
+		c := before.Clone()
+		if err := syncNames(tx, c); err != nil {
+			return err
+		} else if c.Company == before.Company && c.Department == before.Department {
+			continue
+		}
+
+		c.Version = before.Version + 1
+		if err := s.write(tx, store.ActionUpdate, before, c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkManager checks the manager of c, see store.CheckManager. Managers created by batch count as well, if it is
+// set.
+func checkManager(tx *bolt.Tx, c *store.Contact, batch *store.ImportBatch) error {
+	return store.CheckManager(c, func(id string) bool {
+		return tx.Bucket(contactBucket).Get([]byte(id)) != nil || batch.Contains(id)
+	})
+}
+
+// checkReferences checks the company and department of c, see store.CheckReferences.
+func checkReferences(tx *bolt.Tx, c *store.Contact) error {
+	var failed error
+	lookup := func(err error) {
+		if err != nil && err != store.ErrNotFound {
+			failed = err
+		}
+	}
+
+	err := store.CheckReferences(c,
+		func(id string) *store.Company {
+			company, err := getCompany(tx.Bucket(companyBucket), id)
+			lookup(err)
+			return company
+		},
+		func(id string) *store.Department {
+			d, err := getDepartment(tx.Bucket(departmentBucket), id)
+			lookup(err)
+			return d
+		},
+	)
+	if failed != nil {
+		return failed
+	}
+	return err
+}
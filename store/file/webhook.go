@@ -0,0 +1,278 @@
+package file
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/ory/workshop-dbg/store"
+	bolt "go.etcd.io/bbolt"
+)
+
+// deliveryBucket maps delivery IDs to deliveries. pendingBucket holds the IDs of the pending ones, so claiming does
+// not scan the whole delivery log.
+var (
+	webhookBucket  = []byte("webhooks")
+	deliveryBucket = []byte("deliveries")
+	pendingBucket  = []byte("pending_deliveries")
+)
+
+func getWebhook(b *bolt.Bucket, id string) (*store.Webhook, error) {
+	data := b.Get([]byte(id))
+	if data == nil {
+		return nil, store.ErrNotFound
+	}
+
+	var w store.Webhook
+	if err := json.Unmarshal(data, &w); err != nil {
+		return nil, fmt.Errorf("Could not read webhook %q because %s", id, err)
+	}
+	if w.Events == nil {
+		w.Events = []string{}
+	}
+	return &w, nil
+}
+
+func putWebhook(b *bolt.Bucket, w *store.Webhook) error {
+	data, err := json.Marshal(w)
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(w.ID), data)
+}
+
+func getDelivery(b *bolt.Bucket, id int64) (*store.Delivery, error) {
+	data := b.Get(itob(uint64(id)))
+	if data == nil {
+		return nil, store.ErrNotFound
+	}
+	return delivery(data)
+}
+
+func delivery(data []byte) (*store.Delivery, error) {
+	var d store.Delivery
+	if err := json.Unmarshal(data, &d); err != nil {
+		return nil, fmt.Errorf("Could not read delivery because %s", err)
+	}
+	return &d, nil
+}
+
+func putDelivery(tx *bolt.Tx, d *store.Delivery) error {
+	data, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+
+	key := itob(uint64(d.ID))
+	if err := tx.Bucket(deliveryBucket).Put(key, data); err != nil {
+		return err
+	} else if d.Status == store.DeliveryPending {
+		return tx.Bucket(pendingBucket).Put(key, nil)
+	}
+	return tx.Bucket(pendingBucket).Delete(key)
+}
+
+func (s *FileStore) CreateWebhook(w *store.Webhook) error {
+	if err := w.Validate(); err != nil {
+		return err
+	}
+
+	return s.update(context.Background(), func(tx *bolt.Tx) error {
+		b := tx.Bucket(webhookBucket)
+		if w.ID == "" {
+			w.ID = store.NewID()
+		} else if b.Get([]byte(w.ID)) != nil {
+			return store.ErrAlreadyExists
+		}
+
+		w.CreatedAt = time.Now().UTC()
+		return putWebhook(b, w)
+	})
+}
+
+func (s *FileStore) GetWebhook(id string) (*store.Webhook, error) {
+	var w *store.Webhook
+	err := s.view(context.Background(), func(tx *bolt.Tx) error {
+		var err error
+		w, err = getWebhook(tx.Bucket(webhookBucket), id)
+		return err
+	})
+	return w, err
+}
+
+// FetchWebhooks returns the webhooks ordered by creation time.
+func (s *FileStore) FetchWebhooks() ([]*store.Webhook, error) {
+	ws := []*store.Webhook{}
+	err := s.view(context.Background(), func(tx *bolt.Tx) error {
+		b := tx.Bucket(webhookBucket)
+		return b.ForEach(func(k, _ []byte) error {
+			w, err := getWebhook(b, string(k))
+			if err != nil {
+				return err
+			}
+			ws = append(ws, w)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(ws, func(i, j int) bool { return ws[i].CreatedAt.Before(ws[j].CreatedAt) })
+	return ws, nil
+}
+
+func (s *FileStore) UpdateWebhook(w *store.Webhook) error {
+	if err := w.Validate(); err != nil {
+		return err
+	}
+
+	return s.update(context.Background(), func(tx *bolt.Tx) error {
+		b := tx.Bucket(webhookBucket)
+		current, err := getWebhook(b, w.ID)
+		if err != nil {
+			return err
+		}
+
+		w.CreatedAt = current.CreatedAt
+		return putWebhook(b, w)
+	})
+}
+
+func (s *FileStore) DeleteWebhook(id string) error {
+	return s.update(context.Background(), func(tx *bolt.Tx) error {
+		b := tx.Bucket(webhookBucket)
+		if b.Get([]byte(id)) == nil {
+			return store.ErrNotFound
+		} else if err := b.Delete([]byte(id)); err != nil {
+			return err
+		}
+
+		// Keys must not be deleted while iterating, so they are collected first.
+		var keys [][]byte
+		deliveries := tx.Bucket(deliveryBucket)
+		if err := deliveries.ForEach(func(k, v []byte) error {
+			d, err := delivery(v)
+			if err != nil {
+				return err
+			} else if d.WebhookID == id {
+				keys = append(keys, k)
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		for _, k := range keys {
+			if err := deliveries.Delete(k); err != nil {
+				return err
+			} else if err := tx.Bucket(pendingBucket).Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// enqueue queues a delivery of c for every webhook receiving it.
+func enqueue(tx *bolt.Tx, c *store.Change) error {
+	deliveries := tx.Bucket(deliveryBucket)
+	webhooks := tx.Bucket(webhookBucket)
+	return webhooks.ForEach(func(k, _ []byte) error {
+		w, err := getWebhook(webhooks, string(k))
+		if err != nil || !w.Receives(c.Action) {
+			return err
+		}
+
+		id, err := deliveries.NextSequence()
+		if err != nil {
+			return err
+		}
+		return putDelivery(tx, &store.Delivery{
+			ID:          int64(id),
+			WebhookID:   w.ID,
+			Change:      c,
+			Status:      store.DeliveryPending,
+			NextAttempt: c.Time,
+			CreatedAt:   c.Time,
+			UpdatedAt:   c.Time,
+		})
+	})
+}
+
+func (s *FileStore) ClaimDeliveries(now time.Time, lease time.Duration, limit int) ([]*store.Delivery, error) {
+	var claimed []*store.Delivery
+	err := s.update(context.Background(), func(tx *bolt.Tx) error {
+		deliveries := tx.Bucket(deliveryBucket)
+		var due []*store.Delivery
+		cur := tx.Bucket(pendingBucket).Cursor()
+		for k, _ := cur.First(); k != nil && len(due) < limit; k, _ = cur.Next() {
+			d, err := delivery(deliveries.Get(k))
+			if err != nil {
+				return err
+			} else if !d.NextAttempt.After(now) {
+				due = append(due, d)
+			}
+		}
+
+		for _, d := range due {
+			d.NextAttempt = now.Add(lease)
+			if err := putDelivery(tx, d); err != nil {
+				return err
+			}
+		}
+		claimed = due
+		return nil
+	})
+	return claimed, err
+}
+
+// UpdateDelivery stores the status, attempts, next attempt and the outcome of the last attempt.
+func (s *FileStore) UpdateDelivery(d *store.Delivery) error {
+	return s.update(context.Background(), func(tx *bolt.Tx) error {
+		current, err := getDelivery(tx.Bucket(deliveryBucket), d.ID)
+		if err != nil {
+			return err
+		}
+
+		current.Status, current.Attempts, current.NextAttempt = d.Status, d.Attempts, d.NextAttempt
+		current.LastStatus, current.LastError = d.LastStatus, d.LastError
+		current.UpdatedAt = time.Now().UTC()
+		d.UpdatedAt = current.UpdatedAt
+		return putDelivery(tx, current)
+	})
+}
+
+func (s *FileStore) GetDelivery(id int64) (*store.Delivery, error) {
+	var d *store.Delivery
+	err := s.view(context.Background(), func(tx *bolt.Tx) error {
+		var err error
+		d, err = getDelivery(tx.Bucket(deliveryBucket), id)
+		return err
+	})
+	return d, err
+}
+
+func (s *FileStore) FetchDeliveries(q *store.DeliveryQuery) ([]*store.Delivery, error) {
+	q.Normalize()
+
+	ds := []*store.Delivery{}
+	err := s.view(context.Background(), func(tx *bolt.Tx) error {
+		cur := tx.Bucket(deliveryBucket).Cursor()
+		for k, v := cur.Last(); k != nil && len(ds) < q.Limit; k, v = cur.Prev() {
+			d, err := delivery(v)
+			if err != nil {
+				return err
+			} else if q.Matches(d) {
+				ds = append(ds, d)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ds, nil
+}
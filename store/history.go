@@ -0,0 +1,75 @@
+package store
+
+import "time"
+
+// The actions recorded in the history.
+const (
+	ActionCreate  = "create"
+	ActionUpdate  = "update"
+	ActionDelete  = "delete"
+	ActionRestore = "restore"
+	ActionPurge   = "purge"
+)
+
+// Actor tells who made a change. Stores returned by ContactStorer.WithActor record it with every change.
+type Actor struct {
+	// Name identifies the user or system making the change.
+	Name string
+
+	// RequestID identifies the request which caused the change.
+	RequestID string
+}
+
+// Change is an immutable record of a single write to a contact.
+type Change struct {
+	// Seq orders the changes of a store. It increases with every change, but may have gaps.
+	Seq int64 `json:"seq"`
+
+	ContactID string `json:"contact_id"`
+	Action    string `json:"action"`
+
+	// Before and After are snapshots of the contact. Before is nil for creates and After for purges.
+	Before *Contact `json:"before,omitempty"`
+	After  *Contact `json:"after,omitempty"`
+
+	Actor     string    `json:"actor,omitempty"`
+	RequestID string    `json:"request_id,omitempty"`
+	Time      time.Time `json:"time"`
+}
+
+// Clone returns a deep copy of the change.
+func (c *Change) Clone() *Change {
+	clone := *c
+	clone.Before, clone.After = c.Before.Clone(), c.After.Clone()
+	return &clone
+}
+
+// AuditQuery selects changes of all contacts.
+type AuditQuery struct {
+	// Since and Until limit the changes to the ones made in [Since, Until). Zero values do not limit.
+	Since time.Time
+	Until time.Time
+
+	// After selects the changes following the one with this Seq, for paging through the log. The changes are ordered
+	// by Seq, except for PostgreSQL, which orders them by transaction.
+	After int64
+
+	// Limit is the maximum number of changes returned. It defaults to DefaultLimit and is capped at MaxLimit.
+	Limit int
+}
+
+// Normalize applies the default limit.
+func (q *AuditQuery) Normalize() {
+	if q.Limit <= 0 {
+		q.Limit = DefaultLimit
+	} else if q.Limit > MaxLimit {
+		q.Limit = MaxLimit
+	}
+}
+
+// Matches returns true if c is selected by the query, ignoring the limit.
+func (q *AuditQuery) Matches(c *Change) bool {
+	return c.Seq > q.After &&
+		(q.Since.IsZero() || !c.Time.Before(q.Since)) &&
+		(q.Until.IsZero() || c.Time.Before(q.Until))
+}
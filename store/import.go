@@ -0,0 +1,158 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// ContactReader reads contacts one by one, for example from an uploaded file. Read returns io.EOF when there are
+// no more contacts. Errors wrapping ErrValidation only affect the current row and reading may continue, all other
+// errors are fatal.
+type ContactReader interface {
+	Read() (*Contact, error)
+}
+
+// Importer is implemented by stores which can import contacts atomically: either all contacts are created or none.
+type Importer interface {
+	// ImportContacts creates all contacts read from r in a single transaction. If any row is invalid or its ID is
+	// taken, nothing is imported and the report lists all failed rows. Contacts may be managed by contacts created
+	// in a later row.
+	ImportContacts(r ContactReader) (*ImportReport, error)
+}
+
+// ImportReport summarizes an import.
+type ImportReport struct {
+	// Rows is the number of rows read.
+	Rows int `json:"rows"`
+
+	// Imported is the number of contacts created.
+	Imported int `json:"imported"`
+
+	// Errors lists the rows which could not be imported, ordered by row.
+	Errors []*RowError `json:"errors,omitempty"`
+}
+
+// RowError tells why a row could not be imported. Rows are counted from 1 and do not include headers.
+type RowError struct {
+	Row     int          `json:"row"`
+	ID      string       `json:"id,omitempty"`
+	Message string       `json:"message"`
+	Fields  []FieldError `json:"fields,omitempty"`
+}
+
+// AddError records that row failed with err and returns true, unless err is not specific to the row. In that case
+// the import must be aborted and false is returned. c may be nil if the row could not be read.
+func (r *ImportReport) AddError(row int, c *Contact, err error) bool {
+	if !errors.Is(err, ErrValidation) && !errors.Is(err, ErrAlreadyExists) {
+		return false
+	}
+
+	e := &RowError{Row: row, Message: err.Error()}
+	if c != nil {
+		e.ID = c.ID
+	}
+
+	var v *ValidationError
+	if errors.As(err, &v) {
+		e.Fields = v.Fields
+	}
+
+	r.Errors = append(r.Errors, e)
+	return true
+}
+
+// ImportBatch holds the contacts of an atomic import until they are created, for stores which can not stream them.
+type ImportBatch struct {
+	// Report lists the rows which failed so far.
+	Report *ImportReport
+
+	// Contacts are the valid contacts in the order they were read. All of them have an ID.
+	Contacts []*Contact
+
+	// rows maps the ID of a contact to its row.
+	rows map[string]int
+}
+
+// ReadImportBatch reads all contacts from r and validates them. Invalid rows and IDs used by more than one row are
+// listed in the report, contacts without an ID get a new one. The error is only set if reading failed.
+func ReadImportBatch(r ContactReader) (*ImportBatch, error) {
+	b := &ImportBatch{Report: new(ImportReport), rows: map[string]int{}}
+	for {
+		c, err := r.Read()
+		if err == io.EOF {
+			return b, nil
+		}
+
+		b.Report.Rows++
+		if err == nil {
+			err = c.Validate()
+		}
+		if err == nil && b.rows[c.ID] != 0 {
+			err = fmt.Errorf("%w: The ID is already used in row %d", ErrAlreadyExists, b.rows[c.ID])
+		}
+
+		if err != nil {
+			if !b.Report.AddError(b.Report.Rows, c, err) {
+				return b, err
+			}
+			continue
+		}
+
+		if c.ID == "" {
+			c.ID = NewID()
+		}
+		b.rows[c.ID] = b.Report.Rows
+		b.Contacts = append(b.Contacts, c)
+	}
+}
+
+// Contains returns true if the batch creates a contact with the given ID. It may be called on a nil batch.
+func (b *ImportBatch) Contains(id string) bool {
+	return b != nil && b.rows[id] != 0
+}
+
+// Check calls check for every contact and lists the ones it fails for in the report, ordered by row. The batch may
+// only be imported if the report has no errors afterwards. Errors which are not specific to a row abort the check
+// and are returned.
+func (b *ImportBatch) Check(check func(c *Contact) error) error {
+	for _, c := range b.Contacts {
+		if err := check(c); err != nil && !b.Report.AddError(b.rows[c.ID], c, err) {
+			return err
+		}
+	}
+	sort.Slice(b.Report.Errors, func(i, j int) bool { return b.Report.Errors[i].Row < b.Report.Errors[j].Row })
+	return nil
+}
+
+// Import creates the contacts read from r. Unless atomic is set, invalid rows and rows whose ID is taken are
+// skipped and listed in the report. Atomic imports require a store implementing Importer.
+func Import(s ContactStorer, r ContactReader, atomic bool) (*ImportReport, error) {
+	if atomic {
+		importer, ok := s.(Importer)
+		if !ok {
+			return nil, fmt.Errorf("%w: The store does not support atomic imports", ErrValidation)
+		}
+		return importer.ImportContacts(r)
+	}
+
+	report := new(ImportReport)
+	for {
+		c, err := r.Read()
+		if err == io.EOF {
+			return report, nil
+		}
+
+		report.Rows++
+		if err == nil {
+			err = s.CreateContact(c)
+		}
+
+		if err == nil {
+			report.Imported++
+		} else if !report.AddError(report.Rows, c, err) {
+			return report, err
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package memory
+
+import (
+	"context"
+	"time"
+
+	"github.com/ory/workshop-dbg/store"
+)
+
+// DefaultHistorySize is the number of changes an InMemoryStore keeps unless HistorySize is set.
+const DefaultHistorySize = 10000
+
+// history is a ring buffer of the latest changes. Once it is full, the oldest change is dropped for every new one.
+// A history without a size is never full, which is how transactions stage their changes.
+type history struct {
+	changes []*store.Change
+	size    int
+
+	// start is the index of the oldest change once the buffer is full.
+	start int
+
+	// seq is the sequence number of the latest change.
+	seq int64
+}
+
+func newHistory(size int) *history {
+	if size <= 0 {
+		size = DefaultHistorySize
+	}
+	return &history{size: size}
+}
+
+func (h *history) append(c *store.Change) {
+	h.seq++
+	c.Seq = h.seq
+	if h.size == 0 || len(h.changes) < h.size {
+		h.changes = append(h.changes, c)
+		return
+	}
+	h.changes[h.start] = c
+	h.start = (h.start + 1) % h.size
+}
+
+// each calls f for every change, oldest first, until f returns false.
+func (h *history) each(f func(c *store.Change) bool) {
+	if h == nil {
+		return
+	}
+	for i := range h.changes {
+		if !f(h.changes[(h.start+i)%len(h.changes)]) {
+			return
+		}
+	}
+}
+
+// record adds a change to the history. The caller must hold the write lock.
+func (s *InMemoryStore) record(action, id string, before, after *store.Contact, actor store.Actor) {
+	s.appendChange(&store.Change{
+		ContactID: id,
+		Action:    action,
+		Before:    snapshot(id, before),
+		After:     snapshot(id, after),
+		Actor:     actor.Name,
+		RequestID: actor.RequestID,
+		Time:      s.modified,
+	})
+}
+
+func (s *InMemoryStore) appendChange(c *store.Change) {
+	if s.history == nil {
+		s.history = newHistory(s.HistorySize)
+	}
+	s.history.append(c)
+	s.enqueue(c)
+	s.broker.Publish(c.Clone())
+}
+
+// snapshot copies a contact for the history. Contacts are stored without their ID, so it is filled in.
+func snapshot(id string, c *store.Contact) *store.Contact {
+	if c == nil {
+		return nil
+	}
+	c = c.Clone()
+	c.ID = id
+	return c
+}
+
+// History returns the changes of a contact which are still kept, oldest first.
+func (s *InMemoryStore) History(id string) ([]*store.Change, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var changes []*store.Change
+	s.history.each(func(c *store.Change) bool {
+		if c.ContactID == id {
+			changes = append(changes, c.Clone())
+		}
+		return true
+	})
+	if len(changes) == 0 {
+		return nil, store.ErrNotFound
+	}
+	return changes, nil
+}
+
+func (s *InMemoryStore) Audit(q *store.AuditQuery) ([]*store.Change, error) {
+	q.Normalize()
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	changes := []*store.Change{}
+	s.history.each(func(c *store.Change) bool {
+		if q.Matches(c) {
+			changes = append(changes, c.Clone())
+		}
+		return len(changes) < q.Limit
+	})
+	return changes, nil
+}
+
+func (s *InMemoryStore) Subscribe() (<-chan *store.Change, func(), error) {
+	changes, cancel := s.broker.Subscribe()
+	return changes, cancel, nil
+}
+
+func (s *InMemoryStore) WithActor(actor store.Actor) store.ContactStorer {
+	return &actorStore{InMemoryStore: s, actor: actor}
+}
+
+// WithContext returns the store itself. It never waits for anything but its lock, so there is nothing to cancel.
+func (s *InMemoryStore) WithContext(ctx context.Context) store.ContactStorer {
+	return s
+}
+
+// actorStore records its actor with every change it makes to the underlying store.
+type actorStore struct {
+	*InMemoryStore
+	actor store.Actor
+}
+
+func (s *actorStore) CreateContact(c *store.Contact) error {
+	return s.createContact(c, s.actor)
+}
+
+func (s *actorStore) UpdateContact(c *store.Contact) error {
+	return s.updateContact(c, s.actor)
+}
+
+func (s *actorStore) PatchContact(id string, version int, patch func(*store.Contact) error) (*store.Contact, error) {
+	return s.patchContact(id, version, patch, s.actor)
+}
+
+func (s *actorStore) DeleteContact(id string, version int) error {
+	return s.deleteContact(id, version, s.actor)
+}
+
+func (s *actorStore) RestoreContact(id string) (*store.Contact, error) {
+	return s.restoreContact(id, s.actor)
+}
+
+func (s *actorStore) PurgeContacts(deletedBefore time.Time) (int, error) {
+	return s.purgeContacts(deletedBefore, s.actor)
+}
+
+func (s *actorStore) ImportContacts(r store.ContactReader) (*store.ImportReport, error) {
+	return s.importContacts(r, s.actor)
+}
+
+func (s *actorStore) UpdateCompany(c *store.Company) error {
+	return s.updateCompany(c, s.actor)
+}
+
+func (s *actorStore) UpdateDepartment(d *store.Department) error {
+	return s.updateDepartment(d, s.actor)
+}
+
+func (s *actorStore) WithTx(f func(tx store.ContactStorer) error) error {
+	return s.withTx(f, s.actor)
+}
+
+func (s *actorStore) WithContext(ctx context.Context) store.ContactStorer {
+	return s
+}
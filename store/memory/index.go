@@ -0,0 +1,118 @@
+package memory
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/ory/workshop-dbg/store"
+)
+
+// Matches in a contact's name weigh more than matches in its department or company.
+const (
+	nameWeight  = 3
+	otherWeight = 1
+)
+
+// index is an inverted index mapping folded words to the IDs of the contacts containing them.
+type index struct {
+	// words maps a word to the contacts containing it and the weight of the field it was found in.
+	words map[string]map[string]int
+
+	// sorted holds the keys of words in order, so the words a token is a prefix of are found by binary search.
+	sorted []string
+
+	// docs maps a contact ID to the words indexed for it, so they can be removed again.
+	docs map[string][]string
+}
+
+func newIndex() *index {
+	return &index{words: map[string]map[string]int{}, docs: map[string][]string{}}
+}
+
+func (i *index) add(id string, c *store.Contact) {
+	i.remove(id)
+
+	weights := map[string]int{}
+	for _, f := range []struct {
+		text   string
+		weight int
+	}{
+		{text: c.Name, weight: nameWeight},
+		{text: c.Department, weight: otherWeight},
+		{text: c.Company, weight: otherWeight},
+	} {
+		for _, w := range store.IndexWords(f.text) {
+			if f.weight > weights[w] {
+				weights[w] = f.weight
+			}
+		}
+	}
+
+	for w, weight := range weights {
+		if i.words[w] == nil {
+			i.words[w] = map[string]int{}
+			i.insertWord(w)
+		}
+		i.words[w][id] = weight
+		i.docs[id] = append(i.docs[id], w)
+	}
+}
+
+func (i *index) remove(id string) {
+	for _, w := range i.docs[id] {
+		delete(i.words[w], id)
+		if len(i.words[w]) == 0 {
+			delete(i.words, w)
+			i.removeWord(w)
+		}
+	}
+	delete(i.docs, id)
+}
+
+func (i *index) insertWord(w string) {
+	k := sort.SearchStrings(i.sorted, w)
+	i.sorted = append(i.sorted, "")
+	copy(i.sorted[k+1:], i.sorted[k:])
+	i.sorted[k] = w
+}
+
+func (i *index) removeWord(w string) {
+	if k := sort.SearchStrings(i.sorted, w); k < len(i.sorted) && i.sorted[k] == w {
+		i.sorted = append(i.sorted[:k], i.sorted[k+1:]...)
+	}
+}
+
+// search returns the score of every contact matching all tokens. A token matches words it is a prefix of, exact
+// matches score twice as high.
+func (i *index) search(tokens []string) map[string]int {
+	var scores map[string]int
+	for _, t := range tokens {
+		matches := map[string]int{}
+		// The words starting with t follow each other in sorted, beginning with the first one not less than t.
+		for k := sort.SearchStrings(i.sorted, t); k < len(i.sorted) && strings.HasPrefix(i.sorted[k], t); k++ {
+			w, ids := i.sorted[k], i.words[i.sorted[k]]
+			factor := 1
+			if w == t {
+				factor = 2
+			}
+			for id, weight := range ids {
+				if score := weight * factor; score > matches[id] {
+					matches[id] = score
+				}
+			}
+		}
+
+		if scores == nil {
+			scores = matches
+			continue
+		}
+		for id := range scores {
+			if score, ok := matches[id]; ok {
+				scores[id] += score
+			} else {
+				delete(scores, id)
+			}
+		}
+	}
+	return scores
+}
@@ -1,37 +1,522 @@
 package memory
 
 import (
-	"errors"
+	"sort"
+	"sync"
+	"time"
+
 	"github.com/ory/workshop-dbg/store"
 )
 
+// InMemoryStore keeps contacts in a map. It is safe for concurrent use. Contacts passed in and handed out
+// are copied, so callers never share state with the store.
 type InMemoryStore struct {
 	Contacts store.Contacts
+
+	// Companies and Departments are keyed by ID, see OrgStorer. Contacts may only reference existing ones.
+	Companies   map[string]*store.Company
+	Departments map[string]*store.Department
+
+	// HistorySize is the number of changes kept in the history. It defaults to DefaultHistorySize.
+	HistorySize int
+
+	// trash holds the deleted contacts until they are purged.
+	trash store.Contacts
+
+	mu       sync.RWMutex
+	revision uint64
+	modified time.Time
+
+	// index is built on the first search and kept up to date afterwards.
+	index *index
+
+	history *history
+	broker  store.Broker
+
+	// deliveries are ordered by ID, see WebhookStorer.
+	webhooks    map[string]*store.Webhook
+	deliveries  []*store.Delivery
+	deliverySeq int64
 }
 
 func (s *InMemoryStore) FetchContacts() (store.Contacts, error) {
-	return s.Contacts, nil
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	cs := make(store.Contacts, len(s.Contacts))
+	for id, c := range s.Contacts {
+		cs[id] = c.Clone()
+	}
+	return cs, nil
+}
+
+func (s *InMemoryStore) QueryContacts(q *store.Query) (*store.Page, error) {
+	cursor, err := q.Normalize()
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var cs []*store.Contact
+	lists := []store.Contacts{s.Contacts}
+	if q.IncludeDeleted {
+		lists = append(lists, s.trash)
+	}
+	for _, list := range lists {
+		for id, c := range list {
+			if !q.Matches(c) {
+				continue
+			}
+
+			c = c.Clone()
+			if c.ID == "" {
+				c.ID = id
+			}
+			cs = append(cs, c)
+		}
+	}
+	return store.Paginate(cs, q, cursor), nil
+}
+
+func (s *InMemoryStore) SearchContacts(query string, limit int) ([]*store.Contact, error) {
+	tokens, limit, err := store.NormalizeSearch(query, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	s.buildIndex()
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	scores := s.index.search(tokens)
+	cs := make([]*store.Contact, 0, len(scores))
+	for id := range scores {
+		c := s.Contacts[id].Clone()
+		c.ID = id
+		cs = append(cs, c)
+	}
+
+	sort.Slice(cs, func(i, j int) bool {
+		if si, sj := scores[cs[i].ID], scores[cs[j].ID]; si != sj {
+			return si > sj
+		} else if cs[i].Name != cs[j].Name {
+			return cs[i].Name < cs[j].Name
+		}
+		return cs[i].ID < cs[j].ID
+	})
+
+	if len(cs) > limit {
+		cs = cs[:limit]
+	}
+	return cs, nil
+}
+
+// buildIndex creates the search index unless it exists already.
+func (s *InMemoryStore) buildIndex() {
+	s.mu.RLock()
+	built := s.index != nil
+	s.mu.RUnlock()
+	if built {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.index == nil {
+		s.index = newIndex()
+		for id, c := range s.Contacts {
+			s.index.add(id, c)
+		}
+	}
 }
 
 func (s *InMemoryStore) GetContact(id string) (*store.Contact, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
 	if c, ok := s.Contacts[id]; !ok {
-		return nil, errors.New("Not found")
+		return nil, store.ErrNotFound
 	} else {
-		return c, nil
+		return c.Clone(), nil
 	}
 }
 
-func (s *InMemoryStore) DeleteContact(id string) error {
+func (s *InMemoryStore) DeleteContact(id string, version int) error {
+	return s.deleteContact(id, version, store.Actor{})
+}
+
+func (s *InMemoryStore) deleteContact(id string, version int, actor store.Actor) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current, ok := s.Contacts[id]
+	if !ok {
+		return store.ErrNotFound
+	} else if version != 0 && current.Version != version {
+		return store.ErrVersionMismatch
+	}
+
+	c := current.Clone()
+	c.ID = id
+	now := time.Now().UTC()
+	c.DeletedAt = &now
+	if s.trash == nil {
+		s.trash = store.Contacts{}
+	}
+	s.trash[id] = c
+
 	delete(s.Contacts, id)
+	if s.index != nil {
+		s.index.remove(id)
+	}
+	s.touch()
+	s.record(store.ActionDelete, id, current, c, actor)
 	return nil
 }
 
+func (s *InMemoryStore) FetchTrash() ([]*store.Contact, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	cs := make([]*store.Contact, 0, len(s.trash))
+	for _, c := range s.trash {
+		cs = append(cs, c.Clone())
+	}
+	sort.Slice(cs, func(i, j int) bool {
+		if ti, tj := *cs[i].DeletedAt, *cs[j].DeletedAt; !ti.Equal(tj) {
+			return ti.After(tj)
+		}
+		return cs[i].ID < cs[j].ID
+	})
+	return cs, nil
+}
+
+func (s *InMemoryStore) RestoreContact(id string) (*store.Contact, error) {
+	return s.restoreContact(id, store.Actor{})
+}
+
+func (s *InMemoryStore) restoreContact(id string, actor store.Actor) (*store.Contact, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	trashed, ok := s.trash[id]
+	if !ok {
+		return nil, store.ErrNotFound
+	}
+
+	c := trashed.Clone()
+	c.Version++
+	s.syncNames(c)
+	delete(s.trash, id)
+	s.put(c)
+	s.record(store.ActionRestore, id, trashed, c, actor)
+	return c.Clone(), nil
+}
+
+func (s *InMemoryStore) PurgeContacts(deletedBefore time.Time) (int, error) {
+	return s.purgeContacts(deletedBefore, store.Actor{})
+}
+
+func (s *InMemoryStore) purgeContacts(deletedBefore time.Time, actor store.Actor) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var purged []*store.Contact
+	for id, c := range s.trash {
+		if c.DeletedAt.Before(deletedBefore) {
+			delete(s.trash, id)
+			purged = append(purged, c)
+		}
+	}
+	if len(purged) == 0 {
+		return 0, nil
+	}
+
+	s.touch()
+	sort.Slice(purged, func(i, j int) bool { return purged[i].ID < purged[j].ID })
+	for _, c := range purged {
+		s.record(store.ActionPurge, c.ID, c, nil, actor)
+	}
+	return len(purged), nil
+}
+
+// taken returns true if id is used by a contact or by a contact in the trash. The caller must hold the lock.
+func (s *InMemoryStore) taken(id string) bool {
+	_, active := s.Contacts[id]
+	_, trashed := s.trash[id]
+	return active || trashed
+}
+
 func (s *InMemoryStore) CreateContact(c *store.Contact) error {
-	s.Contacts[c.ID] = c
+	return s.createContact(c, store.Actor{})
+}
+
+func (s *InMemoryStore) createContact(c *store.Contact, actor store.Actor) error {
+	if err := c.Validate(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if c.ID == "" {
+		c.ID = store.NewID()
+	} else if s.taken(c.ID) {
+		return store.ErrAlreadyExists
+	}
+	if err := s.checkReferences(c); err != nil {
+		return err
+	} else if err := s.checkManager(c, nil); err != nil {
+		return err
+	}
+
+	c.Version = 1
+	s.put(c)
+	s.record(store.ActionCreate, c.ID, nil, c, actor)
 	return nil
 }
 
 func (s *InMemoryStore) UpdateContact(c *store.Contact) error {
-	s.Contacts[c.ID] = c
+	return s.updateContact(c, store.Actor{})
+}
+
+func (s *InMemoryStore) updateContact(c *store.Contact, actor store.Actor) error {
+	if err := c.Validate(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current, ok := s.Contacts[c.ID]
+	if !ok {
+		return store.ErrNotFound
+	} else if c.Version != 0 && c.Version != current.Version {
+		return store.ErrVersionMismatch
+	} else if err := s.checkReferences(c); err != nil {
+		return err
+	} else if err := s.checkManager(c, nil); err != nil {
+		return err
+	}
+
+	c.Version = current.Version + 1
+	s.put(c)
+	s.record(store.ActionUpdate, c.ID, current, c, actor)
+	return nil
+}
+
+func (s *InMemoryStore) PatchContact(id string, version int, patch func(*store.Contact) error) (*store.Contact, error) {
+	return s.patchContact(id, version, patch, store.Actor{})
+}
+
+func (s *InMemoryStore) patchContact(id string, version int, patch func(*store.Contact) error, actor store.Actor) (*store.Contact, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current, ok := s.Contacts[id]
+	if !ok {
+		return nil, store.ErrNotFound
+	} else if version != 0 && current.Version != version {
+		return nil, store.ErrVersionMismatch
+	}
+
+	c := current.Clone()
+	c.ID = id
+	if err := patch(c); err != nil {
+		return nil, err
+	} else if c.ID != id {
+		return nil, store.ErrIDChanged
+	} else if err := c.Validate(); err != nil {
+		return nil, err
+	} else if err := s.checkReferences(c); err != nil {
+		return nil, err
+	} else if err := s.checkManager(c, nil); err != nil {
+		return nil, err
+	}
+
+	c.Version = current.Version + 1
+	s.put(c)
+	s.record(store.ActionUpdate, id, current, c, actor)
+	return c.Clone(), nil
+}
+
+// put stores a copy of c, which is not in the trash. The caller must hold the write lock.
+func (s *InMemoryStore) put(c *store.Contact) {
+	c.DeletedAt = nil
+	if s.Contacts == nil {
+		s.Contacts = store.Contacts{}
+	}
+	s.Contacts[c.ID] = c.Clone()
+	if s.index != nil {
+		s.index.add(c.ID, c)
+	}
+	s.touch()
+}
+
+// touch records a change. The caller must hold the write lock.
+func (s *InMemoryStore) touch() {
+	s.revision++
+	s.modified = time.Now().UTC()
+}
+
+func (s *InMemoryStore) FetchMeta() (*store.Meta, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return &store.Meta{
+		Count:        len(s.Contacts),
+		Revision:     store.CountedRevision(s.modified, s.revision),
+		LastModified: s.modified,
+	}, nil
+}
+
+// ImportContacts reads all contacts before taking the lock, so a slow upload does not block other requests.
+func (s *InMemoryStore) ImportContacts(r store.ContactReader) (*store.ImportReport, error) {
+	return s.importContacts(r, store.Actor{})
+}
+
+func (s *InMemoryStore) importContacts(r store.ContactReader, actor store.Actor) (*store.ImportReport, error) {
+	batch, err := store.ReadImportBatch(r)
+	if err != nil {
+		return batch.Report, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := batch.Check(func(c *store.Contact) error {
+		if s.taken(c.ID) {
+			return store.ErrAlreadyExists
+		} else if err := s.checkReferences(c); err != nil {
+			return err
+		}
+		return s.checkManager(c, batch)
+	}); err != nil || len(batch.Report.Errors) > 0 {
+		return batch.Report, err
+	}
+
+	for _, c := range batch.Contacts {
+		c.Version = 1
+		s.put(c)
+		s.record(store.ActionCreate, c.ID, nil, c, actor)
+	}
+	batch.Report.Imported = len(batch.Contacts)
+	return batch.Report, nil
+}
+
+// WithTx runs f on a staged copy of the store and takes over the copy's contacts, companies and departments if f
+// returns nil. The store is locked meanwhile, so f must be quick and must not use s itself.
+func (s *InMemoryStore) WithTx(f func(tx store.ContactStorer) error) error {
+	return s.withTx(f, store.Actor{})
+}
+
+func (s *InMemoryStore) withTx(f func(tx store.ContactStorer) error, actor store.Actor) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Stored contacts, companies and departments are never modified in place, so the copy can share them.
+	staged := &InMemoryStore{
+		Contacts:    copyContacts(s.Contacts),
+		Companies:   copyCompanies(s.Companies),
+		Departments: copyDepartments(s.Departments),
+		HistorySize: s.HistorySize,
+		trash:       copyContacts(s.trash),
+		revision:    s.revision,
+		modified:    s.modified,
+
+		// All staged changes are kept until they are appended to this store's history, which drops the oldest.
+		history: &history{},
+	}
+
+	var tx store.ContactStorer = staged
+	if actor != (store.Actor{}) {
+		tx = staged.WithActor(actor)
+	}
+	if err := f(tx); err != nil {
+		return err
+	}
+
+	// The changes are copied back instead of replacing the map, because callers may hold on to s.Contacts.
+	if s.Contacts == nil {
+		s.Contacts = store.Contacts{}
+	}
+	replaceContacts(s.Contacts, staged.Contacts)
+	s.trash = staged.trash
+	s.replaceOrg(staged)
+
+	// The copy only has an index if f searched, otherwise it is rebuilt on the next search.
+	s.revision, s.modified, s.index = staged.revision, staged.modified, staged.index
+
+	// The staged changes get their sequence numbers from this store's history.
+	staged.history.each(func(c *store.Change) bool {
+		s.appendChange(c)
+		return true
+	})
 	return nil
 }
+
+func copyContacts(cs store.Contacts) store.Contacts {
+	c := make(store.Contacts, len(cs))
+	for id, contact := range cs {
+		c[id] = contact
+	}
+	return c
+}
+
+func copyCompanies(cs map[string]*store.Company) map[string]*store.Company {
+	c := make(map[string]*store.Company, len(cs))
+	for id, company := range cs {
+		c[id] = company
+	}
+	return c
+}
+
+func copyDepartments(ds map[string]*store.Department) map[string]*store.Department {
+	d := make(map[string]*store.Department, len(ds))
+	for id, department := range ds {
+		d[id] = department
+	}
+	return d
+}
+
+// replaceOrg makes the companies and departments equal to those of src, keeping the maps like replaceContacts.
+func (s *InMemoryStore) replaceOrg(src *InMemoryStore) {
+	if s.Companies == nil {
+		s.Companies = map[string]*store.Company{}
+	}
+	for id := range s.Companies {
+		if _, ok := src.Companies[id]; !ok {
+			delete(s.Companies, id)
+		}
+	}
+	for id, c := range src.Companies {
+		s.Companies[id] = c
+	}
+
+	if s.Departments == nil {
+		s.Departments = map[string]*store.Department{}
+	}
+	for id := range s.Departments {
+		if _, ok := src.Departments[id]; !ok {
+			delete(s.Departments, id)
+		}
+	}
+	for id, d := range src.Departments {
+		s.Departments[id] = d
+	}
+}
+
+// replaceContacts makes dst equal to src.
+func replaceContacts(dst, src store.Contacts) {
+	for id := range dst {
+		if _, ok := src[id]; !ok {
+			delete(dst, id)
+		}
+	}
+	for id, c := range src {
+		dst[id] = c
+	}
+}
@@ -1,9 +1,18 @@
 package memory
 
 import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ory/workshop-dbg/bulk"
 	"github.com/ory/workshop-dbg/store"
+	"github.com/ory/workshop-dbg/store/storetest"
 	"github.com/pborman/uuid"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"testing"
 )
 
@@ -16,9 +25,9 @@ func TestInMemoryStore(t *testing.T) {
 	c2 := &store.Contact{ID: uuid.New(), Name: "b", Department: "b1", Company: "b2"}
 	c3 := &store.Contact{ID: c2.ID, Name: "ba", Department: "ba1", Company: "ba2"}
 	r, err := s.GetContact(c1.ID)
-	assert.NotNil(t, err)
+	assert.Equal(t, store.ErrNotFound, err)
 
-	assert.Nil(t, s.DeleteContact(c1.ID))
+	assert.Equal(t, store.ErrNotFound, s.DeleteContact(c1.ID, 0))
 	assert.Nil(t, s.CreateContact(c1))
 	assert.Nil(t, s.CreateContact(c2))
 
@@ -34,6 +43,7 @@ func TestInMemoryStore(t *testing.T) {
 	assert.Nil(t, err)
 	assert.EqualValues(t, c2, r)
 
+	assert.Equal(t, store.ErrNotFound, s.UpdateContact(&store.Contact{ID: uuid.New(), Name: "c"}))
 	assert.Nil(t, s.UpdateContact(c3))
 	r, err = s.GetContact(c3.ID)
 	assert.Nil(t, err)
@@ -43,14 +53,701 @@ func TestInMemoryStore(t *testing.T) {
 	assert.Nil(t, err)
 	assert.EqualValues(t, c3, r)
 
-	assert.Nil(t, s.DeleteContact(c1.ID))
-	assert.Nil(t, s.DeleteContact(c1.ID))
+	assert.Nil(t, s.DeleteContact(c1.ID, 0))
+	assert.Equal(t, store.ErrNotFound, s.DeleteContact(c1.ID, 0))
 	cs, err = s.FetchContacts()
 	assert.Nil(t, err)
 	assert.Len(t, cs, 1)
 
-	assert.Nil(t, s.DeleteContact(c2.ID))
+	meta, err := s.FetchMeta()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, meta.Count)
+	assert.False(t, meta.LastModified.IsZero())
+
+	assert.Nil(t, s.DeleteContact(c2.ID, 0))
 	cs, err = s.FetchContacts()
 	assert.Nil(t, err)
 	assert.Len(t, cs, 0)
+
+	updated, err := s.FetchMeta()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, updated.Count)
+	assert.NotEqual(t, meta.Revision, updated.Revision)
+}
+
+func TestInMemoryStoreCopiesContacts(t *testing.T) {
+	s := &InMemoryStore{Contacts: store.Contacts{}}
+
+	c := &store.Contact{ID: uuid.New(), Name: "a", Department: "a1", Company: "a2"}
+	assert.Nil(t, s.CreateContact(c))
+
+	// Modifying the contact after handing it to the store must not change the stored data.
+	c.Name = "changed"
+	r, err := s.GetContact(c.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, "a", r.Name)
+
+	// Modifying returned contacts must not change the stored data either.
+	r.Name = "changed"
+	cs, err := s.FetchContacts()
+	assert.Nil(t, err)
+	assert.Equal(t, "a", cs[c.ID].Name)
+
+	cs[c.ID].Name = "changed"
+	delete(cs, c.ID)
+	r, err = s.GetContact(c.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, "a", r.Name)
+}
+
+// TestInMemoryStoreConcurrency should be run with the race detector enabled (go test -race).
+func TestInMemoryStoreConcurrency(t *testing.T) {
+	s := &InMemoryStore{Contacts: store.Contacts{}}
+
+	const workers = 16
+	const iterations = 200
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				id := fmt.Sprintf("contact-%d", i%10)
+				c := &store.Contact{ID: id, Name: fmt.Sprintf("%d-%d", w, i), Department: "d", Company: "c"}
+
+				switch i % 6 {
+				case 0:
+					if err := s.CreateContact(c); err != nil {
+						assert.Equal(t, store.ErrAlreadyExists, err)
+					}
+				case 1:
+					if err := s.UpdateContact(c); err != nil {
+						assert.Equal(t, store.ErrNotFound, err)
+					}
+				case 2:
+					if r, err := s.GetContact(id); err == nil {
+						r.Name = "mutated"
+					}
+				case 3:
+					cs, err := s.FetchContacts()
+					assert.Nil(t, err)
+					for _, r := range cs {
+						r.Name = "mutated"
+					}
+				case 4:
+					if err := s.DeleteContact(id, 0); err != nil {
+						assert.Equal(t, store.ErrNotFound, err)
+					}
+				case 5:
+					if _, err := s.RestoreContact(id); err != nil {
+						assert.Equal(t, store.ErrNotFound, err)
+					}
+					_, err := s.PurgeContacts(time.Now().Add(time.Hour))
+					assert.Nil(t, err)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	cs, err := s.FetchContacts()
+	assert.Nil(t, err)
+	for _, c := range cs {
+		assert.NotEqual(t, "mutated", c.Name)
+	}
+}
+
+func TestCreateContactGeneratesID(t *testing.T) {
+	s := &InMemoryStore{Contacts: store.Contacts{}}
+
+	c := &store.Contact{Name: "a", Department: "a1", Company: "a2"}
+	assert.Nil(t, s.CreateContact(c))
+	assert.NotEmpty(t, c.ID)
+
+	r, err := s.GetContact(c.ID)
+	assert.Nil(t, err)
+	assert.EqualValues(t, c, r)
+
+	assert.Equal(t, store.ErrAlreadyExists, s.CreateContact(&store.Contact{ID: c.ID, Name: "b"}))
+	r, err = s.GetContact(c.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, "a", r.Name)
+}
+
+func TestQueryContacts(t *testing.T) {
+	s := &InMemoryStore{Contacts: store.Contacts{}}
+	for i := 0; i < 25; i++ {
+		department := "IT"
+		if i%2 == 0 {
+			department = "HR"
+		}
+		assert.Nil(t, s.CreateContact(&store.Contact{
+			ID:         fmt.Sprintf("contact-%02d", i),
+			Name:       fmt.Sprintf("Name %02d", 24-i),
+			Department: department,
+			Company:    fmt.Sprintf("Company %d", i/10),
+		}))
+	}
+
+	// Page through all contacts sorted by name.
+	var ids []string
+	q := &store.Query{Limit: 10, SortBy: store.SortByName}
+	pages := []*store.Page{}
+	for {
+		page, err := s.QueryContacts(q)
+		assert.Nil(t, err)
+		pages = append(pages, page)
+		for _, c := range page.Contacts {
+			ids = append(ids, c.ID)
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		q.Cursor = page.NextCursor
+	}
+	assert.Len(t, pages, 3)
+	assert.Len(t, ids, 25)
+	assert.Equal(t, "contact-24", ids[0])
+	assert.Equal(t, "contact-00", ids[24])
+	assert.Empty(t, pages[0].PrevCursor)
+	assert.NotEmpty(t, pages[2].PrevCursor)
+
+	// Going back from the last page returns the second page again.
+	page, err := s.QueryContacts(&store.Query{Limit: 10, SortBy: store.SortByName, Cursor: pages[2].PrevCursor})
+	assert.Nil(t, err)
+	assert.Equal(t, pages[1].Contacts, page.Contacts)
+	assert.Equal(t, pages[1].NextCursor, page.NextCursor)
+	assert.Equal(t, pages[1].PrevCursor, page.PrevCursor)
+
+	// Filters
+	page, err = s.QueryContacts(&store.Query{Department: "IT", CompanyPrefix: "Company 1"})
+	assert.Nil(t, err)
+	assert.Len(t, page.Contacts, 5)
+	for _, c := range page.Contacts {
+		assert.Equal(t, "IT", c.Department)
+		assert.Equal(t, "Company 1", c.Company)
+	}
+
+	// Invalid queries
+	_, err = s.QueryContacts(&store.Query{SortBy: "foo"})
+	assert.True(t, errors.Is(err, store.ErrValidation))
+	_, err = s.QueryContacts(&store.Query{Cursor: "not-a-cursor"})
+	assert.True(t, errors.Is(err, store.ErrValidation))
+	_, err = s.QueryContacts(&store.Query{Cursor: pages[1].NextCursor, SortBy: store.SortByCompany})
+	assert.True(t, errors.Is(err, store.ErrValidation))
+}
+
+func TestSearchContacts(t *testing.T) {
+	s := &InMemoryStore{Contacts: store.Contacts{
+		"juergen-elsner": &store.Contact{Name: "Jürgen Elsner", Department: "DaCS", Company: "DBG"},
+		"ulrich-meyer":   &store.Contact{Name: "Ulrich Meyer", Department: "TRIT", Company: "DBG"},
+	}}
+
+	cs, err := s.SearchContacts("jurgen", 0)
+	assert.Nil(t, err)
+	assert.Len(t, cs, 1)
+	assert.Equal(t, "juergen-elsner", cs[0].ID)
+
+	cs, err = s.SearchContacts("dbg", 0)
+	assert.Nil(t, err)
+	assert.Len(t, cs, 2)
+
+	// The index is kept up to date.
+	assert.Nil(t, s.CreateContact(&store.Contact{ID: "dbg-bot", Name: "DBG Bot", Department: "IT", Company: "ACME"}))
+	assert.Nil(t, s.UpdateContact(&store.Contact{ID: "ulrich-meyer", Name: "Ulrich Meyer", Department: "TRIT", Company: "ACME"}))
+	cs, err = s.SearchContacts("DBG", 0)
+	assert.Nil(t, err)
+	assert.Len(t, cs, 2)
+	assert.Equal(t, "dbg-bot", cs[0].ID)
+	assert.Equal(t, "juergen-elsner", cs[1].ID)
+
+	assert.Nil(t, s.DeleteContact("juergen-elsner", 0))
+	cs, err = s.SearchContacts("els", 0)
+	assert.Nil(t, err)
+	assert.Len(t, cs, 0)
+
+	_, err = s.SearchContacts("  ", 0)
+	assert.True(t, errors.Is(err, store.ErrValidation))
+}
+
+func TestIndex(t *testing.T) {
+	i := newIndex()
+	i.add("a", &store.Contact{Name: "Ulrich Meyer", Company: "DBG"})
+	i.add("b", &store.Contact{Name: "Anna Meier", Company: "Ameise AG"})
+	i.add("c", &store.Contact{Name: "Me"})
+
+	// The words are kept in order and only the ones starting with the token match.
+	assert.Equal(t, []string{"ag", "ameise", "anna", "dbg", "me", "meier", "meyer", "ulrich"}, i.sorted)
+	assert.Equal(t, map[string]int{"a": nameWeight, "b": nameWeight, "c": 2 * nameWeight}, i.search([]string{"me"}))
+	assert.Equal(t, map[string]int{"a": nameWeight + 2*otherWeight}, i.search([]string{"mey", "dbg"}))
+
+	i.remove("b")
+	i.add("c", &store.Contact{Name: "Zoe"})
+	assert.Equal(t, []string{"dbg", "meyer", "ulrich", "zoe"}, i.sorted)
+	assert.Equal(t, map[string]int{"a": nameWeight}, i.search([]string{"me"}))
+}
+
+func TestVersions(t *testing.T) {
+	s := &InMemoryStore{Contacts: store.Contacts{}}
+
+	c := &store.Contact{Name: "a"}
+	assert.Nil(t, s.CreateContact(c))
+	assert.Equal(t, 1, c.Version)
+
+	// Unconditional and conditional updates increment the version
+	assert.Nil(t, s.UpdateContact(&store.Contact{ID: c.ID, Name: "b"}))
+	u := &store.Contact{ID: c.ID, Name: "c", Version: 2}
+	assert.Nil(t, s.UpdateContact(u))
+	assert.Equal(t, 3, u.Version)
+
+	// Stale writes are rejected
+	assert.Equal(t, store.ErrVersionMismatch, s.UpdateContact(&store.Contact{ID: c.ID, Name: "d", Version: 2}))
+	assert.Equal(t, store.ErrVersionMismatch, s.DeleteContact(c.ID, 2))
+
+	r, err := s.GetContact(c.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, "c", r.Name)
+	assert.Equal(t, 3, r.Version)
+
+	assert.Nil(t, s.DeleteContact(c.ID, 3))
+	assert.Equal(t, store.ErrNotFound, s.DeleteContact(c.ID, 3))
+}
+
+func TestPatchContact(t *testing.T) {
+	s := &InMemoryStore{Contacts: store.Contacts{}}
+
+	c := &store.Contact{Name: "a", Department: "a1", Company: "a2"}
+	assert.Nil(t, s.CreateContact(c))
+
+	r, err := s.PatchContact(c.ID, 1, func(p *store.Contact) error {
+		p.Department = "b1"
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "b1", r.Department)
+	assert.Equal(t, "a", r.Name)
+	assert.Equal(t, 2, r.Version)
+
+	_, err = s.PatchContact(c.ID, 1, func(p *store.Contact) error { return nil })
+	assert.Equal(t, store.ErrVersionMismatch, err)
+
+	_, err = s.PatchContact(c.ID, 0, func(p *store.Contact) error {
+		p.ID = "someone-else"
+		return nil
+	})
+	assert.Equal(t, store.ErrIDChanged, err)
+
+	_, err = s.PatchContact(c.ID, 0, func(p *store.Contact) error {
+		p.Name = ""
+		return nil
+	})
+	assert.True(t, errors.Is(err, store.ErrValidation))
+
+	_, err = s.PatchContact(uuid.New(), 0, func(p *store.Contact) error { return nil })
+	assert.Equal(t, store.ErrNotFound, err)
+
+	r, err = s.GetContact(c.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, "b1", r.Department)
+	assert.Equal(t, 2, r.Version)
+	assert.Nil(t, s.DeleteContact(c.ID, 0))
+}
+
+func TestImportContacts(t *testing.T) {
+	s := &InMemoryStore{Contacts: store.Contacts{}}
+	require.Nil(t, s.CreateContact(&store.Contact{ID: "taken", Name: "Taken"}))
+
+	rows := `{"id": "a", "name": "A"}
+{"id": "taken", "name": "B"}
+{"name": ""}
+{"id": "a", "name": "D"}
+{"name": "E"}`
+
+	// Atomic imports fail as a whole and report every failed row.
+	r, _ := bulk.NewReader(bulk.NDJSONType, strings.NewReader(rows))
+	report, err := store.Import(s, r, true)
+	require.Nil(t, err)
+	assert.Equal(t, 5, report.Rows)
+	assert.Equal(t, 0, report.Imported)
+	require.Len(t, report.Errors, 3)
+	assert.Equal(t, []int{2, 3, 4}, []int{report.Errors[0].Row, report.Errors[1].Row, report.Errors[2].Row})
+	assert.Equal(t, "name", report.Errors[1].Fields[0].Field)
+	assert.Len(t, s.Contacts, 1)
+
+	// Otherwise failed rows are skipped.
+	r, _ = bulk.NewReader(bulk.NDJSONType, strings.NewReader(rows))
+	report, err = store.Import(s, r, false)
+	require.Nil(t, err)
+	assert.Equal(t, 2, report.Imported)
+	require.Len(t, report.Errors, 3)
+	assert.Equal(t, "taken", report.Errors[0].ID)
+	assert.Len(t, s.Contacts, 3)
+
+	r, _ = bulk.NewReader(bulk.NDJSONType, strings.NewReader(`{"id": "b", "name": "B"}`+"\n"+`{"name": "C"}`))
+	report, err = store.Import(s, r, true)
+	require.Nil(t, err)
+	assert.Equal(t, 2, report.Imported)
+	assert.Empty(t, report.Errors)
+	assert.Len(t, s.Contacts, 5)
+	assert.Equal(t, 1, s.Contacts["b"].Version)
+}
+
+func TestWithTx(t *testing.T) {
+	s := &InMemoryStore{Contacts: store.Contacts{}}
+	require.Nil(t, s.CreateContact(&store.Contact{ID: "a", Name: "A"}))
+	meta, _ := s.FetchMeta()
+
+	failed := errors.New("failed")
+	assert.Equal(t, failed, s.WithTx(func(tx store.ContactStorer) error {
+		require.Nil(t, tx.CreateContact(&store.Contact{ID: "b", Name: "B"}))
+		require.Nil(t, tx.DeleteContact("a", 0))
+		return failed
+	}))
+
+	// Nothing changed.
+	_, err := s.GetContact("b")
+	assert.Equal(t, store.ErrNotFound, err)
+	_, err = s.GetContact("a")
+	assert.Nil(t, err)
+	unchanged, _ := s.FetchMeta()
+	assert.Equal(t, meta, unchanged)
+
+	assert.Nil(t, s.WithTx(func(tx store.ContactStorer) error {
+		if err := tx.CreateContact(&store.Contact{ID: "b", Name: "Bravo"}); err != nil {
+			return err
+		}
+		if _, err := tx.SearchContacts("bravo", 0); err != nil {
+			return err
+		}
+		return tx.DeleteContact("a", 1)
+	}))
+
+	_, err = s.GetContact("a")
+	assert.Equal(t, store.ErrNotFound, err)
+	cs, err := s.SearchContacts("bravo", 0)
+	require.Nil(t, err)
+	require.Len(t, cs, 1)
+	assert.Equal(t, "b", cs[0].ID)
+	changed, _ := s.FetchMeta()
+	assert.NotEqual(t, meta.Revision, changed.Revision)
+}
+
+// Transactions with more changes than the history keeps publish all of them.
+func TestWithTxPublishesAllChanges(t *testing.T) {
+	s := &InMemoryStore{Contacts: store.Contacts{}, HistorySize: 3}
+	changes, cancel, err := s.Subscribe()
+	require.Nil(t, err)
+	defer cancel()
+
+	require.Nil(t, s.WithTx(func(tx store.ContactStorer) error {
+		for i := 0; i < 5; i++ {
+			if err := tx.CreateContact(&store.Contact{ID: fmt.Sprint(i), Name: "A"}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+	require.Len(t, changes, 5)
+	for i := 0; i < 5; i++ {
+		c := <-changes
+		assert.Equal(t, fmt.Sprint(i), c.ContactID)
+		assert.Equal(t, int64(i+1), c.Seq)
+	}
+
+	audit, err := s.Audit(&store.AuditQuery{})
+	require.Nil(t, err)
+	require.Len(t, audit, 3)
+	assert.Equal(t, "2", audit[0].ContactID)
+}
+
+func TestWithTxStagesOrg(t *testing.T) {
+	companies := map[string]*store.Company{"dbg": {ID: "dbg", Name: "DBG"}}
+	s := &InMemoryStore{Companies: companies}
+
+	failed := errors.New("failed")
+	assert.Equal(t, failed, s.WithTx(func(tx store.ContactStorer) error {
+		orgs := tx.(store.OrgStorer)
+		require.Nil(t, orgs.CreateCompany(&store.Company{ID: "acme", Name: "ACME"}))
+		require.Nil(t, orgs.CreateDepartment(&store.Department{ID: "dacs", CompanyID: "dbg", Name: "DaCS"}))
+		require.Nil(t, tx.CreateContact(&store.Contact{ID: "a", Name: "A", CompanyID: "acme"}))
+		return failed
+	}))
+	_, err := s.GetCompany("acme")
+	assert.Equal(t, store.ErrNotFound, err)
+	_, err = s.GetDepartment("dacs")
+	assert.Equal(t, store.ErrNotFound, err)
+
+	require.Nil(t, s.WithTx(func(tx store.ContactStorer) error {
+		orgs := tx.(store.OrgStorer)
+		if err := orgs.CreateCompany(&store.Company{ID: "acme", Name: "ACME"}); err != nil {
+			return err
+		}
+		return orgs.DeleteCompany("dbg")
+	}))
+	_, err = s.GetCompany("acme")
+	assert.Nil(t, err)
+
+	// The map is changed in place, like the contacts.
+	assert.Len(t, companies, 1)
+	assert.Equal(t, "ACME", companies["acme"].Name)
+}
+
+func TestTrash(t *testing.T) {
+	s := &InMemoryStore{Contacts: store.Contacts{}}
+	a := &store.Contact{ID: "a", Name: "Alice", Company: "ACME"}
+	b := &store.Contact{ID: "b", Name: "Bob", Company: "ACME"}
+	require.Nil(t, s.CreateContact(a))
+	require.Nil(t, s.CreateContact(b))
+	_, err := s.SearchContacts("alice", 0)
+	require.Nil(t, err)
+
+	require.Nil(t, s.DeleteContact("a", 1))
+	require.Nil(t, s.DeleteContact("b", 0))
+
+	// Trashed contacts are hidden but keep their IDs.
+	_, err = s.GetContact("a")
+	assert.Equal(t, store.ErrNotFound, err)
+	assert.Equal(t, store.ErrNotFound, s.UpdateContact(a))
+	assert.Equal(t, store.ErrAlreadyExists, s.CreateContact(&store.Contact{ID: "a", Name: "Another Alice"}))
+	cs, err := s.SearchContacts("alice", 0)
+	require.Nil(t, err)
+	assert.Empty(t, cs)
+	meta, err := s.FetchMeta()
+	require.Nil(t, err)
+	assert.Equal(t, 0, meta.Count)
+
+	page, err := s.QueryContacts(&store.Query{Company: "ACME"})
+	require.Nil(t, err)
+	assert.Empty(t, page.Contacts)
+	page, err = s.QueryContacts(&store.Query{Company: "ACME", IncludeDeleted: true})
+	require.Nil(t, err)
+	require.Len(t, page.Contacts, 2)
+	assert.NotNil(t, page.Contacts[0].DeletedAt)
+
+	// The most recently deleted contact comes first.
+	trash, err := s.FetchTrash()
+	require.Nil(t, err)
+	require.Len(t, trash, 2)
+	assert.Equal(t, "b", trash[0].ID)
+	assert.Equal(t, "a", trash[1].ID)
+
+	r, err := s.RestoreContact("a")
+	require.Nil(t, err)
+	assert.Nil(t, r.DeletedAt)
+	assert.Equal(t, 2, r.Version)
+	cs, err = s.SearchContacts("alice", 0)
+	require.Nil(t, err)
+	assert.Len(t, cs, 1)
+	_, err = s.RestoreContact("a")
+	assert.Equal(t, store.ErrNotFound, err)
+
+	n, err := s.PurgeContacts(trash[0].DeletedAt.Add(-time.Second))
+	require.Nil(t, err)
+	assert.Equal(t, 0, n)
+	n, err = s.PurgeContacts(time.Now().Add(time.Second))
+	require.Nil(t, err)
+	assert.Equal(t, 1, n)
+
+	trash, err = s.FetchTrash()
+	require.Nil(t, err)
+	assert.Empty(t, trash)
+	assert.Nil(t, s.CreateContact(&store.Contact{ID: "b", Name: "Another Bob"}))
+}
+
+func TestHistory(t *testing.T) {
+	s := &InMemoryStore{Contacts: store.Contacts{}}
+	_, err := s.History("a")
+	assert.Equal(t, store.ErrNotFound, err)
+
+	alice := store.Actor{Name: "alice", RequestID: "r1"}
+	c := &store.Contact{ID: "a", Name: "A"}
+	require.Nil(t, s.WithActor(alice).CreateContact(c))
+	c.Name = "Anna"
+	require.Nil(t, s.UpdateContact(c))
+	_, err = s.WithActor(alice).PatchContact("a", 0, func(c *store.Contact) error {
+		c.Company = "ACME"
+		return nil
+	})
+	require.Nil(t, err)
+	require.Nil(t, s.DeleteContact("a", 0))
+	_, err = s.RestoreContact("a")
+	require.Nil(t, err)
+
+	// A failed transaction leaves no trace, a successful one is recorded with its actor.
+	assert.NotNil(t, s.WithTx(func(tx store.ContactStorer) error {
+		require.Nil(t, tx.DeleteContact("a", 0))
+		return errors.New("failed")
+	}))
+	require.Nil(t, s.WithActor(store.Actor{Name: "bob"}).(store.Transactor).WithTx(func(tx store.ContactStorer) error {
+		return tx.DeleteContact("a", 0)
+	}))
+	n, err := s.PurgeContacts(time.Now().Add(time.Second))
+	require.Nil(t, err)
+	require.Equal(t, 1, n)
+
+	changes, err := s.History("a")
+	require.Nil(t, err)
+	require.Len(t, changes, 7)
+	var actions, actors []string
+	for i, c := range changes {
+		assert.Equal(t, int64(i+1), c.Seq)
+		actions = append(actions, c.Action)
+		actors = append(actors, c.Actor)
+	}
+	assert.Equal(t, []string{"create", "update", "update", "delete", "restore", "delete", "purge"}, actions)
+	assert.Equal(t, []string{"alice", "", "alice", "", "", "bob", ""}, actors)
+
+	assert.Nil(t, changes[0].Before)
+	assert.Equal(t, &store.Contact{ID: "a", Name: "A", Version: 1}, changes[0].After)
+	assert.Equal(t, "r1", changes[0].RequestID)
+	assert.Equal(t, "Anna", changes[2].Before.Name)
+	assert.Equal(t, "ACME", changes[2].After.Company)
+	assert.Nil(t, changes[3].Before.DeletedAt)
+	assert.NotNil(t, changes[3].After.DeletedAt)
+	assert.Nil(t, changes[6].After)
+
+	// The history is copied.
+	changes[0].After.Name = "Changed"
+	changes, _ = s.History("a")
+	assert.Equal(t, "A", changes[0].After.Name)
+}
+
+func TestAudit(t *testing.T) {
+	s := &InMemoryStore{Contacts: store.Contacts{}, HistorySize: 3}
+	changes, err := s.Audit(&store.AuditQuery{})
+	require.Nil(t, err)
+	assert.Empty(t, changes)
+
+	for i := 0; i < 5; i++ {
+		require.Nil(t, s.CreateContact(&store.Contact{ID: fmt.Sprint(i), Name: "A"}))
+	}
+	middle, err := s.History("3")
+	require.Nil(t, err)
+
+	// Only the latest changes are kept.
+	changes, err = s.Audit(&store.AuditQuery{})
+	require.Nil(t, err)
+	require.Len(t, changes, 3)
+	assert.Equal(t, "2", changes[0].ContactID)
+	assert.Equal(t, int64(5), changes[2].Seq)
+	_, err = s.History("0")
+	assert.Equal(t, store.ErrNotFound, err)
+
+	changes, err = s.Audit(&store.AuditQuery{After: 3, Limit: 1})
+	require.Nil(t, err)
+	require.Len(t, changes, 1)
+	assert.Equal(t, "3", changes[0].ContactID)
+
+	changes, err = s.Audit(&store.AuditQuery{Since: middle[0].Time, Until: middle[0].Time.Add(time.Nanosecond)})
+	require.Nil(t, err)
+	for _, c := range changes {
+		assert.Equal(t, middle[0].Time, c.Time)
+	}
+	assert.Contains(t, changes, middle[0])
+}
+
+func TestSubscribe(t *testing.T) {
+	s := &InMemoryStore{Contacts: store.Contacts{}}
+	changes, cancel, err := s.Subscribe()
+	require.Nil(t, err)
+	defer cancel()
+
+	require.Nil(t, s.WithActor(store.Actor{Name: "alice"}).CreateContact(&store.Contact{ID: "a", Name: "A"}))
+	require.Nil(t, s.WithTx(func(tx store.ContactStorer) error {
+		return tx.DeleteContact("a", 0)
+	}))
+
+	c := <-changes
+	assert.Equal(t, store.ActionCreate, c.Action)
+	assert.Equal(t, "alice", c.Actor)
+	assert.Equal(t, int64(1), c.Seq)
+
+	// Changes made in a transaction are published once it is committed.
+	c = <-changes
+	assert.Equal(t, store.ActionDelete, c.Action)
+	assert.Equal(t, int64(2), c.Seq)
+}
+
+func TestWebhooks(t *testing.T) {
+	s := &InMemoryStore{Contacts: store.Contacts{}, HistorySize: 10}
+	assert.True(t, errors.Is(s.CreateWebhook(&store.Webhook{URL: "ftp://example.com"}), store.ErrValidation))
+
+	all := &store.Webhook{URL: "http://example.com/all", Events: []string{}, Active: true}
+	deletes := &store.Webhook{URL: "http://example.com/deletes", Events: []string{store.ActionDelete}, Active: true}
+	require.Nil(t, s.CreateWebhook(all))
+	require.Nil(t, s.CreateWebhook(deletes))
+	assert.NotEmpty(t, all.ID)
+	assert.Equal(t, store.ErrAlreadyExists, s.CreateWebhook(&store.Webhook{ID: all.ID, URL: all.URL}))
+
+	ws, err := s.FetchWebhooks()
+	require.Nil(t, err)
+	assert.Equal(t, []*store.Webhook{all, deletes}, ws)
+
+	// Deliveries are queued for every change a webhook receives, except for rolled back ones.
+	require.Nil(t, s.CreateContact(&store.Contact{ID: "a", Name: "A"}))
+	assert.NotNil(t, s.WithTx(func(tx store.ContactStorer) error {
+		require.Nil(t, tx.DeleteContact("a", 0))
+		return errors.New("failed")
+	}))
+	require.Nil(t, s.DeleteContact("a", 0))
+
+	ds, err := s.FetchDeliveries(&store.DeliveryQuery{})
+	require.Nil(t, err)
+	require.Len(t, ds, 3)
+	ds, err = s.FetchDeliveries(&store.DeliveryQuery{WebhookID: deletes.ID})
+	require.Nil(t, err)
+	require.Len(t, ds, 1)
+	assert.Equal(t, store.ActionDelete, ds[0].Change.Action)
+	assert.Equal(t, store.DeliveryPending, ds[0].Status)
+
+	now := time.Now()
+	claimed, err := s.ClaimDeliveries(now, time.Minute, 2)
+	require.Nil(t, err)
+	require.Len(t, claimed, 2)
+	assert.True(t, claimed[0].ID < claimed[1].ID)
+	claimed, err = s.ClaimDeliveries(now, time.Minute, 2)
+	require.Nil(t, err)
+	require.Len(t, claimed, 1)
+	claimed, err = s.ClaimDeliveries(now, time.Minute, 2)
+	require.Nil(t, err)
+	assert.Empty(t, claimed)
+
+	d, err := s.ClaimDeliveries(now.Add(time.Minute), time.Minute, 1)
+	require.Nil(t, err)
+	require.Len(t, d, 1)
+	d[0].Status, d[0].Attempts = store.DeliveryDelivered, 1
+	require.Nil(t, s.UpdateDelivery(d[0]))
+	delivered, err := s.GetDelivery(d[0].ID)
+	require.Nil(t, err)
+	assert.Equal(t, store.DeliveryDelivered, delivered.Status)
+	assert.Equal(t, store.ErrNotFound, s.UpdateDelivery(&store.Delivery{ID: 100}))
+
+	deletes.Active = false
+	require.Nil(t, s.UpdateWebhook(deletes))
+	require.Nil(t, s.DeleteWebhook(all.ID))
+	assert.Equal(t, store.ErrNotFound, s.DeleteWebhook(all.ID))
+	ds, err = s.FetchDeliveries(&store.DeliveryQuery{})
+	require.Nil(t, err)
+	assert.Len(t, ds, 1)
+
+	// The log is bounded, but pending deliveries are kept.
+	deletes.Active = true
+	require.Nil(t, s.UpdateWebhook(deletes))
+	for i := 0; i < 20; i++ {
+		require.Nil(t, s.CreateContact(&store.Contact{ID: fmt.Sprint(i), Name: "A"}))
+		require.Nil(t, s.DeleteContact(fmt.Sprint(i), 0))
+	}
+	ds, err = s.FetchDeliveries(&store.DeliveryQuery{Status: store.DeliveryPending})
+	require.Nil(t, err)
+	assert.Len(t, ds, 21)
+	ds, err = s.FetchDeliveries(&store.DeliveryQuery{Status: store.DeliveryDelivered})
+	require.Nil(t, err)
+	assert.Empty(t, ds)
+}
+
+func TestConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) (store.ContactStorer, func()) {
+		return &InMemoryStore{Contacts: store.Contacts{}}, nil
+	})
 }
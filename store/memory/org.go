@@ -0,0 +1,281 @@
+package memory
+
+import (
+	"sort"
+	"time"
+
+	"github.com/ory/workshop-dbg/store"
+)
+
+func (s *InMemoryStore) CreateCompany(c *store.Company) error {
+	if err := c.Validate(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if c.ID == "" {
+		c.ID = store.NewID()
+	} else if _, ok := s.Companies[c.ID]; ok {
+		return store.ErrAlreadyExists
+	}
+	if s.companyNamed(c.Name, c.ID) {
+		return store.ErrAlreadyExists
+	}
+	c.CreatedAt = time.Now().UTC()
+
+	if s.Companies == nil {
+		s.Companies = map[string]*store.Company{}
+	}
+	s.Companies[c.ID] = c.Clone()
+	return nil
+}
+
+func (s *InMemoryStore) GetCompany(id string) (*store.Company, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	c, ok := s.Companies[id]
+	if !ok {
+		return nil, store.ErrNotFound
+	}
+	return c.Clone(), nil
+}
+
+func (s *InMemoryStore) FetchCompanies() ([]*store.Company, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	cs := make([]*store.Company, 0, len(s.Companies))
+	for _, c := range s.Companies {
+		cs = append(cs, c.Clone())
+	}
+	store.SortCompanies(cs)
+	return cs, nil
+}
+
+func (s *InMemoryStore) UpdateCompany(c *store.Company) error {
+	return s.updateCompany(c, store.Actor{})
+}
+
+func (s *InMemoryStore) updateCompany(c *store.Company, actor store.Actor) error {
+	if err := c.Validate(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current, ok := s.Companies[c.ID]
+	if !ok {
+		return store.ErrNotFound
+	} else if s.companyNamed(c.Name, c.ID) {
+		return store.ErrAlreadyExists
+	}
+	c.CreatedAt = current.CreatedAt
+	s.Companies[c.ID] = c.Clone()
+	s.syncContacts(func(contact *store.Contact) bool { return contact.CompanyID == c.ID }, actor)
+	return nil
+}
+
+func (s *InMemoryStore) DeleteCompany(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.Companies[id]; !ok {
+		return store.ErrNotFound
+	}
+	for _, d := range s.Departments {
+		if d.CompanyID == id {
+			return store.ErrCompanyInUse
+		}
+	}
+	if s.referenced(func(c *store.Contact) bool { return c.CompanyID == id }) {
+		return store.ErrCompanyInUse
+	}
+	delete(s.Companies, id)
+	return nil
+}
+
+// companyNamed returns true if a company other than the one with ID id is named name. The caller must hold the
+// lock.
+func (s *InMemoryStore) companyNamed(name, id string) bool {
+	for _, c := range s.Companies {
+		if c.ID != id && store.SameName(c.Name, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *InMemoryStore) CreateDepartment(d *store.Department) error {
+	if err := d.Validate(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.Companies[d.CompanyID]; !ok {
+		return store.ErrNotFound
+	}
+	if d.ID == "" {
+		d.ID = store.NewID()
+	} else if _, ok := s.Departments[d.ID]; ok {
+		return store.ErrAlreadyExists
+	}
+	if s.departmentNamed(d) {
+		return store.ErrAlreadyExists
+	}
+	d.CreatedAt = time.Now().UTC()
+
+	if s.Departments == nil {
+		s.Departments = map[string]*store.Department{}
+	}
+	s.Departments[d.ID] = d.Clone()
+	return nil
+}
+
+func (s *InMemoryStore) GetDepartment(id string) (*store.Department, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	d, ok := s.Departments[id]
+	if !ok {
+		return nil, store.ErrNotFound
+	}
+	return d.Clone(), nil
+}
+
+func (s *InMemoryStore) FetchDepartments(companyID string) ([]*store.Department, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if _, ok := s.Companies[companyID]; !ok {
+		return nil, store.ErrNotFound
+	}
+	ds := []*store.Department{}
+	for _, d := range s.Departments {
+		if d.CompanyID == companyID {
+			ds = append(ds, d.Clone())
+		}
+	}
+	store.SortDepartments(ds)
+	return ds, nil
+}
+
+func (s *InMemoryStore) UpdateDepartment(d *store.Department) error {
+	return s.updateDepartment(d, store.Actor{})
+}
+
+func (s *InMemoryStore) updateDepartment(d *store.Department, actor store.Actor) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current, ok := s.Departments[d.ID]
+	if !ok {
+		return store.ErrNotFound
+	}
+	d.CompanyID = current.CompanyID
+	if err := d.Validate(); err != nil {
+		return err
+	} else if s.departmentNamed(d) {
+		return store.ErrAlreadyExists
+	}
+	d.CreatedAt = current.CreatedAt
+	s.Departments[d.ID] = d.Clone()
+	s.syncContacts(func(c *store.Contact) bool { return c.DepartmentID == d.ID }, actor)
+	return nil
+}
+
+func (s *InMemoryStore) DeleteDepartment(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.Departments[id]; !ok {
+		return store.ErrNotFound
+	}
+	if s.referenced(func(c *store.Contact) bool { return c.DepartmentID == id }) {
+		return store.ErrDepartmentInUse
+	}
+	delete(s.Departments, id)
+	return nil
+}
+
+// departmentNamed returns true if another department of d's company has d's name. The caller must hold the lock.
+func (s *InMemoryStore) departmentNamed(d *store.Department) bool {
+	for _, other := range s.Departments {
+		if other.ID != d.ID && other.CompanyID == d.CompanyID && store.SameName(other.Name, d.Name) {
+			return true
+		}
+	}
+	return false
+}
+
+// referenced returns true if f is true for any contact, including those in the trash. The caller must hold the
+// lock.
+func (s *InMemoryStore) referenced(f func(c *store.Contact) bool) bool {
+	for _, list := range []store.Contacts{s.Contacts, s.trash} {
+		for _, c := range list {
+			if f(c) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// syncNames sets the company and department names of c to those of the referenced company and department. The
+// caller must hold the lock.
+func (s *InMemoryStore) syncNames(c *store.Contact) {
+	if company, ok := s.Companies[c.CompanyID]; ok {
+		c.Company = company.Name
+	}
+	if d, ok := s.Departments[c.DepartmentID]; ok {
+		c.Department = d.Name
+	}
+}
+
+// syncContacts updates the names of the contacts matching f after a rename, see syncNames, and records the updates
+// in ID order. Contacts in the trash are synced once they are restored. The caller must hold the write lock.
+func (s *InMemoryStore) syncContacts(f func(c *store.Contact) bool, actor store.Actor) {
+	var ids []string
+	for id, c := range s.Contacts {
+		if f(c) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		current := s.Contacts[id]
+		c := current.Clone()
+		c.ID = id
+		s.syncNames(c)
+		if c.Company == current.Company && c.Department == current.Department {
+			continue
+		}
+
+		c.Version = current.Version + 1
+		s.put(c)
+		s.record(store.ActionUpdate, id, current, c, actor)
+	}
+}
+
+// checkManager checks the manager of c, see store.CheckManager. Managers created by batch count as well, if it is
+// set. The caller must hold the lock.
+func (s *InMemoryStore) checkManager(c *store.Contact, batch *store.ImportBatch) error {
+	return store.CheckManager(c, func(id string) bool {
+		_, ok := s.Contacts[id]
+		return ok || batch.Contains(id)
+	})
+}
+
+// checkReferences checks the company and department of c, see store.CheckReferences. The caller must hold the lock.
+func (s *InMemoryStore) checkReferences(c *store.Contact) error {
+	return store.CheckReferences(c,
+		func(id string) *store.Company { return s.Companies[id] },
+		func(id string) *store.Department { return s.Departments[id] },
+	)
+}
@@ -0,0 +1,206 @@
+package memory
+
+import (
+	"sort"
+	"time"
+
+	"github.com/ory/workshop-dbg/store"
+)
+
+func (s *InMemoryStore) CreateWebhook(w *store.Webhook) error {
+	if err := w.Validate(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if w.ID == "" {
+		w.ID = store.NewID()
+	} else if _, ok := s.webhooks[w.ID]; ok {
+		return store.ErrAlreadyExists
+	}
+	w.CreatedAt = time.Now().UTC()
+
+	if s.webhooks == nil {
+		s.webhooks = map[string]*store.Webhook{}
+	}
+	s.webhooks[w.ID] = w.Clone()
+	return nil
+}
+
+func (s *InMemoryStore) GetWebhook(id string) (*store.Webhook, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	w, ok := s.webhooks[id]
+	if !ok {
+		return nil, store.ErrNotFound
+	}
+	return w.Clone(), nil
+}
+
+// FetchWebhooks returns the webhooks ordered by creation time.
+func (s *InMemoryStore) FetchWebhooks() ([]*store.Webhook, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ws := make([]*store.Webhook, 0, len(s.webhooks))
+	for _, w := range s.webhooks {
+		ws = append(ws, w.Clone())
+	}
+	sort.Slice(ws, func(i, j int) bool {
+		if !ws[i].CreatedAt.Equal(ws[j].CreatedAt) {
+			return ws[i].CreatedAt.Before(ws[j].CreatedAt)
+		}
+		return ws[i].ID < ws[j].ID
+	})
+	return ws, nil
+}
+
+func (s *InMemoryStore) UpdateWebhook(w *store.Webhook) error {
+	if err := w.Validate(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current, ok := s.webhooks[w.ID]
+	if !ok {
+		return store.ErrNotFound
+	}
+	w.CreatedAt = current.CreatedAt
+	s.webhooks[w.ID] = w.Clone()
+	return nil
+}
+
+func (s *InMemoryStore) DeleteWebhook(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.webhooks[id]; !ok {
+		return store.ErrNotFound
+	}
+	delete(s.webhooks, id)
+
+	kept := make([]*store.Delivery, 0, len(s.deliveries))
+	for _, d := range s.deliveries {
+		if d.WebhookID != id {
+			kept = append(kept, d)
+		}
+	}
+	s.deliveries = kept
+	return nil
+}
+
+// enqueue queues a delivery of c for every webhook receiving it. The caller must hold the write lock.
+func (s *InMemoryStore) enqueue(c *store.Change) {
+	for _, w := range s.webhooks {
+		if !w.Receives(c.Action) {
+			continue
+		}
+		s.deliverySeq++
+		s.deliveries = append(s.deliveries, &store.Delivery{
+			ID:          s.deliverySeq,
+			WebhookID:   w.ID,
+			Change:      c.Clone(),
+			Status:      store.DeliveryPending,
+			NextAttempt: c.Time,
+			CreatedAt:   c.Time,
+			UpdatedAt:   c.Time,
+		})
+	}
+	s.trimDeliveries()
+}
+
+// trimDeliveries bounds the delivery log like the history. Once it is full, a tenth of it is made room for by
+// dropping the oldest deliveries which are no longer pending.
+func (s *InMemoryStore) trimDeliveries() {
+	size := s.HistorySize
+	if size <= 0 {
+		size = DefaultHistorySize
+	}
+	if len(s.deliveries) <= size {
+		return
+	}
+
+	excess := len(s.deliveries) - size + size/10
+	kept := make([]*store.Delivery, 0, len(s.deliveries))
+	for _, d := range s.deliveries {
+		if excess > 0 && d.Status != store.DeliveryPending {
+			excess--
+			continue
+		}
+		kept = append(kept, d)
+	}
+	s.deliveries = kept
+}
+
+func (s *InMemoryStore) ClaimDeliveries(now time.Time, lease time.Duration, limit int) ([]*store.Delivery, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var claimed []*store.Delivery
+	for _, d := range s.deliveries {
+		if len(claimed) == limit {
+			break
+		} else if d.Status != store.DeliveryPending || d.NextAttempt.After(now) {
+			continue
+		}
+		d.NextAttempt = now.Add(lease)
+		claimed = append(claimed, d.Clone())
+	}
+	return claimed, nil
+}
+
+// UpdateDelivery stores the status, attempts, next attempt and the outcome of the last attempt.
+func (s *InMemoryStore) UpdateDelivery(d *store.Delivery) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current := s.delivery(d.ID)
+	if current == nil {
+		return store.ErrNotFound
+	}
+	current.Status, current.Attempts, current.NextAttempt = d.Status, d.Attempts, d.NextAttempt
+	current.LastStatus, current.LastError = d.LastStatus, d.LastError
+	current.UpdatedAt = time.Now().UTC()
+	d.UpdatedAt = current.UpdatedAt
+	return nil
+}
+
+func (s *InMemoryStore) GetDelivery(id int64) (*store.Delivery, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	d := s.delivery(id)
+	if d == nil {
+		return nil, store.ErrNotFound
+	}
+	return d.Clone(), nil
+}
+
+// delivery finds a delivery by ID. The deliveries are ordered by ID. The caller must hold the lock.
+func (s *InMemoryStore) delivery(id int64) *store.Delivery {
+	i := sort.Search(len(s.deliveries), func(i int) bool { return s.deliveries[i].ID >= id })
+	if i < len(s.deliveries) && s.deliveries[i].ID == id {
+		return s.deliveries[i]
+	}
+	return nil
+}
+
+func (s *InMemoryStore) FetchDeliveries(q *store.DeliveryQuery) ([]*store.Delivery, error) {
+	q.Normalize()
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ds := []*store.Delivery{}
+	for i := len(s.deliveries) - 1; i >= 0 && len(ds) < q.Limit; i-- {
+		if q.Matches(s.deliveries[i]) {
+			ds = append(ds, s.deliveries[i].Clone())
+		}
+	}
+	return ds, nil
+}
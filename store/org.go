@@ -0,0 +1,287 @@
+package store
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Errors returned when deleting companies and departments which are still referenced. They wrap ErrConflict.
+var (
+	ErrCompanyInUse    = fmt.Errorf("%w: The company still has departments or contacts", ErrConflict)
+	ErrDepartmentInUse = fmt.Errorf("%w: The department still has contacts", ErrConflict)
+)
+
+// Company is a company contacts work for, see Contact.CompanyID.
+type Company struct {
+	ID        string    `json:"id" db:"id"`
+	Name      string    `json:"name" db:"name"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+}
+
+// Clone returns a copy of the company.
+func (c *Company) Clone() *Company {
+	clone := *c
+	return &clone
+}
+
+// Validate normalizes the name and checks the company like Contact.Validate does.
+func (c *Company) Validate() error {
+	c.ID, c.Name = normalize(c.ID), normalize(c.Name)
+
+	e := new(ValidationError)
+	if c.ID != "" {
+		validateText(e, "id", c.ID, MaxIDLength, isIDRune)
+	}
+	validateName(e, c.Name)
+	if len(e.Fields) > 0 {
+		return e
+	}
+	return nil
+}
+
+// Department is a department of a company, see Contact.DepartmentID.
+type Department struct {
+	ID        string    `json:"id" db:"id"`
+	CompanyID string    `json:"company_id" db:"company_id"`
+	Name      string    `json:"name" db:"name"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+}
+
+// Clone returns a copy of the department.
+func (d *Department) Clone() *Department {
+	clone := *d
+	return &clone
+}
+
+// Validate normalizes the name and checks the department like Contact.Validate does.
+func (d *Department) Validate() error {
+	d.ID, d.CompanyID, d.Name = normalize(d.ID), normalize(d.CompanyID), normalize(d.Name)
+
+	e := new(ValidationError)
+	if d.ID != "" {
+		validateText(e, "id", d.ID, MaxIDLength, isIDRune)
+	}
+	if d.CompanyID == "" {
+		e.add("company_id", "is required")
+	}
+	validateName(e, d.Name)
+	if len(e.Fields) > 0 {
+		return e
+	}
+	return nil
+}
+
+func validateName(e *ValidationError, name string) {
+	if name == "" {
+		e.add("name", "is required")
+	} else {
+		validateText(e, "name", name, MaxFieldLength, isTextRune)
+	}
+}
+
+// SameName returns true if two companies or two departments of a company are named alike. Names are compared
+// ignoring case, so "DBG" and "dbg" can not coexist.
+func SameName(a, b string) bool {
+	return strings.ToLower(a) == strings.ToLower(b)
+}
+
+// InvalidReference returns the *ValidationError of a contact referencing a company, department or manager which does
+// not exist.
+func InvalidReference(field string) error {
+	message := "does not exist"
+	if field == "department_id" {
+		message = "is not a department of the company"
+	}
+	return &ValidationError{Fields: []FieldError{{Field: field, Message: message}}}
+}
+
+// InvalidName returns the *ValidationError of a contact whose company or department differs from the name of the
+// referenced one.
+func InvalidName(field string) error {
+	return &ValidationError{Fields: []FieldError{{Field: field, Message: "must be the name of the " + field + " referenced"}}}
+}
+
+// CheckReferences returns the error of InvalidReference if c references a company or department which does not
+// exist, or a department of another company. company and department look up companies and departments by ID and
+// return nil if there is no such one.
+//
+// The company and department names of c are set to the referenced ones. Names which are not the same as them, see
+// SameName, fail with the error of InvalidName, so clients can not write conflicting names.
+func CheckReferences(c *Contact, company func(id string) *Company, department func(id string) *Department) error {
+	if c.CompanyID != "" {
+		co := company(c.CompanyID)
+		if co == nil {
+			return InvalidReference("company_id")
+		} else if c.Company != "" && !SameName(c.Company, co.Name) {
+			return InvalidName("company")
+		}
+		c.Company = co.Name
+	}
+	if c.DepartmentID != "" {
+		d := department(c.DepartmentID)
+		if d == nil || d.CompanyID != c.CompanyID {
+			return InvalidReference("department_id")
+		} else if c.Department != "" && !SameName(c.Department, d.Name) {
+			return InvalidName("department")
+		}
+		c.Department = d.Name
+	}
+	return nil
+}
+
+// CheckManager returns the error of InvalidReference if c has a manager which is not a contact outside of the trash.
+// exists returns true if there is such a contact with the given ID.
+func CheckManager(c *Contact, exists func(id string) bool) error {
+	if c.ManagerID != "" && !exists(c.ManagerID) {
+		return InvalidReference("manager_id")
+	}
+	return nil
+}
+
+// OrgStorer is implemented by stores which keep companies and departments next to their contacts. Contact writes
+// check Contact.CompanyID and Contact.DepartmentID and return the error of InvalidReference if the company or
+// department does not exist. They also set the names of the contact, see CheckReferences.
+//
+// CreateCompany and CreateDepartment assign an ID, unless one is set, and the creation time. They return
+// ErrAlreadyExists if the ID is taken or the name is, see SameName. Department names only need to be unique within
+// their company. CreateDepartment returns ErrNotFound if the company does not exist.
+//
+// UpdateCompany and UpdateDepartment replace the name, keeping the creation time and the company of a department.
+// The contacts referencing the company or department are updated to the new name in the same transaction and the
+// updates are recorded in their history. FetchCompanies and FetchDepartments list by name. FetchDepartments returns
+// ErrNotFound if the company does not exist.
+//
+// DeleteCompany returns ErrCompanyInUse while the company has departments or contacts, DeleteDepartment returns
+// ErrDepartmentInUse while the department has contacts. Contacts in the trash count, too.
+type OrgStorer interface {
+	CreateCompany(*Company) error
+	GetCompany(id string) (*Company, error)
+	FetchCompanies() ([]*Company, error)
+	UpdateCompany(*Company) error
+	DeleteCompany(id string) error
+
+	CreateDepartment(*Department) error
+	GetDepartment(id string) (*Department, error)
+	FetchDepartments(companyID string) ([]*Department, error)
+	UpdateDepartment(*Department) error
+	DeleteDepartment(id string) error
+}
+
+// SortCompanies sorts companies by name and ID.
+func SortCompanies(cs []*Company) {
+	sort.Slice(cs, func(i, j int) bool {
+		if cs[i].Name != cs[j].Name {
+			return cs[i].Name < cs[j].Name
+		}
+		return cs[i].ID < cs[j].ID
+	})
+}
+
+// SortDepartments sorts departments by name and ID.
+func SortDepartments(ds []*Department) {
+	sort.Slice(ds, func(i, j int) bool {
+		if ds[i].Name != ds[j].Name {
+			return ds[i].Name < ds[j].Name
+		}
+		return ds[i].ID < ds[j].ID
+	})
+}
+
+// OrgChart is the tree of a company: its departments and their members, who are nested under their managers.
+type OrgChart struct {
+	Company     *Company   `json:"company"`
+	Departments []*OrgUnit `json:"departments"`
+
+	// Unassigned are the contacts of the company without a department.
+	Unassigned []*OrgNode `json:"unassigned"`
+}
+
+// OrgUnit is a department in an OrgChart. Members lists the contacts whose manager is not in the department.
+type OrgUnit struct {
+	*Department
+	Members []*OrgNode `json:"members"`
+}
+
+// OrgNode is a contact in an OrgChart together with the contacts reporting to it.
+type OrgNode struct {
+	*Contact
+	Reports []*OrgNode `json:"reports,omitempty"`
+}
+
+// BuildOrgChart arranges the contacts of company, ignoring those of other companies. Departments keep their order,
+// contacts are ordered by name and ID.
+func BuildOrgChart(company *Company, departments []*Department, contacts []*Contact) *OrgChart {
+	groups := map[string][]*Contact{}
+	for _, c := range contacts {
+		if c.CompanyID == company.ID {
+			groups[c.DepartmentID] = append(groups[c.DepartmentID], c)
+		}
+	}
+
+	chart := &OrgChart{Company: company, Departments: []*OrgUnit{}}
+	for _, d := range departments {
+		chart.Departments = append(chart.Departments, &OrgUnit{Department: d, Members: orgTree(groups[d.ID])})
+		delete(groups, d.ID)
+	}
+
+	// Contacts of unknown departments are listed as unassigned, so nobody is left out.
+	var unassigned []*Contact
+	for _, cs := range groups {
+		unassigned = append(unassigned, cs...)
+	}
+	chart.Unassigned = orgTree(unassigned)
+	return chart
+}
+
+// orgTree nests contacts under their managers. Contacts whose manager is not among contacts are roots. So are those
+// caught in a cycle of managers, starting with the first one in order.
+func orgTree(contacts []*Contact) []*OrgNode {
+	sort.Slice(contacts, func(i, j int) bool {
+		if contacts[i].Name != contacts[j].Name {
+			return contacts[i].Name < contacts[j].Name
+		}
+		return contacts[i].ID < contacts[j].ID
+	})
+
+	nodes := make(map[string]*OrgNode, len(contacts))
+	for _, c := range contacts {
+		nodes[c.ID] = &OrgNode{Contact: c}
+	}
+
+	reports := map[string][]*OrgNode{}
+	var roots []*OrgNode
+	for _, c := range contacts {
+		if _, ok := nodes[c.ManagerID]; ok && c.ManagerID != c.ID {
+			reports[c.ManagerID] = append(reports[c.ManagerID], nodes[c.ID])
+		} else {
+			roots = append(roots, nodes[c.ID])
+		}
+	}
+
+	placed := map[string]bool{}
+	var place func(n *OrgNode)
+	place = func(n *OrgNode) {
+		placed[n.ID] = true
+		for _, r := range reports[n.ID] {
+			if !placed[r.ID] {
+				n.Reports = append(n.Reports, r)
+				place(r)
+			}
+		}
+	}
+
+	tree := []*OrgNode{}
+	for _, n := range roots {
+		tree = append(tree, n)
+		place(n)
+	}
+	for _, c := range contacts {
+		if n := nodes[c.ID]; !placed[n.ID] {
+			tree = append(tree, n)
+			place(n)
+		}
+	}
+	return tree
+}
@@ -0,0 +1,100 @@
+package store
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateOrg(t *testing.T) {
+	c := &Company{Name: " DBG "}
+	require.Nil(t, c.Validate())
+	assert.Equal(t, "DBG", c.Name)
+
+	var v *ValidationError
+	require.True(t, errors.As((&Company{ID: "a/b"}).Validate(), &v))
+	assert.Equal(t, []FieldError{{Field: "id", Message: `must not contain the character '/'`}, {Field: "name", Message: "is required"}}, v.Fields)
+
+	require.Nil(t, (&Department{CompanyID: "dbg", Name: "DaCS"}).Validate())
+	require.True(t, errors.As((&Department{Name: "DaCS"}).Validate(), &v))
+	assert.Equal(t, []FieldError{{Field: "company_id", Message: "is required"}}, v.Fields)
+
+	assert.True(t, SameName("DBG", "dbg"))
+	assert.False(t, SameName("DBG", "DB"))
+}
+
+func TestCheckReferences(t *testing.T) {
+	companies := map[string]*Company{"dbg": {ID: "dbg", Name: "DBG"}, "acme": {ID: "acme", Name: "ACME"}}
+	departments := map[string]*Department{"dacs": {ID: "dacs", CompanyID: "dbg", Name: "DaCS"}}
+	check := func(c *Contact) []FieldError {
+		err := CheckReferences(c, func(id string) *Company { return companies[id] }, func(id string) *Department { return departments[id] })
+		if err == nil {
+			return nil
+		}
+		var v *ValidationError
+		require.True(t, errors.As(err, &v))
+		return v.Fields
+	}
+
+	assert.Nil(t, check(&Contact{}))
+	assert.Nil(t, check(&Contact{CompanyID: "acme"}))
+	assert.Nil(t, check(&Contact{CompanyID: "dbg", DepartmentID: "dacs"}))
+	assert.Equal(t, []FieldError{{Field: "company_id", Message: "does not exist"}}, check(&Contact{CompanyID: "missing"}))
+	assert.Equal(t, []FieldError{{Field: "department_id", Message: "is not a department of the company"}},
+		check(&Contact{CompanyID: "acme", DepartmentID: "dacs"}))
+	assert.Equal(t, []FieldError{{Field: "department_id", Message: "is not a department of the company"}},
+		check(&Contact{CompanyID: "dbg", DepartmentID: "missing"}))
+
+	// The names are taken from the references and must not differ but in case.
+	c := &Contact{Company: "dbg", Department: "Other", CompanyID: "dbg"}
+	assert.Nil(t, check(c))
+	assert.Equal(t, "DBG", c.Company)
+	assert.Equal(t, "Other", c.Department)
+	c = &Contact{CompanyID: "dbg", DepartmentID: "dacs"}
+	assert.Nil(t, check(c))
+	assert.Equal(t, "DaCS", c.Department)
+	assert.Equal(t, []FieldError{{Field: "company", Message: "must be the name of the company referenced"}},
+		check(&Contact{Company: "ACME", CompanyID: "dbg"}))
+	assert.Equal(t, []FieldError{{Field: "department", Message: "must be the name of the department referenced"}},
+		check(&Contact{Department: "IT", CompanyID: "dbg", DepartmentID: "dacs"}))
+}
+
+func TestBuildOrgChart(t *testing.T) {
+	company := &Company{ID: "dbg", Name: "DBG"}
+	departments := []*Department{{ID: "dacs", CompanyID: "dbg", Name: "DaCS"}, {ID: "trit", CompanyID: "dbg", Name: "TRIT"}}
+	contacts := []*Contact{
+		{ID: "ceo", Name: "Anna", CompanyID: "dbg"},
+		{ID: "lead", Name: "Bert", CompanyID: "dbg", DepartmentID: "dacs", ManagerID: "ceo"},
+		{ID: "dev2", Name: "Dora", CompanyID: "dbg", DepartmentID: "dacs", ManagerID: "lead"},
+		{ID: "dev1", Name: "Carl", CompanyID: "dbg", DepartmentID: "dacs", ManagerID: "lead"},
+		{ID: "cycle1", Name: "Emil", CompanyID: "dbg", DepartmentID: "trit", ManagerID: "cycle2"},
+		{ID: "cycle2", Name: "Finn", CompanyID: "dbg", DepartmentID: "trit", ManagerID: "cycle1"},
+		{ID: "other", Name: "Gina", CompanyID: "acme"},
+	}
+
+	chart := BuildOrgChart(company, departments, contacts)
+	assert.Equal(t, company, chart.Company)
+	require.Len(t, chart.Departments, 2)
+
+	dacs := chart.Departments[0]
+	assert.Equal(t, "dacs", dacs.ID)
+	require.Len(t, dacs.Members, 1)
+	assert.Equal(t, "lead", dacs.Members[0].ID)
+	require.Len(t, dacs.Members[0].Reports, 2)
+	assert.Equal(t, "dev1", dacs.Members[0].Reports[0].ID)
+	assert.Equal(t, "dev2", dacs.Members[0].Reports[1].ID)
+
+	// Cycles are broken up at the first contact.
+	trit := chart.Departments[1]
+	require.Len(t, trit.Members, 1)
+	assert.Equal(t, "cycle1", trit.Members[0].ID)
+	require.Len(t, trit.Members[0].Reports, 1)
+	assert.Equal(t, "cycle2", trit.Members[0].Reports[0].ID)
+	assert.Empty(t, trit.Members[0].Reports[0].Reports)
+
+	require.Len(t, chart.Unassigned, 1)
+	assert.Equal(t, "ceo", chart.Unassigned[0].ID)
+	assert.Empty(t, chart.Unassigned[0].Reports)
+}
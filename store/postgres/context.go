@@ -0,0 +1,120 @@
+package postgres
+
+import (
+	"context"
+	"time"
+
+	"github.com/ory/workshop-dbg/store"
+)
+
+// The operations without a context run with context.Background. Requests use WithContext instead.
+
+// WithContext returns a store which runs its statements using ctx, see store.Bind. Once ctx is done, PostgreSQL
+// cancels the running statement and the transaction is rolled back.
+func (s *PostgresStore) WithContext(ctx context.Context) store.ContactStorer {
+	return store.Bind(ctx, s)
+}
+
+func (s *PostgresStore) FetchContacts() (store.Contacts, error) {
+	return s.FetchContactsContext(context.Background())
+}
+
+func (s *PostgresStore) GetContact(id string) (*store.Contact, error) {
+	return s.GetContactContext(context.Background(), id)
+}
+
+func (s *PostgresStore) DeleteContact(id string, version int) error {
+	return s.DeleteContactContext(context.Background(), id, version)
+}
+
+func (s *PostgresStore) CreateContact(c *store.Contact) error {
+	return s.CreateContactContext(context.Background(), c)
+}
+
+func (s *PostgresStore) UpdateContact(c *store.Contact) error {
+	return s.UpdateContactContext(context.Background(), c)
+}
+
+func (s *PostgresStore) PatchContact(id string, version int, patch func(*store.Contact) error) (*store.Contact, error) {
+	return s.PatchContactContext(context.Background(), id, version, patch)
+}
+
+func (s *PostgresStore) FetchMeta() (*store.Meta, error) {
+	return s.FetchMetaContext(context.Background())
+}
+
+func (s *PostgresStore) QueryContacts(q *store.Query) (*store.Page, error) {
+	return s.QueryContactsContext(context.Background(), q)
+}
+
+func (s *PostgresStore) SearchContacts(query string, limit int) ([]*store.Contact, error) {
+	return s.SearchContactsContext(context.Background(), query, limit)
+}
+
+func (s *PostgresStore) FetchTrash() ([]*store.Contact, error) {
+	return s.FetchTrashContext(context.Background())
+}
+
+func (s *PostgresStore) RestoreContact(id string) (*store.Contact, error) {
+	return s.RestoreContactContext(context.Background(), id)
+}
+
+func (s *PostgresStore) PurgeContacts(deletedBefore time.Time) (int, error) {
+	return s.PurgeContactsContext(context.Background(), deletedBefore)
+}
+
+func (s *PostgresStore) History(id string) ([]*store.Change, error) {
+	return s.HistoryContext(context.Background(), id)
+}
+
+func (s *PostgresStore) Audit(q *store.AuditQuery) ([]*store.Change, error) {
+	return s.AuditContext(context.Background(), q)
+}
+
+func (s *PostgresStore) WithTx(f func(tx store.ContactStorer) error) error {
+	return s.WithTxContext(context.Background(), f)
+}
+
+func (s *PostgresStore) ImportContacts(r store.ContactReader) (*store.ImportReport, error) {
+	return s.ImportContactsContext(context.Background(), r)
+}
+
+func (s *PostgresStore) CreateCompany(c *store.Company) error {
+	return s.CreateCompanyContext(context.Background(), c)
+}
+
+func (s *PostgresStore) GetCompany(id string) (*store.Company, error) {
+	return s.GetCompanyContext(context.Background(), id)
+}
+
+func (s *PostgresStore) FetchCompanies() ([]*store.Company, error) {
+	return s.FetchCompaniesContext(context.Background())
+}
+
+func (s *PostgresStore) UpdateCompany(c *store.Company) error {
+	return s.UpdateCompanyContext(context.Background(), c)
+}
+
+func (s *PostgresStore) DeleteCompany(id string) error {
+	return s.DeleteCompanyContext(context.Background(), id)
+}
+
+func (s *PostgresStore) CreateDepartment(d *store.Department) error {
+	return s.CreateDepartmentContext(context.Background(), d)
+}
+
+func (s *PostgresStore) GetDepartment(id string) (*store.Department, error) {
+	return s.GetDepartmentContext(context.Background(), id)
+}
+
+func (s *PostgresStore) FetchDepartments(companyID string) ([]*store.Department, error) {
+	return s.FetchDepartmentsContext(context.Background(), companyID)
+}
+
+func (s *PostgresStore) UpdateDepartment(d *store.Department) error {
+	return s.UpdateDepartmentContext(context.Background(), d)
+}
+
+func (s *PostgresStore) DeleteDepartment(id string) error {
+	return s.DeleteDepartmentContext(context.Background(), id)
+}
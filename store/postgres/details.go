@@ -0,0 +1,92 @@
+package postgres
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/ory/workshop-dbg/store"
+)
+
+// details holds the fields of a contact which are stored in the details column as JSON. They are only ever read
+// and written together with the contact, so normalizing them into tables of their own would buy nothing but joins.
+// The JSON keys are those of store.Contact, so history snapshots can merge the column into the contact.
+type details struct {
+	Emails     []store.Email     `json:"emails,omitempty"`
+	Phones     []store.Phone     `json:"phones,omitempty"`
+	Addresses  []store.Address   `json:"addresses,omitempty"`
+	ManagerID  string            `json:"manager_id,omitempty"`
+	Tags       []string          `json:"tags,omitempty"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+}
+
+func newDetails(c *store.Contact) details {
+	return details{
+		Emails:     c.Emails,
+		Phones:     c.Phones,
+		Addresses:  c.Addresses,
+		ManagerID:  c.ManagerID,
+		Tags:       c.Tags,
+		Attributes: c.Attributes,
+	}
+}
+
+// Scan implements sql.Scanner.
+func (d *details) Scan(src interface{}) error {
+	var data []byte
+	switch v := src.(type) {
+	case []byte:
+		data = v
+	case string:
+		data = []byte(v)
+	default:
+		return fmt.Errorf("can not scan %T into contact details", src)
+	}
+	*d = details{}
+	return json.Unmarshal(data, d)
+}
+
+// Value implements driver.Valuer. lib/pq sends []byte as bytea, which can not be cast to jsonb.
+func (d details) Value() (driver.Value, error) {
+	data, err := json.Marshal(d)
+	return string(data), err
+}
+
+// contactRow is a row of contactTable. The references to companies and departments are NULL if empty. The revision
+// and modification time are only read by FetchMeta.
+type contactRow struct {
+	store.Contact
+	CompanyRef    sql.NullString `db:"company_id"`
+	DepartmentRef sql.NullString `db:"department_id"`
+	Details       details        `db:"details"`
+	Revision      int64          `db:"revision"`
+	ModifiedAt    time.Time      `db:"modified_at"`
+}
+
+func (r *contactRow) contact() *store.Contact {
+	c := r.Contact
+	c.CompanyID, c.DepartmentID = r.CompanyRef.String, r.DepartmentRef.String
+	c.Emails, c.Phones, c.Addresses = r.Details.Emails, r.Details.Phones, r.Details.Addresses
+	c.ManagerID, c.Tags, c.Attributes = r.Details.ManagerID, r.Details.Tags, r.Details.Attributes
+	return &c
+}
+
+func contacts(rows []*contactRow) []*store.Contact {
+	cs := make([]*store.Contact, len(rows))
+	for i, r := range rows {
+		cs[i] = r.contact()
+	}
+	return cs
+}
+
+// nullString maps the empty string to NULL.
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+// snapshot is the JSON of a contact as recorded in the history, for statements which record contacts themselves.
+func snapshot(row string) string {
+	return fmt.Sprintf("(to_jsonb(%[1]s) - 'details' - 'revision' - 'modified_at') || %[1]s.details", row)
+}
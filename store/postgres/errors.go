@@ -0,0 +1,57 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"net"
+
+	"github.com/lib/pq"
+	"github.com/ory/workshop-dbg/store"
+)
+
+// translate maps database errors to the errors defined in package store.
+func translate(err error) error {
+	if err == nil {
+		return nil
+	} else if err == sql.ErrNoRows {
+		return store.ErrNotFound
+	} else if err == driver.ErrBadConn {
+		return fmt.Errorf("%w: %s", store.ErrUnavailable, err)
+	}
+
+	if _, ok := err.(net.Error); ok {
+		return fmt.Errorf("%w: %s", store.ErrUnavailable, err)
+	}
+
+	pqErr, ok := err.(*pq.Error)
+	if !ok {
+		return err
+	}
+
+	switch pqErr.Code {
+	case "57014": // query_canceled, lib/pq cancels the running statement once its context is done
+		return fmt.Errorf("%w: %s", context.Canceled, pqErr.Message)
+	case "23505": // unique_violation
+		return store.ErrAlreadyExists
+	case "23502", "23514", "22001": // not_null_violation, check_violation, string_data_right_truncation
+		return fmt.Errorf("%w: %s", store.ErrValidation, pqErr.Message)
+	case "23503": // foreign_key_violation
+		switch pqErr.Constraint {
+		case contactCompanyFK:
+			return store.InvalidReference("company_id")
+		case contactDepartmentFK:
+			return store.InvalidReference("department_id")
+		}
+		return fmt.Errorf("%w: %s", store.ErrConflict, pqErr.Message)
+	case "40001", "40P01": // serialization_failure, deadlock_detected
+		return fmt.Errorf("%w: %s", store.ErrConflict, pqErr.Message)
+	}
+
+	switch pqErr.Code.Class() {
+	case "08", "53", "57": // connection_exception, insufficient_resources, operator_intervention
+		return fmt.Errorf("%w: %s", store.ErrUnavailable, pqErr.Message)
+	}
+	return err
+}
@@ -0,0 +1,106 @@
+package postgres
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/ory/workshop-dbg/store"
+)
+
+// changeChannel is notified with the seq of every change inserted into the history table.
+const changeChannel = "dbg_contact_changes"
+
+// listenerPing is how often the listener checks its connection.
+const listenerPing = 90 * time.Second
+
+// listener publishes the changes of all replicas, which it learns about using LISTEN/NOTIFY.
+type listener struct {
+	broker store.Broker
+	conn   *pq.Listener
+}
+
+// Listen starts publishing changes to subscribers. It opens a dedicated connection to url, because the connections
+// of the pool can not receive notifications. Subscribe fails unless Listen was called. Listen and Unlisten must not
+// be called while the store is in use.
+func (s *PostgresStore) Listen(url string) error {
+	if s.events != nil {
+		return errors.New("the store is already listening")
+	}
+
+	conn := pq.NewListener(url, time.Second, time.Minute, nil)
+	if err := conn.Listen(changeChannel); err != nil {
+		conn.Close()
+		return translate(err)
+	}
+
+	s.events = &listener{conn: conn}
+	go s.forward(s.events)
+	return nil
+}
+
+// Unlisten stops publishing changes and ends all subscriptions.
+func (s *PostgresStore) Unlisten() error {
+	if s.events == nil {
+		return nil
+	}
+	events := s.events
+	s.events = nil
+	return events.conn.Close()
+}
+
+func (s *PostgresStore) Subscribe() (<-chan *store.Change, func(), error) {
+	if s.events == nil {
+		return nil, nil, fmt.Errorf("%w: The store does not listen for changes", store.ErrUnavailable)
+	}
+	changes, cancel := s.events.broker.Subscribe()
+	return changes, cancel, nil
+}
+
+// forward reads the changes announced by notifications and publishes them until the listener is closed.
+func (s *PostgresStore) forward(l *listener) {
+	defer l.broker.DropAll()
+
+	ping := time.NewTicker(listenerPing)
+	defer ping.Stop()
+
+	for {
+		select {
+		case n, ok := <-l.conn.Notify:
+			if !ok {
+				return
+			} else if n == nil {
+				// The connection was re-established, so notifications may have been lost.
+				l.broker.DropAll()
+				continue
+			}
+
+			c, err := s.fetchChange(n.Extra)
+			if err != nil {
+				log.Warnf("Could not publish change %s because %s", n.Extra, err)
+				l.broker.DropAll()
+				continue
+			}
+			l.broker.Publish(c)
+		case <-ping.C:
+			go l.conn.Ping()
+		}
+	}
+}
+
+func (s *PostgresStore) fetchChange(seq string) (*store.Change, error) {
+	n, err := strconv.ParseInt(seq, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	var row historyRow
+	if err := sqlx.Get(s.DB, &row, fmt.Sprintf("SELECT * FROM %s WHERE seq = $1", historyTable), n); err != nil {
+		return nil, translate(err)
+	}
+	return row.change()
+}
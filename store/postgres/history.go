@@ -0,0 +1,131 @@
+package postgres
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/ory/workshop-dbg/store"
+)
+
+// historyTable records every change to dbg_contacts. A trigger makes it append-only.
+const historyTable = "dbg_contact_history"
+
+// historyRow is a row of historyTable. The snapshots are kept as JSON, so they survive changes to the contacts
+// table.
+type historyRow struct {
+	Seq       int64     `db:"seq"`
+	ContactID string    `db:"contact_id"`
+	Action    string    `db:"action"`
+	Before    []byte    `db:"before"`
+	After     []byte    `db:"after"`
+	Actor     string    `db:"actor"`
+	RequestID string    `db:"request_id"`
+	CreatedAt time.Time `db:"created_at"`
+
+	// XID is the ID of the transaction which wrote the change, see Audit.
+	XID int64 `db:"xid"`
+}
+
+func (r *historyRow) change() (*store.Change, error) {
+	c := &store.Change{
+		Seq:       r.Seq,
+		ContactID: r.ContactID,
+		Action:    r.Action,
+		Actor:     r.Actor,
+		RequestID: r.RequestID,
+		Time:      r.CreatedAt.UTC(),
+	}
+	for _, s := range []struct {
+		data     []byte
+		snapshot **store.Contact
+	}{{r.Before, &c.Before}, {r.After, &c.After}} {
+		if s.data == nil {
+			continue
+		}
+		if err := json.Unmarshal(s.data, s.snapshot); err != nil {
+			return nil, fmt.Errorf("could not read change %d: %w", r.Seq, err)
+		}
+	}
+	return c, nil
+}
+
+// record appends a change to the history in tx, so it is committed or rolled back together with the write.
+func (s *PostgresStore) record(ctx context.Context, tx *sqlx.Tx, action, id string, before, after *store.Contact) error {
+	snapshots := make([]interface{}, 2)
+	for i, c := range []*store.Contact{before, after} {
+		if c == nil {
+			continue
+		}
+		data, err := json.Marshal(c)
+		if err != nil {
+			return err
+		}
+		// lib/pq sends []byte as bytea, which can not be cast to jsonb.
+		snapshots[i] = string(data)
+	}
+
+	_, err := tx.ExecContext(ctx, fmt.Sprintf(
+		"INSERT INTO %s (contact_id, action, before, after, actor, request_id) VALUES ($1, $2, $3, $4, $5, $6)",
+		historyTable), id, action, snapshots[0], snapshots[1], s.actor.Name, s.actor.RequestID,
+	)
+	return translate(err)
+}
+
+func (s *PostgresStore) HistoryContext(ctx context.Context, id string) ([]*store.Change, error) {
+	var rows []*historyRow
+	if err := sqlx.SelectContext(ctx, s.ext(), &rows, fmt.Sprintf("SELECT * FROM %s WHERE contact_id = $1 ORDER BY seq", historyTable), id); err != nil {
+		return nil, translate(err)
+	} else if len(rows) == 0 {
+		return nil, store.ErrNotFound
+	}
+	return changes(rows)
+}
+
+// AuditContext lists the changes in the order of the transactions which wrote them. Changes become visible when their
+// transaction commits, which may happen after a later transaction committed, so Audit stops at the oldest
+// transaction still running. Every change returned is final and nothing is ever inserted before it, so paging with
+// After does not skip changes. A long running transaction delays the changes of all later ones.
+func (s *PostgresStore) AuditContext(ctx context.Context, q *store.AuditQuery) ([]*store.Change, error) {
+	q.Normalize()
+
+	var rows []*historyRow
+	if err := sqlx.SelectContext(ctx, s.ext(), &rows, fmt.Sprintf(`
+WITH prev AS (SELECT coalesce((SELECT xid FROM %[1]s WHERE seq = $1), 0) AS xid)
+SELECT h.* FROM %[1]s h, prev
+WHERE (h.xid > prev.xid OR (h.xid = prev.xid AND h.seq > $1)) AND h.xid < txid_snapshot_xmin(txid_current_snapshot())
+	AND ($2::timestamptz IS NULL OR h.created_at >= $2) AND ($3::timestamptz IS NULL OR h.created_at < $3)
+ORDER BY h.xid, h.seq LIMIT $4`, historyTable),
+		q.After, nullTime(q.Since), nullTime(q.Until), q.Limit,
+	); err != nil {
+		return nil, translate(err)
+	}
+	return changes(rows)
+}
+
+func changes(rows []*historyRow) ([]*store.Change, error) {
+	cs := make([]*store.Change, len(rows))
+	for i, r := range rows {
+		c, err := r.change()
+		if err != nil {
+			return nil, err
+		}
+		cs[i] = c
+	}
+	return cs, nil
+}
+
+// nullTime maps the zero time to NULL.
+func nullTime(t time.Time) pq.NullTime {
+	return pq.NullTime{Time: t, Valid: !t.IsZero()}
+}
+
+// WithActor returns a copy of the store, which shares its database and transaction.
+func (s *PostgresStore) WithActor(actor store.Actor) store.ContactStorer {
+	clone := *s
+	clone.actor = actor
+	return &clone
+}
@@ -0,0 +1,208 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/ory/workshop-dbg/store"
+)
+
+// importTable is a temporary table which imported contacts are copied into before they are checked for conflicts.
+const importTable = "dbg_import"
+
+// ImportContactsContext streams the contacts into a temporary table using COPY and inserts them from there, all in
+// a single transaction. Conflicting IDs are detected in the temporary table, so they can be reported per row.
+func (s *PostgresStore) ImportContactsContext(ctx context.Context, r store.ContactReader) (*store.ImportReport, error) {
+	report := new(store.ImportReport)
+	var imported int64
+	err := s.transaction(ctx, func(tx *sqlx.Tx) error {
+		// The table is only dropped on commit, so it may be left over from an earlier import in the same transaction.
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf(`DROP TABLE IF EXISTS %s`, importTable)); err != nil {
+			return translate(err)
+		}
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf(`
+CREATE TEMPORARY TABLE %s (
+	ordinal		integer NOT NULL,
+	id			text NOT NULL,
+	name		text NULL,
+	department	text NULL,
+	company		text NULL,
+	company_id	text NULL,
+	department_id	text NULL,
+	details		jsonb NOT NULL
+) ON COMMIT DROP`, importTable)); err != nil {
+			return translate(err)
+		}
+
+		if err := copyContacts(ctx, tx, r, report); err != nil {
+			return err
+		}
+
+		var conflicts []struct {
+			Row int    `db:"ordinal"`
+			ID  string `db:"id"`
+		}
+		if err := tx.SelectContext(ctx, &conflicts, fmt.Sprintf(`
+SELECT i.ordinal, i.id FROM %[1]s i
+WHERE EXISTS (SELECT 1 FROM %[2]s c WHERE c.id = i.id)
+	OR EXISTS (SELECT 1 FROM %[1]s j WHERE j.id = i.id AND j.ordinal < i.ordinal)`,
+			importTable, contactTable,
+		)); err != nil {
+			return translate(err)
+		}
+		failed := map[int]bool{}
+		for _, c := range conflicts {
+			report.AddError(c.Row, &store.Contact{ID: c.ID}, store.ErrAlreadyExists)
+			failed[c.Row] = true
+		}
+
+		// Managers outside of the import are kept from being moved to the trash until the import is committed.
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf(
+			`SELECT 1 FROM %s WHERE deleted_at IS NULL AND id IN (SELECT details->>'manager_id' FROM %s) FOR SHARE`,
+			contactTable, importTable,
+		)); err != nil {
+			return translate(err)
+		}
+
+		// The foreign keys would fail the whole import, so references are checked beforehand to report them by row,
+		// together with names which differ from the referenced ones. Managers are no foreign key, but may be created by
+		// the import itself. Only the first invalid field of a row is reported, in the order of the other stores.
+		var references []struct {
+			Row   int    `db:"ordinal"`
+			ID    string `db:"id"`
+			Field string `db:"field"`
+		}
+		if err := tx.SelectContext(ctx, &references, fmt.Sprintf(`
+SELECT * FROM (
+	SELECT i.ordinal, i.id, CASE
+		WHEN i.company_id IS NOT NULL AND c.id IS NULL THEN 'company_id'
+		WHEN coalesce(i.company, '') <> '' AND lower(i.company) <> lower(c.name) THEN 'company'
+		WHEN i.department_id IS NOT NULL AND d.id IS NULL THEN 'department_id'
+		WHEN coalesce(i.department, '') <> '' AND lower(i.department) <> lower(d.name) THEN 'department'
+	END AS field
+	FROM %[1]s i
+	LEFT JOIN %[2]s c ON c.id = i.company_id
+	LEFT JOIN %[3]s d ON d.id = i.department_id AND d.company_id = i.company_id
+) o WHERE o.field IS NOT NULL
+UNION ALL
+SELECT i.ordinal, i.id, 'manager_id' AS field FROM %[1]s i
+WHERE i.details->>'manager_id' IS NOT NULL
+	AND NOT EXISTS (SELECT 1 FROM %[4]s c WHERE c.id = i.details->>'manager_id' AND c.deleted_at IS NULL)
+	AND NOT EXISTS (SELECT 1 FROM %[1]s j WHERE j.id = i.details->>'manager_id')
+ORDER BY ordinal, field`,
+			importTable, companyTable, departmentTable, contactTable,
+		)); err != nil {
+			return translate(err)
+		}
+		for _, r := range references {
+			if failed[r.Row] {
+				continue
+			}
+			err := store.InvalidReference(r.Field)
+			if r.Field == "company" || r.Field == "department" {
+				err = store.InvalidName(r.Field)
+			}
+			report.AddError(r.Row, &store.Contact{ID: r.ID}, err)
+			failed[r.Row] = true
+		}
+
+		// Nothing but the temporary table was written so far, so there is nothing to roll back.
+		if len(report.Errors) > 0 {
+			sort.Slice(report.Errors, func(i, j int) bool { return report.Errors[i].Row < report.Errors[j].Row })
+			return nil
+		}
+
+		// The companies and departments are locked and their names copied, like lockOrg does for single contacts.
+		for _, table := range []struct{ org, name, column string }{
+			{companyTable, "company", "company_id"},
+			{departmentTable, "department", "department_id"},
+		} {
+			if _, err := tx.ExecContext(ctx, fmt.Sprintf(
+				`SELECT 1 FROM %[1]s WHERE id IN (SELECT %[3]s FROM %[2]s) FOR SHARE`, table.org, importTable, table.column,
+			)); err != nil {
+				return translate(err)
+			}
+			if _, err := tx.ExecContext(ctx, fmt.Sprintf(
+				`UPDATE %[2]s i SET %[3]s = o.name FROM %[1]s o WHERE o.id = i.%[4]s`, table.org, importTable, table.name, table.column,
+			)); err != nil {
+				return translate(err)
+			}
+		}
+
+		// The imported contacts are recorded in the same statement. RowsAffected counts the inserted changes.
+		res, err := tx.ExecContext(ctx, fmt.Sprintf(`
+WITH imported AS (
+	INSERT INTO %s (id, name, department, company, company_id, department_id, details, version)
+	SELECT id, name, department, company, company_id, department_id, details, 1 FROM %s ORDER BY ordinal
+	RETURNING *
+)
+INSERT INTO %s (contact_id, action, after, actor, request_id)
+SELECT id, $1, %s, $2, $3 FROM imported`, contactTable, importTable, historyTable, snapshot("imported")),
+			store.ActionCreate, s.actor.Name, s.actor.RequestID,
+		)
+		if err != nil {
+			return translate(err)
+		}
+		imported, err = res.RowsAffected()
+		return translate(err)
+	})
+	if err != nil {
+		return report, err
+	}
+
+	report.Imported = int(imported)
+	return report, nil
+}
+
+// copyContacts copies valid contacts into the import table and records invalid ones in report. Once a row failed,
+// the remaining rows are only validated, because nothing is going to be imported anyway.
+func copyContacts(ctx context.Context, tx *sqlx.Tx, r store.ContactReader, report *store.ImportReport) error {
+	stmt, err := tx.PrepareContext(ctx, pq.CopyIn(importTable, "ordinal", "id", "name", "department", "company", "company_id", "department_id", "details"))
+	if err != nil {
+		return translate(err)
+	}
+	defer stmt.Close()
+
+	for {
+		c, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+
+		report.Rows++
+		if err == nil {
+			err = c.Validate()
+		}
+		if err != nil {
+			if !report.AddError(report.Rows, c, err) {
+				return err
+			}
+			continue
+		} else if len(report.Errors) > 0 {
+			continue
+		}
+
+		if c.ID == "" {
+			c.ID = store.NewID()
+		}
+		// COPY sends all values as text, so the details are passed as a JSON string.
+		d, err := newDetails(c).Value()
+		if err != nil {
+			return err
+		}
+		if _, err := stmt.ExecContext(ctx, report.Rows, c.ID, c.Name, c.Department, c.Company,
+			nullString(c.CompanyID), nullString(c.DepartmentID), d,
+		); err != nil {
+			return translate(err)
+		}
+	}
+
+	if _, err := stmt.ExecContext(ctx); err != nil {
+		return translate(err)
+	}
+	return translate(stmt.Close())
+}
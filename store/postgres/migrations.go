@@ -0,0 +1,458 @@
+package postgres
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/jmoiron/sqlx"
+)
+
+// migrationTable records which migrations have been applied.
+const migrationTable = "dbg_schema_migrations"
+
+// migrationLock is the key of the advisory lock held while migrating, so replicas booting at the same time do not
+// apply migrations twice.
+const migrationLock = 0x646267
+
+// Migration is a versioned schema change. Up applies the change and Down reverts it.
+type Migration struct {
+	Version     int
+	Description string
+	Up          []string
+	Down        []string
+}
+
+// MigrationStatus tells whether a migration has been applied and when.
+type MigrationStatus struct {
+	*Migration
+	AppliedAt *time.Time
+}
+
+// Migrations are all schema changes in the order they are applied. Never change a migration which was released,
+// add a new one instead. The statements of the first migrations are idempotent because they were originally
+// applied without bookkeeping.
+var Migrations = []*Migration{
+	{
+		Version:     1,
+		Description: "Create contacts table",
+		Up: []string{
+			fmt.Sprintf(`
+CREATE TABLE IF NOT EXISTS %s (
+	id       	text NOT NULL PRIMARY KEY,
+	name		text NULL,
+	department	text NULL,
+	company		text NULL
+)`, contactTable),
+		},
+		Down: []string{
+			fmt.Sprintf(`DROP TABLE %s`, contactTable),
+		},
+	},
+	{
+		// Each contact carries the revision it was written at, drawn from a sequence, so writers never wait for each
+		// other, see FetchMeta.
+		Version:     2,
+		Description: "Track the revision of the contacts table",
+		Up: []string{
+			fmt.Sprintf(`CREATE SEQUENCE IF NOT EXISTS %s`, revisionSequence),
+			fmt.Sprintf(`ALTER TABLE %s ADD COLUMN IF NOT EXISTS revision bigint NOT NULL DEFAULT nextval('%s')`, contactTable, revisionSequence),
+			fmt.Sprintf(`ALTER TABLE %s ADD COLUMN IF NOT EXISTS modified_at timestamptz NOT NULL DEFAULT now()`, contactTable),
+			fmt.Sprintf(`
+CREATE OR REPLACE FUNCTION dbg_contacts_stamp() RETURNS trigger AS $$
+BEGIN
+	NEW.revision := nextval('%s');
+	NEW.modified_at := now();
+	RETURN NEW;
+END
+$$ LANGUAGE plpgsql`, revisionSequence),
+			fmt.Sprintf(`DROP TRIGGER IF EXISTS dbg_contacts_stamp ON %s`, contactTable),
+			fmt.Sprintf(`
+CREATE TRIGGER dbg_contacts_stamp BEFORE INSERT OR UPDATE ON %s
+	FOR EACH ROW EXECUTE PROCEDURE dbg_contacts_stamp()`, contactTable),
+		},
+		Down: []string{
+			fmt.Sprintf(`DROP TRIGGER dbg_contacts_stamp ON %s`, contactTable),
+			`DROP FUNCTION dbg_contacts_stamp()`,
+			fmt.Sprintf(`ALTER TABLE %s DROP COLUMN modified_at`, contactTable),
+			fmt.Sprintf(`ALTER TABLE %s DROP COLUMN revision`, contactTable),
+			fmt.Sprintf(`DROP SEQUENCE %s`, revisionSequence),
+		},
+	},
+	{
+		Version:     3,
+		Description: "Add indices for keyset pagination",
+		Up: []string{
+			fmt.Sprintf(`CREATE INDEX IF NOT EXISTS dbg_contacts_id_idx ON %s ((id COLLATE "C"))`, contactTable),
+			fmt.Sprintf(`CREATE INDEX IF NOT EXISTS dbg_contacts_name_idx ON %s ((coalesce(name, '') COLLATE "C"), (id COLLATE "C"))`, contactTable),
+			fmt.Sprintf(`CREATE INDEX IF NOT EXISTS dbg_contacts_department_idx ON %s ((coalesce(department, '') COLLATE "C"), (id COLLATE "C"))`, contactTable),
+			fmt.Sprintf(`CREATE INDEX IF NOT EXISTS dbg_contacts_company_idx ON %s ((coalesce(company, '') COLLATE "C"), (id COLLATE "C"))`, contactTable),
+		},
+		Down: []string{
+			`DROP INDEX dbg_contacts_id_idx`,
+			`DROP INDEX dbg_contacts_name_idx`,
+			`DROP INDEX dbg_contacts_department_idx`,
+			`DROP INDEX dbg_contacts_company_idx`,
+		},
+	},
+	{
+		// unaccent is not immutable and can therefore not be used in an index directly, dbg_fold wraps it. dbg_fold must
+		// fold like store.IndexWords. Words with umlauts yield both spellings, so "Müller" is found by "Mueller" and
+		// "Muller".
+		Version:     4,
+		Description: "Add full-text and trigram search indices",
+		Up: []string{
+			`CREATE EXTENSION IF NOT EXISTS unaccent`,
+			`CREATE EXTENSION IF NOT EXISTS pg_trgm`,
+			`
+CREATE OR REPLACE FUNCTION dbg_fold(text) RETURNS text AS $$
+	SELECT CASE WHEN folded = stripped THEN folded ELSE folded || ' ' || stripped END FROM (
+		SELECT public.unaccent('public.unaccent'::regdictionary, replace(replace(replace(t, 'ä', 'ae'), 'ö', 'oe'), 'ü', 'ue')) AS folded,
+			public.unaccent('public.unaccent'::regdictionary, t) AS stripped
+		FROM (SELECT replace(lower(coalesce($1, '')), 'ß', 'ss') AS t) AS lowered
+	) AS spellings
+$$ LANGUAGE sql IMMUTABLE`,
+			fmt.Sprintf(`CREATE INDEX IF NOT EXISTS dbg_contacts_search_idx ON %s USING gin ((%s))`, contactTable, searchDocument),
+			fmt.Sprintf(`CREATE INDEX IF NOT EXISTS dbg_contacts_trgm_idx ON %s USING gin ((%s) gin_trgm_ops)`, contactTable, searchText),
+		},
+		Down: []string{
+			`DROP INDEX dbg_contacts_search_idx`,
+			`DROP INDEX dbg_contacts_trgm_idx`,
+			`DROP FUNCTION dbg_fold(text)`,
+		},
+	},
+	{
+		Version:     5,
+		Description: "Add contact versions for optimistic locking",
+		Up: []string{
+			fmt.Sprintf(`ALTER TABLE %s ADD COLUMN version integer NOT NULL DEFAULT 1`, contactTable),
+		},
+		Down: []string{
+			fmt.Sprintf(`ALTER TABLE %s DROP COLUMN version`, contactTable),
+		},
+	},
+	{
+		Version:     6,
+		Description: "Add soft deletion",
+		Up: []string{
+			fmt.Sprintf(`ALTER TABLE %s ADD COLUMN deleted_at timestamptz NULL`, contactTable),
+			fmt.Sprintf(`CREATE INDEX dbg_contacts_deleted_at_idx ON %s (deleted_at) WHERE deleted_at IS NOT NULL`, contactTable),
+		},
+		Down: []string{
+			`DROP INDEX dbg_contacts_deleted_at_idx`,
+			fmt.Sprintf(`ALTER TABLE %s DROP COLUMN deleted_at`, contactTable),
+		},
+	},
+	{
+		// The history is append-only, the trigger rejects any attempt to change it. seq is drawn before the change
+		// commits, so a lower seq may become visible after a higher one. The ID of the writing transaction tells which
+		// changes are final, see Audit.
+		Version:     7,
+		Description: "Add contact history",
+		Up: []string{
+			fmt.Sprintf(`
+CREATE TABLE %s (
+	seq			bigserial NOT NULL PRIMARY KEY,
+	contact_id	text NOT NULL,
+	action		text NOT NULL,
+	before		jsonb NULL,
+	after		jsonb NULL,
+	actor		text NOT NULL DEFAULT '',
+	request_id	text NOT NULL DEFAULT '',
+	created_at	timestamptz NOT NULL DEFAULT now(),
+	xid			bigint NOT NULL DEFAULT txid_current()
+)`, historyTable),
+			fmt.Sprintf(`CREATE INDEX dbg_contact_history_contact_idx ON %s (contact_id, seq)`, historyTable),
+			fmt.Sprintf(`CREATE INDEX dbg_contact_history_created_at_idx ON %s (created_at)`, historyTable),
+			fmt.Sprintf(`CREATE INDEX dbg_contact_history_xid_idx ON %s (xid, seq)`, historyTable),
+			`
+CREATE FUNCTION dbg_history_immutable() RETURNS trigger AS $$
+BEGIN
+	RAISE EXCEPTION 'the contact history can not be changed';
+END
+$$ LANGUAGE plpgsql`,
+			fmt.Sprintf(`
+CREATE TRIGGER dbg_history_immutable BEFORE UPDATE OR DELETE ON %s
+	FOR EACH ROW EXECUTE PROCEDURE dbg_history_immutable()`, historyTable),
+		},
+		Down: []string{
+			fmt.Sprintf(`DROP TABLE %s`, historyTable),
+			`DROP FUNCTION dbg_history_immutable()`,
+		},
+	},
+	{
+		// Notifications are sent on commit, so listeners only learn about committed changes.
+		Version:     8,
+		Description: "Notify listeners of contact changes",
+		Up: []string{
+			fmt.Sprintf(`
+CREATE FUNCTION dbg_contact_history_notify() RETURNS trigger AS $$
+BEGIN
+	PERFORM pg_notify('%s', NEW.seq::text);
+	RETURN NULL;
+END
+$$ LANGUAGE plpgsql`, changeChannel),
+			fmt.Sprintf(`
+CREATE TRIGGER dbg_contact_history_notify AFTER INSERT ON %s
+	FOR EACH ROW EXECUTE PROCEDURE dbg_contact_history_notify()`, historyTable),
+		},
+		Down: []string{
+			fmt.Sprintf(`DROP TRIGGER dbg_contact_history_notify ON %s`, historyTable),
+			`DROP FUNCTION dbg_contact_history_notify()`,
+		},
+	},
+	{
+		// Deliveries are queued by a trigger, so they are committed or rolled back together with the change.
+		Version:     9,
+		Description: "Add webhooks",
+		Up: []string{
+			fmt.Sprintf(`
+CREATE TABLE %s (
+	id			text NOT NULL PRIMARY KEY,
+	url			text NOT NULL,
+	secret		text NOT NULL DEFAULT '',
+	events		text[] NOT NULL DEFAULT '{}',
+	active		boolean NOT NULL DEFAULT true,
+	created_at	timestamptz NOT NULL DEFAULT now()
+)`, webhookTable),
+			fmt.Sprintf(`
+CREATE TABLE %s (
+	id				bigserial NOT NULL PRIMARY KEY,
+	webhook_id		text NOT NULL REFERENCES %s (id) ON DELETE CASCADE,
+	seq				bigint NOT NULL REFERENCES %s (seq),
+	status			text NOT NULL DEFAULT 'pending',
+	attempts		integer NOT NULL DEFAULT 0,
+	next_attempt	timestamptz NOT NULL DEFAULT now(),
+	last_status		integer NOT NULL DEFAULT 0,
+	last_error		text NOT NULL DEFAULT '',
+	created_at		timestamptz NOT NULL DEFAULT now(),
+	updated_at		timestamptz NOT NULL DEFAULT now()
+)`, deliveryTable, webhookTable, historyTable),
+			fmt.Sprintf(`CREATE INDEX dbg_webhook_deliveries_due_idx ON %s (next_attempt) WHERE status = 'pending'`, deliveryTable),
+			fmt.Sprintf(`CREATE INDEX dbg_webhook_deliveries_webhook_idx ON %s (webhook_id, id)`, deliveryTable),
+			fmt.Sprintf(`
+CREATE FUNCTION dbg_webhook_enqueue() RETURNS trigger AS $$
+BEGIN
+	INSERT INTO %s (webhook_id, seq)
+	SELECT id, NEW.seq FROM %s WHERE active AND (cardinality(events) = 0 OR NEW.action = ANY(events));
+	RETURN NULL;
+END
+$$ LANGUAGE plpgsql`, deliveryTable, webhookTable),
+			fmt.Sprintf(`
+CREATE TRIGGER dbg_webhook_enqueue AFTER INSERT ON %s
+	FOR EACH ROW EXECUTE PROCEDURE dbg_webhook_enqueue()`, historyTable),
+		},
+		Down: []string{
+			fmt.Sprintf(`DROP TRIGGER dbg_webhook_enqueue ON %s`, historyTable),
+			`DROP FUNCTION dbg_webhook_enqueue()`,
+			fmt.Sprintf(`DROP TABLE %s`, deliveryTable),
+			fmt.Sprintf(`DROP TABLE %s`, webhookTable),
+		},
+	},
+	{
+		// Emails, phones, addresses, the manager, tags and attributes are kept as JSON, see details.
+		Version:     10,
+		Description: "Add contact details",
+		Up: []string{
+			fmt.Sprintf(`ALTER TABLE %s ADD COLUMN details jsonb NOT NULL DEFAULT '{}'`, contactTable),
+			fmt.Sprintf(`CREATE INDEX dbg_contacts_tags_idx ON %s USING gin ((details->'tags'))`, contactTable),
+		},
+		Down: []string{
+			`DROP INDEX dbg_contacts_tags_idx`,
+			fmt.Sprintf(`ALTER TABLE %s DROP COLUMN details`, contactTable),
+		},
+	},
+	{
+		// The foreign key of a contact's department includes the company, so the department must belong to it.
+		// Companies and departments are created for the names of the existing contacts, ignoring case and taking the
+		// spelling which sorts first, capitals first. The contacts reference them and take their names, which
+		// increments their versions without recording the changes in the history.
+		Version:     11,
+		Description: "Add companies and departments",
+		Up: []string{
+			fmt.Sprintf(`
+CREATE TABLE %s (
+	id			text NOT NULL PRIMARY KEY,
+	name		text NOT NULL,
+	created_at	timestamptz NOT NULL DEFAULT now()
+)`, companyTable),
+			fmt.Sprintf(`CREATE UNIQUE INDEX dbg_companies_name_idx ON %s (lower(name))`, companyTable),
+			fmt.Sprintf(`
+CREATE TABLE %s (
+	id			text NOT NULL PRIMARY KEY,
+	company_id	text NOT NULL CONSTRAINT dbg_departments_company_fk REFERENCES %s (id),
+	name		text NOT NULL,
+	created_at	timestamptz NOT NULL DEFAULT now(),
+	UNIQUE (company_id, id)
+)`, departmentTable, companyTable),
+			fmt.Sprintf(`CREATE UNIQUE INDEX dbg_departments_name_idx ON %s (company_id, lower(name))`, departmentTable),
+			fmt.Sprintf(`ALTER TABLE %s ADD COLUMN company_id text NULL CONSTRAINT %s REFERENCES %s (id)`,
+				contactTable, contactCompanyFK, companyTable),
+			fmt.Sprintf(`ALTER TABLE %s ADD COLUMN department_id text NULL CHECK (department_id IS NULL OR company_id IS NOT NULL)`, contactTable),
+			fmt.Sprintf(`ALTER TABLE %s ADD CONSTRAINT %s FOREIGN KEY (company_id, department_id) REFERENCES %s (company_id, id)`,
+				contactTable, contactDepartmentFK, departmentTable),
+			fmt.Sprintf(`CREATE INDEX dbg_contacts_org_idx ON %s (company_id, department_id)`, contactTable),
+			fmt.Sprintf(`
+INSERT INTO %[2]s (id, name)
+SELECT DISTINCT ON (lower(company)) md5(random()::text || clock_timestamp()::text)::uuid::text, company FROM %[1]s
+WHERE coalesce(company, '') <> ''
+ORDER BY lower(company), company COLLATE "C"`, contactTable, companyTable),
+			fmt.Sprintf(`UPDATE %[1]s ct SET company_id = c.id FROM %[2]s c WHERE lower(c.name) = lower(ct.company)`,
+				contactTable, companyTable),
+			fmt.Sprintf(`
+INSERT INTO %[2]s (id, company_id, name)
+SELECT DISTINCT ON (company_id, lower(department)) md5(random()::text || clock_timestamp()::text)::uuid::text, company_id, department
+FROM %[1]s
+WHERE company_id IS NOT NULL AND coalesce(department, '') <> ''
+ORDER BY company_id, lower(department), department COLLATE "C"`, contactTable, departmentTable),
+			fmt.Sprintf(`
+UPDATE %[1]s ct SET department_id = d.id FROM %[2]s d
+WHERE d.company_id = ct.company_id AND lower(d.name) = lower(ct.department)`, contactTable, departmentTable),
+			fmt.Sprintf(`
+UPDATE %[1]s ct SET company = (SELECT name FROM %[2]s WHERE id = ct.company_id),
+	department = coalesce((SELECT name FROM %[3]s WHERE id = ct.department_id), ct.department), version = ct.version + 1
+WHERE ct.company_id IS NOT NULL`, contactTable, companyTable, departmentTable),
+		},
+		Down: []string{
+			`DROP INDEX dbg_contacts_org_idx`,
+			fmt.Sprintf(`ALTER TABLE %s DROP COLUMN department_id`, contactTable),
+			fmt.Sprintf(`ALTER TABLE %s DROP COLUMN company_id`, contactTable),
+			fmt.Sprintf(`DROP TABLE %s`, departmentTable),
+			fmt.Sprintf(`DROP TABLE %s`, companyTable),
+		},
+	},
+}
+
+// MigrateUp applies all pending migrations in a single transaction and returns how many were applied.
+func (s *PostgresStore) MigrateUp() (int, error) {
+	var applied int
+	err := s.migrate(func(tx *sqlx.Tx, versions map[int]time.Time) error {
+		for _, m := range Migrations {
+			if _, ok := versions[m.Version]; ok {
+				continue
+			}
+
+			log.Infof("Applying migration %d: %s", m.Version, m.Description)
+			if err := execAll(tx, m.Up); err != nil {
+				return fmt.Errorf("migration %d failed: %w", m.Version, err)
+			}
+			if _, err := tx.Exec(fmt.Sprintf("INSERT INTO %s (version) VALUES ($1)", migrationTable), m.Version); err != nil {
+				return err
+			}
+			applied++
+		}
+		return nil
+	})
+	return applied, err
+}
+
+// MigrateDown reverts the latest steps applied migrations in a single transaction and returns how many were
+// reverted.
+func (s *PostgresStore) MigrateDown(steps int) (int, error) {
+	var reverted int
+	err := s.migrate(func(tx *sqlx.Tx, versions map[int]time.Time) error {
+		for i := len(Migrations) - 1; i >= 0 && reverted < steps; i-- {
+			m := Migrations[i]
+			if _, ok := versions[m.Version]; !ok {
+				continue
+			}
+
+			log.Infof("Reverting migration %d: %s", m.Version, m.Description)
+			if err := execAll(tx, m.Down); err != nil {
+				return fmt.Errorf("reverting migration %d failed: %w", m.Version, err)
+			}
+			if _, err := tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE version = $1", migrationTable), m.Version); err != nil {
+				return err
+			}
+			reverted++
+		}
+		return nil
+	})
+	return reverted, err
+}
+
+// MigrationStatus returns all migrations and whether they have been applied. It only reads, so it neither waits for
+// the migration lock nor creates the migration table. All migrations are pending if the table does not exist.
+func (s *PostgresStore) MigrationStatus() ([]*MigrationStatus, error) {
+	var exists bool
+	if err := s.DB.Get(&exists, "SELECT to_regclass($1) IS NOT NULL", migrationTable); err != nil {
+		return nil, translate(err)
+	}
+
+	versions := map[int]time.Time{}
+	if exists {
+		var err error
+		if versions, err = appliedVersions(s.DB); err != nil {
+			return nil, err
+		}
+	}
+
+	var status []*MigrationStatus
+	for _, m := range Migrations {
+		ms := &MigrationStatus{Migration: m}
+		if at, ok := versions[m.Version]; ok {
+			ms.AppliedAt = &at
+		}
+		status = append(status, ms)
+	}
+	return status, nil
+}
+
+// migrate runs f in a transaction holding the migration lock. versions are the applied migrations.
+func (s *PostgresStore) migrate(f func(tx *sqlx.Tx, versions map[int]time.Time) error) error {
+	tx, err := s.DB.Beginx()
+	if err != nil {
+		return translate(err)
+	}
+	defer tx.Rollback()
+
+	// The lock is released automatically when the transaction ends.
+	if _, err := tx.Exec("SELECT pg_advisory_xact_lock($1)", migrationLock); err != nil {
+		return translate(err)
+	}
+
+	if _, err := tx.Exec(fmt.Sprintf(`
+CREATE TABLE IF NOT EXISTS %s (
+	version		integer NOT NULL PRIMARY KEY,
+	applied_at	timestamptz NOT NULL DEFAULT now()
+)`, migrationTable)); err != nil {
+		return translate(err)
+	}
+
+	versions, err := appliedVersions(tx)
+	if err != nil {
+		return err
+	}
+
+	if err := f(tx, versions); err != nil {
+		return translate(err)
+	}
+	return translate(tx.Commit())
+}
+
+// appliedVersions reads the migration table, which must exist, and returns when each migration was applied.
+func appliedVersions(q sqlx.Queryer) (map[int]time.Time, error) {
+	var rows []struct {
+		Version   int       `db:"version"`
+		AppliedAt time.Time `db:"applied_at"`
+	}
+	if err := sqlx.Select(q, &rows, fmt.Sprintf("SELECT version, applied_at FROM %s", migrationTable)); err != nil {
+		return nil, translate(err)
+	}
+
+	versions := map[int]time.Time{}
+	for _, r := range rows {
+		versions[r.Version] = r.AppliedAt
+	}
+	return versions, nil
+}
+
+func execAll(tx *sqlx.Tx, statements []string) error {
+	for _, statement := range statements {
+		if _, err := tx.Exec(statement); err != nil {
+			log.Warnf("Statement failed with error %s: %s", err, statement)
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,258 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/ory/workshop-dbg/store"
+)
+
+// The tables of companies and departments. Contacts reference them by foreign keys, so the database rejects
+// references to missing ones and the deletion of referenced ones.
+const (
+	companyTable    = "dbg_companies"
+	departmentTable = "dbg_departments"
+)
+
+// The constraints checking the references of contacts, see translate.
+const (
+	contactCompanyFK    = "dbg_contacts_company_fk"
+	contactDepartmentFK = "dbg_contacts_department_fk"
+)
+
+// isForeignKeyViolation returns true if err is raised by a foreign key.
+func isForeignKeyViolation(err error) bool {
+	pqErr, ok := err.(*pq.Error)
+	return ok && pqErr.Code == "23503"
+}
+
+func (s *PostgresStore) CreateCompanyContext(ctx context.Context, c *store.Company) error {
+	if err := c.Validate(); err != nil {
+		return err
+	}
+
+	if c.ID == "" {
+		c.ID = store.NewID()
+	}
+	if err := sqlx.GetContext(ctx, s.ext(), &c.CreatedAt, fmt.Sprintf(
+		"INSERT INTO %s (id, name) VALUES ($1, $2) RETURNING created_at", companyTable), c.ID, c.Name,
+	); err != nil {
+		return translate(err)
+	}
+	c.CreatedAt = c.CreatedAt.UTC()
+	return nil
+}
+
+func (s *PostgresStore) GetCompanyContext(ctx context.Context, id string) (*store.Company, error) {
+	var c store.Company
+	if err := sqlx.GetContext(ctx, s.ext(), &c, fmt.Sprintf("SELECT * FROM %s WHERE id = $1", companyTable), id); err != nil {
+		return nil, translate(err)
+	}
+	c.CreatedAt = c.CreatedAt.UTC()
+	return &c, nil
+}
+
+func (s *PostgresStore) FetchCompaniesContext(ctx context.Context) ([]*store.Company, error) {
+	cs := []*store.Company{}
+	if err := sqlx.SelectContext(ctx, s.ext(), &cs, fmt.Sprintf(
+		`SELECT * FROM %s ORDER BY name COLLATE "C", id COLLATE "C"`, companyTable,
+	)); err != nil {
+		return nil, translate(err)
+	}
+	for _, c := range cs {
+		c.CreatedAt = c.CreatedAt.UTC()
+	}
+	return cs, nil
+}
+
+func (s *PostgresStore) UpdateCompanyContext(ctx context.Context, c *store.Company) error {
+	if err := c.Validate(); err != nil {
+		return err
+	}
+
+	err := s.transaction(ctx, func(tx *sqlx.Tx) error {
+		if err := tx.GetContext(ctx, &c.CreatedAt, fmt.Sprintf(
+			"UPDATE %s SET name = $1 WHERE id = $2 RETURNING created_at", companyTable), c.Name, c.ID,
+		); err != nil {
+			return translate(err)
+		}
+		return s.syncContacts(ctx, tx, "company_id", c.ID)
+	})
+	if err != nil {
+		return err
+	}
+	c.CreatedAt = c.CreatedAt.UTC()
+	return nil
+}
+
+func (s *PostgresStore) DeleteCompanyContext(ctx context.Context, id string) error {
+	return s.deleteOrg(ctx, companyTable, id, store.ErrCompanyInUse)
+}
+
+func (s *PostgresStore) CreateDepartmentContext(ctx context.Context, d *store.Department) error {
+	if err := d.Validate(); err != nil {
+		return err
+	}
+
+	if d.ID == "" {
+		d.ID = store.NewID()
+	}
+	err := sqlx.GetContext(ctx, s.ext(), &d.CreatedAt, fmt.Sprintf(
+		"INSERT INTO %s (id, company_id, name) VALUES ($1, $2, $3) RETURNING created_at", departmentTable),
+		d.ID, d.CompanyID, d.Name,
+	)
+	if isForeignKeyViolation(err) {
+		return store.ErrNotFound
+	} else if err != nil {
+		return translate(err)
+	}
+	d.CreatedAt = d.CreatedAt.UTC()
+	return nil
+}
+
+func (s *PostgresStore) GetDepartmentContext(ctx context.Context, id string) (*store.Department, error) {
+	var d store.Department
+	if err := sqlx.GetContext(ctx, s.ext(), &d, fmt.Sprintf("SELECT * FROM %s WHERE id = $1", departmentTable), id); err != nil {
+		return nil, translate(err)
+	}
+	d.CreatedAt = d.CreatedAt.UTC()
+	return &d, nil
+}
+
+func (s *PostgresStore) FetchDepartmentsContext(ctx context.Context, companyID string) ([]*store.Department, error) {
+	if _, err := s.GetCompanyContext(ctx, companyID); err != nil {
+		return nil, err
+	}
+
+	ds := []*store.Department{}
+	if err := sqlx.SelectContext(ctx, s.ext(), &ds, fmt.Sprintf(
+		`SELECT * FROM %s WHERE company_id = $1 ORDER BY name COLLATE "C", id COLLATE "C"`, departmentTable), companyID,
+	); err != nil {
+		return nil, translate(err)
+	}
+	for _, d := range ds {
+		d.CreatedAt = d.CreatedAt.UTC()
+	}
+	return ds, nil
+}
+
+// UpdateDepartmentContext reads the department first, because validating it requires its company.
+func (s *PostgresStore) UpdateDepartmentContext(ctx context.Context, d *store.Department) error {
+	return s.transaction(ctx, func(tx *sqlx.Tx) error {
+		var current store.Department
+		if err := tx.GetContext(ctx, &current, fmt.Sprintf("SELECT * FROM %s WHERE id = $1 FOR UPDATE", departmentTable), d.ID); err != nil {
+			return translate(err)
+		}
+
+		d.CompanyID, d.CreatedAt = current.CompanyID, current.CreatedAt.UTC()
+		if err := d.Validate(); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf("UPDATE %s SET name = $1 WHERE id = $2", departmentTable), d.Name, d.ID); err != nil {
+			return translate(err)
+		}
+		return s.syncContacts(ctx, tx, "department_id", d.ID)
+	})
+}
+
+func (s *PostgresStore) DeleteDepartmentContext(ctx context.Context, id string) error {
+	return s.deleteOrg(ctx, departmentTable, id, store.ErrDepartmentInUse)
+}
+
+// deleteOrg deletes a company or department. The foreign keys referencing it fail the deletion with inUse.
+func (s *PostgresStore) deleteOrg(ctx context.Context, table, id string, inUse error) error {
+	result, err := s.ext().ExecContext(ctx, fmt.Sprintf("DELETE FROM %s WHERE id = $1", table), id)
+	if isForeignKeyViolation(err) {
+		return inUse
+	} else if err != nil {
+		return translate(err)
+	}
+
+	if n, err := result.RowsAffected(); err != nil {
+		return translate(err)
+	} else if n == 0 {
+		return store.ErrNotFound
+	}
+	return nil
+}
+
+// lockOrg checks the company and department of c and sets its names, see store.CheckReferences. FOR SHARE keeps them
+// from being renamed until the transaction ends, so a rename waits for the contact and then updates it, too.
+func lockOrg(ctx context.Context, tx *sqlx.Tx, c *store.Contact) error {
+	var failed error
+	lookup := func(dest interface{}, table, id string) bool {
+		err := tx.GetContext(ctx, dest, fmt.Sprintf("SELECT * FROM %s WHERE id = $1 FOR SHARE", table), id)
+		if err != nil && err != sql.ErrNoRows {
+			failed = translate(err)
+		}
+		return err == nil
+	}
+
+	err := store.CheckReferences(c,
+		func(id string) *store.Company {
+			var company store.Company
+			if !lookup(&company, companyTable, id) {
+				return nil
+			}
+			return &company
+		},
+		func(id string) *store.Department {
+			var d store.Department
+			if !lookup(&d, departmentTable, id) {
+				return nil
+			}
+			return &d
+		},
+	)
+	if failed != nil {
+		return failed
+	}
+	return err
+}
+
+// syncNames sets the company and department names of c to those of the referenced company and department, see
+// lockOrg.
+func syncNames(ctx context.Context, tx *sqlx.Tx, c *store.Contact) error {
+	if c.CompanyID != "" {
+		c.Company = ""
+	}
+	if c.DepartmentID != "" {
+		c.Department = ""
+	}
+	return lockOrg(ctx, tx, c)
+}
+
+// syncContacts updates the names of the contacts whose column references id after a rename, see syncNames, and
+// records the updates. Contacts in the trash are synced once they are restored.
+func (s *PostgresStore) syncContacts(ctx context.Context, tx *sqlx.Tx, column, id string) error {
+	var rows []*contactRow
+	if err := tx.SelectContext(ctx, &rows, fmt.Sprintf(
+		`SELECT * FROM %s WHERE %s = $1 AND deleted_at IS NULL ORDER BY id COLLATE "C" FOR UPDATE`, contactTable, column), id,
+	); err != nil {
+		return translate(err)
+	}
+
+	for _, row := range rows {
+		before := row.contact()
+		c := before.Clone()
+		if err := syncNames(ctx, tx, c); err != nil {
+			return err
+		} else if c.Company == before.Company && c.Department == before.Department {
+			continue
+		}
+
+		if err := tx.GetContext(ctx, &c.Version, fmt.Sprintf(
+			"UPDATE %s SET company = $1, department = $2, version = version + 1 WHERE id = $3 RETURNING version", contactTable),
+			c.Company, c.Department, c.ID,
+		); err != nil {
+			return translate(err)
+		}
+		if err := s.record(ctx, tx, store.ActionUpdate, c.ID, before, c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
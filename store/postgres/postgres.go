@@ -1,86 +1,482 @@
 package postgres
 
 import (
+	"context"
+	"database/sql"
 	"fmt"
-	log "github.com/Sirupsen/logrus"
+	"strings"
+	"time"
+
 	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
 	"github.com/ory/workshop-dbg/store"
 )
 
 const contactTable = "dbg_contacts"
 
+// revisionSequence numbers the writes to dbg_contacts. A trigger stamps each written row with the next number,
+// see FetchMeta.
+const revisionSequence = "dbg_contacts_revision_seq"
+
 type PostgresStore struct {
 	DB *sqlx.DB
+
+	// tx is set for stores passed to WithTx callbacks. All statements are run in it.
+	tx *sqlx.Tx
+
+	// actor is recorded with every change, see WithActor.
+	actor store.Actor
+
+	// events is set once Listen was called.
+	events *listener
 }
 
-var schemata = []string{
-	fmt.Sprintf(`
-CREATE TABLE IF NOT EXISTS %s (
-	id       	text NOT NULL PRIMARY KEY,
-	name		text NULL,
-	department	text NULL,
-	company		text NULL
+// searchDocument is the weighted full-text document and searchText the plain text used for trigram matching. Both
+// must match the index definitions exactly, otherwise PostgreSQL does not use the indices.
+const (
+	searchDocument = `setweight(to_tsvector('simple', dbg_fold(name)), 'A') || ` +
+		`to_tsvector('simple', dbg_fold(department) || ' ' || dbg_fold(company))`
+	searchText = `dbg_fold(name) || ' ' || dbg_fold(department) || ' ' || dbg_fold(company)`
 )
-`, contactTable),
-}
 
+// CreateSchemas applies all pending migrations, see MigrateUp.
 func (s *PostgresStore) CreateSchemas() error {
-	for k, schema := range schemata {
-		if _, err := s.DB.Exec(schema); err != nil {
-			log.Warnf("Error creating schema %d with error %s: %s", k, err, schema)
-			return err
-		}
-	}
-	return nil
+	_, err := s.MigrateUp()
+	return err
 }
 
-func (s *PostgresStore) FetchContacts() (store.Contacts, error) {
-	var cs []*store.Contact
+func (s *PostgresStore) FetchContactsContext(ctx context.Context) (store.Contacts, error) {
+	var rows []*contactRow
 	csi := store.Contacts{}
-	if err := s.DB.Select(&cs, fmt.Sprintf("SELECT * FROM %s", contactTable)); err != nil {
-		return csi, err
+	if err := sqlx.SelectContext(ctx, s.ext(), &rows, fmt.Sprintf("SELECT * FROM %s WHERE deleted_at IS NULL", contactTable)); err != nil {
+		return csi, translate(err)
 	}
 
-	for _, c := range cs {
-		csi[c.ID] = c
+	for _, r := range rows {
+		csi[r.ID] = r.contact()
 	}
 	return csi, nil
 }
 
-func (s *PostgresStore) GetContact(id string) (*store.Contact, error) {
+// sortColumns maps the sort fields to the expressions used for ordering. The "C" collation makes PostgreSQL
+// order by byte value like the other backends do.
+var sortColumns = map[string]string{
+	store.SortByID:         `id COLLATE "C"`,
+	store.SortByName:       `coalesce(name, '') COLLATE "C"`,
+	store.SortByDepartment: `coalesce(department, '') COLLATE "C"`,
+	store.SortByCompany:    `coalesce(company, '') COLLATE "C"`,
+}
+
+func (s *PostgresStore) QueryContactsContext(ctx context.Context, q *store.Query) (*store.Page, error) {
+	cursor, err := q.Normalize()
+	if err != nil {
+		return nil, err
+	}
+
+	var where []string
+	var args []interface{}
+	if !q.IncludeDeleted {
+		where = append(where, "deleted_at IS NULL")
+	}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	if q.Department != "" {
+		where = append(where, "department = "+arg(q.Department))
+	}
+	if q.Company != "" {
+		where = append(where, "company = "+arg(q.Company))
+	}
+	if q.DepartmentPrefix != "" {
+		where = append(where, "department LIKE "+arg(likePrefix(q.DepartmentPrefix)))
+	}
+	if q.CompanyPrefix != "" {
+		where = append(where, "company LIKE "+arg(likePrefix(q.CompanyPrefix)))
+	}
+	if q.Tag != "" {
+		// Matches the GIN index on the tags.
+		where = append(where, "details->'tags' @> jsonb_build_array("+arg(q.Tag)+"::text)")
+	}
+
+	// The total is counted without the cursor's condition.
+	count := fmt.Sprintf("SELECT count(*) FROM %s", contactTable)
+	if len(where) > 0 {
+		count += " WHERE " + strings.Join(where, " AND ")
+	}
+	countArgs := args
+
+	// Keyset pagination: continue after (or before) the sort key and ID the cursor points at.
+	column := sortColumns[q.SortBy]
+	order := "ASC"
+	if cursor != nil {
+		op := ">"
+		if cursor.Before {
+			op, order = "<", "DESC"
+		}
+		where = append(where, fmt.Sprintf(`(%s, id COLLATE "C") %s (%s, %s)`, column, op, arg(cursor.Key), arg(cursor.ID)))
+	}
+
+	query := fmt.Sprintf("SELECT * FROM %s", contactTable)
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	// Fetch one more row than requested to find out whether there are more pages.
+	query += fmt.Sprintf(` ORDER BY %s %s, id COLLATE "C" %s LIMIT %d`, column, order, order, q.Limit+1)
+
+	// Both are read from the same snapshot, so the total matches the contacts the page was taken from.
+	var total int
+	var rows []*contactRow
+	if err := s.snapshot(ctx, func(ext sqlx.ExtContext) error {
+		if err := sqlx.GetContext(ctx, ext, &total, count, countArgs...); err != nil {
+			return translate(err)
+		}
+		return translate(sqlx.SelectContext(ctx, ext, &rows, query, args...))
+	}); err != nil {
+		return nil, err
+	}
+	cs := contacts(rows)
+
+	more := len(cs) > q.Limit
+	if more {
+		cs = cs[:q.Limit]
+	}
+
+	before := cursor != nil && cursor.Before
+	if before {
+		// The rows were fetched in reverse order.
+		for i, j := 0, len(cs)-1; i < j; i, j = i+1, j-1 {
+			cs[i], cs[j] = cs[j], cs[i]
+		}
+	}
+
+	page := &store.Page{Contacts: cs, Total: total}
+	if len(cs) == 0 {
+		return page, nil
+	}
+
+	// Paging forward, there is a previous page if we came from one. Paging backward, there is a next page because we
+	// came from it.
+	if (cursor != nil && !before) || (before && more) {
+		page.PrevCursor = store.CursorBefore(cs[0], q.SortBy)
+	}
+	if (!before && more) || before {
+		page.NextCursor = store.CursorAfter(cs[len(cs)-1], q.SortBy)
+	}
+	return page, nil
+}
+
+func (s *PostgresStore) SearchContactsContext(ctx context.Context, query string, limit int) ([]*store.Contact, error) {
+	tokens, limit, err := store.NormalizeSearch(query, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	// Every word matches as a prefix, just like in the in-memory index. Tokens consist of letters and numbers only
+	// and are therefore safe to use in a tsquery. The trigram match additionally finds misspelled words.
+	tsquery := strings.Join(tokens, ":* & ") + ":*"
+	text := strings.Join(tokens, " ")
+
+	rows := []*contactRow{}
+	if err := sqlx.SelectContext(ctx, s.ext(), &rows, fmt.Sprintf(`
+SELECT c.* FROM %s c
+WHERE c.deleted_at IS NULL AND ((%s) @@ to_tsquery('simple', $1) OR $2 <%% (%s))
+ORDER BY ts_rank(%s, to_tsquery('simple', $1)) + word_similarity($2, %s) DESC, c.name, c.id
+LIMIT $3`, contactTable, searchDocument, searchText, searchDocument, searchText),
+		tsquery, text, limit,
+	); err != nil {
+		return nil, translate(err)
+	}
+	return contacts(rows), nil
+}
+
+// likePrefix returns a LIKE pattern matching strings which start with prefix.
+func likePrefix(prefix string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(prefix) + "%"
+}
+
+func (s *PostgresStore) GetContactContext(ctx context.Context, id string) (*store.Contact, error) {
+	var row contactRow
+	if err := sqlx.GetContext(ctx, s.ext(), &row, fmt.Sprintf("SELECT * FROM %s WHERE id = $1 AND deleted_at IS NULL", contactTable), id); err != nil {
+		return nil, translate(err)
+	}
+	return row.contact(), nil
+}
+
+func (s *PostgresStore) DeleteContactContext(ctx context.Context, id string, version int) error {
+	return s.transaction(ctx, func(tx *sqlx.Tx) error {
+		before, err := lockContact(ctx, tx, id, version)
+		if err != nil {
+			return err
+		}
+
+		var after contactRow
+		if err := tx.GetContext(ctx, &after, fmt.Sprintf("UPDATE %s SET deleted_at = now() WHERE id = $1 RETURNING *", contactTable), id); err != nil {
+			return translate(err)
+		}
+		return s.record(ctx, tx, store.ActionDelete, id, before, after.contact())
+	})
+}
+
+func (s *PostgresStore) UpdateContactContext(ctx context.Context, c *store.Contact) error {
+	if err := c.Validate(); err != nil {
+		return err
+	}
+
+	var version int
+	err := s.transaction(ctx, func(tx *sqlx.Tx) error {
+		before, err := lockContact(ctx, tx, c.ID, c.Version)
+		if err != nil {
+			return err
+		} else if err := lockOrg(ctx, tx, c); err != nil {
+			return err
+		} else if err := lockManager(ctx, tx, c); err != nil {
+			return err
+		}
+
+		if err := tx.GetContext(ctx, &version, fmt.Sprintf(
+			`UPDATE %s SET name = $1, department = $2, company = $3, company_id = $4, department_id = $5, details = $6,
+				version = version + 1 WHERE id = $7 RETURNING version`,
+			contactTable), c.Name, c.Department, c.Company, nullString(c.CompanyID), nullString(c.DepartmentID), newDetails(c), c.ID,
+		); err != nil {
+			return translate(err)
+		}
+
+		after := *c
+		after.Version, after.DeletedAt = version, nil
+		return s.record(ctx, tx, store.ActionUpdate, c.ID, before, &after)
+	})
+	if err != nil {
+		return err
+	}
+
+	c.Version, c.DeletedAt = version, nil
+	return nil
+}
+
+func (s *PostgresStore) PatchContactContext(ctx context.Context, id string, version int, patch func(*store.Contact) error) (*store.Contact, error) {
 	var c store.Contact
-	if err := s.DB.Get(&c, fmt.Sprintf("SELECT * FROM %s WHERE id = $1", contactTable), id); err != nil {
+	err := s.transaction(ctx, func(tx *sqlx.Tx) error {
+		before, err := lockContact(ctx, tx, id, version)
+		if err != nil {
+			return err
+		}
+
+		c = *before.Clone()
+		if err := patch(&c); err != nil {
+			return err
+		} else if c.ID != id {
+			return store.ErrIDChanged
+		} else if err := c.Validate(); err != nil {
+			return err
+		} else if err := lockOrg(ctx, tx, &c); err != nil {
+			return err
+		} else if err := lockManager(ctx, tx, &c); err != nil {
+			return err
+		}
+		c.DeletedAt = nil
+
+		if err := tx.GetContext(ctx, &c.Version, fmt.Sprintf(
+			`UPDATE %s SET name = $1, department = $2, company = $3, company_id = $4, department_id = $5, details = $6,
+				version = version + 1 WHERE id = $7 RETURNING version`,
+			contactTable), c.Name, c.Department, c.Company, nullString(c.CompanyID), nullString(c.DepartmentID), newDetails(&c), id,
+		); err != nil {
+			return translate(err)
+		}
+		return s.record(ctx, tx, store.ActionUpdate, id, before, &c)
+	})
+	if err != nil {
 		return nil, err
 	}
 	return &c, nil
 }
 
-func (s *PostgresStore) DeleteContact(id string) error {
-	if _, err := s.DB.Exec(fmt.Sprintf("DELETE FROM %s WHERE id = $1", contactTable), id); err != nil {
+func (s *PostgresStore) FetchTrashContext(ctx context.Context) ([]*store.Contact, error) {
+	rows := []*contactRow{}
+	if err := sqlx.SelectContext(ctx, s.ext(), &rows, fmt.Sprintf(
+		"SELECT * FROM %s WHERE deleted_at IS NOT NULL ORDER BY deleted_at DESC, id COLLATE \"C\"", contactTable,
+	)); err != nil {
+		return nil, translate(err)
+	}
+	return contacts(rows), nil
+}
+
+func (s *PostgresStore) RestoreContactContext(ctx context.Context, id string) (*store.Contact, error) {
+	var c *store.Contact
+	err := s.transaction(ctx, func(tx *sqlx.Tx) error {
+		var before contactRow
+		if err := tx.GetContext(ctx, &before, fmt.Sprintf("SELECT * FROM %s WHERE id = $1 AND deleted_at IS NOT NULL FOR UPDATE", contactTable), id); err != nil {
+			return translate(err)
+		}
+
+		// The company or department may have been renamed meanwhile.
+		names := before.contact()
+		if err := syncNames(ctx, tx, names); err != nil {
+			return err
+		}
+
+		var after contactRow
+		if err := tx.GetContext(ctx, &after, fmt.Sprintf(
+			"UPDATE %s SET company = $1, department = $2, deleted_at = NULL, version = version + 1 WHERE id = $3 RETURNING *",
+			contactTable), names.Company, names.Department, id,
+		); err != nil {
+			return translate(err)
+		}
+		c = after.contact()
+		return s.record(ctx, tx, store.ActionRestore, id, before.contact(), c)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (s *PostgresStore) PurgeContactsContext(ctx context.Context, deletedBefore time.Time) (int, error) {
+	// The purged contacts are recorded in the same statement. RowsAffected counts the inserted changes.
+	result, err := s.ext().ExecContext(ctx, fmt.Sprintf(`
+WITH purged AS (DELETE FROM %s WHERE deleted_at < $1 RETURNING *)
+INSERT INTO %s (contact_id, action, before, actor, request_id)
+SELECT id, $2, %s, $3, $4 FROM purged ORDER BY id COLLATE "C"`, contactTable, historyTable, snapshot("purged")),
+		deletedBefore, store.ActionPurge, s.actor.Name, s.actor.RequestID,
+	)
+	if err != nil {
+		return 0, translate(err)
+	}
+	n, err := result.RowsAffected()
+	return int(n), translate(err)
+}
+
+// WithTxContext runs f in a database transaction, which is committed if f returns nil. Within a transaction, WithTx
+// reuses it instead of starting another one.
+func (s *PostgresStore) WithTxContext(ctx context.Context, f func(tx store.ContactStorer) error) error {
+	return s.transaction(ctx, func(tx *sqlx.Tx) error {
+		return f(store.Bind(ctx, &PostgresStore{DB: s.DB, tx: tx, actor: s.actor, events: s.events}))
+	})
+}
+
+// transaction runs f in a new transaction, or in the store's transaction if it has one. In the latter case
+// committing is up to WithTx.
+func (s *PostgresStore) transaction(ctx context.Context, f func(tx *sqlx.Tx) error) error {
+	if s.tx != nil {
+		return f(s.tx)
+	}
+
+	tx, err := s.DB.BeginTxx(ctx, nil)
+	if err != nil {
+		return translate(err)
+	}
+	defer tx.Rollback()
+
+	if err := f(tx); err != nil {
 		return err
 	}
-	return nil
+	return translate(tx.Commit())
 }
 
-func (s *PostgresStore) UpdateContact(c *store.Contact) error {
-	if _, err := s.DB.NamedExec(
-		fmt.Sprintf("UPDATE %s SET name = :name, department = :department, company = :company WHERE id = :id", contactTable),
-		&c,
-	); err != nil {
+// snapshot runs f in a read-only transaction in which all statements see the same snapshot. Stores in a transaction
+// run f in it instead, so that f sees the transaction's writes.
+func (s *PostgresStore) snapshot(ctx context.Context, f func(ext sqlx.ExtContext) error) error {
+	if s.tx != nil {
+		return f(s.tx)
+	}
+
+	tx, err := s.DB.BeginTxx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return translate(err)
+	}
+	defer tx.Rollback()
+
+	if err := f(tx); err != nil {
 		return err
 	}
-	return nil
+	return translate(tx.Commit())
 }
 
-func (s *PostgresStore) CreateContact(c *store.Contact) error {
-	if _, err := s.DB.NamedExec(
-		fmt.Sprintf(
-			`INSERT INTO %s (id, name, department, company) VALUES (:id, :name, :department, :company)`,
-			contactTable,
-		),
-		*c,
-	); err != nil {
+// ext returns the store's transaction, if it has one, or the database.
+func (s *PostgresStore) ext() sqlx.ExtContext {
+	if s.tx != nil {
+		return s.tx
+	}
+	return s.DB
+}
+
+// lockContact reads a contact which is not in the trash and checks its version, unless version is 0. FOR UPDATE
+// locks the row until the transaction ends, so concurrent writes are applied one after another.
+func lockContact(ctx context.Context, tx *sqlx.Tx, id string, version int) (*store.Contact, error) {
+	var row contactRow
+	if err := tx.GetContext(ctx, &row, fmt.Sprintf("SELECT * FROM %s WHERE id = $1 AND deleted_at IS NULL FOR UPDATE", contactTable), id); err != nil {
+		return nil, translate(err)
+	} else if version != 0 && row.Version != version {
+		return nil, store.ErrVersionMismatch
+	}
+	return row.contact(), nil
+}
+
+// lockManager checks that the manager of c is a contact outside of the trash, see store.CheckManager. FOR SHARE keeps
+// the manager from being moved to the trash until the transaction ends.
+func lockManager(ctx context.Context, tx *sqlx.Tx, c *store.Contact) error {
+	if c.ManagerID == "" {
+		return nil
+	}
+
+	var id string
+	err := tx.GetContext(ctx, &id, fmt.Sprintf("SELECT id FROM %s WHERE id = $1 AND deleted_at IS NULL FOR SHARE", contactTable), c.ManagerID)
+	if err == sql.ErrNoRows {
+		return store.InvalidReference("manager_id")
+	}
+	return translate(err)
+}
+
+func (s *PostgresStore) CreateContactContext(ctx context.Context, c *store.Contact) error {
+	if err := c.Validate(); err != nil {
 		return err
 	}
-	return nil
+
+	if c.ID == "" {
+		c.ID = store.NewID()
+	}
+
+	c.Version, c.DeletedAt = 1, nil
+	return s.transaction(ctx, func(tx *sqlx.Tx) error {
+		if err := lockOrg(ctx, tx, c); err != nil {
+			return err
+		} else if err := lockManager(ctx, tx, c); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf(
+			`INSERT INTO %s (id, name, department, company, company_id, department_id, details, version)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+			contactTable), c.ID, c.Name, c.Department, c.Company, nullString(c.CompanyID), nullString(c.DepartmentID), newDetails(c), c.Version,
+		); err != nil {
+			return translate(err)
+		}
+		return s.record(ctx, tx, store.ActionCreate, c.ID, nil, c)
+	})
+}
+
+// FetchMetaContext derives the revision from the revisions of the listed contacts. Every write stamps a contact with a
+// revision above all earlier ones, so their count and sum change with every committed write, even if writes commit
+// in another order than they were stamped in. Trashing a contact stamps it, too, so the last modification includes
+// the trash. An empty list is at revision "0", like the lists of the other stores.
+func (s *PostgresStore) FetchMetaContext(ctx context.Context) (*store.Meta, error) {
+	var m struct {
+		Count      int         `db:"count"`
+		Sum        int64       `db:"sum"`
+		ModifiedAt pq.NullTime `db:"modified_at"`
+	}
+	if err := sqlx.GetContext(ctx, s.ext(), &m, fmt.Sprintf(`
+SELECT count(*) FILTER (WHERE deleted_at IS NULL) AS count,
+	coalesce(sum(revision) FILTER (WHERE deleted_at IS NULL), 0) AS sum,
+	max(modified_at) AS modified_at
+FROM %s`, contactTable,
+	)); err != nil {
+		return nil, translate(err)
+	}
+
+	meta := &store.Meta{Count: m.Count, Revision: "0", LastModified: m.ModifiedAt.Time.UTC()}
+	if m.Count > 0 {
+		meta.Revision = fmt.Sprintf("%d-%d", m.Count, m.Sum)
+	}
+	return meta, nil
 }
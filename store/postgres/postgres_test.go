@@ -1,27 +1,47 @@
 package postgres
 
 import (
+	"errors"
+	"fmt"
+	"strings"
+
 	"github.com/jmoiron/sqlx"
 	"github.com/ory-am/dockertest"
 	"testing"
 	"time"
 
 	_ "github.com/lib/pq"
+	"github.com/ory/workshop-dbg/bulk"
 	"github.com/ory/workshop-dbg/store"
+	"github.com/ory/workshop-dbg/store/storetest"
 	"github.com/pborman/uuid"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"log"
 	"os"
 )
 
 var s *PostgresStore
 
+// databaseURL is needed to listen for notifications.
+var databaseURL string
+
+// TestMain runs the tests against TEST_DATABASE_URL if set, for example a database service in CI, and against a
+// fresh container otherwise.
 func TestMain(m *testing.M) {
 	var db *sqlx.DB
 	var err error
 	var c dockertest.ContainerID
-	if c, err = dockertest.ConnectToPostgreSQL(15, time.Second, func(url string) bool {
+	if databaseURL = os.Getenv("TEST_DATABASE_URL"); databaseURL != "" {
+		if db, err = sqlx.Open("postgres", databaseURL); err == nil {
+			err = db.Ping()
+		}
+		if err != nil {
+			log.Fatalf("Could not connect to database: %s", err)
+		}
+	} else if c, err = dockertest.ConnectToPostgreSQL(15, time.Second, func(url string) bool {
 		var err error
+		databaseURL = url
 		db, err = sqlx.Open("postgres", url)
 		if err != nil {
 			return false
@@ -40,7 +60,9 @@ func TestMain(m *testing.M) {
 	}
 
 	result := m.Run()
-	c.KillRemove()
+	if c != "" {
+		c.KillRemove()
+	}
 	os.Exit(result)
 }
 
@@ -49,9 +71,9 @@ func TestStore(t *testing.T) {
 	c2 := &store.Contact{ID: uuid.New(), Name: "b", Department: "b1", Company: "b2"}
 	c3 := &store.Contact{ID: c2.ID, Name: "ba", Department: "ba1", Company: "ba2"}
 	r, err := s.GetContact(c1.ID)
-	assert.NotNil(t, err)
+	assert.Equal(t, store.ErrNotFound, err)
 
-	assert.Nil(t, s.DeleteContact(c1.ID))
+	assert.Equal(t, store.ErrNotFound, s.DeleteContact(c1.ID, 0))
 	assert.Nil(t, s.CreateContact(c1))
 	assert.Nil(t, s.CreateContact(c2))
 
@@ -67,6 +89,7 @@ func TestStore(t *testing.T) {
 	assert.Nil(t, err)
 	assert.EqualValues(t, c2, r)
 
+	assert.Equal(t, store.ErrNotFound, s.UpdateContact(&store.Contact{ID: uuid.New(), Name: "c"}))
 	assert.Nil(t, s.UpdateContact(c3))
 	r, err = s.GetContact(c3.ID)
 	assert.Nil(t, err)
@@ -76,15 +99,628 @@ func TestStore(t *testing.T) {
 	assert.Nil(t, err)
 	assert.EqualValues(t, c3, r)
 
-	assert.Nil(t, s.DeleteContact(c1.ID))
-	assert.Nil(t, s.DeleteContact(c1.ID))
+	assert.Nil(t, s.DeleteContact(c1.ID, 0))
+	assert.Equal(t, store.ErrNotFound, s.DeleteContact(c1.ID, 0))
 	cs, err = s.FetchContacts()
 	assert.Nil(t, err)
 	assert.Len(t, cs, 1)
 
-	assert.Nil(t, s.DeleteContact(c2.ID))
+	meta, err := s.FetchMeta()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, meta.Count)
+	assert.False(t, meta.LastModified.IsZero())
+
+	assert.Nil(t, s.DeleteContact(c2.ID, 0))
 	cs, err = s.FetchContacts()
 	assert.Nil(t, err)
 	assert.Len(t, cs, 0)
 
+	updated, err := s.FetchMeta()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, updated.Count)
+	assert.NotEqual(t, meta.Revision, updated.Revision)
+
+}
+
+func TestCreateContactGeneratesID(t *testing.T) {
+	c := &store.Contact{Name: "a", Department: "a1", Company: "a2"}
+	assert.Nil(t, s.CreateContact(c))
+	assert.NotEmpty(t, c.ID)
+
+	r, err := s.GetContact(c.ID)
+	assert.Nil(t, err)
+	assert.EqualValues(t, c, r)
+
+	assert.Equal(t, store.ErrAlreadyExists, s.CreateContact(&store.Contact{ID: c.ID, Name: "b"}))
+	assert.Nil(t, s.DeleteContact(c.ID, 0))
+}
+
+func TestQueryContacts(t *testing.T) {
+	// All contacts of this test share a company prefix, so contacts of other tests do not interfere.
+	prefix := uuid.New()
+	for i := 0; i < 25; i++ {
+		department := "IT"
+		if i%2 == 0 {
+			department = "HR"
+		}
+		assert.Nil(t, s.CreateContact(&store.Contact{
+			ID:         fmt.Sprintf("%s-%02d", prefix, i),
+			Name:       fmt.Sprintf("Name %02d", 24-i),
+			Department: department,
+			Company:    fmt.Sprintf("%s %d", prefix, i/10),
+		}))
+	}
+
+	// Page through all contacts sorted by name.
+	var ids []string
+	q := &store.Query{Limit: 10, SortBy: store.SortByName, CompanyPrefix: prefix}
+	pages := []*store.Page{}
+	for {
+		page, err := s.QueryContacts(q)
+		assert.Nil(t, err)
+		pages = append(pages, page)
+		for _, c := range page.Contacts {
+			ids = append(ids, c.ID)
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		q.Cursor = page.NextCursor
+	}
+	assert.Len(t, pages, 3)
+	assert.Len(t, ids, 25)
+	assert.Equal(t, prefix+"-24", ids[0])
+	assert.Equal(t, prefix+"-00", ids[24])
+	assert.Empty(t, pages[0].PrevCursor)
+	assert.NotEmpty(t, pages[2].PrevCursor)
+
+	// Going back from the last page returns the second page again.
+	page, err := s.QueryContacts(&store.Query{Limit: 10, SortBy: store.SortByName, CompanyPrefix: prefix, Cursor: pages[2].PrevCursor})
+	assert.Nil(t, err)
+	assert.Equal(t, pages[1].Contacts, page.Contacts)
+
+	// Filters
+	page, err = s.QueryContacts(&store.Query{Department: "IT", CompanyPrefix: prefix + " 1"})
+	assert.Nil(t, err)
+	assert.Len(t, page.Contacts, 5)
+	for _, c := range page.Contacts {
+		assert.Equal(t, "IT", c.Department)
+	}
+
+	for _, id := range ids {
+		assert.Nil(t, s.DeleteContact(id, 0))
+	}
+}
+
+func TestSearchContacts(t *testing.T) {
+	c1 := &store.Contact{Name: "Jürgen Elsner", Department: "DaCS", Company: "DBG"}
+	c2 := &store.Contact{Name: "Ulrich Meyer", Department: "TRIT", Company: "DBG"}
+	assert.Nil(t, s.CreateContact(c1))
+	assert.Nil(t, s.CreateContact(c2))
+
+	cs, err := s.SearchContacts("JURGEN", 0)
+	assert.Nil(t, err)
+	assert.NotEmpty(t, cs)
+	assert.Equal(t, c1.ID, cs[0].ID)
+
+	cs, err = s.SearchContacts("ulrich dbg", 0)
+	assert.Nil(t, err)
+	assert.NotEmpty(t, cs)
+	assert.Equal(t, c2.ID, cs[0].ID)
+
+	assert.Nil(t, s.DeleteContact(c1.ID, 0))
+	assert.Nil(t, s.DeleteContact(c2.ID, 0))
+}
+
+func TestMigrations(t *testing.T) {
+	status, err := s.MigrationStatus()
+	assert.Nil(t, err)
+	assert.Len(t, status, len(Migrations))
+	for _, m := range status {
+		assert.NotNil(t, m.AppliedAt, "migration %d", m.Version)
+	}
+
+	n, err := s.MigrateUp()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, n)
+
+	n, err = s.MigrateDown(1)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, n)
+
+	status, err = s.MigrationStatus()
+	assert.Nil(t, err)
+	assert.Nil(t, status[len(status)-1].AppliedAt)
+
+	n, err = s.MigrateUp()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, n)
+}
+
+// Migration 11 creates and references the companies and departments named by the existing contacts.
+func TestOrgMigration(t *testing.T) {
+	a := &store.Contact{Name: "a", Company: "Backfill Acme", Department: "Sales"}
+	b := &store.Contact{Name: "b", Company: "backfill initech", Department: "it"}
+	c := &store.Contact{Name: "c", Company: "Backfill Initech", Department: "IT"}
+	for _, contact := range []*store.Contact{a, b, c} {
+		require.Nil(t, s.CreateContact(contact))
+	}
+	defer func() {
+		_, err := s.DB.Exec(fmt.Sprintf("DELETE FROM %s WHERE id IN ($1, $2, $3)", contactTable), a.ID, b.ID, c.ID)
+		assert.Nil(t, err)
+		_, err = s.DB.Exec(fmt.Sprintf("DELETE FROM %s WHERE company_id IN (SELECT id FROM %s WHERE name LIKE 'Backfill %%')",
+			departmentTable, companyTable))
+		assert.Nil(t, err)
+		_, err = s.DB.Exec(fmt.Sprintf("DELETE FROM %s WHERE name LIKE 'Backfill %%'", companyTable))
+		assert.Nil(t, err)
+	}()
+
+	n, err := s.MigrateDown(1)
+	require.Nil(t, err)
+	require.Equal(t, 1, n)
+	n, err = s.MigrateUp()
+	require.Nil(t, err)
+	require.Equal(t, 1, n)
+
+	got := map[string]*store.Contact{}
+	for _, contact := range []*store.Contact{a, b, c} {
+		got[contact.Name], err = s.GetContact(contact.ID)
+		require.Nil(t, err)
+		assert.Equal(t, 2, got[contact.Name].Version, contact.Name)
+	}
+	assert.NotEmpty(t, got["a"].CompanyID)
+	assert.Equal(t, "Backfill Acme", got["a"].Company)
+	assert.NotEmpty(t, got["a"].DepartmentID)
+	assert.Equal(t, "Sales", got["a"].Department)
+
+	// The spelling with capitals is taken
+	assert.NotEmpty(t, got["b"].CompanyID)
+	assert.Equal(t, got["b"].CompanyID, got["c"].CompanyID)
+	assert.Equal(t, got["b"].DepartmentID, got["c"].DepartmentID)
+	assert.Equal(t, "Backfill Initech", got["b"].Company)
+	assert.Equal(t, "IT", got["b"].Department)
+}
+
+// The status of a database which was never migrated is read without creating the migration table.
+func TestMigrationStatusOfEmptyDatabase(t *testing.T) {
+	_, err := s.DB.Exec("CREATE SCHEMA dbg_status_test")
+	require.Nil(t, err)
+	defer s.DB.Exec("DROP SCHEMA dbg_status_test CASCADE")
+
+	separator := "?"
+	if strings.Contains(databaseURL, "?") {
+		separator = "&"
+	}
+	db, err := sqlx.Open("postgres", databaseURL+separator+"search_path=dbg_status_test")
+	require.Nil(t, err)
+	defer db.Close()
+
+	status, err := (&PostgresStore{DB: db}).MigrationStatus()
+	require.Nil(t, err)
+	require.Len(t, status, len(Migrations))
+	for _, m := range status {
+		assert.Nil(t, m.AppliedAt, "migration %d", m.Version)
+	}
+
+	var exists bool
+	require.Nil(t, db.Get(&exists, "SELECT to_regclass($1) IS NOT NULL", migrationTable))
+	assert.False(t, exists)
+}
+
+func TestVersions(t *testing.T) {
+	c := &store.Contact{Name: "a"}
+	assert.Nil(t, s.CreateContact(c))
+	assert.Equal(t, 1, c.Version)
+
+	// Unconditional and conditional updates increment the version
+	assert.Nil(t, s.UpdateContact(&store.Contact{ID: c.ID, Name: "b"}))
+	u := &store.Contact{ID: c.ID, Name: "c", Version: 2}
+	assert.Nil(t, s.UpdateContact(u))
+	assert.Equal(t, 3, u.Version)
+
+	// Stale writes are rejected
+	assert.Equal(t, store.ErrVersionMismatch, s.UpdateContact(&store.Contact{ID: c.ID, Name: "d", Version: 2}))
+	assert.Equal(t, store.ErrVersionMismatch, s.DeleteContact(c.ID, 2))
+
+	r, err := s.GetContact(c.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, "c", r.Name)
+	assert.Equal(t, 3, r.Version)
+
+	assert.Nil(t, s.DeleteContact(c.ID, 3))
+	assert.Equal(t, store.ErrNotFound, s.DeleteContact(c.ID, 3))
+}
+
+func TestPatchContact(t *testing.T) {
+	c := &store.Contact{Name: "a", Department: "a1", Company: "a2"}
+	assert.Nil(t, s.CreateContact(c))
+
+	r, err := s.PatchContact(c.ID, 1, func(p *store.Contact) error {
+		p.Department = "b1"
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "b1", r.Department)
+	assert.Equal(t, "a", r.Name)
+	assert.Equal(t, 2, r.Version)
+
+	_, err = s.PatchContact(c.ID, 1, func(p *store.Contact) error { return nil })
+	assert.Equal(t, store.ErrVersionMismatch, err)
+
+	_, err = s.PatchContact(c.ID, 0, func(p *store.Contact) error {
+		p.ID = "someone-else"
+		return nil
+	})
+	assert.Equal(t, store.ErrIDChanged, err)
+
+	_, err = s.PatchContact(c.ID, 0, func(p *store.Contact) error {
+		p.Name = ""
+		return nil
+	})
+	assert.True(t, errors.Is(err, store.ErrValidation))
+
+	_, err = s.PatchContact(uuid.New(), 0, func(p *store.Contact) error { return nil })
+	assert.Equal(t, store.ErrNotFound, err)
+
+	r, err = s.GetContact(c.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, "b1", r.Department)
+	assert.Equal(t, 2, r.Version)
+	assert.Nil(t, s.DeleteContact(c.ID, 0))
+}
+
+func TestImportContacts(t *testing.T) {
+	taken, a, b := uuid.New(), uuid.New(), uuid.New()
+	assert.Nil(t, s.CreateContact(&store.Contact{ID: taken, Name: "Taken"}))
+
+	rows := fmt.Sprintf(`{"id": %[1]q, "name": "A"}
+{"id": %[2]q, "name": "B"}
+{"name": ""}
+{"id": %[1]q, "name": "D"}`, a, taken)
+
+	// Atomic imports fail as a whole and report every failed row.
+	r, _ := bulk.NewReader(bulk.NDJSONType, strings.NewReader(rows))
+	report, err := store.Import(s, r, true)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, report.Rows)
+	assert.Equal(t, 0, report.Imported)
+	if assert.Len(t, report.Errors, 3) {
+		assert.Equal(t, []int{2, 3, 4}, []int{report.Errors[0].Row, report.Errors[1].Row, report.Errors[2].Row})
+		assert.Equal(t, taken, report.Errors[0].ID)
+	}
+	_, err = s.GetContact(a)
+	assert.Equal(t, store.ErrNotFound, err)
+
+	r, _ = bulk.NewReader(bulk.NDJSONType, strings.NewReader(fmt.Sprintf(`{"id": %q, "name": "A"}`+"\n"+`{"id": %q, "name": "B"}`, a, b)))
+	report, err = store.Import(s, r, true)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, report.Imported)
+	assert.Empty(t, report.Errors)
+
+	c, err := s.GetContact(b)
+	assert.Nil(t, err)
+	assert.Equal(t, "B", c.Name)
+	assert.Equal(t, 1, c.Version)
+
+	for _, id := range []string{taken, a, b} {
+		assert.Nil(t, s.DeleteContact(id, 0))
+	}
+}
+
+func TestWithTx(t *testing.T) {
+	a, b := uuid.New(), uuid.New()
+	assert.Nil(t, s.CreateContact(&store.Contact{ID: a, Name: "A"}))
+
+	failed := errors.New("failed")
+	assert.Equal(t, failed, s.WithTx(func(tx store.ContactStorer) error {
+		assert.Nil(t, tx.CreateContact(&store.Contact{ID: b, Name: "B"}))
+		assert.Nil(t, tx.DeleteContact(a, 0))
+
+		// Writes are visible within the transaction.
+		_, err := tx.GetContact(b)
+		assert.Nil(t, err)
+		return failed
+	}))
+
+	_, err := s.GetContact(b)
+	assert.Equal(t, store.ErrNotFound, err)
+	_, err = s.GetContact(a)
+	assert.Nil(t, err)
+
+	assert.Nil(t, s.WithTx(func(tx store.ContactStorer) error {
+		if err := tx.CreateContact(&store.Contact{ID: b, Name: "B"}); err != nil {
+			return err
+		}
+		if _, err := tx.PatchContact(b, 1, func(c *store.Contact) error {
+			c.Company = "ACME"
+			return nil
+		}); err != nil {
+			return err
+		}
+		return tx.DeleteContact(a, 1)
+	}))
+
+	_, err = s.GetContact(a)
+	assert.Equal(t, store.ErrNotFound, err)
+	c, err := s.GetContact(b)
+	assert.Nil(t, err)
+	assert.Equal(t, "ACME", c.Company)
+	assert.Equal(t, 2, c.Version)
+	assert.Nil(t, s.DeleteContact(b, 0))
+}
+
+func TestTrash(t *testing.T) {
+	company := uuid.New()
+	a := &store.Contact{ID: uuid.New(), Name: "Alice", Company: company}
+	b := &store.Contact{ID: uuid.New(), Name: "Bob", Company: company}
+	assert.Nil(t, s.CreateContact(a))
+	assert.Nil(t, s.CreateContact(b))
+	meta, err := s.FetchMeta()
+	assert.Nil(t, err)
+
+	assert.Nil(t, s.DeleteContact(a.ID, 1))
+	assert.Nil(t, s.DeleteContact(b.ID, 0))
+	assert.Equal(t, store.ErrNotFound, s.DeleteContact(b.ID, 0))
+
+	// Trashed contacts are hidden but keep their IDs.
+	_, err = s.GetContact(a.ID)
+	assert.Equal(t, store.ErrNotFound, err)
+	assert.Equal(t, store.ErrNotFound, s.UpdateContact(a))
+	assert.Equal(t, store.ErrAlreadyExists, s.CreateContact(&store.Contact{ID: a.ID, Name: "Another Alice"}))
+	deleted, err := s.FetchMeta()
+	assert.Nil(t, err)
+	assert.Equal(t, meta.Count-2, deleted.Count)
+
+	page, err := s.QueryContacts(&store.Query{Company: company})
+	assert.Nil(t, err)
+	assert.Empty(t, page.Contacts)
+	page, err = s.QueryContacts(&store.Query{Company: company, IncludeDeleted: true})
+	assert.Nil(t, err)
+	assert.Len(t, page.Contacts, 2)
+
+	var trashed []*store.Contact
+	trash, err := s.FetchTrash()
+	assert.Nil(t, err)
+	for _, c := range trash {
+		if c.Company == company {
+			trashed = append(trashed, c)
+		}
+	}
+	if assert.Len(t, trashed, 2) {
+		assert.NotNil(t, trashed[0].DeletedAt)
+	}
+
+	r, err := s.RestoreContact(a.ID)
+	assert.Nil(t, err)
+	assert.Nil(t, r.DeletedAt)
+	assert.Equal(t, 2, r.Version)
+	_, err = s.RestoreContact(a.ID)
+	assert.Equal(t, store.ErrNotFound, err)
+
+	// The database clock may differ from ours, so purge everything deleted until well after now.
+	n, err := s.PurgeContacts(time.Now().Add(time.Hour))
+	assert.Nil(t, err)
+	assert.True(t, n >= 1)
+	_, err = s.RestoreContact(b.ID)
+	assert.Equal(t, store.ErrNotFound, err)
+	assert.Nil(t, s.CreateContact(&store.Contact{ID: b.ID, Name: "Another Bob"}))
+}
+
+func TestHistory(t *testing.T) {
+	id := uuid.New()
+	_, err := s.History(id)
+	assert.Equal(t, store.ErrNotFound, err)
+
+	alice := store.Actor{Name: "alice", RequestID: uuid.New()}
+	c := &store.Contact{ID: id, Name: "A"}
+	assert.Nil(t, s.WithActor(alice).CreateContact(c))
+	c.Name = "Anna"
+	assert.Nil(t, s.UpdateContact(c))
+	_, err = s.WithActor(alice).PatchContact(id, 0, func(c *store.Contact) error {
+		c.Company = "ACME"
+		return nil
+	})
+	assert.Nil(t, err)
+
+	// A rolled back transaction leaves no trace.
+	assert.NotNil(t, s.WithActor(alice).(store.Transactor).WithTx(func(tx store.ContactStorer) error {
+		assert.Nil(t, tx.DeleteContact(id, 0))
+		return errors.New("failed")
+	}))
+	assert.Nil(t, s.WithActor(store.Actor{Name: "bob"}).DeleteContact(id, 0))
+	_, err = s.RestoreContact(id)
+	assert.Nil(t, err)
+
+	changes, err := s.History(id)
+	assert.Nil(t, err)
+	if !assert.Len(t, changes, 5) {
+		return
+	}
+	var actions, actors []string
+	for _, c := range changes {
+		actions = append(actions, c.Action)
+		actors = append(actors, c.Actor)
+	}
+	assert.Equal(t, []string{"create", "update", "update", "delete", "restore"}, actions)
+	assert.Equal(t, []string{"alice", "", "alice", "bob", ""}, actors)
+	assert.Equal(t, alice.RequestID, changes[0].RequestID)
+	assert.Nil(t, changes[0].Before)
+	assert.Equal(t, &store.Contact{ID: id, Name: "A", Version: 1}, changes[0].After)
+	assert.Equal(t, "Anna", changes[2].Before.Name)
+	assert.Equal(t, "ACME", changes[2].After.Company)
+	assert.NotNil(t, changes[3].After.DeletedAt)
+	assert.Equal(t, 4, changes[4].After.Version)
+
+	audit, err := s.Audit(&store.AuditQuery{After: changes[0].Seq, Since: changes[0].Time, Limit: 2})
+	assert.Nil(t, err)
+	assert.Len(t, audit, 2)
+	for _, c := range audit {
+		assert.True(t, c.Seq > changes[0].Seq)
+	}
+
+	// The history can not be changed.
+	_, err = s.DB.Exec(fmt.Sprintf("DELETE FROM %s WHERE contact_id = $1", historyTable), id)
+	assert.NotNil(t, err)
+}
+
+func TestAuditWithConcurrentWriters(t *testing.T) {
+	// The changes so far are paged through, so the cursor points to the latest.
+	var after int64
+	for {
+		changes, err := s.Audit(&store.AuditQuery{After: after, Limit: store.MaxLimit})
+		require.Nil(t, err)
+		if len(changes) == 0 {
+			break
+		}
+		after = changes[len(changes)-1].Seq
+	}
+
+	// The first writer draws the lower seq, but commits after the second one.
+	tx, err := s.DB.Beginx()
+	require.Nil(t, err)
+	defer tx.Rollback()
+	first, second := uuid.New(), uuid.New()
+	require.Nil(t, (&PostgresStore{DB: s.DB, tx: tx}).CreateContact(&store.Contact{ID: first, Name: "First"}))
+	require.Nil(t, s.CreateContact(&store.Contact{ID: second, Name: "Second"}))
+
+	changes, err := s.Audit(&store.AuditQuery{After: after})
+	require.Nil(t, err)
+	assert.Len(t, changes, 0)
+
+	require.Nil(t, tx.Commit())
+	changes, err = s.Audit(&store.AuditQuery{After: after})
+	require.Nil(t, err)
+	var ids []string
+	for _, c := range changes {
+		ids = append(ids, c.ContactID)
+	}
+	assert.Equal(t, []string{first, second}, ids)
+	assert.True(t, changes[0].Seq < changes[1].Seq)
+}
+
+func TestSubscribe(t *testing.T) {
+	_, _, err := s.Subscribe()
+	assert.True(t, errors.Is(err, store.ErrUnavailable))
+
+	// A second store stands in for another replica.
+	listening := &PostgresStore{DB: s.DB}
+	if !assert.Nil(t, listening.Listen(databaseURL)) {
+		return
+	}
+	defer listening.Unlisten()
+	changes, cancel, err := listening.Subscribe()
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer cancel()
+
+	id := uuid.New()
+	assert.Nil(t, s.WithActor(store.Actor{Name: "alice"}).CreateContact(&store.Contact{ID: id, Name: "A"}))
+	assert.NotNil(t, s.WithTx(func(tx store.ContactStorer) error {
+		assert.Nil(t, tx.DeleteContact(id, 0))
+		return errors.New("failed")
+	}))
+	assert.Nil(t, s.DeleteContact(id, 0))
+
+	// Rolled back changes are never announced.
+	var actions []string
+	timeout := time.After(10 * time.Second)
+	for len(actions) < 2 {
+		select {
+		case c := <-changes:
+			if c.ContactID != id {
+				continue
+			}
+			actions = append(actions, c.Action)
+			if c.Action == store.ActionCreate {
+				assert.Equal(t, "alice", c.Actor)
+				assert.Equal(t, "A", c.After.Name)
+			}
+		case <-timeout:
+			t.Fatalf("Received only %v", actions)
+		}
+	}
+	assert.Equal(t, []string{store.ActionCreate, store.ActionDelete}, actions)
+}
+
+func TestWebhooks(t *testing.T) {
+	assert.True(t, errors.Is(s.CreateWebhook(&store.Webhook{URL: "ftp://example.com"}), store.ErrValidation))
+
+	deletes := &store.Webhook{URL: "http://example.com/deletes", Secret: "secret", Events: []string{store.ActionDelete}, Active: true}
+	inactive := &store.Webhook{URL: "http://example.com/inactive", Events: []string{}}
+	assert.Nil(t, s.CreateWebhook(deletes))
+	assert.Nil(t, s.CreateWebhook(inactive))
+	defer s.DeleteWebhook(deletes.ID)
+	defer s.DeleteWebhook(inactive.ID)
+
+	w, err := s.GetWebhook(deletes.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, deletes, w)
+	ws, err := s.FetchWebhooks()
+	assert.Nil(t, err)
+	assert.Contains(t, ws, inactive)
+
+	// Deliveries are queued for every change a webhook receives, except for rolled back ones.
+	id := uuid.New()
+	assert.Nil(t, s.CreateContact(&store.Contact{ID: id, Name: "A"}))
+	assert.NotNil(t, s.WithTx(func(tx store.ContactStorer) error {
+		assert.Nil(t, tx.DeleteContact(id, 0))
+		return errors.New("failed")
+	}))
+	assert.Nil(t, s.DeleteContact(id, 0))
+
+	ds, err := s.FetchDeliveries(&store.DeliveryQuery{WebhookID: deletes.ID})
+	assert.Nil(t, err)
+	if !assert.Len(t, ds, 1) {
+		return
+	}
+	assert.Equal(t, store.ActionDelete, ds[0].Change.Action)
+	assert.Equal(t, id, ds[0].Change.ContactID)
+	assert.Equal(t, store.DeliveryPending, ds[0].Status)
+	ds, err = s.FetchDeliveries(&store.DeliveryQuery{WebhookID: inactive.ID})
+	assert.Nil(t, err)
+	assert.Empty(t, ds)
+
+	// The database clock may differ from ours.
+	now := time.Now().Add(time.Hour)
+	claimed, err := s.ClaimDeliveries(now, time.Minute, 10)
+	assert.Nil(t, err)
+	if !assert.Len(t, claimed, 1) {
+		return
+	}
+	claimed, err = s.ClaimDeliveries(now, time.Minute, 10)
+	assert.Nil(t, err)
+	assert.Empty(t, claimed)
+
+	claimed, err = s.ClaimDeliveries(now.Add(time.Minute), time.Minute, 10)
+	assert.Nil(t, err)
+	if !assert.Len(t, claimed, 1) {
+		return
+	}
+	d := claimed[0]
+	d.Status, d.Attempts, d.LastStatus, d.LastError = store.DeliveryDead, 8, 500, "failed"
+	assert.Nil(t, s.UpdateDelivery(d))
+	dead, err := s.GetDelivery(d.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, store.DeliveryDead, dead.Status)
+	assert.Equal(t, 500, dead.LastStatus)
+	assert.Equal(t, store.ErrNotFound, s.UpdateDelivery(&store.Delivery{ID: -1}))
+
+	assert.Nil(t, s.DeleteWebhook(deletes.ID))
+	assert.Equal(t, store.ErrNotFound, s.DeleteWebhook(deletes.ID))
+	_, err = s.GetDelivery(d.ID)
+	assert.Equal(t, store.ErrNotFound, err)
+}
+
+// TestConformance empties the tables before every test, so it must not run in parallel to other tests.
+func TestConformance(t *testing.T) {
+	listening := &PostgresStore{DB: s.DB}
+	require.Nil(t, listening.Listen(databaseURL))
+	defer listening.Unlisten()
+
+	storetest.Run(t, func(t *testing.T) (store.ContactStorer, func()) {
+		_, err := s.DB.Exec(fmt.Sprintf("TRUNCATE %s, %s, %s, %s, %s, %s", contactTable, historyTable, webhookTable, deliveryTable, departmentTable, companyTable))
+		require.Nil(t, err)
+		return listening, nil
+	})
 }
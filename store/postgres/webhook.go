@@ -0,0 +1,215 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/ory/workshop-dbg/store"
+)
+
+const (
+	webhookTable  = "dbg_webhooks"
+	deliveryTable = "dbg_webhook_deliveries"
+)
+
+// webhookRow is a row of webhookTable. lib/pq needs the events as pq.StringArray.
+type webhookRow struct {
+	ID        string         `db:"id"`
+	URL       string         `db:"url"`
+	Secret    string         `db:"secret"`
+	Events    pq.StringArray `db:"events"`
+	Active    bool           `db:"active"`
+	CreatedAt time.Time      `db:"created_at"`
+}
+
+func (r *webhookRow) webhook() *store.Webhook {
+	return &store.Webhook{
+		ID:        r.ID,
+		URL:       r.URL,
+		Secret:    r.Secret,
+		Events:    append([]string{}, r.Events...),
+		Active:    r.Active,
+		CreatedAt: r.CreatedAt.UTC(),
+	}
+}
+
+// deliveryRow is a row of deliveryTable joined with the change it delivers.
+type deliveryRow struct {
+	ID          int64      `db:"id"`
+	WebhookID   string     `db:"webhook_id"`
+	Status      string     `db:"status"`
+	Attempts    int        `db:"attempts"`
+	NextAttempt time.Time  `db:"next_attempt"`
+	LastStatus  int        `db:"last_status"`
+	LastError   string     `db:"last_error"`
+	CreatedAt   time.Time  `db:"created_at"`
+	UpdatedAt   time.Time  `db:"updated_at"`
+	Change      historyRow `db:"change"`
+}
+
+// selectDeliveries selects deliveryRows, the query continues with a WHERE clause on d.
+var selectDeliveries = fmt.Sprintf(`
+SELECT d.id, d.webhook_id, d.status, d.attempts, d.next_attempt, d.last_status, d.last_error, d.created_at, d.updated_at,
+	h.seq AS "change.seq", h.contact_id AS "change.contact_id", h.action AS "change.action",
+	h.before AS "change.before", h.after AS "change.after", h.actor AS "change.actor",
+	h.request_id AS "change.request_id", h.created_at AS "change.created_at"
+FROM %s d JOIN %s h ON h.seq = d.seq`, deliveryTable, historyTable)
+
+func (r *deliveryRow) delivery() (*store.Delivery, error) {
+	c, err := r.Change.change()
+	if err != nil {
+		return nil, err
+	}
+	return &store.Delivery{
+		ID:          r.ID,
+		WebhookID:   r.WebhookID,
+		Change:      c,
+		Status:      r.Status,
+		Attempts:    r.Attempts,
+		NextAttempt: r.NextAttempt.UTC(),
+		LastStatus:  r.LastStatus,
+		LastError:   r.LastError,
+		CreatedAt:   r.CreatedAt.UTC(),
+		UpdatedAt:   r.UpdatedAt.UTC(),
+	}, nil
+}
+
+func deliveries(rows []*deliveryRow) ([]*store.Delivery, error) {
+	ds := make([]*store.Delivery, len(rows))
+	for i, r := range rows {
+		d, err := r.delivery()
+		if err != nil {
+			return nil, err
+		}
+		ds[i] = d
+	}
+	return ds, nil
+}
+
+func (s *PostgresStore) CreateWebhook(w *store.Webhook) error {
+	if err := w.Validate(); err != nil {
+		return err
+	}
+
+	if w.ID == "" {
+		w.ID = store.NewID()
+	}
+	if err := sqlx.GetContext(context.Background(), s.ext(), &w.CreatedAt, fmt.Sprintf(
+		`INSERT INTO %s (id, url, secret, events, active) VALUES ($1, $2, $3, $4, $5) RETURNING created_at`, webhookTable),
+		w.ID, w.URL, w.Secret, pq.StringArray(w.Events), w.Active,
+	); err != nil {
+		return translate(err)
+	}
+	w.CreatedAt = w.CreatedAt.UTC()
+	return nil
+}
+
+func (s *PostgresStore) GetWebhook(id string) (*store.Webhook, error) {
+	var r webhookRow
+	if err := sqlx.GetContext(context.Background(), s.ext(), &r, fmt.Sprintf("SELECT * FROM %s WHERE id = $1", webhookTable), id); err != nil {
+		return nil, translate(err)
+	}
+	return r.webhook(), nil
+}
+
+// FetchWebhooks returns the webhooks ordered by creation time.
+func (s *PostgresStore) FetchWebhooks() ([]*store.Webhook, error) {
+	var rows []*webhookRow
+	if err := sqlx.SelectContext(context.Background(), s.ext(), &rows, fmt.Sprintf("SELECT * FROM %s ORDER BY created_at, id", webhookTable)); err != nil {
+		return nil, translate(err)
+	}
+
+	ws := make([]*store.Webhook, len(rows))
+	for i, r := range rows {
+		ws[i] = r.webhook()
+	}
+	return ws, nil
+}
+
+func (s *PostgresStore) UpdateWebhook(w *store.Webhook) error {
+	if err := w.Validate(); err != nil {
+		return err
+	}
+
+	if err := sqlx.GetContext(context.Background(), s.ext(), &w.CreatedAt, fmt.Sprintf(
+		`UPDATE %s SET url = $1, secret = $2, events = $3, active = $4 WHERE id = $5 RETURNING created_at`, webhookTable),
+		w.URL, w.Secret, pq.StringArray(w.Events), w.Active, w.ID,
+	); err != nil {
+		return translate(err)
+	}
+	w.CreatedAt = w.CreatedAt.UTC()
+	return nil
+}
+
+func (s *PostgresStore) DeleteWebhook(id string) error {
+	result, err := s.ext().ExecContext(context.Background(), fmt.Sprintf("DELETE FROM %s WHERE id = $1", webhookTable), id)
+	if err != nil {
+		return translate(err)
+	}
+
+	if rows, err := result.RowsAffected(); err != nil {
+		return translate(err)
+	} else if rows == 0 {
+		return store.ErrNotFound
+	}
+	return nil
+}
+
+// ClaimDeliveries skips deliveries locked by other replicas claiming at the same time.
+func (s *PostgresStore) ClaimDeliveries(now time.Time, lease time.Duration, limit int) ([]*store.Delivery, error) {
+	var ids []int64
+	if err := sqlx.SelectContext(context.Background(), s.ext(), &ids, fmt.Sprintf(`
+WITH due AS (
+	SELECT id FROM %[1]s WHERE status = $1 AND next_attempt <= $2 ORDER BY id LIMIT $3 FOR UPDATE SKIP LOCKED
+)
+UPDATE %[1]s d SET next_attempt = $4 FROM due WHERE d.id = due.id RETURNING d.id`, deliveryTable),
+		store.DeliveryPending, now, limit, now.Add(lease),
+	); err != nil {
+		return nil, translate(err)
+	} else if len(ids) == 0 {
+		return nil, nil
+	}
+
+	var rows []*deliveryRow
+	if err := sqlx.SelectContext(context.Background(), s.ext(), &rows, selectDeliveries+" WHERE d.id = ANY($1) ORDER BY d.id", pq.Int64Array(ids)); err != nil {
+		return nil, translate(err)
+	}
+	return deliveries(rows)
+}
+
+// UpdateDelivery stores the status, attempts, next attempt and the outcome of the last attempt.
+func (s *PostgresStore) UpdateDelivery(d *store.Delivery) error {
+	if err := sqlx.GetContext(context.Background(), s.ext(), &d.UpdatedAt, fmt.Sprintf(`
+UPDATE %s SET status = $1, attempts = $2, next_attempt = $3, last_status = $4, last_error = $5, updated_at = now()
+WHERE id = $6 RETURNING updated_at`, deliveryTable),
+		d.Status, d.Attempts, d.NextAttempt, d.LastStatus, d.LastError, d.ID,
+	); err != nil {
+		return translate(err)
+	}
+	d.UpdatedAt = d.UpdatedAt.UTC()
+	return nil
+}
+
+func (s *PostgresStore) GetDelivery(id int64) (*store.Delivery, error) {
+	var r deliveryRow
+	if err := sqlx.GetContext(context.Background(), s.ext(), &r, selectDeliveries+" WHERE d.id = $1", id); err != nil {
+		return nil, translate(err)
+	}
+	return r.delivery()
+}
+
+func (s *PostgresStore) FetchDeliveries(q *store.DeliveryQuery) ([]*store.Delivery, error) {
+	q.Normalize()
+
+	var rows []*deliveryRow
+	if err := sqlx.SelectContext(context.Background(), s.ext(), &rows, selectDeliveries+`
+WHERE ($1 = '' OR d.webhook_id = $1) AND ($2 = '' OR d.status = $2) ORDER BY d.id DESC LIMIT $3`,
+		q.WebhookID, q.Status, q.Limit,
+	); err != nil {
+		return nil, translate(err)
+	}
+	return deliveries(rows)
+}
@@ -0,0 +1,200 @@
+package store
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// The fields contacts can be sorted by. Contacts with equal sort keys are ordered by ID.
+const (
+	SortByID         = "id"
+	SortByName       = "name"
+	SortByDepartment = "department"
+	SortByCompany    = "company"
+)
+
+// DefaultLimit is the page size used when a query does not set one, MaxLimit is the largest page size allowed.
+const (
+	DefaultLimit = 100
+	MaxLimit     = 1000
+)
+
+// Query selects a page of contacts. Empty filters match all contacts.
+type Query struct {
+	// Limit is the maximum number of contacts returned.
+	Limit int
+
+	// Cursor is the NextCursor or PrevCursor of a previous page. If empty, the first page is returned.
+	Cursor string
+
+	// SortBy is one of the SortBy constants and defaults to SortByID.
+	SortBy string
+
+	// Department and Company match contacts whose department and company are equal to the given value.
+	Department string
+	Company    string
+
+	// DepartmentPrefix and CompanyPrefix match contacts whose department and company start with the given value.
+	DepartmentPrefix string
+	CompanyPrefix    string
+
+	// Tag matches contacts tagged with the given value.
+	Tag string
+
+	// IncludeDeleted includes contacts in the trash.
+	IncludeDeleted bool
+}
+
+// Page is a page of contacts returned by QueryContacts.
+type Page struct {
+	// Contacts are the contacts on this page in sort order.
+	Contacts []*Contact
+
+	// NextCursor and PrevCursor point to the next and previous page. They are empty if there is no such page.
+	NextCursor string
+	PrevCursor string
+
+	// Total is the number of contacts passing the query's filters on all pages.
+	Total int
+}
+
+// Cursor marks a position in a sorted list of contacts. Cursors are handed to clients in encoded form only.
+type Cursor struct {
+	// SortBy is the sort field the cursor was created for.
+	SortBy string `json:"s"`
+
+	// Key and ID are the sort key and ID of the contact the cursor points at.
+	Key string `json:"k"`
+	ID  string `json:"i"`
+
+	// Before is true if the cursor selects the contacts before the position instead of the ones after it.
+	Before bool `json:"b,omitempty"`
+}
+
+// Encode returns the cursor in the opaque form used by Query and Page.
+func (c *Cursor) Encode() string {
+	out, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(out)
+}
+
+// Normalize sets defaults and checks that the query is valid. It returns the decoded cursor which is nil if the
+// query starts at the first page.
+func (q *Query) Normalize() (*Cursor, error) {
+	if q.Limit <= 0 {
+		q.Limit = DefaultLimit
+	} else if q.Limit > MaxLimit {
+		q.Limit = MaxLimit
+	}
+
+	// Tags are stored normalized, see Contact.Normalize.
+	q.Tag = normalize(q.Tag)
+
+	if q.SortBy == "" {
+		q.SortBy = SortByID
+	}
+	switch q.SortBy {
+	case SortByID, SortByName, SortByDepartment, SortByCompany:
+	default:
+		return nil, fmt.Errorf("%w: Contacts can not be sorted by %q", ErrValidation, q.SortBy)
+	}
+
+	if q.Cursor == "" {
+		return nil, nil
+	}
+
+	var c Cursor
+	if raw, err := base64.RawURLEncoding.DecodeString(q.Cursor); err != nil {
+		return nil, fmt.Errorf("%w: The cursor is malformed", ErrValidation)
+	} else if err := json.Unmarshal(raw, &c); err != nil {
+		return nil, fmt.Errorf("%w: The cursor is malformed", ErrValidation)
+	} else if c.SortBy != q.SortBy {
+		return nil, fmt.Errorf("%w: The cursor was created for a different sort order", ErrValidation)
+	}
+	return &c, nil
+}
+
+// Matches returns true if c passes the query's filters.
+func (q *Query) Matches(c *Contact) bool {
+	return (q.Department == "" || c.Department == q.Department) &&
+		(q.Company == "" || c.Company == q.Company) &&
+		strings.HasPrefix(c.Department, q.DepartmentPrefix) &&
+		strings.HasPrefix(c.Company, q.CompanyPrefix) &&
+		(q.Tag == "" || c.HasTag(q.Tag))
+}
+
+// SortKey returns the value of c's field which is used for sorting.
+func SortKey(c *Contact, field string) string {
+	switch field {
+	case SortByName:
+		return c.Name
+	case SortByDepartment:
+		return c.Department
+	case SortByCompany:
+		return c.Company
+	}
+	return c.ID
+}
+
+// Paginate sorts contacts which already passed the query's filters and returns the page selected by the
+// query and cursor. It is meant for backends which can not sort and paginate natively.
+func Paginate(contacts []*Contact, q *Query, cursor *Cursor) *Page {
+	less := func(key, id string, c *Contact) bool {
+		k := SortKey(c, q.SortBy)
+		return key < k || (key == k && id < c.ID)
+	}
+
+	sort.Slice(contacts, func(i, j int) bool {
+		return less(SortKey(contacts[i], q.SortBy), contacts[i].ID, contacts[j])
+	})
+
+	// The page is contacts[start:end].
+	start, end := 0, len(contacts)
+	if cursor != nil {
+		// pos is the index of the first contact sorted after the cursor.
+		pos := sort.Search(len(contacts), func(i int) bool {
+			return less(cursor.Key, cursor.ID, contacts[i])
+		})
+		if cursor.Before {
+			// The contact the cursor points at is not part of the previous page.
+			if pos > 0 && contacts[pos-1].ID == cursor.ID {
+				pos--
+			}
+			end = pos
+		} else {
+			start = pos
+		}
+	}
+
+	if cursor != nil && cursor.Before {
+		if end-start > q.Limit {
+			start = end - q.Limit
+		}
+	} else if end-start > q.Limit {
+		end = start + q.Limit
+	}
+
+	page := &Page{Contacts: contacts[start:end], Total: len(contacts)}
+	if len(page.Contacts) == 0 {
+		return page
+	}
+	if start > 0 {
+		page.PrevCursor = CursorBefore(page.Contacts[0], q.SortBy)
+	}
+	if end < len(contacts) {
+		page.NextCursor = CursorAfter(page.Contacts[len(page.Contacts)-1], q.SortBy)
+	}
+	return page
+}
+
+// CursorAfter returns an encoded cursor selecting the contacts sorted after c.
+func CursorAfter(c *Contact, sortBy string) string {
+	return (&Cursor{SortBy: sortBy, Key: SortKey(c, sortBy), ID: c.ID}).Encode()
+}
+
+// CursorBefore returns an encoded cursor selecting the contacts sorted before c.
+func CursorBefore(c *Contact, sortBy string) string {
+	return (&Cursor{SortBy: sortBy, Key: SortKey(c, sortBy), ID: c.ID, Before: true}).Encode()
+}
@@ -0,0 +1,89 @@
+package store
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+)
+
+// DefaultSearchLimit is the number of search results returned when no limit is set.
+const DefaultSearchLimit = 20
+
+// umlauts spells out German umlauts the way they are written without them, so that "Müller" and "Mueller" are the
+// same name. ß is always spelled out, because it has no diacritic to strip.
+var (
+	umlauts = strings.NewReplacer("ä", "ae", "ö", "oe", "ü", "ue", "Ä", "Ae", "Ö", "Oe", "Ü", "Ue")
+	sharpS  = strings.NewReplacer("ß", "ss", "ẞ", "SS")
+)
+
+// Fold lower-cases s, transliterates German umlauts and strips diacritics, so that "Jürgen", "Juergen" and
+// "JUERGEN" all become "juergen".
+func Fold(s string) string {
+	return fold(s, true)
+}
+
+func fold(s string, transliterate bool) string {
+	s = sharpS.Replace(norm.NFC.String(s))
+	if transliterate {
+		s = umlauts.Replace(s)
+	}
+
+	t := transform.Chain(norm.NFD, runes.Remove(runes.In(unicode.Mn)), norm.NFC)
+	folded, _, err := transform.String(t, s)
+	if err != nil {
+		folded = s
+	}
+	return strings.ToLower(folded)
+}
+
+// Tokenize folds s and splits it into words.
+func Tokenize(s string) []string {
+	return words(Fold(s))
+}
+
+// IndexWords returns the words of s which a search must find it by. Words with umlauts are indexed both
+// transliterated and with the umlauts stripped, so "Müller" is found by "Müller", "Mueller" and "Muller".
+func IndexWords(s string) []string {
+	ws := Tokenize(s)
+	for _, w := range words(fold(s, false)) {
+		if !contains(ws, w) {
+			ws = append(ws, w)
+		}
+	}
+	return ws
+}
+
+func words(s string) []string {
+	return strings.FieldsFunc(s, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+func contains(ws []string, w string) bool {
+	for _, v := range ws {
+		if v == w {
+			return true
+		}
+	}
+	return false
+}
+
+// NormalizeSearch tokenizes a search query and sets the default limit. It returns an error wrapping ErrValidation
+// if the query contains no words.
+func NormalizeSearch(query string, limit int) ([]string, int, error) {
+	tokens := Tokenize(query)
+	if len(tokens) == 0 {
+		return nil, 0, fmt.Errorf("%w: The search query must contain at least one word", ErrValidation)
+	}
+
+	if limit <= 0 {
+		limit = DefaultSearchLimit
+	} else if limit > MaxLimit {
+		limit = MaxLimit
+	}
+	return tokens, limit, nil
+}
@@ -0,0 +1,31 @@
+package store
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFold(t *testing.T) {
+	for in, out := range map[string]string{
+		"Jürgen":        "juergen",
+		"JUERGEN":       "juergen",
+		"Müller":        "mueller",
+		"Mu\u0308ller":  "mueller",
+		"Mueller":       "mueller",
+		"ÄRGER":         "aerger",
+		"Öl":            "oel",
+		"Straße":        "strasse",
+		"STRAẞE":        "strasse",
+		"Stéphane Lamy": "stephane lamy",
+	} {
+		assert.Equal(t, out, Fold(in), in)
+	}
+}
+
+func TestIndexWords(t *testing.T) {
+	assert.Equal(t, []string{"cathrine", "mueller", "muller"}, IndexWords("Cathrine Müller"))
+	assert.Equal(t, []string{"hans", "mueller"}, IndexWords("Hans Mueller"))
+	assert.Equal(t, []string{"strasse"}, IndexWords("Straße"))
+	assert.Empty(t, IndexWords(" - "))
+}
@@ -1,11 +1,80 @@
 package store
 
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/pborman/uuid"
+)
+
+// ContactStorer is implemented by all contact backends. CreateContact assigns a new ID to contacts which
+// do not have one and returns ErrAlreadyExists if the ID is already taken. SearchContacts matches the words of
+// the query against name, department and company, ignoring case and accents, and returns the best matches first.
+//
+// All writes validate the contact using Contact.Validate and return its *ValidationError if the contact is invalid.
+//
+// Every write increments the contact's version, starting at 1, and sets it on the contact passed in. UpdateContact
+// and DeleteContact only write if the version passed equals the stored one and return ErrVersionMismatch otherwise.
+// Version 0 writes unconditionally.
+//
+// PatchContact atomically reads the contact, modifies it using patch and writes it back. patch must not change
+// the contact's ID. The patched contact is returned.
+//
+// DeleteContact moves the contact to the trash and returns ErrNotFound if there is no such contact. Trashed
+// contacts are hidden from all other methods, unless Query.IncludeDeleted is set, but their IDs stay taken until
+// PurgeContacts deletes them for good. FetchTrash lists them, most recently deleted first, and RestoreContact
+// moves them back, incrementing their version.
+//
+// Every write appends a Change to the store's history, atomically with the write itself. History lists the changes
+// of a contact, oldest first, and returns ErrNotFound if there are none. Audit lists the changes of all contacts
+// ordered by Seq. WithActor returns a store which attributes all changes it makes to actor.
+//
+// WithContext returns a store whose operations end with ctx. Backends which wait for I/O implement ContextStorer
+// and adapt it using Bind, backends which never block may ignore ctx. The store returned keeps the actor, and
+// WithActor keeps the context.
+//
+// Subscribe streams the changes recorded after the call, see Broker. Stores shared by several replicas publish the
+// changes of all of them. The channel is closed if the subscriber falls behind or changes may have been missed.
 type ContactStorer interface {
 	FetchContacts() (Contacts, error)
 	GetContact(id string) (*Contact, error)
-	DeleteContact(id string) error
+	DeleteContact(id string, version int) error
 	CreateContact(*Contact) error
 	UpdateContact(*Contact) error
+	PatchContact(id string, version int, patch func(*Contact) error) (*Contact, error)
+	FetchMeta() (*Meta, error)
+	QueryContacts(*Query) (*Page, error)
+	SearchContacts(query string, limit int) ([]*Contact, error)
+	FetchTrash() ([]*Contact, error)
+	RestoreContact(id string) (*Contact, error)
+	PurgeContacts(deletedBefore time.Time) (int, error)
+	History(id string) ([]*Change, error)
+	Audit(*AuditQuery) ([]*Change, error)
+	WithActor(actor Actor) ContactStorer
+	WithContext(ctx context.Context) ContactStorer
+	Subscribe() (changes <-chan *Change, cancel func(), err error)
+}
+
+// Meta describes the contact list without containing the contacts themselves.
+type Meta struct {
+	// Count is the number of contacts.
+	Count int
+
+	// Revision changes whenever a contact is created, updated or deleted.
+	Revision string
+
+	// LastModified is the time of the last change. It is zero if the list was never changed.
+	LastModified time.Time
+}
+
+// CountedRevision is the revision of stores which count their changes. The time of the last change tells apart
+// stores which count from zero again after a restart. The revision of a store which was never changed is "0".
+func CountedRevision(modified time.Time, changes uint64) string {
+	if changes == 0 {
+		return "0"
+	}
+	return fmt.Sprintf("%d-%d", modified.Unix(), changes)
 }
 
 // Contacts is a list of contacts.
@@ -28,5 +97,72 @@ type Contact struct {
 	// Company is the name of the company the contact works for.
 	Company string `json:"company" db:"company"`
 
+	// CompanyID and DepartmentID reference the contact's Company and Department in stores implementing OrgStorer.
+	// Relational backends store NULL for empty references, hence the db tags.
+	//
+	// While a reference is set, the store keeps the name in Company or Department equal to the referenced one, even
+	// when it is renamed, see CheckReferences. The names of contacts in the trash are updated once they are restored.
+	CompanyID    string `json:"company_id,omitempty" db:"-"`
+	DepartmentID string `json:"department_id,omitempty" db:"-"`
+
+	// Version is incremented by the store whenever the contact changes. It is used for optimistic locking.
+	Version int `json:"version,omitempty" db:"version"`
+
+	// DeletedAt is set while the contact is in the trash. It is maintained by the store.
+	DeletedAt *time.Time `json:"deleted_at,omitempty" db:"deleted_at"`
+
+	// Emails, Phones and Addresses are the ways to reach the contact. They are not columns of their own in
+	// relational backends, hence the db tags.
+	Emails    []Email   `json:"emails,omitempty" db:"-"`
+	Phones    []Phone   `json:"phones,omitempty" db:"-"`
+	Addresses []Address `json:"addresses,omitempty" db:"-"`
+
+	// ManagerID is the ID of the contact's manager. Writes fail with the error of InvalidReference unless the manager
+	// exists and is not in the trash, see CheckManager. Moving the manager to the trash later keeps the reference.
+	ManagerID string `json:"manager_id,omitempty" db:"-"`
+
+	// Tags label the contact, see Query.Tag.
+	Tags []string `json:"tags,omitempty" db:"-"`
+
+	// Attributes are custom fields, for example a cost center.
+	Attributes map[string]string `json:"attributes,omitempty" db:"-"`
+
 	// Here is room for improvements like adding new fields
 }
+
+// NewID returns a new, random contact ID.
+func NewID() string {
+	return uuid.New()
+}
+
+// Clone returns a deep copy of the contact which can be modified without affecting the original. Empty lists and
+// maps stay nil.
+func (c *Contact) Clone() *Contact {
+	if c == nil {
+		return nil
+	}
+	clone := *c
+	if c.DeletedAt != nil {
+		deletedAt := *c.DeletedAt
+		clone.DeletedAt = &deletedAt
+	}
+	if c.Emails != nil {
+		clone.Emails = append([]Email{}, c.Emails...)
+	}
+	if c.Phones != nil {
+		clone.Phones = append([]Phone{}, c.Phones...)
+	}
+	if c.Addresses != nil {
+		clone.Addresses = append([]Address{}, c.Addresses...)
+	}
+	if c.Tags != nil {
+		clone.Tags = append([]string{}, c.Tags...)
+	}
+	if c.Attributes != nil {
+		clone.Attributes = make(map[string]string, len(c.Attributes))
+		for k, v := range c.Attributes {
+			clone.Attributes[k] = v
+		}
+	}
+	return &clone
+}
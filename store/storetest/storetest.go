@@ -0,0 +1,1131 @@
+// Package storetest checks that a store.ContactStorer behaves like all the others. Every backend runs it from its
+// own tests:
+//
+//	func TestConformance(t *testing.T) {
+//		storetest.Run(t, func(t *testing.T) (store.ContactStorer, func()) {
+//			return &InMemoryStore{Contacts: store.Contacts{}}, nil
+//		})
+//	}
+//
+// The optional interfaces store.Transactor, store.Importer, store.WebhookStorer and store.OrgStorer are tested if
+// the store implements them.
+package storetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ory/workshop-dbg/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Factory returns an empty store and a function releasing it once the test is done, which may be nil. It is called
+// once for every test.
+type Factory func(t *testing.T) (s store.ContactStorer, cleanup func())
+
+// LargeListSize is the number of contacts created by the large list test.
+const LargeListSize = 1000
+
+// Run runs all conformance tests as subtests of t.
+func Run(t *testing.T, newStore Factory) {
+	for _, test := range []struct {
+		name string
+		run  func(t *testing.T, s store.ContactStorer)
+	}{
+		{"CRUD", testCRUD},
+		{"NotFound", testNotFound},
+		{"DuplicateCreate", testDuplicateCreate},
+		{"Validation", testValidation},
+		{"Copies", testCopies},
+		{"Details", testDetails},
+		{"Managers", testManagers},
+		{"Versions", testVersions},
+		{"Patch", testPatch},
+		{"Trash", testTrash},
+		{"History", testHistory},
+		{"Context", testContext},
+		{"Unicode", testUnicode},
+		{"Search", testSearch},
+		{"LargeList", testLargeList},
+		{"ConcurrentWriters", testConcurrentWriters},
+		{"ConcurrentCreates", testConcurrentCreates},
+		{"Subscribe", testSubscribe},
+		{"Transactions", testTransactions},
+		{"Import", testImport},
+		{"Webhooks", testWebhooks},
+		{"Org", testOrg},
+		{"OrgNames", testOrgNames},
+	} {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			s, cleanup := newStore(t)
+			if cleanup != nil {
+				defer cleanup()
+			}
+			test.run(t, s)
+		})
+	}
+}
+
+func testCRUD(t *testing.T, s store.ContactStorer) {
+	// Stores which were never written to are at revision "0".
+	empty, err := s.FetchMeta()
+	require.Nil(t, err)
+	assert.Equal(t, &store.Meta{Revision: "0"}, empty)
+
+	a := &store.Contact{ID: "a", Name: "A", Department: "IT", Company: "ACME"}
+	require.Nil(t, s.CreateContact(a))
+	assert.Equal(t, 1, a.Version)
+
+	// The store generates missing IDs.
+	b := &store.Contact{Name: "B", Department: "HR", Company: "ACME"}
+	require.Nil(t, s.CreateContact(b))
+	assert.NotEmpty(t, b.ID)
+
+	c, err := s.GetContact("a")
+	require.Nil(t, err)
+	assert.Equal(t, a, c)
+
+	cs, err := s.FetchContacts()
+	require.Nil(t, err)
+	require.Len(t, cs, 2)
+	assert.Equal(t, b, cs[b.ID])
+
+	meta, err := s.FetchMeta()
+	require.Nil(t, err)
+	assert.Equal(t, 2, meta.Count)
+	assert.False(t, meta.LastModified.IsZero())
+
+	u := &store.Contact{ID: "a", Name: "A2", Department: "PR", Company: "ACME"}
+	require.Nil(t, s.UpdateContact(u))
+	assert.Equal(t, 2, u.Version)
+	c, err = s.GetContact("a")
+	require.Nil(t, err)
+	assert.Equal(t, u, c)
+
+	// Updates change the revision, too, although the count stays the same.
+	renamed, err := s.FetchMeta()
+	require.Nil(t, err)
+	assert.Equal(t, 2, renamed.Count)
+	assert.NotEqual(t, meta.Revision, renamed.Revision)
+
+	require.Nil(t, s.DeleteContact(b.ID, 0))
+	cs, err = s.FetchContacts()
+	require.Nil(t, err)
+	assert.Len(t, cs, 1)
+
+	updated, err := s.FetchMeta()
+	require.Nil(t, err)
+	assert.Equal(t, 1, updated.Count)
+	assert.NotEqual(t, meta.Revision, updated.Revision)
+}
+
+func testNotFound(t *testing.T, s store.ContactStorer) {
+	require.Nil(t, s.CreateContact(&store.Contact{ID: "trashed", Name: "Trashed"}))
+	require.Nil(t, s.DeleteContact("trashed", 0))
+
+	// Contacts in the trash are not found either, except by RestoreContact.
+	for _, id := range []string{"missing", "trashed"} {
+		_, err := s.GetContact(id)
+		assert.True(t, errors.Is(err, store.ErrNotFound), "GetContact(%q): %v", id, err)
+
+		err = s.UpdateContact(&store.Contact{ID: id, Name: "X"})
+		assert.True(t, errors.Is(err, store.ErrNotFound), "UpdateContact(%q): %v", id, err)
+		err = s.UpdateContact(&store.Contact{ID: id, Name: "X", Version: 1})
+		assert.True(t, errors.Is(err, store.ErrNotFound), "UpdateContact(%q) with version: %v", id, err)
+
+		_, err = s.PatchContact(id, 0, func(c *store.Contact) error { return nil })
+		assert.True(t, errors.Is(err, store.ErrNotFound), "PatchContact(%q): %v", id, err)
+
+		err = s.DeleteContact(id, 0)
+		assert.True(t, errors.Is(err, store.ErrNotFound), "DeleteContact(%q): %v", id, err)
+		err = s.DeleteContact(id, 1)
+		assert.True(t, errors.Is(err, store.ErrNotFound), "DeleteContact(%q) with version: %v", id, err)
+	}
+
+	_, err := s.RestoreContact("missing")
+	assert.True(t, errors.Is(err, store.ErrNotFound), "RestoreContact: %v", err)
+	require.Nil(t, s.CreateContact(&store.Contact{ID: "active", Name: "Active"}))
+	_, err = s.RestoreContact("active")
+	assert.True(t, errors.Is(err, store.ErrNotFound), "RestoreContact of an active contact: %v", err)
+
+	_, err = s.History("missing")
+	assert.True(t, errors.Is(err, store.ErrNotFound), "History: %v", err)
+}
+
+func testDuplicateCreate(t *testing.T, s store.ContactStorer) {
+	require.Nil(t, s.CreateContact(&store.Contact{ID: "a", Name: "A"}))
+	err := s.CreateContact(&store.Contact{ID: "a", Name: "Other"})
+	assert.True(t, errors.Is(err, store.ErrAlreadyExists), "%v", err)
+
+	c, err := s.GetContact("a")
+	require.Nil(t, err)
+	assert.Equal(t, "A", c.Name)
+	assert.Equal(t, 1, c.Version)
+
+	// IDs in the trash stay taken until they are purged.
+	require.Nil(t, s.DeleteContact("a", 0))
+	err = s.CreateContact(&store.Contact{ID: "a", Name: "Other"})
+	assert.True(t, errors.Is(err, store.ErrAlreadyExists), "%v", err)
+
+	n, err := s.PurgeContacts(time.Now().Add(time.Minute))
+	require.Nil(t, err)
+	assert.Equal(t, 1, n)
+	assert.Nil(t, s.CreateContact(&store.Contact{ID: "a", Name: "Other"}))
+}
+
+func testValidation(t *testing.T, s store.ContactStorer) {
+	require.Nil(t, s.CreateContact(&store.Contact{ID: "a", Name: "A"}))
+
+	var invalid *store.ValidationError
+	assert.True(t, errors.As(s.CreateContact(&store.Contact{ID: "b"}), &invalid))
+	assert.True(t, errors.As(s.CreateContact(&store.Contact{ID: "b/c", Name: "B"}), &invalid))
+	assert.True(t, errors.As(s.UpdateContact(&store.Contact{ID: "a", Name: "A\x00"}), &invalid))
+	_, err := s.PatchContact("a", 0, func(c *store.Contact) error {
+		c.Name = ""
+		return nil
+	})
+	assert.True(t, errors.As(err, &invalid))
+
+	// Nothing was written.
+	cs, err := s.FetchContacts()
+	require.Nil(t, err)
+	require.Len(t, cs, 1)
+	assert.Equal(t, "A", cs["a"].Name)
+	assert.Equal(t, 1, cs["a"].Version)
+}
+
+func testCopies(t *testing.T, s store.ContactStorer) {
+	c := &store.Contact{ID: "a", Name: "A"}
+	require.Nil(t, s.CreateContact(c))
+
+	// Modifying a contact after handing it to the store does not change the stored one.
+	c.Name = "changed"
+	r, err := s.GetContact("a")
+	require.Nil(t, err)
+	assert.Equal(t, "A", r.Name)
+
+	// Neither does modifying returned contacts.
+	r.Name = "changed"
+	cs, err := s.FetchContacts()
+	require.Nil(t, err)
+	cs["a"].Name = "changed"
+	delete(cs, "a")
+
+	r, err = s.GetContact("a")
+	require.Nil(t, err)
+	assert.Equal(t, "A", r.Name)
+	cs, err = s.FetchContacts()
+	require.Nil(t, err)
+	assert.Len(t, cs, 1)
+}
+
+func testDetails(t *testing.T, s store.ContactStorer) {
+	require.Nil(t, s.CreateContact(&store.Contact{ID: "b", Name: "B", Tags: []string{"vip"}}))
+	require.Nil(t, s.CreateContact(&store.Contact{ID: "c", Name: "C", Tags: []string{"board"}}))
+	a := &store.Contact{
+		ID:         "a",
+		Name:       "A",
+		Emails:     []store.Email{{Type: "Work", Address: "a@example.com"}, {Address: "a@example.org"}},
+		Phones:     []store.Phone{{Type: store.TypeMobile, Number: "+49 (69) 211-111"}},
+		Addresses:  []store.Address{{Type: store.TypeWork, Street: "Main St 1", City: "Frankfurt", Country: "de"}},
+		ManagerID:  "b",
+		Tags:       []string{"vip", "board"},
+		Attributes: map[string]string{"cost_center": "4711"},
+	}
+	require.Nil(t, s.CreateContact(a))
+
+	// The details are stored normalized.
+	assert.Equal(t, store.TypeWork, a.Emails[0].Type)
+	assert.Equal(t, "+4969211111", a.Phones[0].Number)
+	assert.Equal(t, "DE", a.Addresses[0].Country)
+
+	r, err := s.GetContact("a")
+	require.Nil(t, err)
+	assert.Equal(t, a, r)
+
+	// Modifying the lists and maps of a returned contact does not change the stored one.
+	r.Emails[0].Address = "changed@example.com"
+	r.Tags[0] = "changed"
+	r.Attributes["cost_center"] = "changed"
+	r, err = s.GetContact("a")
+	require.Nil(t, err)
+	assert.Equal(t, a, r)
+
+	page, err := s.QueryContacts(&store.Query{Tag: "vip"})
+	require.Nil(t, err)
+	assert.Equal(t, 2, page.Total)
+	require.Len(t, page.Contacts, 2)
+	assert.Equal(t, "a", page.Contacts[0].ID)
+	assert.Equal(t, "b", page.Contacts[1].ID)
+
+	page, err = s.QueryContacts(&store.Query{Tag: "board", Company: "ACME"})
+	require.Nil(t, err)
+	assert.Equal(t, 0, page.Total)
+
+	changes, err := s.History("a")
+	require.Nil(t, err)
+	require.Len(t, changes, 1)
+	assert.Equal(t, a.Tags, changes[0].After.Tags)
+	assert.Equal(t, a.Attributes, changes[0].After.Attributes)
+
+	// Deleting and restoring keeps the details, updating replaces them.
+	require.Nil(t, s.DeleteContact("a", 0))
+	r, err = s.RestoreContact("a")
+	require.Nil(t, err)
+	assert.Equal(t, a.Emails, r.Emails)
+	assert.Equal(t, a.Tags, r.Tags)
+
+	u := &store.Contact{ID: "a", Name: "A", Tags: []string{"board"}}
+	require.Nil(t, s.UpdateContact(u))
+	r, err = s.GetContact("a")
+	require.Nil(t, err)
+	assert.Equal(t, u, r)
+	assert.Nil(t, r.Emails)
+	assert.Nil(t, r.Attributes)
+
+	page, err = s.QueryContacts(&store.Query{Tag: "vip"})
+	require.Nil(t, err)
+	assert.Equal(t, 1, page.Total)
+
+	// Invalid details are rejected like any other invalid field.
+	err = s.CreateContact(&store.Contact{Name: "D", Emails: []store.Email{{Address: "d"}}, Phones: []store.Phone{{Number: "0691234"}}})
+	var v *store.ValidationError
+	require.True(t, errors.As(err, &v), "CreateContact: %v", err)
+	assert.Len(t, v.Fields, 2)
+}
+
+func testManagers(t *testing.T, s store.ContactStorer) {
+	invalid := []store.FieldError{{Field: "manager_id", Message: "does not exist"}}
+	assertInvalid := func(err error, op string) {
+		var v *store.ValidationError
+		if assert.True(t, errors.As(err, &v), "%s: %v", op, err) {
+			assert.Equal(t, invalid, v.Fields, op)
+		}
+	}
+
+	assertInvalid(s.CreateContact(&store.Contact{ID: "a", Name: "A", ManagerID: "b"}), "CreateContact")
+	assertInvalid(s.CreateContact(&store.Contact{Name: "A", ManagerID: "b"}), "CreateContact without ID")
+	require.Nil(t, s.CreateContact(&store.Contact{ID: "b", Name: "B"}))
+	require.Nil(t, s.CreateContact(&store.Contact{ID: "a", Name: "A", ManagerID: "b"}))
+
+	assertInvalid(s.UpdateContact(&store.Contact{ID: "a", Name: "A", ManagerID: "missing"}), "UpdateContact")
+	_, err := s.PatchContact("a", 0, func(c *store.Contact) error {
+		c.ManagerID = "missing"
+		return nil
+	})
+	assertInvalid(err, "PatchContact")
+
+	// Managers in the trash can not be assigned, but contacts keep them.
+	require.Nil(t, s.DeleteContact("b", 0))
+	assertInvalid(s.CreateContact(&store.Contact{ID: "c", Name: "C", ManagerID: "b"}), "CreateContact with manager in the trash")
+	r, err := s.GetContact("a")
+	require.Nil(t, err)
+	assert.Equal(t, "b", r.ManagerID)
+	_, err = s.PatchContact("a", 0, func(c *store.Contact) error {
+		c.ManagerID = ""
+		return nil
+	})
+	require.Nil(t, err)
+
+	// Imports may create the managers themselves, in any row.
+	if importer, ok := s.(store.Importer); ok {
+		report, err := importer.ImportContacts(&contactReader{
+			{ID: "c", Name: "C", ManagerID: "missing"},
+			{ID: "d", Name: "D", ManagerID: "e"},
+			{ID: "e", Name: "E", ManagerID: "a"},
+		})
+		require.Nil(t, err)
+		assert.Equal(t, 0, report.Imported)
+		require.Len(t, report.Errors, 1)
+		assert.Equal(t, 1, report.Errors[0].Row)
+		assert.Equal(t, invalid, report.Errors[0].Fields)
+
+		report, err = importer.ImportContacts(&contactReader{
+			{ID: "d", Name: "D", ManagerID: "e"},
+			{ID: "e", Name: "E", ManagerID: "a"},
+		})
+		require.Nil(t, err)
+		assert.Equal(t, 2, report.Imported)
+		assert.Empty(t, report.Errors)
+		r, err = s.GetContact("d")
+		require.Nil(t, err)
+		assert.Equal(t, "e", r.ManagerID)
+	}
+}
+
+func testVersions(t *testing.T, s store.ContactStorer) {
+	c := &store.Contact{ID: "a", Name: "A"}
+	require.Nil(t, s.CreateContact(c))
+
+	// Unconditional and conditional updates increment the version.
+	require.Nil(t, s.UpdateContact(&store.Contact{ID: "a", Name: "B"}))
+	u := &store.Contact{ID: "a", Name: "C", Version: 2}
+	require.Nil(t, s.UpdateContact(u))
+	assert.Equal(t, 3, u.Version)
+
+	// Stale writes are rejected.
+	assert.True(t, errors.Is(s.UpdateContact(&store.Contact{ID: "a", Name: "D", Version: 2}), store.ErrVersionMismatch))
+	assert.True(t, errors.Is(s.DeleteContact("a", 2), store.ErrVersionMismatch))
+	_, err := s.PatchContact("a", 2, func(c *store.Contact) error { return nil })
+	assert.True(t, errors.Is(err, store.ErrVersionMismatch))
+
+	r, err := s.GetContact("a")
+	require.Nil(t, err)
+	assert.Equal(t, "C", r.Name)
+	assert.Equal(t, 3, r.Version)
+
+	require.Nil(t, s.DeleteContact("a", 3))
+	restored, err := s.RestoreContact("a")
+	require.Nil(t, err)
+	assert.Equal(t, 4, restored.Version)
+}
+
+func testPatch(t *testing.T, s store.ContactStorer) {
+	require.Nil(t, s.CreateContact(&store.Contact{ID: "a", Name: "A", Department: "IT", Company: "ACME"}))
+
+	c, err := s.PatchContact("a", 1, func(c *store.Contact) error {
+		assert.Equal(t, "a", c.ID)
+		assert.Equal(t, "IT", c.Department)
+		c.Department = "HR"
+		return nil
+	})
+	require.Nil(t, err)
+	assert.Equal(t, &store.Contact{ID: "a", Name: "A", Department: "HR", Company: "ACME", Version: 2}, c)
+
+	r, err := s.GetContact("a")
+	require.Nil(t, err)
+	assert.Equal(t, c, r)
+
+	// Errors of the patch abort it.
+	failed := errors.New("failed")
+	_, err = s.PatchContact("a", 0, func(c *store.Contact) error {
+		c.Name = "B"
+		return failed
+	})
+	assert.Equal(t, failed, err)
+
+	_, err = s.PatchContact("a", 0, func(c *store.Contact) error {
+		c.ID = "b"
+		return nil
+	})
+	assert.True(t, errors.Is(err, store.ErrIDChanged))
+
+	r, err = s.GetContact("a")
+	require.Nil(t, err)
+	assert.Equal(t, c, r)
+}
+
+func testTrash(t *testing.T, s store.ContactStorer) {
+	for _, id := range []string{"a", "b", "c"} {
+		require.Nil(t, s.CreateContact(&store.Contact{ID: id, Name: "Contact " + id, Company: "ACME"}))
+	}
+	for _, id := range []string{"a", "b"} {
+		require.Nil(t, s.DeleteContact(id, 0))
+	}
+
+	trash, err := s.FetchTrash()
+	require.Nil(t, err)
+	require.Len(t, trash, 2)
+	for _, c := range trash {
+		assert.NotNil(t, c.DeletedAt)
+		assert.Equal(t, 1, c.Version)
+	}
+
+	// Trashed contacts are only listed on request.
+	page, err := s.QueryContacts(&store.Query{Company: "ACME"})
+	require.Nil(t, err)
+	assert.Len(t, page.Contacts, 1)
+	assert.Equal(t, 1, page.Total)
+	page, err = s.QueryContacts(&store.Query{Company: "ACME", IncludeDeleted: true})
+	require.Nil(t, err)
+	assert.Len(t, page.Contacts, 3)
+	assert.Equal(t, 3, page.Total)
+
+	c, err := s.RestoreContact("a")
+	require.Nil(t, err)
+	assert.Nil(t, c.DeletedAt)
+	assert.Equal(t, "Contact a", c.Name)
+	r, err := s.GetContact("a")
+	require.Nil(t, err)
+	assert.Equal(t, c, r)
+
+	n, err := s.PurgeContacts(time.Now().Add(-time.Hour))
+	require.Nil(t, err)
+	assert.Equal(t, 0, n)
+	n, err = s.PurgeContacts(time.Now().Add(time.Hour))
+	require.Nil(t, err)
+	assert.Equal(t, 1, n)
+
+	trash, err = s.FetchTrash()
+	require.Nil(t, err)
+	assert.Len(t, trash, 0)
+	_, err = s.RestoreContact("b")
+	assert.True(t, errors.Is(err, store.ErrNotFound))
+}
+
+func testHistory(t *testing.T, s store.ContactStorer) {
+	alice := s.WithActor(store.Actor{Name: "alice", RequestID: "r1"})
+	require.Nil(t, alice.CreateContact(&store.Contact{ID: "a", Name: "A"}))
+	require.Nil(t, s.UpdateContact(&store.Contact{ID: "a", Name: "B"}))
+	require.Nil(t, alice.DeleteContact("a", 0))
+	_, err := alice.RestoreContact("a")
+	require.Nil(t, err)
+	require.Nil(t, s.CreateContact(&store.Contact{ID: "b", Name: "B"}))
+
+	changes, err := s.History("a")
+	require.Nil(t, err)
+	require.Len(t, changes, 4)
+
+	var actions []string
+	for i, c := range changes {
+		actions = append(actions, c.Action)
+		assert.Equal(t, "a", c.ContactID)
+		assert.False(t, c.Time.IsZero())
+		if i > 0 {
+			assert.True(t, c.Seq > changes[i-1].Seq)
+		}
+	}
+	assert.Equal(t, []string{store.ActionCreate, store.ActionUpdate, store.ActionDelete, store.ActionRestore}, actions)
+
+	assert.Nil(t, changes[0].Before)
+	assert.Equal(t, "A", changes[0].After.Name)
+	assert.Equal(t, "alice", changes[0].Actor)
+	assert.Equal(t, "r1", changes[0].RequestID)
+	assert.Equal(t, "A", changes[1].Before.Name)
+	assert.Equal(t, "B", changes[1].After.Name)
+	assert.Empty(t, changes[1].Actor)
+	assert.NotNil(t, changes[2].After.DeletedAt)
+	assert.Equal(t, 3, changes[3].After.Version)
+
+	all, err := s.Audit(&store.AuditQuery{})
+	require.Nil(t, err)
+	require.Len(t, all, 5)
+	assert.Equal(t, "b", all[4].ContactID)
+
+	page, err := s.Audit(&store.AuditQuery{After: all[1].Seq, Limit: 2})
+	require.Nil(t, err)
+	require.Len(t, page, 2)
+	assert.Equal(t, all[2].Seq, page[0].Seq)
+	assert.Equal(t, all[3].Seq, page[1].Seq)
+
+	later, err := s.Audit(&store.AuditQuery{Since: time.Now().Add(time.Minute)})
+	require.Nil(t, err)
+	assert.Len(t, later, 0)
+}
+
+func testContext(t *testing.T, s store.ContactStorer) {
+	// WithActor and WithContext keep each other's settings.
+	alice := store.Actor{Name: "alice"}
+	require.Nil(t, s.WithActor(alice).WithContext(context.Background()).CreateContact(&store.Contact{ID: "a", Name: "A"}))
+	require.Nil(t, s.WithContext(context.Background()).WithActor(alice).UpdateContact(&store.Contact{ID: "a", Name: "B"}))
+	changes, err := s.History("a")
+	require.Nil(t, err)
+	require.Len(t, changes, 2)
+	assert.Equal(t, "alice", changes[0].Actor)
+	assert.Equal(t, "alice", changes[1].Actor)
+
+	// Stores may ignore the context. If they do not, nothing is written once it is done.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = s.WithContext(ctx).CreateContact(&store.Contact{ID: "b", Name: "B"})
+	if err == nil {
+		return
+	}
+	assert.True(t, errors.Is(err, context.Canceled), "%v", err)
+	_, err = s.GetContact("b")
+	assert.True(t, errors.Is(err, store.ErrNotFound))
+
+	_, err = s.WithContext(ctx).GetContact("a")
+	assert.True(t, errors.Is(err, context.Canceled), "%v", err)
+
+	// Companies and departments are bound to the context as well.
+	if _, ok := s.(store.OrgStorer); ok {
+		orgs, ok := s.WithContext(ctx).WithActor(alice).(store.OrgStorer)
+		require.True(t, ok, "The store returned by WithContext does not implement store.OrgStorer")
+		err = orgs.CreateCompany(&store.Company{ID: "dbg", Name: "DBG"})
+		assert.True(t, errors.Is(err, context.Canceled), "%v", err)
+		_, err = s.(store.OrgStorer).GetCompany("dbg")
+		assert.True(t, errors.Is(err, store.ErrNotFound), "%v", err)
+	}
+}
+
+// unicodeContacts cover accents, combining marks, non-Latin scripts and symbols.
+var unicodeContacts = []*store.Contact{
+	{ID: "jürgen-elsner", Name: "Jürgen Elsner", Department: "Forschung & Entwicklung", Company: "Börse AG"},
+	{ID: "zhang-wei", Name: "张伟", Department: "研究开发", Company: "北京公司"},
+	{ID: "olga", Name: "Ольга Петрова", Department: "Отдел кадров", Company: "ООО «Ромашка»"},
+	{ID: "rocket", Name: "Zoë Ångström", Department: "R&D ✓", Company: "🚀 Rocket GmbH"},
+}
+
+func testUnicode(t *testing.T, s store.ContactStorer) {
+	for _, c := range unicodeContacts {
+		require.Nil(t, s.CreateContact(c.Clone()))
+	}
+
+	for _, want := range unicodeContacts {
+		c, err := s.GetContact(want.ID)
+		require.Nil(t, err, want.ID)
+		assert.Equal(t, want.Name, c.Name)
+		assert.Equal(t, want.Department, c.Department)
+		assert.Equal(t, want.Company, c.Company)
+	}
+
+	// Names are stored in composed form, so "Zoë" typed with a combining diaeresis is the same name.
+	require.Nil(t, s.UpdateContact(&store.Contact{ID: "rocket", Name: "Zoe\u0308 A\u030angstro\u0308m"}))
+	c, err := s.GetContact("rocket")
+	require.Nil(t, err)
+	assert.Equal(t, "Zo\u00eb \u00c5ngstr\u00f6m", c.Name)
+
+	// Sorting is by byte value in every backend.
+	page, err := s.QueryContacts(&store.Query{SortBy: store.SortByName})
+	require.Nil(t, err)
+	var names []string
+	for _, c := range page.Contacts {
+		names = append(names, c.Name)
+	}
+	assert.True(t, sort.StringsAreSorted(names), "%v", names)
+	assert.Len(t, names, len(unicodeContacts))
+}
+
+func testSearch(t *testing.T, s store.ContactStorer) {
+	for _, c := range []*store.Contact{
+		{ID: "juergen-elsner", Name: "Jürgen Elsner", Department: "DaCS", Company: "DBG"},
+		{ID: "ulrich-meyer", Name: "Ulrich Meyer", Department: "TRIT", Company: "DBG"},
+		{ID: "dbg-bot", Name: "DBG Bot", Department: "IT", Company: "ACME"},
+		{ID: "cathrine-mueller", Name: "Cathrine Müller", Department: "HR", Company: "Grove AG"},
+		{ID: "hans-mueller", Name: "Hans Mueller", Department: "Straße", Company: "Grove AG"},
+	} {
+		require.Nil(t, s.CreateContact(c))
+	}
+
+	// Accents and case are ignored.
+	cs, err := s.SearchContacts("JURGEN", 0)
+	require.Nil(t, err)
+	require.Len(t, cs, 1)
+	assert.Equal(t, "juergen-elsner", cs[0].ID)
+
+	// Umlauts match their transliteration, both ways.
+	for _, q := range []string{"Jürgen", "Juergen"} {
+		cs, err = s.SearchContacts(q, 0)
+		require.Nil(t, err)
+		require.Len(t, cs, 1, q)
+		assert.Equal(t, "juergen-elsner", cs[0].ID, q)
+	}
+	for _, q := range []string{"Müller", "Mueller", "MÜLLER"} {
+		cs, err = s.SearchContacts(q, 0)
+		require.Nil(t, err)
+		assert.Len(t, cs, 2, q)
+	}
+	cs, err = s.SearchContacts("strasse", 0)
+	require.Nil(t, err)
+	require.Len(t, cs, 1)
+	assert.Equal(t, "hans-mueller", cs[0].ID)
+
+	// Words match as prefixes, matches in the name rank first.
+	cs, err = s.SearchContacts("db", 0)
+	require.Nil(t, err)
+	require.Len(t, cs, 3)
+	assert.Equal(t, "dbg-bot", cs[0].ID)
+
+	cs, err = s.SearchContacts("dbg", 1)
+	require.Nil(t, err)
+	assert.Len(t, cs, 1)
+
+	// Deleted contacts are not found.
+	require.Nil(t, s.DeleteContact("juergen-elsner", 0))
+	cs, err = s.SearchContacts("elsner", 0)
+	require.Nil(t, err)
+	assert.Len(t, cs, 0)
+
+	_, err = s.SearchContacts(" ,. ", 0)
+	assert.True(t, errors.Is(err, store.ErrValidation))
+}
+
+func testLargeList(t *testing.T, s store.ContactStorer) {
+	for i := 0; i < LargeListSize; i++ {
+		require.Nil(t, s.CreateContact(&store.Contact{
+			ID:         fmt.Sprintf("contact-%04d", i),
+			Name:       fmt.Sprintf("Contact %04d", LargeListSize-i),
+			Department: fmt.Sprintf("D%d", i%10),
+		}))
+	}
+
+	cs, err := s.FetchContacts()
+	require.Nil(t, err)
+	assert.Len(t, cs, LargeListSize)
+
+	meta, err := s.FetchMeta()
+	require.Nil(t, err)
+	assert.Equal(t, LargeListSize, meta.Count)
+
+	// Paging through the list returns every contact once, in order.
+	seen := map[string]bool{}
+	var last string
+	q := &store.Query{SortBy: store.SortByName, Limit: 64}
+	for pages := 0; ; pages++ {
+		require.True(t, pages <= LargeListSize/q.Limit+1, "too many pages")
+
+		page, err := s.QueryContacts(q)
+		require.Nil(t, err)
+		assert.Equal(t, LargeListSize, page.Total)
+		for _, c := range page.Contacts {
+			assert.False(t, seen[c.ID], c.ID)
+			assert.True(t, c.Name > last, "%s after %s", c.Name, last)
+			seen[c.ID], last = true, c.Name
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		q.Cursor = page.NextCursor
+	}
+	assert.Len(t, seen, LargeListSize)
+
+	page, err := s.QueryContacts(&store.Query{Department: "D3", Limit: 10})
+	require.Nil(t, err)
+	assert.Len(t, page.Contacts, 10)
+	assert.Equal(t, LargeListSize/10, page.Total)
+}
+
+func testConcurrentWriters(t *testing.T, s store.ContactStorer) {
+	require.Nil(t, s.CreateContact(&store.Contact{ID: "counter", Name: "Counter"}))
+
+	const workers = 8
+	const iterations = 20
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				_, err := s.PatchContact("counter", 0, func(c *store.Contact) error {
+					c.Department += "x"
+					return nil
+				})
+				assert.Nil(t, err)
+
+				// Readers never see partial writes.
+				c, err := s.GetContact("counter")
+				if assert.Nil(t, err) {
+					assert.Equal(t, c.Version-1, len(c.Department))
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	// No patch was lost.
+	c, err := s.GetContact("counter")
+	require.Nil(t, err)
+	assert.Equal(t, 1+workers*iterations, c.Version)
+	assert.Len(t, c.Department, workers*iterations)
+}
+
+func testConcurrentCreates(t *testing.T, s store.ContactStorer) {
+	const workers = 8
+
+	var wg sync.WaitGroup
+	errs := make([]error, workers)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			errs[w] = s.CreateContact(&store.Contact{ID: "a", Name: fmt.Sprintf("Writer %d", w)})
+			assert.Nil(t, s.CreateContact(&store.Contact{ID: fmt.Sprintf("own-%d", w), Name: "Own"}))
+		}(w)
+	}
+	wg.Wait()
+
+	// Exactly one writer gets the ID.
+	created := 0
+	for _, err := range errs {
+		if err == nil {
+			created++
+		} else {
+			assert.True(t, errors.Is(err, store.ErrAlreadyExists), "%v", err)
+		}
+	}
+	assert.Equal(t, 1, created)
+
+	cs, err := s.FetchContacts()
+	require.Nil(t, err)
+	assert.Len(t, cs, workers+1)
+}
+
+func testSubscribe(t *testing.T, s store.ContactStorer) {
+	changes, cancel, err := s.Subscribe()
+	if errors.Is(err, store.ErrUnavailable) {
+		t.Skip("The store can not stream changes:", err)
+	}
+	require.Nil(t, err)
+	defer cancel()
+
+	require.Nil(t, s.WithActor(store.Actor{Name: "alice"}).CreateContact(&store.Contact{ID: "a", Name: "A"}))
+	require.Nil(t, s.DeleteContact("a", 0))
+
+	var actions []string
+	timeout := time.After(10 * time.Second)
+	for len(actions) < 2 {
+		select {
+		case c, ok := <-changes:
+			require.True(t, ok, "The subscription ended")
+			if c.ContactID != "a" {
+				continue
+			}
+			actions = append(actions, c.Action)
+			if c.Action == store.ActionCreate {
+				assert.Equal(t, "alice", c.Actor)
+			}
+		case <-timeout:
+			t.Fatalf("Received only %v", actions)
+		}
+	}
+	assert.Equal(t, []string{store.ActionCreate, store.ActionDelete}, actions)
+
+	// Cancelling closes the channel eventually. Changes which were already buffered may still arrive.
+	cancel()
+	for range changes {
+	}
+}
+
+func testTransactions(t *testing.T, s store.ContactStorer) {
+	transactor, ok := s.(store.Transactor)
+	if !ok {
+		t.Skip("The store does not implement store.Transactor")
+	}
+	require.Nil(t, s.CreateContact(&store.Contact{ID: "a", Name: "A"}))
+
+	// Failed transactions leave no trace, not even in the history.
+	failed := errors.New("failed")
+	err := transactor.WithTx(func(tx store.ContactStorer) error {
+		require.Nil(t, tx.CreateContact(&store.Contact{ID: "b", Name: "B"}))
+		require.Nil(t, tx.UpdateContact(&store.Contact{ID: "a", Name: "A2"}))
+
+		// The transaction sees its own writes.
+		c, err := tx.GetContact("a")
+		require.Nil(t, err)
+		assert.Equal(t, "A2", c.Name)
+		return failed
+	})
+	assert.Equal(t, failed, err)
+
+	c, err := s.GetContact("a")
+	require.Nil(t, err)
+	assert.Equal(t, "A", c.Name)
+	_, err = s.GetContact("b")
+	assert.True(t, errors.Is(err, store.ErrNotFound))
+	_, err = s.History("b")
+	assert.True(t, errors.Is(err, store.ErrNotFound))
+
+	require.Nil(t, transactor.WithTx(func(tx store.ContactStorer) error {
+		if err := tx.CreateContact(&store.Contact{ID: "b", Name: "B"}); err != nil {
+			return err
+		}
+		return tx.DeleteContact("a", 1)
+	}))
+	cs, err := s.FetchContacts()
+	require.Nil(t, err)
+	assert.Len(t, cs, 1)
+	assert.Contains(t, cs, "b")
+}
+
+// contactReader reads a fixed list of contacts.
+type contactReader []*store.Contact
+
+func (r *contactReader) Read() (*store.Contact, error) {
+	if len(*r) == 0 {
+		return nil, io.EOF
+	}
+	c := (*r)[0]
+	*r = (*r)[1:]
+	return c, nil
+}
+
+func testImport(t *testing.T, s store.ContactStorer) {
+	importer, ok := s.(store.Importer)
+	if !ok {
+		t.Skip("The store does not implement store.Importer")
+	}
+	require.Nil(t, s.CreateContact(&store.Contact{ID: "a", Name: "A"}))
+
+	// A single invalid row or taken ID fails the whole import.
+	r := &contactReader{{ID: "b", Name: "B"}, {ID: "a", Name: "A"}, {ID: "c"}}
+	report, err := importer.ImportContacts(r)
+	require.Nil(t, err)
+	assert.Equal(t, 3, report.Rows)
+	assert.Equal(t, 0, report.Imported)
+	require.Len(t, report.Errors, 2)
+	assert.Equal(t, 2, report.Errors[0].Row)
+	assert.Equal(t, 3, report.Errors[1].Row)
+	_, err = s.GetContact("b")
+	assert.True(t, errors.Is(err, store.ErrNotFound))
+
+	r = &contactReader{{ID: "b", Name: "B", Tags: []string{"imported"}}, {Name: "C"}}
+	report, err = importer.ImportContacts(r)
+	require.Nil(t, err)
+	assert.Equal(t, 2, report.Imported)
+	assert.Len(t, report.Errors, 0)
+
+	cs, err := s.FetchContacts()
+	require.Nil(t, err)
+	assert.Len(t, cs, 3)
+	assert.Equal(t, 1, cs["b"].Version)
+	assert.Equal(t, []string{"imported"}, cs["b"].Tags)
+}
+
+func testWebhooks(t *testing.T, s store.ContactStorer) {
+	webhooks, ok := s.(store.WebhookStorer)
+	if !ok {
+		t.Skip("The store does not implement store.WebhookStorer")
+	}
+
+	w := &store.Webhook{URL: "http://example.com/hook", Events: []string{store.ActionDelete}, Active: true}
+	require.Nil(t, webhooks.CreateWebhook(w))
+	require.Nil(t, webhooks.CreateWebhook(&store.Webhook{URL: "http://example.com/inactive", Events: []string{}}))
+	assert.True(t, errors.Is(webhooks.CreateWebhook(&store.Webhook{URL: "ftp://example.com"}), store.ErrValidation))
+
+	_, err := webhooks.GetWebhook("missing")
+	assert.True(t, errors.Is(err, store.ErrNotFound))
+	assert.True(t, errors.Is(webhooks.UpdateWebhook(&store.Webhook{ID: "missing", URL: "http://example.com"}), store.ErrNotFound))
+
+	// Only active webhooks subscribed to the action get a delivery.
+	require.Nil(t, s.CreateContact(&store.Contact{ID: "a", Name: "A"}))
+	require.Nil(t, s.DeleteContact("a", 0))
+
+	now := time.Now()
+	claimed, err := webhooks.ClaimDeliveries(now.Add(time.Second), time.Minute, 10)
+	require.Nil(t, err)
+	require.Len(t, claimed, 1)
+	assert.Equal(t, w.ID, claimed[0].WebhookID)
+	assert.Equal(t, store.DeliveryPending, claimed[0].Status)
+	assert.Equal(t, "a", claimed[0].Change.ContactID)
+	assert.Equal(t, store.ActionDelete, claimed[0].Change.Action)
+
+	// Claimed deliveries are leased.
+	again, err := webhooks.ClaimDeliveries(now.Add(time.Second), time.Minute, 10)
+	require.Nil(t, err)
+	assert.Len(t, again, 0)
+
+	d := claimed[0]
+	d.Status, d.Attempts, d.LastStatus = store.DeliveryDead, 3, 500
+	require.Nil(t, webhooks.UpdateDelivery(d))
+	dead, err := webhooks.FetchDeliveries(&store.DeliveryQuery{Status: store.DeliveryDead})
+	require.Nil(t, err)
+	require.Len(t, dead, 1)
+	assert.Equal(t, 3, dead[0].Attempts)
+	assert.Equal(t, 500, dead[0].LastStatus)
+
+	require.Nil(t, webhooks.DeleteWebhook(w.ID))
+	assert.True(t, errors.Is(webhooks.DeleteWebhook(w.ID), store.ErrNotFound))
+	_, err = webhooks.GetDelivery(d.ID)
+	assert.True(t, errors.Is(err, store.ErrNotFound))
+}
+
+func testOrg(t *testing.T, s store.ContactStorer) {
+	orgs, ok := s.(store.OrgStorer)
+	if !ok {
+		t.Skip("The store does not implement store.OrgStorer")
+	}
+
+	dbg := &store.Company{ID: "dbg", Name: "DBG"}
+	require.Nil(t, orgs.CreateCompany(dbg))
+	assert.False(t, dbg.CreatedAt.IsZero())
+	acme := &store.Company{Name: "ACME"}
+	require.Nil(t, orgs.CreateCompany(acme))
+	assert.NotEmpty(t, acme.ID)
+
+	// IDs and names are unique, names ignoring case.
+	err := orgs.CreateCompany(&store.Company{ID: "dbg", Name: "Other"})
+	assert.True(t, errors.Is(err, store.ErrAlreadyExists), "CreateCompany with a taken ID: %v", err)
+	err = orgs.CreateCompany(&store.Company{Name: "dbg"})
+	assert.True(t, errors.Is(err, store.ErrAlreadyExists), "CreateCompany with a taken name: %v", err)
+	err = orgs.CreateCompany(&store.Company{})
+	assert.True(t, errors.Is(err, store.ErrValidation), "CreateCompany without a name: %v", err)
+
+	c, err := orgs.GetCompany("dbg")
+	require.Nil(t, err)
+	assert.Equal(t, dbg, c)
+	_, err = orgs.GetCompany("missing")
+	assert.True(t, errors.Is(err, store.ErrNotFound), "GetCompany: %v", err)
+
+	cs, err := orgs.FetchCompanies()
+	require.Nil(t, err)
+	require.Len(t, cs, 2)
+	assert.Equal(t, acme.ID, cs[0].ID)
+	assert.Equal(t, "dbg", cs[1].ID)
+
+	require.Nil(t, orgs.UpdateCompany(&store.Company{ID: "dbg", Name: "Deutsche Börse Group"}))
+	c, err = orgs.GetCompany("dbg")
+	require.Nil(t, err)
+	assert.Equal(t, "Deutsche Börse Group", c.Name)
+	assert.Equal(t, dbg.CreatedAt, c.CreatedAt)
+	err = orgs.UpdateCompany(&store.Company{ID: "dbg", Name: "acme"})
+	assert.True(t, errors.Is(err, store.ErrAlreadyExists), "UpdateCompany with a taken name: %v", err)
+	err = orgs.UpdateCompany(&store.Company{ID: "missing", Name: "Missing"})
+	assert.True(t, errors.Is(err, store.ErrNotFound), "UpdateCompany: %v", err)
+
+	dacs := &store.Department{ID: "dacs", CompanyID: "dbg", Name: "DaCS"}
+	require.Nil(t, orgs.CreateDepartment(dacs))
+	require.Nil(t, orgs.CreateDepartment(&store.Department{ID: "trit", CompanyID: "dbg", Name: "TRIT"}))
+	require.Nil(t, orgs.CreateDepartment(&store.Department{ID: "acme-it", CompanyID: acme.ID, Name: "DaCS"}))
+	err = orgs.CreateDepartment(&store.Department{CompanyID: "dbg", Name: "dacs"})
+	assert.True(t, errors.Is(err, store.ErrAlreadyExists), "CreateDepartment with a taken name: %v", err)
+	err = orgs.CreateDepartment(&store.Department{CompanyID: "missing", Name: "IT"})
+	assert.True(t, errors.Is(err, store.ErrNotFound), "CreateDepartment of a missing company: %v", err)
+
+	// Departments can not move to another company.
+	require.Nil(t, orgs.UpdateDepartment(&store.Department{ID: "trit", CompanyID: acme.ID, Name: "Trading IT"}))
+	d, err := orgs.GetDepartment("trit")
+	require.Nil(t, err)
+	assert.Equal(t, "dbg", d.CompanyID)
+	assert.Equal(t, "Trading IT", d.Name)
+
+	ds, err := orgs.FetchDepartments("dbg")
+	require.Nil(t, err)
+	require.Len(t, ds, 2)
+	assert.Equal(t, dacs, ds[0])
+	assert.Equal(t, "trit", ds[1].ID)
+	_, err = orgs.FetchDepartments("missing")
+	assert.True(t, errors.Is(err, store.ErrNotFound), "FetchDepartments: %v", err)
+
+	// Contacts can only reference existing companies and departments of their company.
+	for _, c := range []*store.Contact{
+		{Name: "A", CompanyID: "missing"},
+		{Name: "A", CompanyID: "dbg", DepartmentID: "missing"},
+		{Name: "A", CompanyID: "dbg", DepartmentID: "acme-it"},
+	} {
+		err := s.CreateContact(c)
+		assert.True(t, errors.Is(err, store.ErrValidation), "CreateContact(%s, %s): %v", c.CompanyID, c.DepartmentID, err)
+	}
+	require.Nil(t, s.CreateContact(&store.Contact{ID: "a", Name: "A", CompanyID: "dbg", DepartmentID: "dacs"}))
+	require.Nil(t, s.CreateContact(&store.Contact{ID: "b", Name: "B", CompanyID: "dbg"}))
+	r, err := s.GetContact("a")
+	require.Nil(t, err)
+	assert.Equal(t, "dbg", r.CompanyID)
+	assert.Equal(t, "dacs", r.DepartmentID)
+
+	err = s.UpdateContact(&store.Contact{ID: "b", Name: "B", CompanyID: acme.ID, DepartmentID: "dacs"})
+	assert.True(t, errors.Is(err, store.ErrValidation), "UpdateContact: %v", err)
+	_, err = s.PatchContact("b", 0, func(c *store.Contact) error {
+		c.CompanyID = "missing"
+		return nil
+	})
+	assert.True(t, errors.Is(err, store.ErrValidation), "PatchContact: %v", err)
+
+	// Referenced companies and departments can not be deleted, not even while their contacts are in the trash.
+	require.Nil(t, s.DeleteContact("a", 0))
+	err = orgs.DeleteDepartment("dacs")
+	assert.True(t, errors.Is(err, store.ErrConflict), "DeleteDepartment: %v", err)
+	err = orgs.DeleteCompany("dbg")
+	assert.True(t, errors.Is(err, store.ErrConflict), "DeleteCompany: %v", err)
+
+	_, err = s.PurgeContacts(time.Now().Add(time.Minute))
+	require.Nil(t, err)
+	require.Nil(t, orgs.DeleteDepartment("dacs"))
+	require.Nil(t, orgs.DeleteDepartment("trit"))
+	err = orgs.DeleteCompany("dbg")
+	assert.True(t, errors.Is(err, store.ErrConflict), "DeleteCompany while contact b works there: %v", err)
+
+	require.Nil(t, s.DeleteContact("b", 0))
+	_, err = s.PurgeContacts(time.Now().Add(time.Minute))
+	require.Nil(t, err)
+	require.Nil(t, orgs.DeleteCompany("dbg"))
+	assert.True(t, errors.Is(orgs.DeleteCompany("dbg"), store.ErrNotFound))
+	assert.True(t, errors.Is(orgs.DeleteDepartment("dacs"), store.ErrNotFound))
+
+	// Imports report invalid references by row.
+	if importer, ok := s.(store.Importer); ok {
+		r := &contactReader{{ID: "c", Name: "C", CompanyID: acme.ID}, {ID: "d", Name: "D", CompanyID: "dbg"}}
+		report, err := importer.ImportContacts(r)
+		require.Nil(t, err)
+		assert.Equal(t, 0, report.Imported)
+		require.Len(t, report.Errors, 1)
+		assert.Equal(t, 2, report.Errors[0].Row)
+		assert.Equal(t, []store.FieldError{{Field: "company_id", Message: "does not exist"}}, report.Errors[0].Fields)
+	}
+}
+
+func testOrgNames(t *testing.T, s store.ContactStorer) {
+	orgs, ok := s.(store.OrgStorer)
+	if !ok {
+		t.Skip("The store does not implement store.OrgStorer")
+	}
+	require.Nil(t, orgs.CreateCompany(&store.Company{ID: "dbg", Name: "DBG"}))
+	require.Nil(t, orgs.CreateDepartment(&store.Department{ID: "dacs", CompanyID: "dbg", Name: "DaCS"}))
+
+	// The names are taken from the references, the case of a name does not matter.
+	a := &store.Contact{ID: "a", Name: "A", CompanyID: "dbg", DepartmentID: "dacs"}
+	require.Nil(t, s.CreateContact(a))
+	assert.Equal(t, "DBG", a.Company)
+	assert.Equal(t, "DaCS", a.Department)
+	b := &store.Contact{ID: "b", Name: "B", Company: "dbg", Department: "Sales", CompanyID: "dbg"}
+	require.Nil(t, s.CreateContact(b))
+	r, err := s.GetContact("b")
+	require.Nil(t, err)
+	assert.Equal(t, "DBG", r.Company)
+	assert.Equal(t, "Sales", r.Department)
+
+	// Other names conflict with the references.
+	var v *store.ValidationError
+	err = s.CreateContact(&store.Contact{Name: "C", Company: "ACME", CompanyID: "dbg"})
+	require.True(t, errors.As(err, &v), "CreateContact with another company: %v", err)
+	assert.Equal(t, "company", v.Fields[0].Field)
+	err = s.UpdateContact(&store.Contact{ID: "a", Name: "A", Department: "IT", CompanyID: "dbg", DepartmentID: "dacs"})
+	require.True(t, errors.As(err, &v), "UpdateContact with another department: %v", err)
+	assert.Equal(t, "department", v.Fields[0].Field)
+
+	// Renames reach the contacts, which are recorded as updated.
+	require.Nil(t, orgs.UpdateCompany(&store.Company{ID: "dbg", Name: "Deutsche Börse Group"}))
+	require.Nil(t, orgs.UpdateDepartment(&store.Department{ID: "dacs", CompanyID: "dbg", Name: "Data Center Services"}))
+	r, err = s.GetContact("a")
+	require.Nil(t, err)
+	assert.Equal(t, "Deutsche Börse Group", r.Company)
+	assert.Equal(t, "Data Center Services", r.Department)
+	assert.Equal(t, 3, r.Version)
+	changes, err := s.History("a")
+	require.Nil(t, err)
+	require.Len(t, changes, 3)
+	assert.Equal(t, store.ActionUpdate, changes[1].Action)
+	assert.Equal(t, "DBG", changes[1].Before.Company)
+	assert.Equal(t, "Deutsche Börse Group", changes[1].After.Company)
+	assert.Equal(t, store.ActionUpdate, changes[2].Action)
+	assert.Equal(t, "Data Center Services", changes[2].After.Department)
+	r, err = s.GetContact("b")
+	require.Nil(t, err)
+	assert.Equal(t, "Deutsche Börse Group", r.Company)
+	assert.Equal(t, "Sales", r.Department)
+
+	// Contacts in the trash get the names once they are restored.
+	require.Nil(t, s.DeleteContact("b", 0))
+	require.Nil(t, orgs.UpdateCompany(&store.Company{ID: "dbg", Name: "DBG AG"}))
+	r, err = s.RestoreContact("b")
+	require.Nil(t, err)
+	assert.Equal(t, "DBG AG", r.Company)
+	r, err = s.GetContact("b")
+	require.Nil(t, err)
+	assert.Equal(t, "DBG AG", r.Company)
+
+	if importer, ok := s.(store.Importer); ok {
+		report, err := importer.ImportContacts(&contactReader{{ID: "c", Name: "C", Company: "ACME", CompanyID: "dbg"}})
+		require.Nil(t, err)
+		require.Len(t, report.Errors, 1)
+		assert.Equal(t, []store.FieldError{{Field: "company", Message: "must be the name of the company referenced"}},
+			report.Errors[0].Fields)
+
+		report, err = importer.ImportContacts(&contactReader{{ID: "c", Name: "C", CompanyID: "dbg", DepartmentID: "dacs"}})
+		require.Nil(t, err)
+		assert.Equal(t, 1, report.Imported)
+		r, err = s.GetContact("c")
+		require.Nil(t, err)
+		assert.Equal(t, "DBG AG", r.Company)
+		assert.Equal(t, "Data Center Services", r.Department)
+	}
+}
@@ -0,0 +1,9 @@
+package store
+
+// Transactor is implemented by stores which can apply several writes atomically.
+type Transactor interface {
+	// WithTx calls f with a store whose writes become visible to others only if f returns nil. If f returns an
+	// error, all writes made through tx are discarded and the error is returned. f must not use any other store
+	// than tx, and tx must not be used after f returned.
+	WithTx(f func(tx ContactStorer) error) error
+}
@@ -0,0 +1,287 @@
+package store
+
+import (
+	"fmt"
+	"net/mail"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// The maximum lengths of a contact's fields, counted in characters.
+const (
+	MaxIDLength    = 128
+	MaxNameLength  = 200
+	MaxFieldLength = 200
+)
+
+// ReservedIDs can not be used as contact IDs because they name collections below /contacts, like /contacts/search.
+var ReservedIDs = []string{"events", "search", "trash"}
+
+// FieldError describes why a single field is invalid.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationError is returned when a contact is invalid. It wraps ErrValidation.
+type ValidationError struct {
+	Fields []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	messages := make([]string, len(e.Fields))
+	for i, f := range e.Fields {
+		messages[i] = f.Field + " " + f.Message
+	}
+	return fmt.Sprintf("%s: %s", ErrValidation, strings.Join(messages, ", "))
+}
+
+func (e *ValidationError) Unwrap() error {
+	return ErrValidation
+}
+
+func (e *ValidationError) add(field, message string, args ...interface{}) {
+	e.Fields = append(e.Fields, FieldError{Field: field, Message: fmt.Sprintf(message, args...)})
+}
+
+// e164 matches phone numbers in E.164 format: a plus sign and up to 15 digits, starting with the country code.
+var e164 = regexp.MustCompile(`^\+[1-9][0-9]{1,14}$`)
+
+// Normalize converts the contact's text to Unicode NFC and trims leading and trailing white space, so that
+// equal text is stored the same way no matter how the client encoded it. Types are lower cased, phone numbers
+// stripped of the spaces, dashes, dots and parentheses used to group digits, and empty lists and maps become nil.
+func (c *Contact) Normalize() {
+	for _, f := range []*string{&c.ID, &c.Name, &c.Department, &c.Company, &c.CompanyID, &c.DepartmentID, &c.ManagerID} {
+		*f = normalize(*f)
+	}
+
+	for i := range c.Emails {
+		email := &c.Emails[i]
+		email.Type = strings.ToLower(normalize(email.Type))
+		email.Address = normalize(email.Address)
+	}
+	for i := range c.Phones {
+		phone := &c.Phones[i]
+		phone.Type = strings.ToLower(normalize(phone.Type))
+		phone.Number = strings.Map(func(r rune) rune {
+			if unicode.IsSpace(r) || strings.ContainsRune("-.()", r) {
+				return -1
+			}
+			return r
+		}, normalize(phone.Number))
+	}
+	for i := range c.Addresses {
+		address := &c.Addresses[i]
+		address.Type = strings.ToLower(normalize(address.Type))
+		for _, f := range []*string{&address.Street, &address.City, &address.PostalCode, &address.Region} {
+			*f = normalize(*f)
+		}
+		address.Country = strings.ToUpper(normalize(address.Country))
+	}
+	for i, tag := range c.Tags {
+		c.Tags[i] = normalize(tag)
+	}
+	if len(c.Attributes) > 0 {
+		attributes := make(map[string]string, len(c.Attributes))
+		for k, v := range c.Attributes {
+			attributes[normalize(k)] = normalize(v)
+		}
+		c.Attributes = attributes
+	}
+
+	if len(c.Emails) == 0 {
+		c.Emails = nil
+	}
+	if len(c.Phones) == 0 {
+		c.Phones = nil
+	}
+	if len(c.Addresses) == 0 {
+		c.Addresses = nil
+	}
+	if len(c.Tags) == 0 {
+		c.Tags = nil
+	}
+	if len(c.Attributes) == 0 {
+		c.Attributes = nil
+	}
+}
+
+func normalize(s string) string {
+	return strings.TrimSpace(norm.NFC.String(s))
+}
+
+// Validate normalizes the contact and checks that all fields are within their limits and only contain allowed
+// characters. It returns a *ValidationError listing all invalid fields.
+func (c *Contact) Validate() error {
+	c.Normalize()
+
+	e := new(ValidationError)
+	if c.ID != "" {
+		validateText(e, "id", c.ID, MaxIDLength, isIDRune)
+		for _, id := range ReservedIDs {
+			if c.ID == id {
+				e.add("id", "must not be %q, which is reserved", id)
+			}
+		}
+	}
+
+	if c.Name == "" {
+		e.add("name", "is required")
+	} else {
+		validateText(e, "name", c.Name, MaxNameLength, isNameRune)
+	}
+
+	validateText(e, "department", c.Department, MaxFieldLength, isTextRune)
+	validateText(e, "company", c.Company, MaxFieldLength, isTextRune)
+
+	if c.CompanyID != "" {
+		validateText(e, "company_id", c.CompanyID, MaxIDLength, isIDRune)
+	}
+	if c.DepartmentID != "" {
+		validateText(e, "department_id", c.DepartmentID, MaxIDLength, isIDRune)
+		if c.CompanyID == "" {
+			e.add("department_id", "requires company_id")
+		}
+	}
+
+	if c.ManagerID != "" {
+		validateText(e, "manager_id", c.ManagerID, MaxIDLength, isIDRune)
+		if c.ManagerID == c.ID {
+			e.add("manager_id", "must not be the contact itself")
+		}
+	}
+
+	c.validateDetails(e)
+
+	if len(e.Fields) > 0 {
+		return e
+	}
+	return nil
+}
+
+func (c *Contact) validateDetails(e *ValidationError) {
+	validateCount(e, "emails", len(c.Emails), MaxValues)
+	for i, email := range c.Emails {
+		field := fmt.Sprintf("emails[%d]", i)
+		validateType(e, field+".type", email.Type, TypeWork, TypeHome, TypeOther)
+		if email.Address == "" {
+			e.add(field+".address", "is required")
+		} else if addr, err := mail.ParseAddress(email.Address); err != nil || addr.Address != email.Address {
+			e.add(field+".address", "must be an email address like jane@example.com")
+		} else {
+			validateText(e, field+".address", email.Address, MaxFieldLength, isTextRune)
+		}
+	}
+
+	validateCount(e, "phones", len(c.Phones), MaxValues)
+	for i, phone := range c.Phones {
+		field := fmt.Sprintf("phones[%d]", i)
+		validateType(e, field+".type", phone.Type, TypeWork, TypeHome, TypeMobile, TypeFax, TypeOther)
+		if phone.Number == "" {
+			e.add(field+".number", "is required")
+		} else if !e164.MatchString(phone.Number) {
+			e.add(field+".number", "must be in E.164 format like +4969211111")
+		}
+	}
+
+	validateCount(e, "addresses", len(c.Addresses), MaxValues)
+	for i, address := range c.Addresses {
+		field := fmt.Sprintf("addresses[%d]", i)
+		validateType(e, field+".type", address.Type, TypeWork, TypeHome, TypeOther)
+		validateText(e, field+".street", address.Street, MaxFieldLength, isTextRune)
+		validateText(e, field+".city", address.City, MaxFieldLength, isTextRune)
+		validateText(e, field+".postal_code", address.PostalCode, MaxFieldLength, isTextRune)
+		validateText(e, field+".region", address.Region, MaxFieldLength, isTextRune)
+		if address.Country != "" && !isCountryCode(address.Country) {
+			e.add(field+".country", "must be a two letter country code like DE")
+		}
+	}
+
+	validateCount(e, "tags", len(c.Tags), MaxTags)
+	seen := make(map[string]bool, len(c.Tags))
+	for i, tag := range c.Tags {
+		field := fmt.Sprintf("tags[%d]", i)
+		if tag == "" {
+			e.add(field, "must not be empty")
+		} else if seen[tag] {
+			e.add(field, "must not repeat %q", tag)
+		} else {
+			validateText(e, field, tag, MaxTagLength, isTextRune)
+		}
+		seen[tag] = true
+	}
+
+	validateCount(e, "attributes", len(c.Attributes), MaxAttributes)
+	keys := make([]string, 0, len(c.Attributes))
+	for k := range c.Attributes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		field := "attributes." + k
+		if k == "" {
+			e.add("attributes", "must not have an empty key")
+			continue
+		}
+		validateText(e, field, k, MaxAttributeKeyLength, isAttributeKeyRune)
+		validateText(e, field, c.Attributes[k], MaxFieldLength, isTextRune)
+	}
+}
+
+func validateCount(e *ValidationError, field string, n, max int) {
+	if n > max {
+		e.add(field, "must not have more than %d entries", max)
+	}
+}
+
+func validateType(e *ValidationError, field, value string, allowed ...string) {
+	if value == "" {
+		return
+	}
+	for _, t := range allowed {
+		if value == t {
+			return
+		}
+	}
+	e.add(field, "must be one of %s", strings.Join(allowed, ", "))
+}
+
+func isCountryCode(s string) bool {
+	return len(s) == 2 && 'A' <= s[0] && s[0] <= 'Z' && 'A' <= s[1] && s[1] <= 'Z'
+}
+
+func validateText(e *ValidationError, field, value string, max int, allowed func(rune) bool) {
+	if !utf8.ValidString(value) {
+		e.add(field, "is not valid UTF-8")
+	} else if n := utf8.RuneCountInString(value); n > max {
+		e.add(field, "must not be longer than %d characters", max)
+	} else if i := strings.IndexFunc(value, func(r rune) bool { return !allowed(r) }); i >= 0 {
+		r, _ := utf8.DecodeRuneInString(value[i:])
+		e.add(field, "must not contain the character %q", r)
+	}
+}
+
+// isIDRune allows printable characters except for those with a special meaning in URLs.
+func isIDRune(r rune) bool {
+	return unicode.IsPrint(r) && !strings.ContainsRune(`/?#%\`, r)
+}
+
+// isNameRune allows letters, marks, numbers, punctuation and spaces.
+func isNameRune(r rune) bool {
+	return unicode.In(r, unicode.L, unicode.M, unicode.N, unicode.P) || r == ' '
+}
+
+// isAttributeKeyRune allows letters, digits, underscores, dashes and dots.
+func isAttributeKeyRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune("_-.", r)
+}
+
+// isTextRune additionally allows symbols like & or +.
+func isTextRune(r rune) bool {
+	return isNameRune(r) || unicode.IsSymbol(r)
+}
@@ -0,0 +1,111 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidate(t *testing.T) {
+	for k, c := range []struct {
+		contact Contact
+		fields  []string
+	}{
+		{contact: Contact{Name: "John Bravo", Department: "R&D", Company: "ACME Inc."}},
+		{contact: Contact{ID: "john-bravo", Name: "Cathrine Müller"}},
+		{contact: Contact{}, fields: []string{"name"}},
+		{contact: Contact{Name: "   "}, fields: []string{"name"}},
+		{contact: Contact{Name: "John\x00Bravo"}, fields: []string{"name"}},
+		{contact: Contact{Name: "John", Department: strings.Repeat("a", MaxFieldLength+1)}, fields: []string{"department"}},
+		{contact: Contact{ID: "a/b", Name: "John", Company: "\n"}, fields: []string{"id"}},
+		{contact: Contact{ID: "a/b", Company: "ACME\tInc"}, fields: []string{"id", "name", "company"}},
+		{contact: Contact{Name: "John", Company: "\xff"}, fields: []string{"company"}},
+		{contact: Contact{
+			Name:       "John",
+			Emails:     []Email{{Type: "Work", Address: "john@example.com"}},
+			Phones:     []Phone{{Type: TypeMobile, Number: "+49 (69) 211-111"}},
+			Addresses:  []Address{{Street: "Main St 1", City: "Frankfurt", Country: "de"}},
+			ManagerID:  "jane",
+			Tags:       []string{"vip", "board"},
+			Attributes: map[string]string{"cost_center": "4711"},
+		}},
+		{contact: Contact{Name: "John", Emails: []Email{{Address: "john"}, {Address: "John <john@example.com>"}, {}}},
+			fields: []string{"emails[0].address", "emails[1].address", "emails[2].address"}},
+		{contact: Contact{Name: "John", Emails: []Email{{Type: TypeFax, Address: "john@example.com"}}},
+			fields: []string{"emails[0].type"}},
+		{contact: Contact{Name: "John", Phones: []Phone{{Number: "069 211111"}, {Number: "+0123"}, {Number: "+1234567890123456"}}},
+			fields: []string{"phones[0].number", "phones[1].number", "phones[2].number"}},
+		{contact: Contact{Name: "John", Addresses: []Address{{Country: "Germany"}}}, fields: []string{"addresses[0].country"}},
+		{contact: Contact{ID: "john", Name: "John", ManagerID: "john"}, fields: []string{"manager_id"}},
+		{contact: Contact{ID: "search", Name: "John"}, fields: []string{"id"}},
+		{contact: Contact{ID: "trash", Name: "John"}, fields: []string{"id"}},
+		{contact: Contact{ID: "Trash", Name: "John"}},
+		{contact: Contact{Name: "John", CompanyID: "dbg", DepartmentID: "dacs"}},
+		{contact: Contact{Name: "John", DepartmentID: "dacs"}, fields: []string{"department_id"}},
+		{contact: Contact{Name: "John", Tags: []string{"vip", " ", "vip"}}, fields: []string{"tags[1]", "tags[2]"}},
+		{contact: Contact{Name: "John", Tags: make([]string, MaxTags+1)}, fields: append([]string{"tags"}, tagFields(MaxTags+1)...)},
+		{contact: Contact{Name: "John", Attributes: map[string]string{"cost center": "4711", "b": "\x00"}},
+			fields: []string{"attributes.b", "attributes.cost center"}},
+	} {
+		err := c.contact.Validate()
+		if len(c.fields) == 0 {
+			assert.Nil(t, err, "case %d", k)
+			continue
+		}
+
+		require.True(t, errors.Is(err, ErrValidation), "case %d", k)
+		var v *ValidationError
+		require.True(t, errors.As(err, &v), "case %d", k)
+
+		var fields []string
+		for _, f := range v.Fields {
+			fields = append(fields, f.Field)
+		}
+		assert.Equal(t, c.fields, fields, "case %d", k)
+	}
+}
+
+func tagFields(n int) []string {
+	fields := make([]string, n)
+	for i := range fields {
+		fields[i] = fmt.Sprintf("tags[%d]", i)
+	}
+	return fields
+}
+
+func TestNormalize(t *testing.T) {
+	// "Müller" with a combining diaeresis is stored precomposed.
+	c := &Contact{Name: " Müller\t", Company: " ACME "}
+	require.Nil(t, c.Validate())
+	assert.Equal(t, "Müller", c.Name)
+	assert.Equal(t, "ACME", c.Company)
+
+	c = &Contact{
+		Name:      "John",
+		Emails:    []Email{{Type: " WORK ", Address: " john@example.com "}},
+		Phones:    []Phone{{Number: "+49 (69) 211-111"}},
+		Addresses: []Address{{Country: "de"}},
+		Tags:      []string{},
+	}
+	require.Nil(t, c.Validate())
+	assert.Equal(t, []Email{{Type: TypeWork, Address: "john@example.com"}}, c.Emails)
+	assert.Equal(t, "+4969211111", c.Phones[0].Number)
+	assert.Equal(t, "DE", c.Addresses[0].Country)
+	assert.Nil(t, c.Tags)
+}
+
+func TestCloneDetails(t *testing.T) {
+	c := &Contact{Emails: []Email{{Address: "john@example.com"}}, Tags: []string{"vip"}, Attributes: map[string]string{"a": "b"}}
+	clone := c.Clone()
+	clone.Emails[0].Address = "jane@example.com"
+	clone.Tags[0] = "board"
+	clone.Attributes["a"] = "c"
+	assert.Equal(t, "john@example.com", c.Emails[0].Address)
+	assert.Equal(t, []string{"vip"}, c.Tags)
+	assert.Equal(t, "b", c.Attributes["a"])
+	assert.Nil(t, (&Contact{}).Clone().Tags)
+}
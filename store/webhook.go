@@ -0,0 +1,155 @@
+package store
+
+import (
+	"net/url"
+	"time"
+)
+
+// The states of a delivery. Pending deliveries are attempted until they are delivered or run out of attempts, in
+// which case they become dead letters.
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryDead      = "dead"
+)
+
+// MaxURLLength is the maximum length of a webhook's URL.
+const MaxURLLength = 2048
+
+// Webhook subscribes a URL to the changes of a store.
+type Webhook struct {
+	ID  string `json:"id"`
+	URL string `json:"url"`
+
+	// Secret is the key deliveries are signed with.
+	Secret string `json:"secret,omitempty"`
+
+	// Events lists the actions the webhook receives, see ActionCreate and friends. Empty means all actions.
+	Events []string `json:"events"`
+
+	// Active webhooks receive deliveries. Inactive ones are kept, but get nothing.
+	Active bool `json:"active"`
+
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Clone returns a deep copy of the webhook.
+func (w *Webhook) Clone() *Webhook {
+	clone := *w
+	clone.Events = append([]string{}, w.Events...)
+	return &clone
+}
+
+// Receives returns true if the webhook is active and subscribed to action.
+func (w *Webhook) Receives(action string) bool {
+	if !w.Active {
+		return false
+	}
+	for _, e := range w.Events {
+		if e == action {
+			return true
+		}
+	}
+	return len(w.Events) == 0
+}
+
+// Validate checks that the URL is an absolute HTTP(S) URL and the events are known actions. It returns a
+// *ValidationError listing all invalid fields.
+func (w *Webhook) Validate() error {
+	e := new(ValidationError)
+	if u, err := url.Parse(w.URL); w.URL == "" {
+		e.add("url", "is required")
+	} else if len(w.URL) > MaxURLLength {
+		e.add("url", "must be at most %d characters long", MaxURLLength)
+	} else if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		e.add("url", "must be an absolute http or https URL")
+	}
+
+	for _, event := range w.Events {
+		switch event {
+		case ActionCreate, ActionUpdate, ActionDelete, ActionRestore, ActionPurge:
+		default:
+			e.add("events", "contains the unknown event %q", event)
+		}
+	}
+
+	if len(e.Fields) > 0 {
+		return e
+	}
+	return nil
+}
+
+// Delivery is the attempt to send a change to a webhook.
+type Delivery struct {
+	ID        int64   `json:"id"`
+	WebhookID string  `json:"webhook_id"`
+	Change    *Change `json:"change"`
+	Status    string  `json:"status"`
+	Attempts  int     `json:"attempts"`
+
+	// NextAttempt is when a pending delivery is attempted next.
+	NextAttempt time.Time `json:"next_attempt"`
+
+	// LastStatus is the response status of the last attempt, 0 if there was no response.
+	LastStatus int    `json:"last_status,omitempty"`
+	LastError  string `json:"last_error,omitempty"`
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Clone returns a deep copy of the delivery.
+func (d *Delivery) Clone() *Delivery {
+	clone := *d
+	if d.Change != nil {
+		clone.Change = d.Change.Clone()
+	}
+	return &clone
+}
+
+// DeliveryQuery selects deliveries for the delivery log.
+type DeliveryQuery struct {
+	// WebhookID and Status restrict the deliveries if set.
+	WebhookID string
+	Status    string
+
+	// Limit is the maximum number of deliveries returned, most recent first. It defaults to DefaultLimit and is
+	// capped at MaxLimit.
+	Limit int
+}
+
+// Normalize applies the default limit.
+func (q *DeliveryQuery) Normalize() {
+	if q.Limit <= 0 {
+		q.Limit = DefaultLimit
+	} else if q.Limit > MaxLimit {
+		q.Limit = MaxLimit
+	}
+}
+
+// Matches returns true if d is selected by the query, ignoring the limit.
+func (q *DeliveryQuery) Matches(d *Delivery) bool {
+	return (q.WebhookID == "" || d.WebhookID == q.WebhookID) && (q.Status == "" || d.Status == q.Status)
+}
+
+// WebhookStorer is implemented by stores which keep webhooks next to their contacts. Whenever a change is recorded
+// in the history, the store atomically queues a pending delivery for every webhook receiving it.
+//
+// CreateWebhook assigns an ID and the creation time. UpdateWebhook replaces everything but those. Deleting a webhook
+// also deletes its deliveries.
+//
+// ClaimDeliveries returns up to limit pending deliveries which are due at now, oldest first, and postpones them by
+// lease, so other dispatchers do not pick them up while they are being delivered. UpdateDelivery stores the outcome
+// of an attempt. FetchDeliveries lists deliveries, most recent first.
+type WebhookStorer interface {
+	CreateWebhook(*Webhook) error
+	GetWebhook(id string) (*Webhook, error)
+	FetchWebhooks() ([]*Webhook, error)
+	UpdateWebhook(*Webhook) error
+	DeleteWebhook(id string) error
+
+	ClaimDeliveries(now time.Time, lease time.Duration, limit int) ([]*Delivery, error)
+	UpdateDelivery(*Delivery) error
+	GetDelivery(id int64) (*Delivery, error)
+	FetchDeliveries(*DeliveryQuery) ([]*Delivery, error)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Timeouts limit how long a request may take, depending on its route: Bulk applies to imports, exports and batches,
+// Read to other GET and HEAD requests and Write to everything else. Event streams are never limited, and zero
+// timeouts do not limit either.
+//
+// The timeout becomes the deadline of the request's context, which RequestStore hands to the store. Requests taking
+// longer fail with 504 Gateway Timeout, see StatusCode.
+type Timeouts struct {
+	Read  time.Duration
+	Write time.Duration
+	Bulk  time.Duration
+}
+
+// ParseTimeouts parses durations like "5s". "0" disables a timeout.
+func ParseTimeouts(read, write, bulk string) (*Timeouts, error) {
+	t := new(Timeouts)
+	for _, d := range []struct {
+		name  string
+		value string
+		into  *time.Duration
+	}{{"read", read, &t.Read}, {"write", write, &t.Write}, {"bulk", bulk, &t.Bulk}} {
+		timeout, err := time.ParseDuration(d.value)
+		if err != nil || timeout < 0 {
+			return nil, fmt.Errorf("The %s timeout must be a duration like 5s, got %q", d.name, d.value)
+		}
+		*d.into = timeout
+	}
+	return t, nil
+}
+
+// For returns the timeout of r. Routes are told apart by their path template, so contact IDs can not change the
+// timeout.
+func (t *Timeouts) For(r *http.Request) time.Duration {
+	path := r.URL.Path
+	if route := mux.CurrentRoute(r); route != nil {
+		if template, err := route.GetPathTemplate(); err == nil {
+			path = template
+		}
+	}
+
+	switch {
+	case strings.HasSuffix(path, "/events"):
+		return 0
+	case strings.HasSuffix(path, ":import"), strings.HasSuffix(path, ":export"), strings.HasSuffix(path, ":batch"):
+		return t.Bulk
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		return t.Read
+	}
+	return t.Write
+}
+
+// Handler sets the deadline of requests. Use it with mux.Router.Use, which runs it once the route is known.
+func (t *Timeouts) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if timeout := t.For(r); timeout > 0 {
+			ctx, cancel := context.WithTimeout(r.Context(), timeout)
+			defer cancel()
+			r = r.WithContext(ctx)
+		}
+		next.ServeHTTP(rw, r)
+	})
+}
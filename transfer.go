@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/ory/workshop-dbg/bulk"
+	. "github.com/ory/workshop-dbg/store"
+)
+
+// ImportContacts creates the contacts in the request body, which is read as CSV, JSON Lines or vCard depending on
+// the Content-Type. The body is streamed, so there is no size limit. By default invalid rows are skipped, with
+// ?atomic=true nothing is imported unless all rows are valid. Either way the response lists the failed rows.
+func ImportContacts(store ContactStorer) func(rw http.ResponseWriter, r *http.Request) {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		reader, err := bulk.NewReader(mediaType, r.Body)
+		if err != nil {
+			WriteError(rw, fmt.Errorf("%w: Use %s, %s or %s", ErrUnsupportedMediaType, bulk.CSVType, bulk.NDJSONType, bulk.VCardType))
+			return
+		}
+
+		atomic := false
+		if value := r.URL.Query().Get("atomic"); value != "" {
+			if atomic, err = strconv.ParseBool(value); err != nil {
+				WriteError(rw, fmt.Errorf("%w: atomic must be true or false", ErrBadRequest))
+				return
+			}
+		}
+
+		report, err := Import(RequestStore(store, r), reader, atomic)
+		if err != nil {
+			WriteError(rw, err)
+			return
+		}
+
+		code := http.StatusOK
+		if atomic && len(report.Errors) > 0 {
+			code = http.StatusUnprocessableEntity
+		}
+		WriteJSON(rw, code, report)
+	}
+}
+
+// ExportContacts streams all contacts matching the filters understood by ParseQuery. The format is chosen by the
+// format query parameter (csv, ndjson or vcard) or the Accept header and defaults to JSON Lines.
+func ExportContacts(store ContactStorer) func(rw http.ResponseWriter, r *http.Request) {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		store := RequestStore(store, r)
+		mediaType, err := exportType(r)
+		if err != nil {
+			WriteError(rw, err)
+			return
+		}
+
+		q, err := ParseQuery(r)
+		if err != nil {
+			WriteError(rw, err)
+			return
+		}
+		q.Limit, q.Cursor = MaxLimit, ""
+
+		// The first page is fetched before writing anything, so errors like an invalid sort field still result
+		// in a proper error response.
+		page, err := store.QueryContacts(q)
+		if err != nil {
+			WriteError(rw, err)
+			return
+		}
+
+		rw.Header().Set("Content-Type", mediaType)
+		rw.Header().Set("Content-Disposition", `attachment; filename="contacts.`+bulk.Extensions[mediaType]+`"`)
+		w, _ := bulk.NewWriter(mediaType, rw)
+		for {
+			for _, c := range page.Contacts {
+				if err := w.Write(c); err != nil {
+					log.Printf("Could not export contacts because %s", err)
+					return
+				}
+			}
+			if err := w.Flush(); err != nil {
+				log.Printf("Could not export contacts because %s", err)
+				return
+			}
+			if f, ok := rw.(http.Flusher); ok {
+				f.Flush()
+			}
+
+			if page.NextCursor == "" {
+				return
+			}
+
+			// The response has already started, all we can do is to cut it short.
+			q.Cursor = page.NextCursor
+			if page, err = store.QueryContacts(q); err != nil {
+				log.Printf("Could not export contacts because %s", err)
+				return
+			}
+		}
+	}
+}
+
+// exportType returns the media type requested by the format query parameter or the Accept header.
+func exportType(r *http.Request) (string, error) {
+	if format := r.URL.Query().Get("format"); format != "" {
+		mediaType, ok := bulk.Formats[format]
+		if !ok {
+			return "", fmt.Errorf("%w: Unknown format %q, use csv, ndjson or vcard", ErrBadRequest, format)
+		}
+		return mediaType, nil
+	}
+
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return bulk.NDJSONType, nil
+	}
+
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, _, err := mime.ParseMediaType(part)
+		if err != nil {
+			continue
+		} else if _, ok := bulk.Extensions[mediaType]; ok {
+			return mediaType, nil
+		} else if mediaType == "*/*" {
+			return bulk.NDJSONType, nil
+		}
+	}
+	return "", fmt.Errorf("%w: Use %s, %s or %s", ErrNotAcceptable, bulk.CSVType, bulk.NDJSONType, bulk.VCardType)
+}
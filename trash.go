@@ -0,0 +1,57 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	. "github.com/ory/workshop-dbg/store"
+)
+
+// TrashContacts lists the deleted contacts, most recently deleted first.
+func TrashContacts(store ContactStorer) func(rw http.ResponseWriter, r *http.Request) {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		contacts, err := RequestStore(store, r).FetchTrash()
+		if err != nil {
+			WriteError(rw, err)
+			return
+		}
+		WriteJSON(rw, http.StatusOK, contacts)
+	}
+}
+
+// RestoreContact moves a contact out of the trash.
+func RestoreContact(store ContactStorer) func(rw http.ResponseWriter, r *http.Request) {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		contact, err := RequestStore(store, r).RestoreContact(mux.Vars(r)["id"])
+		if err != nil {
+			WriteError(rw, err)
+			return
+		}
+
+		WriteETag(rw, contact)
+		WriteJSON(rw, http.StatusOK, contact)
+	}
+}
+
+// PurgeTrash permanently deletes contacts which have been in the trash for longer than retention. It checks every
+// interval until stop is closed.
+func PurgeTrash(store ContactStorer, retention, interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if n, err := store.PurgeContacts(time.Now().Add(-retention)); err != nil {
+			log.Printf("Could not purge the trash because %s", err)
+		} else if n > 0 {
+			log.Printf("Purged %d contacts from the trash", n)
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,254 @@
+// Package webhook delivers the changes queued by a store.WebhookStorer to the webhooks' URLs.
+//
+// Every delivery is a POST request whose body is the JSON encoded store.Change. The SignatureHeader holds the time
+// of the attempt and an HMAC-SHA256 of the time and the body, keyed with the webhook's secret, so receivers can
+// check where the request came from and reject replays, see Verify. Deliveries which fail are retried with
+// exponential backoff until they run out of attempts and become dead letters.
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ory/workshop-dbg/store"
+)
+
+// The headers sent with every delivery.
+const (
+	SignatureHeader = "X-Webhook-Signature"
+	WebhookHeader   = "X-Webhook-ID"
+	DeliveryHeader  = "X-Webhook-Delivery"
+	EventHeader     = "X-Webhook-Event"
+)
+
+// The defaults of a Dispatcher.
+const (
+	DefaultMaxAttempts = 8
+	DefaultBackoff     = 30 * time.Second
+	DefaultMaxBackoff  = time.Hour
+	DefaultInterval    = time.Second
+	DefaultTimeout     = 10 * time.Second
+	DefaultBatchSize   = 20
+)
+
+var (
+	// ErrInvalidSignature is returned by Verify if the signature is missing, malformed or does not match.
+	ErrInvalidSignature = errors.New("Invalid webhook signature")
+
+	// ErrExpiredSignature is returned by Verify if the signature is older than the tolerance.
+	ErrExpiredSignature = errors.New("Expired webhook signature")
+)
+
+// NewSecret returns a random secret for signing deliveries.
+func NewSecret() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// Sign returns the value of the SignatureHeader for body sent at t.
+func Sign(secret string, t time.Time, body []byte) string {
+	ts := strconv.FormatInt(t.Unix(), 10)
+	return "t=" + ts + ",v1=" + mac(secret, ts, body)
+}
+
+func mac(secret, ts string, body []byte) string {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(ts + "."))
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Verify checks the signature of a delivery received at now. Signatures older than tolerance are rejected.
+func Verify(secret, signature string, body []byte, now time.Time, tolerance time.Duration) error {
+	var ts, v1 string
+	for _, part := range strings.Split(signature, ",") {
+		if strings.HasPrefix(part, "t=") {
+			ts = part[2:]
+		} else if strings.HasPrefix(part, "v1=") {
+			v1 = part[3:]
+		}
+	}
+
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil || v1 == "" || !hmac.Equal([]byte(v1), []byte(mac(secret, ts, body))) {
+		return ErrInvalidSignature
+	} else if now.Sub(time.Unix(sec, 0)) > tolerance {
+		return ErrExpiredSignature
+	}
+	return nil
+}
+
+// Dispatcher sends due deliveries. Zero fields take their defaults. Several dispatchers may share a store, each
+// delivery is claimed by one of them at a time.
+type Dispatcher struct {
+	Store store.WebhookStorer
+
+	// Client sends the requests. It defaults to a client with DefaultTimeout.
+	Client *http.Client
+
+	// MaxAttempts is the number of attempts after which a delivery becomes a dead letter.
+	MaxAttempts int
+
+	// Backoff is the delay before the first retry. It doubles with every further retry up to MaxBackoff.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+
+	// Interval is how often Run looks for due deliveries.
+	Interval time.Duration
+
+	// BatchSize is the number of deliveries claimed at once.
+	BatchSize int
+}
+
+// Run dispatches due deliveries every Interval until stop is closed.
+func (d *Dispatcher) Run(stop <-chan struct{}) {
+	d = d.withDefaults()
+	ticker := time.NewTicker(d.Interval)
+	defer ticker.Stop()
+
+	for {
+		// Keep going while there is a backlog.
+		for {
+			n, err := d.Dispatch(time.Now())
+			if err != nil {
+				log.Printf("Could not dispatch webhook deliveries because %s", err)
+			}
+			if err != nil || n < d.BatchSize {
+				break
+			}
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Dispatch attempts a batch of the deliveries due at now and returns how many it attempted.
+func (d *Dispatcher) Dispatch(now time.Time) (int, error) {
+	d = d.withDefaults()
+
+	// The lease outlasts the attempts of the whole batch, so no other dispatcher picks them up in the meantime.
+	timeout := d.Client.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	deliveries, err := d.Store.ClaimDeliveries(now, 2*time.Duration(d.BatchSize)*timeout, d.BatchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, delivery := range deliveries {
+		if err := d.attempt(delivery, now); err != nil {
+			return 0, err
+		}
+	}
+	return len(deliveries), nil
+}
+
+// attempt sends a delivery and stores the outcome.
+func (d *Dispatcher) attempt(delivery *store.Delivery, now time.Time) error {
+	w, err := d.Store.GetWebhook(delivery.WebhookID)
+	if errors.Is(err, store.ErrNotFound) {
+		// The webhook was deleted together with its deliveries.
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	delivery.Attempts++
+	delivery.LastStatus, delivery.LastError = send(d.Client, w, delivery)
+	if delivery.LastError == "" {
+		delivery.Status = store.DeliveryDelivered
+	} else if delivery.Attempts >= d.MaxAttempts {
+		delivery.Status = store.DeliveryDead
+	} else {
+		delivery.NextAttempt = now.Add(d.backoff(delivery.Attempts))
+	}
+	return d.Store.UpdateDelivery(delivery)
+}
+
+// backoff returns the delay after the given number of failed attempts.
+func (d *Dispatcher) backoff(attempts int) time.Duration {
+	delay := d.Backoff
+	for i := 1; i < attempts && delay < d.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > d.MaxBackoff {
+		return d.MaxBackoff
+	}
+	return delay
+}
+
+// withDefaults returns a copy of the dispatcher with the defaults applied.
+func (d *Dispatcher) withDefaults() *Dispatcher {
+	c := *d
+	if c.Client == nil {
+		c.Client = &http.Client{Timeout: DefaultTimeout}
+	}
+	if c.MaxAttempts <= 0 {
+		c.MaxAttempts = DefaultMaxAttempts
+	}
+	if c.Backoff <= 0 {
+		c.Backoff = DefaultBackoff
+	}
+	if c.MaxBackoff <= 0 {
+		c.MaxBackoff = DefaultMaxBackoff
+	}
+	if c.Interval <= 0 {
+		c.Interval = DefaultInterval
+	}
+	if c.BatchSize <= 0 {
+		c.BatchSize = DefaultBatchSize
+	}
+	return &c
+}
+
+// send posts the delivery and returns the response status and an error message unless the webhook responded with
+// 2xx.
+func send(client *http.Client, w *store.Webhook, delivery *store.Delivery) (int, string) {
+	body, err := json.Marshal(delivery.Change)
+	if err != nil {
+		return 0, err.Error()
+	}
+
+	req, err := http.NewRequest("POST", w.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err.Error()
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(SignatureHeader, Sign(w.Secret, time.Now(), body))
+	req.Header.Set(WebhookHeader, w.ID)
+	req.Header.Set(DeliveryHeader, strconv.FormatInt(delivery.ID, 10))
+	req.Header.Set(EventHeader, delivery.Change.Action)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err.Error()
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Sprintf("The webhook responded with %s", resp.Status)
+	}
+	return resp.StatusCode, ""
+}
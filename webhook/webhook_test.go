@@ -0,0 +1,126 @@
+package webhook
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ory/workshop-dbg/store"
+	"github.com/ory/workshop-dbg/store/memory"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSignature(t *testing.T) {
+	now := time.Now()
+	body := []byte(`{"seq": 1}`)
+	signature := Sign("secret", now, body)
+
+	assert.Nil(t, Verify("secret", signature, body, now.Add(time.Minute), 5*time.Minute))
+	assert.Equal(t, ErrExpiredSignature, Verify("secret", signature, body, now.Add(time.Hour), 5*time.Minute))
+	assert.Equal(t, ErrInvalidSignature, Verify("other", signature, body, now, time.Minute))
+	assert.Equal(t, ErrInvalidSignature, Verify("secret", signature, []byte(`{"seq": 2}`), now, time.Minute))
+	assert.Equal(t, ErrInvalidSignature, Verify("secret", "", body, now, time.Minute))
+}
+
+func TestDispatcher(t *testing.T) {
+	var mu sync.Mutex
+	var received []*http.Request
+	var bodies [][]byte
+	failures := 2
+	receiver := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		body, _ := ioutil.ReadAll(r.Body)
+		received, bodies = append(received, r), append(bodies, body)
+		if failures > 0 {
+			failures--
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		rw.WriteHeader(http.StatusNoContent)
+	}))
+	defer receiver.Close()
+
+	s := &memory.InMemoryStore{Contacts: store.Contacts{}}
+	w := &store.Webhook{URL: receiver.URL, Secret: "secret", Events: []string{store.ActionCreate}, Active: true}
+	require.Nil(t, s.CreateWebhook(w))
+	require.Nil(t, s.CreateContact(&store.Contact{ID: "a", Name: "A"}))
+	require.Nil(t, s.DeleteContact("a", 0))
+
+	d := &Dispatcher{Store: s, MaxAttempts: 3, Backoff: time.Minute, MaxBackoff: time.Hour}
+	now := time.Now()
+
+	// The first attempt fails and the retry is not due yet.
+	n, err := d.Dispatch(now)
+	require.Nil(t, err)
+	assert.Equal(t, 1, n)
+	n, err = d.Dispatch(now.Add(59 * time.Second))
+	require.Nil(t, err)
+	assert.Equal(t, 0, n)
+
+	n, err = d.Dispatch(now.Add(time.Minute))
+	require.Nil(t, err)
+	assert.Equal(t, 1, n)
+	n, err = d.Dispatch(now.Add(3 * time.Minute))
+	require.Nil(t, err)
+	assert.Equal(t, 1, n)
+
+	deliveries, err := s.FetchDeliveries(&store.DeliveryQuery{WebhookID: w.ID})
+	require.Nil(t, err)
+	require.Len(t, deliveries, 1)
+	assert.Equal(t, store.DeliveryDelivered, deliveries[0].Status)
+	assert.Equal(t, 3, deliveries[0].Attempts)
+	assert.Equal(t, http.StatusNoContent, deliveries[0].LastStatus)
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, received, 3)
+	r := received[2]
+	assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+	assert.Equal(t, w.ID, r.Header.Get(WebhookHeader))
+	assert.Equal(t, strconv.FormatInt(deliveries[0].ID, 10), r.Header.Get(DeliveryHeader))
+	assert.Equal(t, store.ActionCreate, r.Header.Get(EventHeader))
+	assert.Nil(t, Verify("secret", r.Header.Get(SignatureHeader), bodies[2], time.Now(), time.Minute))
+	assert.Contains(t, string(bodies[2]), `"contact_id":"a"`)
+}
+
+func TestDispatcherDeadLetters(t *testing.T) {
+	receiver := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer receiver.Close()
+
+	s := &memory.InMemoryStore{Contacts: store.Contacts{}}
+	require.Nil(t, s.CreateWebhook(&store.Webhook{URL: receiver.URL, Active: true}))
+	require.Nil(t, s.CreateWebhook(&store.Webhook{URL: receiver.URL, Active: false}))
+	require.Nil(t, s.CreateContact(&store.Contact{ID: "a", Name: "A"}))
+
+	d := &Dispatcher{Store: s, MaxAttempts: 2, Backoff: time.Minute}
+	now := time.Now()
+	for _, at := range []time.Duration{0, time.Minute, time.Hour} {
+		_, err := d.Dispatch(now.Add(at))
+		require.Nil(t, err)
+	}
+
+	dead, err := s.FetchDeliveries(&store.DeliveryQuery{Status: store.DeliveryDead})
+	require.Nil(t, err)
+	require.Len(t, dead, 1)
+	assert.Equal(t, 2, dead[0].Attempts)
+	assert.Equal(t, http.StatusInternalServerError, dead[0].LastStatus)
+	assert.NotEmpty(t, dead[0].LastError)
+}
+
+func TestBackoff(t *testing.T) {
+	d := (&Dispatcher{Backoff: time.Second, MaxBackoff: 10 * time.Second}).withDefaults()
+	assert.Equal(t, time.Second, d.backoff(1))
+	assert.Equal(t, 2*time.Second, d.backoff(2))
+	assert.Equal(t, 8*time.Second, d.backoff(4))
+	assert.Equal(t, 10*time.Second, d.backoff(5))
+	assert.Equal(t, 10*time.Second, d.backoff(100))
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	. "github.com/ory/workshop-dbg/store"
+	"github.com/ory/workshop-dbg/webhook"
+)
+
+// WebhookRequest is the body of requests creating or replacing a webhook. Active defaults to true. Without a secret,
+// creating generates one and replacing keeps the current one.
+type WebhookRequest struct {
+	URL    string   `json:"url"`
+	Secret string   `json:"secret"`
+	Events []string `json:"events"`
+	Active *bool    `json:"active"`
+}
+
+// ListWebhooks outputs all webhooks without their secrets.
+func ListWebhooks(store WebhookStorer) func(rw http.ResponseWriter, r *http.Request) {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		webhooks, err := store.FetchWebhooks()
+		if err != nil {
+			WriteError(rw, err)
+			return
+		}
+		for _, w := range webhooks {
+			w.Secret = ""
+		}
+		WriteJSON(rw, http.StatusOK, webhooks)
+	}
+}
+
+// AddWebhook subscribes a URL to the changes of a store. The response is the only one containing the secret.
+func AddWebhook(store WebhookStorer) func(rw http.ResponseWriter, r *http.Request) {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		w, err := ReadWebhook(r)
+		if err != nil {
+			WriteError(rw, err)
+			return
+		}
+		if w.Secret == "" {
+			w.Secret = webhook.NewSecret()
+		}
+
+		if err := store.CreateWebhook(w); err != nil {
+			WriteError(rw, err)
+			return
+		}
+
+		rw.Header().Set("Location", r.URL.Path+"/"+url.PathEscape(w.ID))
+		WriteJSON(rw, http.StatusCreated, w)
+	}
+}
+
+// GetWebhook outputs a webhook without its secret.
+func GetWebhook(store WebhookStorer) func(rw http.ResponseWriter, r *http.Request) {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		w, err := store.GetWebhook(mux.Vars(r)["id"])
+		if err != nil {
+			WriteError(rw, err)
+			return
+		}
+		w.Secret = ""
+		WriteJSON(rw, http.StatusOK, w)
+	}
+}
+
+// UpdateWebhook replaces a webhook.
+func UpdateWebhook(store WebhookStorer) func(rw http.ResponseWriter, r *http.Request) {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		w, err := ReadWebhook(r)
+		if err != nil {
+			WriteError(rw, err)
+			return
+		}
+
+		w.ID = mux.Vars(r)["id"]
+		if w.Secret == "" {
+			current, err := store.GetWebhook(w.ID)
+			if err != nil {
+				WriteError(rw, err)
+				return
+			}
+			w.Secret = current.Secret
+		}
+
+		if err := store.UpdateWebhook(w); err != nil {
+			WriteError(rw, err)
+			return
+		}
+		w.Secret = ""
+		WriteJSON(rw, http.StatusOK, w)
+	}
+}
+
+// DeleteWebhook deletes a webhook together with its deliveries.
+func DeleteWebhook(store WebhookStorer) func(rw http.ResponseWriter, r *http.Request) {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		if err := store.DeleteWebhook(mux.Vars(r)["id"]); err != nil {
+			WriteError(rw, err)
+			return
+		}
+		rw.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// ListDeliveries outputs the delivery log, most recent first. The optional parameters status (pending, delivered
+// or dead) and limit filter it. Within /webhooks/{id}, only the webhook's deliveries are listed, otherwise those of
+// all webhooks, so status=dead lists all dead letters.
+func ListDeliveries(store WebhookStorer) func(rw http.ResponseWriter, r *http.Request) {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		q := &DeliveryQuery{WebhookID: mux.Vars(r)["id"], Status: r.URL.Query().Get("status")}
+		switch q.Status {
+		case "", DeliveryPending, DeliveryDelivered, DeliveryDead:
+		default:
+			WriteError(rw, fmt.Errorf("%w: Unknown status %q, use pending, delivered or dead", ErrBadRequest, q.Status))
+			return
+		}
+		if l := r.URL.Query().Get("limit"); l != "" {
+			var err error
+			if q.Limit, err = strconv.Atoi(l); err != nil || q.Limit < 1 {
+				WriteError(rw, fmt.Errorf("%w: The limit must be a positive number", ErrBadRequest))
+				return
+			}
+		}
+
+		if q.WebhookID != "" {
+			if _, err := store.GetWebhook(q.WebhookID); err != nil {
+				WriteError(rw, err)
+				return
+			}
+		}
+
+		deliveries, err := store.FetchDeliveries(q)
+		if err != nil {
+			WriteError(rw, err)
+			return
+		}
+		WriteJSON(rw, http.StatusOK, deliveries)
+	}
+}
+
+// RetryDelivery queues a delivery again, for example a dead letter after the receiver was fixed. It gets all
+// attempts again.
+func RetryDelivery(store WebhookStorer) func(rw http.ResponseWriter, r *http.Request) {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+		if err != nil {
+			WriteError(rw, fmt.Errorf("%w: The delivery ID must be a number", ErrBadRequest))
+			return
+		}
+
+		d, err := store.GetDelivery(id)
+		if err != nil {
+			WriteError(rw, err)
+			return
+		}
+
+		d.Status, d.Attempts, d.NextAttempt = DeliveryPending, 0, time.Now().UTC()
+		if err := store.UpdateDelivery(d); err != nil {
+			WriteError(rw, err)
+			return
+		}
+		WriteJSON(rw, http.StatusOK, d)
+	}
+}
+
+// ReadWebhook reads a WebhookRequest. The webhook is validated by the store.
+func ReadWebhook(r *http.Request) (*Webhook, error) {
+	body, err := ReadBody(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var req WebhookRequest
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		return nil, fmt.Errorf("%w: Could not read the webhook because %s", ErrBadRequest, err)
+	}
+
+	w := &Webhook{URL: req.URL, Secret: req.Secret, Events: req.Events, Active: req.Active == nil || *req.Active}
+	if w.Events == nil {
+		w.Events = []string{}
+	}
+	return w, nil
+}